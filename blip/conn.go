@@ -0,0 +1,504 @@
+package blip
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frame flags, the low bits of which are the MessageType
+const (
+	typeMask   = 0x07
+	compressed = 0x08
+	urgent     = 0x10
+	noReply    = 0x20
+	moreComing = 0x40
+)
+
+var (
+	// Messages bigger than this are split into several frames
+	maxFrameSize = 16 * 1024
+
+	// While receiving a message split into several frames, acknowledge it
+	// every time this many more bytes have been received
+	ackThreshold = 50000
+
+	// How long to wait for the WebSocket handshake
+	handshakeTimeout = 45 * time.Second
+
+	// The empty stored block which ends the data deflate flushes for each compressed
+	// frame.  It's left out of the frame, and added back before inflating it.
+	deflateTrailer = []byte{0x00, 0x00, 0xff, 0xff}
+)
+
+// Deflate can refer back this far into the data already compressed
+const deflateWindowSize = 32 * 1024
+
+// The error of a connection which was closed by Close
+var ErrClosed = errors.New("BLIP connection closed")
+
+// Handles an incoming request, and returns its reply.  If the reply is nil,
+// an empty successful reply is sent.  The reply isn't sent if the request is
+// NoReply.
+type Handler func(conn *Conn, request *Message) *Message
+
+// A BLIP connection, on either the client or the server side
+type Conn struct {
+	ws      *websocket.Conn
+	handler Handler
+
+	// Whole messages are written under writeMutex, so that their frames aren't interleaved
+	// with other messages, and requests go out in the order they're numbered
+	writeMutex   sync.Mutex
+	sendChecksum uint32
+	nextNumber   uint64
+	deflater     *flate.Writer // Compresses the compressed frames sent, created for the first one
+	deflated     bytes.Buffer  // Where the deflater writes each frame's compressed body
+
+	// Only used by the read loop
+	recvChecksum uint32
+	incoming     map[incomingKey]*incomingMessage
+	inflater     io.ReadCloser // Decompresses the compressed frames received, created for the first one
+	inflated     []byte        // The end of the data inflated so far, which later frames can refer back to
+
+	mutex   sync.Mutex
+	pending map[uint64]chan *Message // Channels for the replies to the requests that were sent, by request number
+	err     error
+	done    chan struct{}
+}
+
+// Identifies an incoming message whose frames are still being received.  Requests
+// and replies are numbered separately.
+type incomingKey struct {
+	isRequest bool
+	number    uint64
+}
+
+type incomingMessage struct {
+	data     []byte
+	numAcked int
+}
+
+// The error of a WebSocket handshake which the server refused, eg because the
+// client's credentials were rejected
+type HandshakeError struct {
+	URL        string
+	StatusCode int
+	Err        error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("BLIP handshake with %s failed with status %d: %v", e.URL, e.StatusCode, e.Err)
+}
+
+// Open a BLIP connection to the given ws:// or wss:// URL, eg a Sync Gateway
+// database's /_blipsync endpoint.  The handler handles the requests the server
+// sends.
+func Dial(ctx context.Context, url string, header http.Header, handler Handler) (*Conn, error) {
+	return DialWith(ctx, websocket.Dialer{Proxy: http.ProxyFromEnvironment}, url, header, handler)
+}
+
+// Like Dial, but the connection is opened with the given dialer, eg to use a TLS
+// config or count connections
+func DialWith(ctx context.Context, dialer websocket.Dialer, url string, header http.Header, handler Handler) (*Conn, error) {
+
+	dialer.HandshakeTimeout = handshakeTimeout
+	dialer.Subprotocols = []string{ProtocolName}
+
+	ws, resp, err := dialer.DialContext(ctx, url, header)
+	if err != nil {
+		if resp != nil {
+			return nil, &HandshakeError{URL: url, StatusCode: resp.StatusCode, Err: err}
+		}
+		return nil, err
+	}
+
+	return newConn(ws, handler), nil
+
+}
+
+// Upgrade an HTTP request to a BLIP connection.  If the client doesn't speak
+// BLIP, an error response is written and an error is returned.
+func Upgrade(w http.ResponseWriter, req *http.Request, handler Handler) (*Conn, error) {
+
+	speaksBlip := false
+	for _, protocol := range websocket.Subprotocols(req) {
+		if protocol == ProtocolName {
+			speaksBlip = true
+		}
+	}
+	if !speaksBlip {
+		http.Error(w, fmt.Sprintf("Expected WebSocket subprotocol %s", ProtocolName), http.StatusBadRequest)
+		return nil, fmt.Errorf("Client doesn't speak %s", ProtocolName)
+	}
+
+	upgrader := websocket.Upgrader{
+		HandshakeTimeout: handshakeTimeout,
+		Subprotocols:     []string{ProtocolName},
+		CheckOrigin:      func(req *http.Request) bool { return true },
+	}
+	ws, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return newConn(ws, handler), nil
+
+}
+
+func newConn(ws *websocket.Conn, handler Handler) *Conn {
+	conn := &Conn{
+		ws:       ws,
+		handler:  handler,
+		incoming: map[incomingKey]*incomingMessage{},
+		pending:  map[uint64]chan *Message{},
+		done:     make(chan struct{}),
+	}
+	go conn.readLoop()
+	return conn
+}
+
+// Send a request, and return the channel which will get its reply, or nil if the
+// request is NoReply.  The reply channel never gets anything if the connection is
+// closed first, so wait on Done() as well.
+func (c *Conn) Send(request *Message) (<-chan *Message, error) {
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.nextNumber++
+	request.Type = RequestType
+	request.Number = c.nextNumber
+
+	var reply chan *Message
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return nil, c.err
+	}
+	if !request.NoReply {
+		reply = make(chan *Message, 1)
+		c.pending[request.Number] = reply
+	}
+	c.mutex.Unlock()
+
+	if err := c.writeMessage(request); err != nil {
+		c.close(err)
+		return nil, err
+	}
+
+	return reply, nil
+
+}
+
+// Send a request and wait for its reply.  An error reply is returned along with
+// its *Error.
+func (c *Conn) SendAndWait(ctx context.Context, request *Message) (*Message, error) {
+
+	reply, err := c.Send(request)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	select {
+	case response := <-reply:
+		return response, response.Err()
+	case <-ctx.Done():
+		c.mutex.Lock()
+		delete(c.pending, request.Number)
+		c.mutex.Unlock()
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, c.Err()
+	}
+
+}
+
+// Closed when the connection is closed, by either side
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Why the connection was closed, or nil if it's open
+func (c *Conn) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+func (c *Conn) Close() error {
+	c.ws.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second),
+	)
+	c.close(ErrClosed)
+	return nil
+}
+
+func (c *Conn) close(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.ws.Close()
+}
+
+// Write a message as one or more frames.  The caller must hold writeMutex.
+func (c *Conn) writeMessage(message *Message) error {
+
+	flags := byte(message.Type)
+	if message.NoReply {
+		flags |= noReply
+	}
+	if message.Compressed {
+		flags |= compressed
+	}
+
+	data := message.encode()
+	for len(data) > maxFrameSize {
+		if err := c.writeFrame(message.Number, flags|moreComing, data[:maxFrameSize]); err != nil {
+			return err
+		}
+		data = data[maxFrameSize:]
+	}
+	return c.writeFrame(message.Number, flags, data)
+
+}
+
+// Write a frame: the message number and flags as varints, then the body (deflated, if
+// it's compressed), then the CRC32 checksum of the uncompressed bodies of all the frames
+// sent so far.  The caller must hold writeMutex.
+func (c *Conn) writeFrame(number uint64, flags byte, body []byte) error {
+	c.sendChecksum = crc32.Update(c.sendChecksum, crc32.IEEETable, body)
+	if flags&compressed != 0 {
+		deflated, err := c.deflate(body)
+		if err != nil {
+			return err
+		}
+		body = deflated
+	}
+	frame := frameHeader(number, flags, len(body)+4)
+	frame = append(frame, body...)
+	frame = append(frame, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(frame[len(frame)-4:], c.sendChecksum)
+	return c.ws.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// Compress a frame's body, carrying on the deflate stream of the compressed frames
+// already sent.  The caller must hold writeMutex.
+func (c *Conn) deflate(body []byte) ([]byte, error) {
+
+	if c.deflater == nil {
+		deflater, err := flate.NewWriter(&c.deflated, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		c.deflater = deflater
+	}
+
+	c.deflated.Reset()
+	if _, err := c.deflater.Write(body); err != nil {
+		return nil, err
+	}
+	if err := c.deflater.Flush(); err != nil {
+		return nil, err
+	}
+	deflated := c.deflated.Bytes()
+	if !bytes.HasSuffix(deflated, deflateTrailer) {
+		return nil, fmt.Errorf("Deflated BLIP frame doesn't end with a sync flush")
+	}
+	return append([]byte{}, deflated[:len(deflated)-len(deflateTrailer)]...), nil
+
+}
+
+// Decompress a frame's body, carrying on from the compressed frames already received.
+// Each frame ends on a block boundary, so the inflater starts afresh for every one,
+// with the data inflated so far as its dictionary.
+func (c *Conn) inflate(body []byte) ([]byte, error) {
+
+	input := bytes.NewReader(append(append([]byte{}, body...), deflateTrailer...))
+	if c.inflater == nil {
+		c.inflater = flate.NewReader(input)
+	}
+	if err := c.inflater.(flate.Resetter).Reset(input, c.inflated); err != nil {
+		return nil, err
+	}
+
+	// The inflater doesn't know the stream carries on in the next frame, so it runs
+	// out of input once it has inflated all of this one
+	inflated, err := ioutil.ReadAll(c.inflater)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("Error inflating BLIP frame: %v", err)
+	}
+
+	c.inflated = append(c.inflated, inflated...)
+	if len(c.inflated) > deflateWindowSize {
+		c.inflated = append([]byte{}, c.inflated[len(c.inflated)-deflateWindowSize:]...)
+	}
+	return inflated, nil
+
+}
+
+// Acknowledge the bytes received so far of an incoming message.  ACKs don't have
+// a checksum.
+func (c *Conn) writeAck(key incomingKey, numReceived int) error {
+
+	flags := byte(ackResponseType)
+	if key.isRequest {
+		flags = byte(ackRequestType)
+	}
+	flags |= urgent | noReply
+
+	frame := frameHeader(key.number, flags, binary.MaxVarintLen64)
+	frame = frame[:len(frame)+binary.PutUvarint(frame[len(frame):cap(frame)], uint64(numReceived))]
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.ws.WriteMessage(websocket.BinaryMessage, frame)
+
+}
+
+// The number and flags at the start of a frame, with room for the rest of it
+func frameHeader(number uint64, flags byte, restLength int) []byte {
+	header := make([]byte, 2*binary.MaxVarintLen64, 2*binary.MaxVarintLen64+restLength)
+	n := binary.PutUvarint(header, number)
+	n += binary.PutUvarint(header[n:], uint64(flags))
+	return header[:n]
+}
+
+func (c *Conn) readLoop() {
+	for {
+		messageType, frame, err := c.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				err = ErrClosed
+			}
+			c.close(err)
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			c.close(fmt.Errorf("Unexpected WebSocket message type %d on BLIP connection", messageType))
+			return
+		}
+		if err := c.readFrame(frame); err != nil {
+			c.close(err)
+			return
+		}
+	}
+}
+
+func (c *Conn) readFrame(frame []byte) error {
+
+	number, n := binary.Uvarint(frame)
+	if n <= 0 {
+		return fmt.Errorf("Invalid BLIP frame message number")
+	}
+	frame = frame[n:]
+	flags, n := binary.Uvarint(frame)
+	if n <= 0 {
+		return fmt.Errorf("Invalid BLIP frame flags")
+	}
+	frame = frame[n:]
+
+	messageType := MessageType(flags & typeMask)
+	if messageType == ackRequestType || messageType == ackResponseType {
+		return nil
+	}
+
+	if len(frame) < 4 {
+		return fmt.Errorf("BLIP frame is too short to have a checksum")
+	}
+	body := frame[:len(frame)-4]
+	if flags&compressed != 0 {
+		inflated, err := c.inflate(body)
+		if err != nil {
+			return err
+		}
+		body = inflated
+	}
+	c.recvChecksum = crc32.Update(c.recvChecksum, crc32.IEEETable, body)
+	if checksum := binary.BigEndian.Uint32(frame[len(frame)-4:]); checksum != c.recvChecksum {
+		return fmt.Errorf("BLIP frame checksum mismatch")
+	}
+
+	key := incomingKey{isRequest: messageType == RequestType, number: number}
+	incoming, ok := c.incoming[key]
+	if !ok {
+		incoming = &incomingMessage{}
+	}
+	incoming.data = append(incoming.data, body...)
+
+	if flags&moreComing != 0 {
+		c.incoming[key] = incoming
+		if len(incoming.data)-incoming.numAcked >= ackThreshold {
+			incoming.numAcked = len(incoming.data)
+			return c.writeAck(key, incoming.numAcked)
+		}
+		return nil
+	}
+	delete(c.incoming, key)
+
+	message, err := decodeMessage(incoming.data)
+	if err != nil {
+		return err
+	}
+	message.Type = messageType
+	message.Number = number
+	message.NoReply = flags&noReply != 0
+	message.Compressed = flags&compressed != 0
+
+	if messageType == RequestType {
+		go c.handleRequest(message)
+		return nil
+	}
+
+	c.mutex.Lock()
+	reply, ok := c.pending[number]
+	delete(c.pending, number)
+	c.mutex.Unlock()
+	if ok {
+		reply <- message
+	}
+	return nil
+
+}
+
+func (c *Conn) handleRequest(request *Message) {
+
+	var response *Message
+	if c.handler == nil {
+		response = request.ErrorResponse(BLIPErrorDomain, http.StatusNotFound, "No handler")
+	} else {
+		response = c.handler(c, request)
+	}
+
+	if request.NoReply {
+		return
+	}
+	if response == nil {
+		response = request.Response()
+	}
+	response.Number = request.Number
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if err := c.writeMessage(response); err != nil {
+		c.close(err)
+	}
+
+}
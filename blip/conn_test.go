@@ -0,0 +1,208 @@
+package blip
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Starts a BLIP server with the given handler, and returns a client connected to it
+func newTestConn(t *testing.T, serverHandler Handler, clientHandler Handler) (*Conn, func()) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := Upgrade(w, req, serverHandler)
+		if err != nil {
+			return
+		}
+		<-conn.Done()
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil, clientHandler)
+	if err != nil {
+		server.Close()
+		t.Fatalf("Error dialing BLIP server: %v", err)
+	}
+
+	return conn, func() {
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestMessageEncodeDecode(t *testing.T) {
+
+	message := NewRequest("rev")
+	message.Properties["id"] = "doc1"
+	message.Properties["history"] = ""
+	message.Body = []byte(`{"foo":"bar"}`)
+
+	decoded, err := decodeMessage(message.encode())
+	if err != nil {
+		t.Fatalf("Error decoding message: %v", err)
+	}
+	if len(decoded.Properties) != 3 || decoded.Profile() != "rev" || decoded.Properties["id"] != "doc1" {
+		t.Fatalf("Unexpected properties: %v", decoded.Properties)
+	}
+	if _, ok := decoded.Properties["history"]; !ok {
+		t.Fatalf("Expected empty history property to be kept")
+	}
+	if string(decoded.Body) != `{"foo":"bar"}` {
+		t.Fatalf("Unexpected body: %s", decoded.Body)
+	}
+
+	if _, err := decodeMessage([]byte{3, 'i', 'd', 0}); err == nil {
+		t.Fatalf("Expected error decoding property without a value")
+	}
+
+}
+
+func TestRequestsAndReplies(t *testing.T) {
+
+	serverHandler := func(conn *Conn, request *Message) *Message {
+		switch request.Profile() {
+		case "echo":
+			response := request.Response()
+			response.Properties["id"] = request.Properties["id"]
+			response.Body = request.Body
+			return response
+		case "empty":
+			return nil
+		default:
+			return request.ErrorResponse(BLIPErrorDomain, 404, "Unknown profile")
+		}
+	}
+	conn, cleanup := newTestConn(t, serverHandler, nil)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	// Bigger than several frames, and than the ACK threshold
+	body := bytes.Repeat([]byte("0123456789"), 20000)
+	request := NewRequest("echo")
+	request.Properties["id"] = "doc1"
+	request.Body = body
+	response, err := conn.SendAndWait(ctx, request)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if response.Properties["id"] != "doc1" || !bytes.Equal(response.Body, body) {
+		t.Fatalf("Unexpected reply, properties: %v, body length: %d", response.Properties, len(response.Body))
+	}
+
+	if response, err := conn.SendAndWait(ctx, NewRequest("empty")); err != nil || len(response.Body) != 0 {
+		t.Fatalf("Expected empty reply, got: %v, %v", response, err)
+	}
+
+	_, err = conn.SendAndWait(ctx, NewRequest("nosuchprofile"))
+	blipErr, ok := err.(*Error)
+	if !ok || blipErr.Domain != BLIPErrorDomain || blipErr.Code != 404 {
+		t.Fatalf("Expected BLIP 404 error, got: %v", err)
+	}
+
+	// The connection is still usable after an error reply
+	if _, err := conn.SendAndWait(ctx, NewRequest("empty")); err != nil {
+		t.Fatalf("Error sending request after an error reply: %v", err)
+	}
+
+}
+
+// Compressed messages carry on the deflate stream of the ones before, so their frames
+// refer back to data in earlier frames and messages, and they can be interleaved with
+// uncompressed ones
+func TestCompressedMessages(t *testing.T) {
+
+	serverHandler := func(conn *Conn, request *Message) *Message {
+		if !request.Compressed {
+			return request.ErrorResponse(BLIPErrorDomain, 400, "Expected a compressed request")
+		}
+		response := request.Response()
+		response.Compressed = request.Properties["compress"] == "true"
+		response.Body = request.Body
+		return response
+	}
+	conn, cleanup := newTestConn(t, serverHandler, nil)
+	defer cleanup()
+
+	// Random data repeated every 20KB, so that it only compresses by referring back
+	// into the frame (or message) before
+	rng := rand.New(rand.NewSource(1))
+	chunk := make([]byte, 20*1024)
+	rng.Read(chunk)
+	bodies := [][]byte{
+		bytes.Repeat(chunk, 5),
+		bytes.Repeat([]byte("0123456789"), 20000),
+		chunk,
+	}
+
+	for i, body := range bodies {
+		for _, compressResponse := range []bool{true, false} {
+			request := NewRequest("echo")
+			request.Compressed = true
+			request.Properties["compress"] = strconv.FormatBool(compressResponse)
+			request.Body = body
+			response, err := conn.SendAndWait(context.Background(), request)
+			if err != nil {
+				t.Fatalf("Error sending compressed request %d: %v", i, err)
+			}
+			if response.Compressed != compressResponse || !bytes.Equal(response.Body, body) {
+				t.Fatalf("Unexpected reply to request %d, compressed: %v, body length: %d", i, response.Compressed, len(response.Body))
+			}
+		}
+	}
+
+}
+
+func TestServerSendsRequests(t *testing.T) {
+
+	// The server sends a request back to the client while handling the client's request
+	serverHandler := func(conn *Conn, request *Message) *Message {
+		response, err := conn.SendAndWait(context.Background(), NewRequest("ping"))
+		if err != nil {
+			return request.ErrorResponse(HTTPErrorDomain, 500, err.Error())
+		}
+		reply := request.Response()
+		reply.Body = response.Body
+		return reply
+	}
+	clientHandler := func(conn *Conn, request *Message) *Message {
+		response := request.Response()
+		response.Body = []byte("pong")
+		return response
+	}
+	conn, cleanup := newTestConn(t, serverHandler, clientHandler)
+	defer cleanup()
+
+	response, err := conn.SendAndWait(context.Background(), NewRequest("start"))
+	if err != nil || string(response.Body) != "pong" {
+		t.Fatalf("Expected pong, got: %v, %v", response, err)
+	}
+
+}
+
+func TestSendAndWaitWhenClosed(t *testing.T) {
+
+	serverHandler := func(conn *Conn, request *Message) *Message {
+		conn.Close()
+		return nil
+	}
+	conn, cleanup := newTestConn(t, serverHandler, nil)
+	defer cleanup()
+
+	if _, err := conn.SendAndWait(context.Background(), NewRequest("close")); err == nil {
+		t.Fatalf("Expected error when the server closes the connection")
+	}
+	select {
+	case <-conn.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected connection to be closed")
+	}
+
+}
@@ -0,0 +1,189 @@
+// Package blip is a minimal implementation of the BLIP messaging protocol over
+// WebSockets, which Couchbase Lite 2.x clients use to replicate with Sync Gateway
+// via its /_blipsync endpoint.  It only has what sgload needs to generate that
+// traffic, and what sgsimulator needs to serve it:
+//
+//   - Requests are numbered and matched up with their replies, and incoming
+//     requests are passed to a Handler, each in its own goroutine.
+//   - Messages that don't fit in a frame are split into several frames, and the
+//     frames of incoming messages are acknowledged so that the peer doesn't stall.
+//   - Messages can be compressed, with a deflate stream shared by all the
+//     compressed frames sent in one direction, like Sync Gateway's rev messages.
+//   - Outgoing messages are never throttled, so ACKs from the peer are ignored.
+package blip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// The WebSocket subprotocol spoken between Couchbase Lite 2.x and Sync Gateway
+const ProtocolName = "BLIP_3+CBMobile_2"
+
+type MessageType byte
+
+const (
+	RequestType     MessageType = 0 // A request, which gets a reply unless it's NoReply
+	ResponseType    MessageType = 1 // The reply to a request that succeeded
+	ErrorType       MessageType = 2 // The reply to a request that failed
+	ackRequestType  MessageType = 4 // Acknowledges the bytes received so far of a request
+	ackResponseType MessageType = 5 // Acknowledges the bytes received so far of a reply
+)
+
+// Well-known message properties
+const (
+	ProfileProperty     = "Profile"      // The kind of request, eg "subChanges"
+	ErrorDomainProperty = "Error-Domain" // Set on error replies, eg "HTTP"
+	ErrorCodeProperty   = "Error-Code"   // Set on error replies, eg "404"
+)
+
+// Error domains
+const (
+	BLIPErrorDomain = "BLIP" // Errors in the protocol itself, eg an unknown profile
+	HTTPErrorDomain = "HTTP" // Errors from handling the request, with an HTTP status as the code
+)
+
+type Properties map[string]string
+
+// A BLIP request or reply
+type Message struct {
+	Type       MessageType
+	Number     uint64 // Assigned when a request is sent.  A reply has the number of its request.
+	NoReply    bool   // If true, the request doesn't get a reply
+	Compressed bool   // If true, the message is sent in compressed frames
+	Properties Properties
+	Body       []byte
+}
+
+// The error carried by a reply of ErrorType
+type Error struct {
+	Domain  string
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("BLIP error %s/%d: %s", e.Domain, e.Code, e.Message)
+}
+
+// Create a new request with the given profile
+func NewRequest(profile string) *Message {
+	return &Message{
+		Type:       RequestType,
+		Properties: Properties{ProfileProperty: profile},
+	}
+}
+
+func (m *Message) Profile() string {
+	return m.Properties[ProfileProperty]
+}
+
+// Create the reply to this request for when it succeeded
+func (m *Message) Response() *Message {
+	return &Message{
+		Type:       ResponseType,
+		Number:     m.Number,
+		Properties: Properties{},
+	}
+}
+
+// Create the reply to this request for when it failed
+func (m *Message) ErrorResponse(domain string, code int, message string) *Message {
+	return &Message{
+		Type:   ErrorType,
+		Number: m.Number,
+		Properties: Properties{
+			ErrorDomainProperty: domain,
+			ErrorCodeProperty:   strconv.Itoa(code),
+		},
+		Body: []byte(message),
+	}
+}
+
+// If this is an error reply, the error it carries, otherwise nil
+func (m *Message) Err() error {
+	if m.Type != ErrorType {
+		return nil
+	}
+	code, _ := strconv.Atoi(m.Properties[ErrorCodeProperty])
+	return &Error{
+		Domain:  m.Properties[ErrorDomainProperty],
+		Code:    code,
+		Message: string(m.Body),
+	}
+}
+
+func (m *Message) SetJSONBody(v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m.Body = body
+	return nil
+}
+
+func (m *Message) ReadJSONBody(v interface{}) error {
+	return json.Unmarshal(m.Body, v)
+}
+
+// Encode the properties and body of the message, which is what gets split into frames.
+// The properties are a varint length followed by null-terminated keys and values.
+func (m *Message) encode() []byte {
+
+	keys := make([]string, 0, len(m.Properties))
+	for key := range m.Properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	properties := bytes.Buffer{}
+	for _, key := range keys {
+		properties.WriteString(key)
+		properties.WriteByte(0)
+		properties.WriteString(m.Properties[key])
+		properties.WriteByte(0)
+	}
+
+	encoded := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+properties.Len()+len(m.Body))
+	n := binary.PutUvarint(encoded, uint64(properties.Len()))
+	encoded = append(encoded[:n], properties.Bytes()...)
+	return append(encoded, m.Body...)
+
+}
+
+// Decode the properties and body of a message from the data of all its frames
+func decodeMessage(data []byte) (*Message, error) {
+
+	propertiesLength, n := binary.Uvarint(data)
+	if n <= 0 || propertiesLength > uint64(len(data)-n) {
+		return nil, fmt.Errorf("Invalid BLIP message properties length")
+	}
+	properties := data[n : n+int(propertiesLength)]
+	body := data[n+int(propertiesLength):]
+
+	message := &Message{
+		Properties: Properties{},
+		Body:       body,
+	}
+	if len(properties) == 0 {
+		return message, nil
+	}
+
+	if properties[len(properties)-1] != 0 {
+		return nil, fmt.Errorf("BLIP message properties aren't null-terminated")
+	}
+	strs := bytes.Split(properties[:len(properties)-1], []byte{0})
+	if len(strs)%2 != 0 {
+		return nil, fmt.Errorf("BLIP message property has no value")
+	}
+	for i := 0; i < len(strs); i += 2 {
+		message.Properties[string(strs[i])] = string(strs[i+1])
+	}
+
+	return message, nil
+
+}
@@ -1,6 +1,12 @@
 package cmd
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/couchbaselabs/sgload/sgload"
 	"github.com/inconshreveable/log15"
 )
@@ -40,7 +46,7 @@ const (
 
 	FEED_TYPE_CMD_NAME    = "readerfeedtype"
 	FEED_TYPE_CMD_DEFAULT = "longpoll"
-	FEED_TYPE_CMD_DESC    = "The changes feed type: normal or longpoll"
+	FEED_TYPE_CMD_DESC    = "The changes feed type: normal, longpoll, or a streaming feed held open by each reader: continuous, websocket or eventsource"
 
 	NUM_REVS_PER_DOC_CMD_NAME    = "numrevsperdoc"
 	NUM_REVS_PER_DOC_CMD_DEFAULT = 5
@@ -49,6 +55,70 @@ const (
 	NUM_REVS_PER_UPDATE_CMD_NAME    = "numrevsperupdate"
 	NUM_REVS_PER_UPDATE_CMD_DEFAULT = 1
 	NUM_REVS_PER_UPDATE_CMD_DESC    = "The number of revisions per doc to add in each update"
+
+	NUM_CONFLICT_BRANCHES_CMD_NAME    = "numconflictbranches"
+	NUM_CONFLICT_BRANCHES_CMD_DEFAULT = 0
+	NUM_CONFLICT_BRANCHES_CMD_DESC    = "If > 1, each doc is updated by a group of this many updaters, each adding its own branch from the writer's revision, so that the docs end up in conflict.  numupdaters must be a multiple of it"
+
+	NUM_DELETERS_CMD_NAME    = "numdeleters"
+	NUM_DELETERS_CMD_DEFAULT = 0
+	NUM_DELETERS_CMD_DESC    = "The number of unique users that will delete each doc once it has had all its updates.  Readers then expect every doc to end up as a tombstone"
+
+	PURGE_TOMBSTONES_CMD_NAME    = "purgetombstones"
+	PURGE_TOMBSTONES_CMD_DEFAULT = false
+	PURGE_TOMBSTONES_CMD_DESC    = "Add this flag to have the deleters purge the deleted docs via the admin port once the readers have seen their tombstones"
+
+	NUM_ACCESS_CHURNERS_CMD_NAME    = "numaccesschurners"
+	NUM_ACCESS_CHURNERS_CMD_DEFAULT = 0
+	NUM_ACCESS_CHURNERS_CMD_DESC    = "The number of churners that grant and revoke the readers' channels and roles through the admin _user endpoint while the run goes on.  Readers then check that granted channels are backfilled and revoked ones removed from their changes feeds.  Needs --duration"
+
+	ACCESS_CHANGE_DELAY_CMD_NAME    = "accesschangedelayms"
+	ACCESS_CHANGE_DELAY_CMD_DEFAULT = 1000
+	ACCESS_CHANGE_DELAY_CMD_DESC    = "How long each access churner waits between changes to a reader's access, in milliseconds"
+
+	NUM_ROLES_CMD_NAME    = "numroles"
+	NUM_ROLES_CMD_DEFAULT = 0
+	NUM_ROLES_CMD_DESC    = "The number of roles the access churners create and add to (and remove from) the readers.  If 0, they only change the readers' admin channels"
+
+	NUM_CHANS_PER_ROLE_CMD_NAME    = "numchansperrole"
+	NUM_CHANS_PER_ROLE_CMD_DEFAULT = 1
+	NUM_CHANS_PER_ROLE_CMD_DESC    = "The number of channels each of the access churners' roles has"
+
+	ACCESS_VISIBILITY_TIMEOUT_CMD_NAME    = "accessvisibilitytimeoutms"
+	ACCESS_VISIBILITY_TIMEOUT_CMD_DEFAULT = 30000
+	ACCESS_VISIBILITY_TIMEOUT_CMD_DESC    = "How long readers wait for the docs of a granted channel to be backfilled, or those of a revoked one to be removed, before it's an error, in milliseconds"
+
+	WRITE_OPS_PER_SEC_CMD_NAME    = "writeopspersec"
+	WRITE_OPS_PER_SEC_CMD_DEFAULT = 0.0
+	WRITE_OPS_PER_SEC_CMD_DESC    = "If set, send this many writes per second in total across all writers, on a fixed schedule, instead of waiting writerdelayms between writes.  Writes are sent on schedule without waiting for earlier ones to finish, up to writemaxinflight per writer.  Write latency is then measured from when each write was scheduled to be sent (create_document_intended stat)"
+
+	WRITE_MAX_IN_FLIGHT_CMD_NAME    = "writemaxinflight"
+	WRITE_MAX_IN_FLIGHT_CMD_DEFAULT = 100
+	WRITE_MAX_IN_FLIGHT_CMD_DESC    = "With writeopspersec, the most writes each writer has in flight at once.  Writes due while that many are in flight are sent late, and counted in the writes_late stat"
+
+	PUSH_REPLICATOR_CMD_NAME    = "pushreplicator"
+	PUSH_REPLICATOR_CMD_DEFAULT = false
+	PUSH_REPLICATOR_CMD_DESC    = "Add this flag to have writers push their docs like a Couchbase Lite 1.x push replicator: _revs_diff, then _bulk_docs with new_edits=false for the missing revisions, then saving a _local checkpoint"
+
+	NUM_KNOWN_REVS_CMD_NAME    = "numknownrevs"
+	NUM_KNOWN_REVS_CMD_DEFAULT = 0
+	NUM_KNOWN_REVS_CMD_DESC    = "With --pushreplicator, how many revisions each writer has already pushed to ask about again in every _revs_diff, like a replicator restarting from an older checkpoint"
+
+	PULL_REPLICATOR_CMD_NAME    = "pullreplicator"
+	PULL_REPLICATOR_CMD_DEFAULT = false
+	PULL_REPLICATOR_CMD_DESC    = "Add this flag to have readers pull like a Couchbase Lite 1.x pull replicator: resuming from a _local checkpoint, listing the revisions they already have in atts_since on _bulk_get, and saving the checkpoint as they go"
+
+	CHECKPOINT_INTERVAL_MS_CMD_NAME    = "checkpointintervalms"
+	CHECKPOINT_INTERVAL_MS_CMD_DEFAULT = 5000
+	CHECKPOINT_INTERVAL_MS_CMD_DESC    = "With --pullreplicator, how often each reader saves its checkpoint while it's pulling changes, in milliseconds.  0 saves it after every batch of changes"
+
+	SCENARIO_CMD_NAME    = "scenario"
+	SCENARIO_CMD_DEFAULT = ""
+	SCENARIO_CMD_DESC    = "A YAML or JSON scenario file describing the load, write, read, update, delete and access specs (see sgload.ReadGateLoadScenario).  Anything it doesn't set comes from the command line flags"
+
+	DURATION_CMD_NAME    = "duration"
+	DURATION_CMD_DEFAULT = time.Duration(0)
+	DURATION_CMD_DESC    = "If set (eg, 8h), keep writing, updating and reading docs for this long rather than stopping once numdocs have been written and read.  numdocs then only sets how many docs each writer spreads across the channels before starting over with new docs"
 )
 
 func createLoadSpecFromArgs() sgload.LoadSpec {
@@ -56,11 +126,14 @@ func createLoadSpecFromArgs() sgload.LoadSpec {
 	loadSpec := sgload.LoadSpec{
 		SyncGatewayUrl:        *sgUrl,
 		SyncGatewayAdminPort:  *sgAdminPort,
+		SyncGatewayAdminUrl:   *sgAdminUrl,
 		MockDataStore:         *mockDataStore,
 		StatsdEnabled:         *statsdEnabled,
+		PrometheusEnabled:     *prometheusEnabled,
 		StatsdEndpoint:        *statsdEndpoint,
 		StatsdPrefix:          *statsdPrefix,
 		TestSessionID:         *testSessionID,
+		Seed:                  *seed,
 		AttachSizeBytes:       *attachSizeBytes,
 		BatchSize:             *batchSize,
 		NumChannels:           *numChannels,
@@ -68,6 +141,62 @@ func createLoadSpecFromArgs() sgload.LoadSpec {
 		NumDocs:               *numDocs,
 		CompressionEnabled:    *compressionEnabled,
 		ExpvarProgressEnabled: *expvarProgressEnabled,
+		MaxErrors:             *maxErrors,
+		MaxErrorPercent:       *maxErrorPercent,
+		DrainTimeout:          time.Millisecond * time.Duration(*drainTimeoutMs),
+		ReportFile:            *reportFile,
+		Protocol:              sgload.ReplicationProtocol(*protocol),
+		Keyspaces:             *keyspaces,
+		DocGenerator: sgload.DocGeneratorSpec{
+			Type:         *docGenerator,
+			TemplateFile: *docTemplateFile,
+		},
+		Channels: sgload.ChannelDistributionSpec{
+			Distribution:      *channelDistribution,
+			ZipfExponent:      *zipfExponent,
+			HotChannelPercent: *hotChannelPercent,
+			HotDocPercent:     *hotDocPercent,
+			Weights:           channelWeightsFromArgs(),
+			MinChannelsPerDoc: *minChannelsPerDoc,
+			MaxChannelsPerDoc: *maxChannelsPerDoc,
+		},
+		HTTPClient: sgload.HTTPClientSpec{
+			PerAgent:            *httpPerAgent,
+			MaxConnsPerHost:     *httpMaxConnsPerHost,
+			MaxIdleConnsPerHost: *httpMaxIdleConns,
+			IdleConnTimeout:     *httpIdleConnTimeout,
+			DisableKeepAlives:   *httpDisableKeepAlives,
+			HTTP2:               *http2,
+		},
+		TLS: sgload.TLSSpec{
+			CACertFile:         *tlsCACert,
+			ClientCertFile:     *tlsClientCert,
+			ClientKeyFile:      *tlsClientKey,
+			ServerName:         *tlsServerName,
+			InsecureSkipVerify: *tlsInsecureSkipVerify,
+		},
+		Auth: sgload.AuthSpec{
+			Mode: sgload.AuthMode(*authMode),
+			JWT: sgload.JWTSpec{
+				KeyFile:    *jwtKeyFile,
+				KeyID:      *jwtKeyID,
+				Issuer:     *jwtIssuer,
+				Audience:   *jwtAudience,
+				TokenTTL:   *jwtTokenTTL,
+				KeySetFile: *jwtKeySetFile,
+			},
+		},
+		Admin: sgload.AdminSpec{
+			Username: *sgAdminUsername,
+			Password: *sgAdminPassword,
+			TLS: sgload.TLSSpec{
+				CACertFile:         *adminTLSCACert,
+				ClientCertFile:     *adminTLSClientCert,
+				ClientKeyFile:      *adminTLSClientKey,
+				ServerName:         *adminTLSServerName,
+				InsecureSkipVerify: *adminTLSSkipVerify,
+			},
+		},
 	}
 
 	switch *logLevelStr {
@@ -83,6 +212,60 @@ func createLoadSpecFromArgs() sgload.LoadSpec {
 		loadSpec.LogLevel = log15.LvlDebug
 	}
 
-	loadSpec.TestSessionID = sgload.NewUuid()
+	// Keep the test session id if one was given (eg, to read the docs written by an
+	// earlier writeload)
+	if loadSpec.TestSessionID == "" {
+		loadSpec.TestSessionID = sgload.NewTestSessionID(loadSpec.Seed)
+	}
 	return loadSpec
 }
+
+// Returns a context which is cancelled on the first SIGINT or SIGTERM, so that the
+// runner stops starting new work and drains the requests in flight.  A second
+// signal exits immediately.
+func createInterruptibleContext() context.Context {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		sgload.Logger().Warn("Stopping run and waiting for in-flight requests.  Send again to exit immediately", "signal", sig)
+		cancel()
+
+		<-signals
+		sgload.Logger().Crit("Exiting without waiting for in-flight requests")
+		os.Exit(1)
+	}()
+
+	return ctx
+
+}
+
+// Print what the run did, then exit with a non-zero status if it failed or was interrupted
+func finishRun(description string, err error) {
+
+	sgload.WriteProgressSummary(os.Stdout)
+
+	switch {
+	case err == context.Canceled:
+		sgload.Logger().Warn("Run interrupted", "run", description)
+		os.Exit(130)
+	case err != nil:
+		sgload.Logger().Crit("Run failed", "run", description, "error", err)
+		os.Exit(1)
+	}
+
+}
+
+// The --channelweights flag is a list of ints, since this version of pflag has no float
+// lists, but scenario files can have any weights
+func channelWeightsFromArgs() []float64 {
+	weights := []float64{}
+	for _, weight := range *channelWeights {
+		weights = append(weights, float64(weight))
+	}
+	return weights
+}
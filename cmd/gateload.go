@@ -2,22 +2,40 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/couchbaselabs/sgload/sgload"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var (
-	glNumReaders        *int
-	glNumWriters        *int
-	glNumChansPerReader *int
-	glCreateReaders     *bool
-	glCreateWriters     *bool
-	glNumRevsPerDoc     *int
-	glNumUpdaters       *int
-	glFeedType          *string
-	glWriterDelayMs     *int
+	glNumReaders           *int
+	glNumWriters           *int
+	glNumChansPerReader    *int
+	glCreateReaders        *bool
+	glCreateWriters        *bool
+	glNumRevsPerDoc        *int
+	glNumUpdaters          *int
+	glNumConflicts         *int
+	glNumDeleters          *int
+	glPurgeTombstones      *bool
+	glFeedType             *string
+	glWriterDelayMs        *int
+	glDuration             *time.Duration
+	glWriteOpsPerSec       *float64
+	glWriteMaxInFlight     *int
+	glPushReplicator       *bool
+	glNumKnownRevs         *int
+	glPullReplicator       *bool
+	glCheckpointIntervalMs *int
+	glScenarioFile         *string
+	glNumAccessChurners    *int
+	glAccessChangeDelayMs  *int
+	glNumRoles             *int
+	glNumChansPerRole      *int
+	glAccessTimeoutMs      *int
 )
 
 var gateloadCmd = &cobra.Command{
@@ -30,16 +48,23 @@ var gateloadCmd = &cobra.Command{
 		logger := sgload.Logger()
 
 		loadSpec := createLoadSpecFromArgs()
-		sgload.SetLogLevel(loadSpec.LogLevel)
+		loadSpec.Duration = *glDuration
 
 		delayBetweenWrites := time.Millisecond * time.Duration(*glWriterDelayMs)
 		delayBetweenUpdates := time.Millisecond * time.Duration(*glWriterDelayMs)
+		delayBetweenDeletes := time.Millisecond * time.Duration(*glWriterDelayMs)
 
 		writeLoadSpec := sgload.WriteLoadSpec{
 			LoadSpec:           loadSpec,
 			NumWriters:         *glNumWriters,
 			CreateWriters:      *glCreateWriters,
 			DelayBetweenWrites: delayBetweenWrites,
+			TargetOpsPerSec:    *glWriteOpsPerSec,
+			MaxWritesInFlight:  *glWriteMaxInFlight,
+			PushReplicator: sgload.PushReplicatorSpec{
+				Enabled:      *glPushReplicator,
+				NumKnownRevs: *glNumKnownRevs,
+			},
 		}
 
 		readLoadSpec := sgload.ReadLoadSpec{
@@ -48,7 +73,13 @@ var gateloadCmd = &cobra.Command{
 			NumChansPerReader:         *glNumChansPerReader,
 			CreateReaders:             *glCreateReaders,
 			NumRevGenerationsExpected: calcNumRevGenerationsExpected(),
+			ExpectTombstones:          *glNumDeleters > 0,
+			NumLeavesExpected:         calcNumLeavesExpected(),
 			FeedType:                  sgload.ChangesFeedType(*glFeedType),
+			PullReplicator: sgload.PullReplicatorSpec{
+				Enabled:              *glPullReplicator,
+				CheckpointIntervalMs: *glCheckpointIntervalMs,
+			},
 		}
 
 		updateLoadSpec := sgload.UpdateLoadSpec{
@@ -56,6 +87,23 @@ var gateloadCmd = &cobra.Command{
 			NumUpdatesPerDoc:    *glNumRevsPerDoc,
 			NumUpdaters:         *glNumUpdaters,
 			DelayBetweenUpdates: delayBetweenUpdates,
+			NumConflictBranches: *glNumConflicts,
+		}
+
+		deleteLoadSpec := sgload.DeleteLoadSpec{
+			LoadSpec:            loadSpec,
+			NumDeleters:         *glNumDeleters,
+			DelayBetweenDeletes: delayBetweenDeletes,
+			PurgeTombstones:     *glPurgeTombstones,
+		}
+
+		accessLoadSpec := sgload.AccessLoadSpec{
+			LoadSpec:            loadSpec,
+			NumAccessChurners:   *glNumAccessChurners,
+			DelayBetweenChanges: time.Millisecond * time.Duration(*glAccessChangeDelayMs),
+			NumRoles:            *glNumRoles,
+			NumChansPerRole:     *glNumChansPerRole,
+			VisibilityTimeout:   time.Millisecond * time.Duration(*glAccessTimeoutMs),
 		}
 
 		gateLoadSpec := sgload.GateLoadSpec{
@@ -63,8 +111,23 @@ var gateloadCmd = &cobra.Command{
 			WriteLoadSpec:  writeLoadSpec,
 			UpdateLoadSpec: updateLoadSpec,
 			ReadLoadSpec:   readLoadSpec,
+			DeleteLoadSpec: deleteLoadSpec,
+			AccessLoadSpec: accessLoadSpec,
 		}
 
+		if *glScenarioFile != "" {
+			var err error
+			// A test session ID given on the command line or in the config is kept, even
+			// if the scenario file has a seed
+			testSessionIDGiven := cmd.Flags().Changed("testsessionid") || viper.IsSet("testsessionid")
+			gateLoadSpec, err = sgload.ReadGateLoadScenario(*glScenarioFile, gateLoadSpec, testSessionIDGiven)
+			if err != nil {
+				logger.Crit("Unable to use scenario file", "error", err)
+				os.Exit(1)
+			}
+		}
+		sgload.SetLogLevel(gateLoadSpec.LoadSpec.LogLevel)
+
 		logger.Info("Running gateload scenario", "gateLoadSpec", gateLoadSpec)
 
 		if err := gateLoadSpec.Validate(); err != nil {
@@ -74,9 +137,8 @@ var gateloadCmd = &cobra.Command{
 
 		// Run gateload runner with provided spec
 		gateLoadRunner := sgload.NewGateLoadRunner(gateLoadSpec)
-		if err := gateLoadRunner.Run(); err != nil {
-			panic(fmt.Sprintf("Gateload.Run() failed with: %v", err))
-		}
+		err := gateLoadRunner.Run(createInterruptibleContext())
+		finishRun("gateload", err)
 
 	},
 }
@@ -89,9 +151,21 @@ func calcNumRevGenerationsExpected() int {
 		// to get bumped up *glNumRevsPerDoc more rev generations
 		numRevGenerationsExpected += *glNumRevsPerDoc
 	}
+	if *glNumDeleters > 0 {
+		// Deleting the doc adds the tombstone as one more rev generation
+		numRevGenerationsExpected += 1
+	}
 	return numRevGenerationsExpected
 }
 
+func calcNumLeavesExpected() int {
+	// Each conflict branch ends up as one of the doc's leaf revisions
+	if *glNumUpdaters > 0 && *glNumConflicts > 1 {
+		return *glNumConflicts
+	}
+	return 1
+}
+
 func init() {
 
 	RootCmd.AddCommand(gateloadCmd)
@@ -138,6 +212,24 @@ func init() {
 		NUM_UPDATERS_CMD_DESC,
 	)
 
+	glNumConflicts = gateloadCmd.PersistentFlags().Int(
+		NUM_CONFLICT_BRANCHES_CMD_NAME,
+		NUM_CONFLICT_BRANCHES_CMD_DEFAULT,
+		NUM_CONFLICT_BRANCHES_CMD_DESC,
+	)
+
+	glNumDeleters = gateloadCmd.PersistentFlags().Int(
+		NUM_DELETERS_CMD_NAME,
+		NUM_DELETERS_CMD_DEFAULT,
+		NUM_DELETERS_CMD_DESC,
+	)
+
+	glPurgeTombstones = gateloadCmd.PersistentFlags().Bool(
+		PURGE_TOMBSTONES_CMD_NAME,
+		PURGE_TOMBSTONES_CMD_DEFAULT,
+		PURGE_TOMBSTONES_CMD_DESC,
+	)
+
 	glFeedType = gateloadCmd.PersistentFlags().String(
 		FEED_TYPE_CMD_NAME,
 		FEED_TYPE_CMD_DEFAULT,
@@ -150,4 +242,82 @@ func init() {
 		WRITER_DELAY_CMD_DESC,
 	)
 
+	glDuration = gateloadCmd.PersistentFlags().Duration(
+		DURATION_CMD_NAME,
+		DURATION_CMD_DEFAULT,
+		DURATION_CMD_DESC,
+	)
+
+	glWriteOpsPerSec = gateloadCmd.PersistentFlags().Float64(
+		WRITE_OPS_PER_SEC_CMD_NAME,
+		WRITE_OPS_PER_SEC_CMD_DEFAULT,
+		WRITE_OPS_PER_SEC_CMD_DESC,
+	)
+
+	glWriteMaxInFlight = gateloadCmd.PersistentFlags().Int(
+		WRITE_MAX_IN_FLIGHT_CMD_NAME,
+		WRITE_MAX_IN_FLIGHT_CMD_DEFAULT,
+		WRITE_MAX_IN_FLIGHT_CMD_DESC,
+	)
+
+	glPushReplicator = gateloadCmd.PersistentFlags().Bool(
+		PUSH_REPLICATOR_CMD_NAME,
+		PUSH_REPLICATOR_CMD_DEFAULT,
+		PUSH_REPLICATOR_CMD_DESC,
+	)
+
+	glNumKnownRevs = gateloadCmd.PersistentFlags().Int(
+		NUM_KNOWN_REVS_CMD_NAME,
+		NUM_KNOWN_REVS_CMD_DEFAULT,
+		NUM_KNOWN_REVS_CMD_DESC,
+	)
+
+	glPullReplicator = gateloadCmd.PersistentFlags().Bool(
+		PULL_REPLICATOR_CMD_NAME,
+		PULL_REPLICATOR_CMD_DEFAULT,
+		PULL_REPLICATOR_CMD_DESC,
+	)
+
+	glCheckpointIntervalMs = gateloadCmd.PersistentFlags().Int(
+		CHECKPOINT_INTERVAL_MS_CMD_NAME,
+		CHECKPOINT_INTERVAL_MS_CMD_DEFAULT,
+		CHECKPOINT_INTERVAL_MS_CMD_DESC,
+	)
+
+	glNumAccessChurners = gateloadCmd.PersistentFlags().Int(
+		NUM_ACCESS_CHURNERS_CMD_NAME,
+		NUM_ACCESS_CHURNERS_CMD_DEFAULT,
+		NUM_ACCESS_CHURNERS_CMD_DESC,
+	)
+
+	glAccessChangeDelayMs = gateloadCmd.PersistentFlags().Int(
+		ACCESS_CHANGE_DELAY_CMD_NAME,
+		ACCESS_CHANGE_DELAY_CMD_DEFAULT,
+		ACCESS_CHANGE_DELAY_CMD_DESC,
+	)
+
+	glNumRoles = gateloadCmd.PersistentFlags().Int(
+		NUM_ROLES_CMD_NAME,
+		NUM_ROLES_CMD_DEFAULT,
+		NUM_ROLES_CMD_DESC,
+	)
+
+	glNumChansPerRole = gateloadCmd.PersistentFlags().Int(
+		NUM_CHANS_PER_ROLE_CMD_NAME,
+		NUM_CHANS_PER_ROLE_CMD_DEFAULT,
+		NUM_CHANS_PER_ROLE_CMD_DESC,
+	)
+
+	glAccessTimeoutMs = gateloadCmd.PersistentFlags().Int(
+		ACCESS_VISIBILITY_TIMEOUT_CMD_NAME,
+		ACCESS_VISIBILITY_TIMEOUT_CMD_DEFAULT,
+		ACCESS_VISIBILITY_TIMEOUT_CMD_DESC,
+	)
+
+	glScenarioFile = gateloadCmd.PersistentFlags().String(
+		SCENARIO_CMD_NAME,
+		SCENARIO_CMD_DEFAULT,
+		SCENARIO_CMD_DESC,
+	)
+
 }
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"os"
 
 	"github.com/couchbaselabs/sgload/sgload"
@@ -16,6 +17,8 @@ var (
 	readLoadNumWriters    *int
 	readLoadCreateWriters *bool
 	readLoadFeedType      *string
+	pullReplicator        *bool
+	checkpointIntervalMs  *int
 	logger                log15.Logger
 )
 
@@ -41,16 +44,21 @@ or it can pass a test session id from a previously run write load.`,
 			SkipWriteLoadSetup:        *skipWriteload,
 			NumRevGenerationsExpected: 1, // Expect writer to add one rev
 			FeedType:                  sgload.ChangesFeedType(*readLoadFeedType),
+			PullReplicator: sgload.PullReplicatorSpec{
+				Enabled:              *pullReplicator,
+				CheckpointIntervalMs: *checkpointIntervalMs,
+			},
 		}
 
 		logger.Info("Running readload scenario", "readLoadSpec", readLoadSpec)
 
+		ctx := createInterruptibleContext()
+
 		if *skipWriteload == false {
 
 			logger.Info("Running writeload scenario")
-			if err := runWriteLoadScenarioReadLoad(loadSpec); err != nil {
-				logger.Crit("Failed to run writeload", "error", err)
-				os.Exit(1)
+			if err := runWriteLoadScenarioReadLoad(ctx, loadSpec); err != nil {
+				finishRun("writeload", err)
 			}
 			logger.Info("Finished running writeload scenario")
 
@@ -64,16 +72,14 @@ or it can pass a test session id from a previously run write load.`,
 
 		logger.Info("Running readload scenario")
 		readLoadRunner := sgload.NewReadLoadRunner(readLoadSpec)
-		if err := readLoadRunner.Run(); err != nil {
-			logger.Crit("Readload.Run() failed", "error", err)
-			os.Exit(1)
-		}
+		err := readLoadRunner.Run(ctx)
 		logger.Info("Finished running readload scenario")
+		finishRun("readload", err)
 
 	},
 }
 
-func runWriteLoadScenarioReadLoad(loadSpec sgload.LoadSpec) error {
+func runWriteLoadScenarioReadLoad(ctx context.Context, loadSpec sgload.LoadSpec) error {
 
 	writeLoadSpec := sgload.WriteLoadSpec{
 		LoadSpec:      loadSpec,
@@ -85,7 +91,7 @@ func runWriteLoadScenarioReadLoad(loadSpec sgload.LoadSpec) error {
 	}
 	writeLoadRunner := sgload.NewWriteLoadRunner(writeLoadSpec)
 
-	return writeLoadRunner.Run()
+	return writeLoadRunner.Run(ctx)
 
 }
 
@@ -135,4 +141,16 @@ func init() {
 		FEED_TYPE_CMD_DESC,
 	)
 
+	pullReplicator = readloadCmd.PersistentFlags().Bool(
+		PULL_REPLICATOR_CMD_NAME,
+		PULL_REPLICATOR_CMD_DEFAULT,
+		PULL_REPLICATOR_CMD_DESC,
+	)
+
+	checkpointIntervalMs = readloadCmd.PersistentFlags().Int(
+		CHECKPOINT_INTERVAL_MS_CMD_NAME,
+		CHECKPOINT_INTERVAL_MS_CMD_DEFAULT,
+		CHECKPOINT_INTERVAL_MS_CMD_DESC,
+	)
+
 }
@@ -3,8 +3,11 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -12,19 +15,62 @@ var (
 	cfgFile               string
 	sgUrl                 *string
 	sgAdminPort           *int
+	sgAdminUrl            *string
+	sgAdminUsername       *string
+	sgAdminPassword       *string
+	adminTLSCACert        *string
+	adminTLSClientCert    *string
+	adminTLSClientKey     *string
+	adminTLSServerName    *string
+	adminTLSSkipVerify    *bool
 	mockDataStore         *bool
 	statsdEndpoint        *string
 	statsdPrefix          *string
 	statsdEnabled         *bool
+	prometheusEnabled     *bool
 	testSessionID         *string
+	seed                  *int64
 	numChannels           *int
 	numDocs               *int
 	docSizeBytes          *int
+	docGenerator          *string
+	docTemplateFile       *string
+	channelDistribution   *string
+	zipfExponent          *float64
+	hotChannelPercent     *float64
+	hotDocPercent         *float64
+	channelWeights        *[]int
+	minChannelsPerDoc     *int
+	maxChannelsPerDoc     *int
 	batchSize             *int
 	attachSizeBytes       *int
 	compressionEnabled    *bool
 	expvarProgressEnabled *bool
 	logLevelStr           *string
+	maxErrors             *int
+	maxErrorPercent       *float64
+	drainTimeoutMs        *int
+	reportFile            *string
+	protocol              *string
+	keyspaces             *[]string
+	httpPerAgent          *bool
+	httpMaxConnsPerHost   *int
+	httpMaxIdleConns      *int
+	httpIdleConnTimeout   *time.Duration
+	httpDisableKeepAlives *bool
+	http2                 *bool
+	tlsCACert             *string
+	tlsClientCert         *string
+	tlsClientKey          *string
+	tlsServerName         *string
+	tlsInsecureSkipVerify *bool
+	authMode              *string
+	jwtKeyFile            *string
+	jwtKeyID              *string
+	jwtIssuer             *string
+	jwtAudience           *string
+	jwtTokenTTL           *time.Duration
+	jwtKeySetFile         *string
 )
 
 // This represents the base command when called without any subcommands
@@ -37,6 +83,10 @@ var RootCmd = &cobra.Command{
 	// Run: func(cmd *cobra.Command, args []string) {
 	// 	log.Printf("hello")
 	// },
+
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return applyConfigToFlags(cmd)
+	},
 }
 
 //Execute adds all child commands to the root command sets flags appropriately.
@@ -62,7 +112,55 @@ func init() {
 	sgAdminPort = RootCmd.PersistentFlags().Int(
 		"sg-admin-port",
 		4985,
-		"The Sync Gateway admin port.  NOTE: if SG is not on the same box you will need to setup SSH port forwarding, VPN, or configure SG to allow access",
+		"The Sync Gateway admin port, on the host of the --sg-url.  NOTE: if SG is not on the same box you will need to setup SSH port forwarding, VPN, or configure SG to allow access",
+	)
+
+	sgAdminUrl = RootCmd.PersistentFlags().String(
+		"sg-admin-url",
+		"",
+		"The Sync Gateway admin URL including port and database, eg: https://sg-admin:4985/db/.  If set, it's used instead of --sg-admin-port, eg when the admin API is on another host or behind a proxy",
+	)
+
+	sgAdminUsername = RootCmd.PersistentFlags().String(
+		"sg-admin-username",
+		"",
+		"If set, send admin requests (such as creating users) with basic auth as this user, which Sync Gateway 3.x requires",
+	)
+
+	sgAdminPassword = RootCmd.PersistentFlags().String(
+		"sg-admin-password",
+		"",
+		"The password of the --sg-admin-username",
+	)
+
+	adminTLSCACert = RootCmd.PersistentFlags().String(
+		"sg-admin-tls-ca-cert",
+		"",
+		"PEM bundle of the CAs to verify an https admin API's certificate with.  If none of the --sg-admin-tls flags are set, the --tls flags are used for the admin API too",
+	)
+
+	adminTLSClientCert = RootCmd.PersistentFlags().String(
+		"sg-admin-tls-client-cert",
+		"",
+		"PEM certificate to present to the admin API.  Needs --sg-admin-tls-client-key",
+	)
+
+	adminTLSClientKey = RootCmd.PersistentFlags().String(
+		"sg-admin-tls-client-key",
+		"",
+		"PEM private key of the --sg-admin-tls-client-cert",
+	)
+
+	adminTLSServerName = RootCmd.PersistentFlags().String(
+		"sg-admin-tls-server-name",
+		"",
+		"The name to verify the admin API's certificate against, if not the host of its URL",
+	)
+
+	adminTLSSkipVerify = RootCmd.PersistentFlags().Bool(
+		"sg-admin-tls-insecure-skip-verify",
+		false,
+		"Don't verify the admin API's certificate at all",
 	)
 
 	mockDataStore = RootCmd.PersistentFlags().Bool(
@@ -89,12 +187,24 @@ func init() {
 		"Add this flag to push stats to statsdendpoint",
 	)
 
+	prometheusEnabled = RootCmd.PersistentFlags().Bool(
+		"prometheusenabled",
+		false,
+		"Add this flag to expose stats to Prometheus at /metrics on the expvar port (9876, or the next free port).  Can be used along with statsdenabled",
+	)
+
 	testSessionID = RootCmd.PersistentFlags().String(
 		"testsessionid",
 		"",
 		"A unique identifier for this test session, used for generating channel names.  If omitted, a UUID will be auto-generated",
 	)
 
+	seed = RootCmd.PersistentFlags().Int64(
+		"seed",
+		0,
+		"If non-zero, makes channel assignment, reader subscriptions, doc bodies and (unless --testsessionid is given) doc IDs and usernames the same in every run with this seed.  Needs a fresh Sync Gateway database, since the doc IDs and users will already exist from the last run",
+	)
+
 	numChannels = RootCmd.PersistentFlags().Int(
 		"numchannels",
 		100,
@@ -108,13 +218,66 @@ func init() {
 		"The number of total docs that will be written.  Will be evenly distributed among writers",
 	)
 
-	// NOTE: could also just point to a sample doc or doc templates
 	docSizeBytes = RootCmd.PersistentFlags().Int(
 		"docsizebytes",
 		1024,
 		"The size of each doc, in bytes, that will be pushed up to sync gateway",
 	)
 
+	docGenerator = RootCmd.PersistentFlags().String(
+		"docgenerator",
+		"filler",
+		"What the doc bodies look like.  Values: filler (fields of the letter a, which compress very well), random (fields of random strings, which hardly compress), nested (an array of nested objects with mixed types), template (filled in from --doctemplate)",
+	)
+
+	docTemplateFile = RootCmd.PersistentFlags().String(
+		"doctemplate",
+		"",
+		"With --docgenerator template, a JSON file of the doc body, in which strings like {{name}}, {{timestamp}}, {{int:1:10}}, {{float:0:1}}, {{enum:a|b|c}}, {{bool}}, {{uuid}} and {{text:100}} are replaced by random values of that type.  The template sets the size of the docs, rather than --docsizebytes",
+	)
+
+	channelDistribution = RootCmd.PersistentFlags().String(
+		"channeldistribution",
+		"uniform",
+		"How the docs are spread across the channels.  Values: uniform (every channel gets the same number of docs), zipfian (a few hot channels and a long tail, see --zipfexponent), hotspot (see --hotchannelpercent and --hotdocpercent), weights (see --channelweights)",
+	)
+
+	zipfExponent = RootCmd.PersistentFlags().Float64(
+		"zipfexponent",
+		1,
+		"With --channeldistribution zipfian, channel i (from 0) gets docs in proportion to 1/(i+1)^zipfexponent.  The higher it is, the more skewed",
+	)
+
+	hotChannelPercent = RootCmd.PersistentFlags().Float64(
+		"hotchannelpercent",
+		20,
+		"With --channeldistribution hotspot, the percentage of the channels that are hot",
+	)
+
+	hotDocPercent = RootCmd.PersistentFlags().Float64(
+		"hotdocpercent",
+		80,
+		"With --channeldistribution hotspot, the percentage of the docs that go in the hot channels",
+	)
+
+	channelWeights = RootCmd.PersistentFlags().IntSlice(
+		"channelweights",
+		nil,
+		"With --channeldistribution weights, the relative weight of each channel, eg 5,1,1,1 for --numchannels 4",
+	)
+
+	minChannelsPerDoc = RootCmd.PersistentFlags().Int(
+		"minchannelsperdoc",
+		1,
+		"The least channels a doc is in.  Each doc is in between --minchannelsperdoc and --maxchannelsperdoc channels, picked uniformly",
+	)
+
+	maxChannelsPerDoc = RootCmd.PersistentFlags().Int(
+		"maxchannelsperdoc",
+		1,
+		"The most channels a doc is in.  With more than 1, or a distribution other than uniform, the channels don't all get exactly the same number of docs",
+	)
+
 	batchSize = RootCmd.PersistentFlags().Int(
 		"batchsize",
 		1,
@@ -130,7 +293,7 @@ func init() {
 	compressionEnabled = RootCmd.PersistentFlags().Bool(
 		"compressionenabled",
 		false,
-		"Whether gzip compression is enabled",
+		"Whether compression is enabled: gzip with the REST API, and compressed rev messages with --protocol blip",
 	)
 
 	expvarProgressEnabled = RootCmd.PersistentFlags().Bool(
@@ -145,6 +308,150 @@ func init() {
 		"Will show all levels up to and including this log level.  Values: critical, error, warn, info, debug",
 	)
 
+	maxErrors = RootCmd.PersistentFlags().Int(
+		"maxerrors",
+		0,
+		"Abort the run once more than this many operations (writes, reads, updates, user creation) have failed.  Set to -1 for no maximum",
+	)
+
+	maxErrorPercent = RootCmd.PersistentFlags().Float64(
+		"maxerrorpercent",
+		0,
+		"If > 0, abort the run once more than this percentage of operations have failed.  Only takes effect after the first 100 operations",
+	)
+
+	drainTimeoutMs = RootCmd.PersistentFlags().Int(
+		"draintimeoutms",
+		10000,
+		"On SIGINT or SIGTERM, or when the error budget is exceeded, how long to wait for in-flight requests to finish before cancelling them",
+	)
+
+	reportFile = RootCmd.PersistentFlags().String(
+		"report-file",
+		"",
+		"If set, write the latency percentiles (p50, p90, p99, p999, max) and throughput of each operation, along with the progress stats, to this file as JSON when the run finishes",
+	)
+
+	protocol = RootCmd.PersistentFlags().String(
+		"protocol",
+		"rest",
+		"How the agents talk to Sync Gateway.  Values: rest (the REST API, like Couchbase Lite 1.x), blip (the BLIP replication protocol over /_blipsync, like Couchbase Lite 2.x)",
+	)
+
+	keyspaces = RootCmd.PersistentFlags().StringSlice(
+		"keyspaces",
+		[]string{},
+		"The collections (Sync Gateway 3.1+) to spread the docs across, as a comma separated list of scope.collection (or just collection, in the default scope).  Readers follow the changes feed of each, and users are granted their channels in each.  If empty, the default collection",
+	)
+
+	httpPerAgent = RootCmd.PersistentFlags().Bool(
+		"http-per-agent",
+		false,
+		"Give each writer, reader and updater its own HTTP client and connection pool, like separate devices, rather than sharing one",
+	)
+
+	httpMaxConnsPerHost = RootCmd.PersistentFlags().Int(
+		"http-max-conns-per-host",
+		0,
+		"If > 0, the most connections (in use or idle) each HTTP client opens to Sync Gateway",
+	)
+
+	httpMaxIdleConns = RootCmd.PersistentFlags().Int(
+		"http-max-idle-conns-per-host",
+		0,
+		"How many idle connections each HTTP client keeps for reuse.  Defaults to 1000 for the shared client and 2 with --http-per-agent",
+	)
+
+	httpIdleConnTimeout = RootCmd.PersistentFlags().Duration(
+		"http-idle-conn-timeout",
+		0,
+		"How long an idle connection is kept before it's closed (default 90s)",
+	)
+
+	httpDisableKeepAlives = RootCmd.PersistentFlags().Bool(
+		"http-disable-keep-alives",
+		false,
+		"Open a new connection for every request",
+	)
+
+	http2 = RootCmd.PersistentFlags().Bool(
+		"http2",
+		false,
+		"Use HTTP/2: negotiated with TLS for https URLs, or with prior knowledge (h2c) for http URLs",
+	)
+
+	tlsCACert = RootCmd.PersistentFlags().String(
+		"tls-ca-cert",
+		"",
+		"PEM bundle of the CAs to verify an https Sync Gateway's certificate with, instead of the system's",
+	)
+
+	tlsClientCert = RootCmd.PersistentFlags().String(
+		"tls-client-cert",
+		"",
+		"PEM certificate to present to Sync Gateway.  Needs --tls-client-key",
+	)
+
+	tlsClientKey = RootCmd.PersistentFlags().String(
+		"tls-client-key",
+		"",
+		"PEM private key of the --tls-client-cert",
+	)
+
+	tlsServerName = RootCmd.PersistentFlags().String(
+		"tls-server-name",
+		"",
+		"The name to verify Sync Gateway's certificate against (and send as SNI), if not the host of the --sg-url",
+	)
+
+	tlsInsecureSkipVerify = RootCmd.PersistentFlags().Bool(
+		"tls-insecure-skip-verify",
+		false,
+		"Don't verify Sync Gateway's certificate at all",
+	)
+
+	authMode = RootCmd.PersistentFlags().String(
+		"auth",
+		"basic",
+		"How the agents authenticate as their users.  Values: basic (basic auth on every request), session (log in once with POST /{db}/_session and send the session cookie), jwt (a bearer token signed with a local key, for an OpenID Connect provider)",
+	)
+
+	jwtKeyFile = RootCmd.PersistentFlags().String(
+		"jwt-key-file",
+		"",
+		"PEM RSA private key to sign the --auth jwt tokens with.  If not set, a new key is generated for the run",
+	)
+
+	jwtKeyID = RootCmd.PersistentFlags().String(
+		"jwt-key-id",
+		"sgload",
+		"The kid of the JWT signing key",
+	)
+
+	jwtIssuer = RootCmd.PersistentFlags().String(
+		"jwt-issuer",
+		"sgload",
+		"The iss claim of the tokens, which must match the issuer of Sync Gateway's OpenID Connect provider",
+	)
+
+	jwtAudience = RootCmd.PersistentFlags().String(
+		"jwt-audience",
+		"sync_gateway",
+		"The aud claim of the tokens, which must match the client_id of Sync Gateway's OpenID Connect provider",
+	)
+
+	jwtTokenTTL = RootCmd.PersistentFlags().Duration(
+		"jwt-token-ttl",
+		time.Hour,
+		"How long each token is valid for.  Tokens are signed again shortly before they expire",
+	)
+
+	jwtKeySetFile = RootCmd.PersistentFlags().String(
+		"jwt-keyset",
+		"",
+		"If set, write the public key of the JWT signing key here as a JSON Web Key Set, to configure Sync Gateway (or sgsimulator --jwt-keyset) with",
+	)
+
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.sgload.yaml)")
 
 	// Cobra also supports local flags which will only run when this action is called directly
@@ -156,14 +463,37 @@ func init() {
 func initConfig() {
 	if cfgFile != "" { // enable ability to specify config file via flag
 		viper.SetConfigFile(cfgFile)
+	} else {
+		// NOTE: SetConfigName would override the --config file, so only use it as a fallback
+		viper.SetConfigName(".sgload") // name of config file (without extension)
+		viper.AddConfigPath("$HOME")   // adding home directory as first search path
 	}
 
-	viper.SetConfigName(".sgload") // name of config file (without extension)
-	viper.AddConfigPath("$HOME")   // adding home directory as first search path
-	viper.AutomaticEnv()           // read in environment variables that match
+	// read in environment variables that match, eg SGLOAD_NUMDOCS or SGLOAD_SG_URL
+	viper.SetEnvPrefix("sgload")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
 }
+
+// Any flag of the command being run that wasn't given on the command line takes its
+// value from the environment or the config file (where the keys are the flag names,
+// eg "numdocs: 1000"), if it's set there.
+func applyConfigToFlags(cmd *cobra.Command) error {
+
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed || !viper.IsSet(flag.Name) {
+			return
+		}
+		if setErr := flag.Value.Set(viper.GetString(flag.Name)); setErr != nil {
+			err = fmt.Errorf("Invalid value for %s in config: %v", flag.Name, setErr)
+		}
+	})
+	return err
+
+}
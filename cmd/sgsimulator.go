@@ -1,21 +1,71 @@
 package cmd
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/couchbaselabs/sgload/jwt"
+
 	"github.com/couchbaselabs/sgload/sgsimulator"
 	"github.com/spf13/cobra"
 )
 
 var (
-	db *string
+	db             *string
+	simPort        *int
+	simAdminPort   *int
+	simFaultConfig *string
+	simTLSCert     *string
+	simTLSKey      *string
+	simTLSClientCA *string
+	simSessionTTL  *time.Duration
+	simJWTIssuer   *string
+	simJWTKeySet   *string
+	simAdminUser   *string
+	simAdminPass   *string
+	simCollections *[]string
 )
 
 // sgsimulatorCmd respresents the sgsimulator command
 var sgsimulatorCmd = &cobra.Command{
 	Use:   "sgsimulator",
 	Short: "Run a Sync Gateway simulator",
-	Long:  `Run a Sync Gateway simulator that responds to requests but does not save any data`,
+	Long:  `Run a Sync Gateway simulator that keeps documents, revisions, channels and users in memory`,
 	Run: func(cmd *cobra.Command, args []string) {
 		sgSimulator := sgsimulator.NewSGSimulator(*db)
+		sgSimulator.Port = *simPort
+		sgSimulator.AdminPort = *simAdminPort
+		sgSimulator.TLSCertFile = *simTLSCert
+		sgSimulator.TLSKeyFile = *simTLSKey
+		sgSimulator.TLSClientCAFile = *simTLSClientCA
+		sgSimulator.SessionTTL = *simSessionTTL
+		sgSimulator.AdminUsername = *simAdminUser
+		sgSimulator.AdminPassword = *simAdminPass
+		for _, collection := range *simCollections {
+			if err := sgSimulator.AddCollection(collection); err != nil {
+				log.Fatalf("Unable to add collection: %v", err)
+			}
+		}
+		if *simJWTKeySet != "" {
+			keySetJSON, err := ioutil.ReadFile(*simJWTKeySet)
+			if err != nil {
+				log.Fatalf("Unable to read JWT key set %v: %v", *simJWTKeySet, err)
+			}
+			keySet := jwt.KeySet{}
+			if err := json.Unmarshal(keySetJSON, &keySet); err != nil {
+				log.Fatalf("Unable to parse JWT key set %v: %v", *simJWTKeySet, err)
+			}
+			sgSimulator.SetJWTProvider(sgsimulator.JWTProvider{Issuer: *simJWTIssuer, Keys: keySet})
+		}
+		if *simFaultConfig != "" {
+			faultConfig, err := sgsimulator.LoadFaultConfig(*simFaultConfig)
+			if err != nil {
+				log.Fatalf("Unable to load fault config %v: %v", *simFaultConfig, err)
+			}
+			sgSimulator.SetFaultConfig(faultConfig)
+		}
 		sgSimulator.Run()
 	},
 }
@@ -28,6 +78,30 @@ func init() {
 	// Cobra supports Persistent Flags which will work for this command and all subcommands
 	db = sgsimulatorCmd.PersistentFlags().String("db", "db", "The database to respond to")
 
+	simPort = sgsimulatorCmd.PersistentFlags().Int("port", sgsimulator.DefaultPort, "The port to serve the public REST API on")
+
+	simAdminPort = sgsimulatorCmd.PersistentFlags().Int("adminport", sgsimulator.DefaultAdminPort, "The port to serve the admin REST API on")
+
+	simCollections = sgsimulatorCmd.PersistentFlags().StringSlice("collections", []string{}, "The collections to serve besides the default one, as a comma separated list of scope.collection.  Each is served at /{db}.{scope}.{collection}/, like Sync Gateway 3.1+")
+
+	simAdminUser = sgsimulatorCmd.PersistentFlags().String("admin-username", "", "If set, the admin REST API only accepts requests with basic auth as this user, like Sync Gateway 3.x")
+
+	simAdminPass = sgsimulatorCmd.PersistentFlags().String("admin-password", "", "The password of the --admin-username")
+
+	simFaultConfig = sgsimulatorCmd.PersistentFlags().String("faultconfig", "", "Path to a JSON file describing latency, errors, connection resets, stuck requests and partial _bulk_docs failures to inject per endpoint")
+
+	simTLSCert = sgsimulatorCmd.PersistentFlags().String("tls-cert", "", "Path to a PEM certificate to serve https with.  Needs --tls-key")
+
+	simTLSKey = sgsimulatorCmd.PersistentFlags().String("tls-key", "", "Path to the PEM private key of the --tls-cert")
+
+	simTLSClientCA = sgsimulatorCmd.PersistentFlags().String("tls-client-ca", "", "Path to a PEM bundle of CAs.  If set, clients must present a certificate signed by one of them")
+
+	simSessionTTL = sgsimulatorCmd.PersistentFlags().Duration("session-ttl", sgsimulator.DefaultSessionTTL, "How long the sessions created by logging in with POST /{db}/_session last")
+
+	simJWTIssuer = sgsimulatorCmd.PersistentFlags().String("jwt-issuer", "sgload", "The issuer of the bearer tokens to accept, if --jwt-keyset is set")
+
+	simJWTKeySet = sgsimulatorCmd.PersistentFlags().String("jwt-keyset", "", "Path to a JSON Web Key Set (eg, written by sgload's --jwt-keyset).  If set, bearer tokens signed with its keys are accepted, with the sub claim as the username")
+
 	// Cobra supports local flags which will only run when this command is called directly
 	// sgsimulatorCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle" )
 
@@ -9,9 +9,14 @@ import (
 )
 
 var (
-	numWriters    *int
-	createWriters *bool
-	writerDelayMs *int
+	numWriters       *int
+	createWriters    *bool
+	writerDelayMs    *int
+	duration         *time.Duration
+	writeOpsPerSec   *float64
+	writeMaxInFlight *int
+	pushReplicator   *bool
+	numKnownRevs     *int
 )
 
 // writeloadCmd respresents the writeload command
@@ -25,24 +30,30 @@ var writeloadCmd = &cobra.Command{
 		logger = sgload.Logger()
 
 		loadSpec := createLoadSpecFromArgs()
+		loadSpec.Duration = *duration
 		sgload.SetLogLevel(loadSpec.LogLevel)
 
 		delayBetweenWrites := time.Millisecond * time.Duration(*writerDelayMs)
 
 		writeLoadSpec := sgload.WriteLoadSpec{
-			LoadSpec:      loadSpec,
-			NumWriters:    *numWriters,
-			CreateWriters: *createWriters,
+			LoadSpec:           loadSpec,
+			NumWriters:         *numWriters,
+			CreateWriters:      *createWriters,
 			DelayBetweenWrites: delayBetweenWrites,
+			TargetOpsPerSec:    *writeOpsPerSec,
+			MaxWritesInFlight:  *writeMaxInFlight,
+			PushReplicator: sgload.PushReplicatorSpec{
+				Enabled:      *pushReplicator,
+				NumKnownRevs: *numKnownRevs,
+			},
 		}
 		if err := writeLoadSpec.Validate(); err != nil {
 
 			panic(fmt.Sprintf("Invalid parameters: %+v. Error: %v", writeLoadSpec, err))
 		}
 		writeLoadRunner := sgload.NewWriteLoadRunner(writeLoadSpec)
-		if err := writeLoadRunner.Run(); err != nil {
-			panic(fmt.Sprintf("Writeload.Run() failed with: %v", err))
-		}
+		err := writeLoadRunner.Run(createInterruptibleContext())
+		finishRun("writeload", err)
 
 	},
 }
@@ -69,4 +80,34 @@ func init() {
 		WRITER_DELAY_CMD_DESC,
 	)
 
+	duration = writeloadCmd.PersistentFlags().Duration(
+		DURATION_CMD_NAME,
+		DURATION_CMD_DEFAULT,
+		DURATION_CMD_DESC,
+	)
+
+	writeOpsPerSec = writeloadCmd.PersistentFlags().Float64(
+		WRITE_OPS_PER_SEC_CMD_NAME,
+		WRITE_OPS_PER_SEC_CMD_DEFAULT,
+		WRITE_OPS_PER_SEC_CMD_DESC,
+	)
+
+	writeMaxInFlight = writeloadCmd.PersistentFlags().Int(
+		WRITE_MAX_IN_FLIGHT_CMD_NAME,
+		WRITE_MAX_IN_FLIGHT_CMD_DEFAULT,
+		WRITE_MAX_IN_FLIGHT_CMD_DESC,
+	)
+
+	pushReplicator = writeloadCmd.PersistentFlags().Bool(
+		PUSH_REPLICATOR_CMD_NAME,
+		PUSH_REPLICATOR_CMD_DEFAULT,
+		PUSH_REPLICATOR_CMD_DESC,
+	)
+
+	numKnownRevs = writeloadCmd.PersistentFlags().Int(
+		NUM_KNOWN_REVS_CMD_NAME,
+		NUM_KNOWN_REVS_CMD_DEFAULT,
+		NUM_KNOWN_REVS_CMD_DESC,
+	)
+
 }
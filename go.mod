@@ -3,16 +3,22 @@ module github.com/couchbaselabs/sgload
 go 1.14
 
 require (
+	github.com/HdrHistogram/hdrhistogram-go v1.0.1
 	github.com/abiosoft/semaphore v0.0.0-20180811165425-cb737ff681bd
-	github.com/couchbase/clog v0.0.0-20190523192451-b8e6d5d421bc // indirect
+	github.com/couchbase/clog v0.0.0-20190523192451-b8e6d5d421bc
 	github.com/couchbaselabs/go.assert v0.0.0-20130325201400-cfb33e3a0dac // indirect
 	github.com/couchbaselabs/sg-replicate v0.0.0-20190619162552-d6eb45633e57
 	github.com/gorilla/mux v1.7.4
+	github.com/gorilla/websocket v1.5.0
 	github.com/hashicorp/go-retryablehttp v0.6.6
 	github.com/inconshreveable/log15 v0.0.0-20200109203555-b30bc20e4fd1
 	github.com/peterbourgon/g2s v0.0.0-20170223122336-d4e7ad98afea
+	github.com/prometheus/client_golang v1.7.1
 	github.com/satori/go.uuid v1.2.0
 	github.com/spf13/cobra v1.0.0
+	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.7.0
 	github.com/tleyden/fakehttp v0.0.0-20150307184655-084795c8f01f // indirect
+	golang.org/x/net v0.0.0-20201021035429-f5854403a974
+	gopkg.in/yaml.v2 v2.2.5
 )
@@ -0,0 +1,167 @@
+// Package jwt is a minimal implementation of RS256 signed JSON Web Tokens, and of the
+// JSON Web Key Sets that publish the keys to verify them with.  sgload signs tokens
+// with a local key, as an OpenID Connect provider would, and Sync Gateway (or
+// sgsimulator) is configured with the key set to accept them as bearer tokens.
+package jwt
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const algorithm = "RS256"
+
+// The claims that Sync Gateway checks, where Subject is the username
+type Claims struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	Audience string `json:"aud,omitempty"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+var encoding = base64.RawURLEncoding
+
+// Sign the claims with the private key, whose ID is put in the token's header so the
+// right key can be found to verify it
+func Sign(claims Claims, key *rsa.PrivateKey, keyID string) (string, error) {
+
+	headerJSON, err := json.Marshal(header{Algorithm: algorithm, Type: "JWT", KeyID: keyID})
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encoding.EncodeToString(headerJSON) + "." + encoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + encoding.EncodeToString(signature), nil
+
+}
+
+// Check the token's signature against the key set, and that it hasn't expired, and
+// return its claims
+func Verify(token string, keys KeySet) (Claims, error) {
+
+	claims := Claims{}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("Malformed token")
+	}
+
+	hdr := header{}
+	if err := decodeJSON(parts[0], &hdr); err != nil {
+		return claims, fmt.Errorf("Malformed token header: %v", err)
+	}
+	if hdr.Algorithm != algorithm {
+		return claims, fmt.Errorf("Unsupported signing algorithm %q", hdr.Algorithm)
+	}
+	key, err := keys.publicKey(hdr.KeyID)
+	if err != nil {
+		return claims, err
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("Malformed token signature: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return claims, errors.New("Invalid token signature")
+	}
+
+	if err := decodeJSON(parts[1], &claims); err != nil {
+		return claims, fmt.Errorf("Malformed token claims: %v", err)
+	}
+	if time.Now().Unix() >= claims.Expiry {
+		return claims, errors.New("Token has expired")
+	}
+	return claims, nil
+
+}
+
+func decodeJSON(part string, value interface{}) error {
+	js, err := encoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(js, value)
+}
+
+// A public key in JSON Web Key format
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+// The keys that tokens can be signed with, as published by a provider
+type KeySet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// The key set with just the public half of the given key
+func PublicKeySet(key *rsa.PublicKey, keyID string) KeySet {
+	return KeySet{
+		Keys: []JWK{
+			{
+				KeyType:   "RSA",
+				KeyID:     keyID,
+				Use:       "sig",
+				Algorithm: algorithm,
+				Modulus:   encoding.EncodeToString(key.N.Bytes()),
+				Exponent:  encoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			},
+		},
+	}
+}
+
+// The key with the given ID, or the only key if the token didn't say
+func (ks KeySet) publicKey(keyID string) (*rsa.PublicKey, error) {
+
+	for _, jwk := range ks.Keys {
+		if jwk.KeyType != "RSA" || (keyID != "" && jwk.KeyID != keyID) {
+			continue
+		}
+		modulus, err := encoding.DecodeString(jwk.Modulus)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed modulus of key %q: %v", jwk.KeyID, err)
+		}
+		exponent, err := encoding.DecodeString(jwk.Exponent)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed exponent of key %q: %v", jwk.KeyID, err)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(modulus),
+			E: int(new(big.Int).SetBytes(exponent).Int64()),
+		}, nil
+	}
+	return nil, fmt.Errorf("No RSA key with ID %q", keyID)
+
+}
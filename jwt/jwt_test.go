@@ -0,0 +1,66 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	// The key set survives being written out and read back in, as it is when
+	// Sync Gateway is configured with it
+	js, err := json.Marshal(PublicKeySet(&key.PublicKey, "sgload"))
+	if err != nil {
+		t.Fatalf("Error marshalling key set: %v", err)
+	}
+	keys := KeySet{}
+	if err := json.Unmarshal(js, &keys); err != nil {
+		t.Fatalf("Error unmarshalling key set: %v", err)
+	}
+
+	claims := Claims{
+		Issuer:   "sgload",
+		Subject:  "reader-0",
+		Audience: "sync_gateway",
+		IssuedAt: time.Now().Unix(),
+		Expiry:   time.Now().Add(time.Hour).Unix(),
+	}
+	token, err := Sign(claims, key, "sgload")
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+	verified, err := Verify(token, keys)
+	if err != nil || verified != claims {
+		t.Fatalf("Expected to verify %+v, got %+v, %v", claims, verified, err)
+	}
+
+	// Tokens signed with another key, with an unknown key ID, that have been
+	// tampered with or that have expired are rejected
+	signedByOther, _ := Sign(claims, otherKey, "sgload")
+	unknownKeyID, _ := Sign(claims, key, "other")
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + encoding.EncodeToString([]byte(`{"iss":"sgload","sub":"admin","exp":9999999999}`)) + "." + parts[2]
+	expiredClaims := claims
+	expiredClaims.Expiry = time.Now().Add(-time.Minute).Unix()
+	expired, _ := Sign(expiredClaims, key, "sgload")
+
+	for _, badToken := range []string{signedByOther, unknownKeyID, tampered, expired, "not.a.token", "garbage"} {
+		if _, err := Verify(badToken, keys); err == nil {
+			t.Fatalf("Expected error verifying %q", badToken)
+		}
+	}
+
+}
@@ -0,0 +1,399 @@
+package sgload
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	USER_PREFIX_ACCESS_CHURNER = "churner"
+)
+
+var (
+	// How long a churner waits to try again when every reader's access is already being changed
+	accessChurnerIdleInterval = 100 * time.Millisecond
+)
+
+// A change to the channels a reader has access to.  The churner that made it tells the
+// reader once Sync Gateway has saved it, so that the reader can check its changes feed
+// catches up: the docs of the granted channels are backfilled, and those it can no
+// longer see are removed.
+type AccessChange struct {
+	ChangedAt      time.Time // Just before the user was saved
+	Granted        []string  // The channels the reader got access to, through its admin channels or a role
+	Revoked        []string  // The channels the reader lost access to
+	ChannelsAfter  []string  // All the channels the reader has access to after the change
+	BackfillDocIds []string  // The docs that were in the granted channels just before the change
+}
+
+// The readers whose access the churners change, and the roles they give them.  Readers
+// register once their user has been created, and unregister when they stop.
+type AccessRegistry struct {
+	Roles             map[string][]string // The channels of each role, by role name
+	VisibilityTimeout time.Duration       // How long readers wait for the effect of a change on their changes feeds
+	mutex             sync.Mutex
+	subscribers       []*accessSubscriber
+}
+
+func NewAccessRegistry(roles map[string][]string, visibilityTimeout time.Duration) *AccessRegistry {
+	return &AccessRegistry{
+		Roles:             roles,
+		VisibilityTimeout: visibilityTimeout,
+	}
+}
+
+// The access of a registered reader
+type accessSubscriber struct {
+	username      string
+	changes       chan AccessChange // The changes made, in order, for the reader
+	done          chan struct{}     // Closed when the reader unregisters
+	mutex         sync.Mutex
+	adminChannels []string
+	roles         []string
+	changing      bool            // Whether a churner is changing the reader's access, so that no other one does at the same time
+	everGranted   map[string]bool // Every channel the reader has had access to, so it may have docs from
+	everRevoked   map[string]bool // Every channel the reader has lost access to, so it may have docs removed from
+}
+
+func (ar *AccessRegistry) register(username string, channels []string) *accessSubscriber {
+
+	subscriber := &accessSubscriber{
+		username:      username,
+		changes:       make(chan AccessChange, 100),
+		done:          make(chan struct{}),
+		adminChannels: append([]string{}, channels...),
+		roles:         []string{},
+		everGranted:   map[string]bool{},
+		everRevoked:   map[string]bool{},
+	}
+	for _, channel := range channels {
+		subscriber.everGranted[channel] = true
+	}
+
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+	ar.subscribers = append(ar.subscribers, subscriber)
+	return subscriber
+
+}
+
+func (ar *AccessRegistry) unregister(subscriber *accessSubscriber) {
+
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+	for i, s := range ar.subscribers {
+		if s == subscriber {
+			ar.subscribers = append(ar.subscribers[:i], ar.subscribers[i+1:]...)
+			break
+		}
+	}
+	close(subscriber.done)
+
+}
+
+// Pick a reader at random whose access isn't already being changed, and mark it as
+// being changed until it's released.  Returns nil if there's none.
+func (ar *AccessRegistry) acquire(rng *rand.Rand) *accessSubscriber {
+
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+
+	available := []*accessSubscriber{}
+	for _, subscriber := range ar.subscribers {
+		subscriber.mutex.Lock()
+		if !subscriber.changing {
+			available = append(available, subscriber)
+		}
+		subscriber.mutex.Unlock()
+	}
+	if len(available) == 0 {
+		return nil
+	}
+
+	subscriber := available[rng.Intn(len(available))]
+	subscriber.mutex.Lock()
+	subscriber.changing = true
+	subscriber.mutex.Unlock()
+	return subscriber
+
+}
+
+func (ar *AccessRegistry) release(subscriber *accessSubscriber) {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+	subscriber.changing = false
+}
+
+// The names of the roles, in a fixed order
+func (ar *AccessRegistry) roleNames() []string {
+	roleNames := []string{}
+	for roleName := range ar.Roles {
+		roleNames = append(roleNames, roleName)
+	}
+	sort.Strings(roleNames)
+	return roleNames
+}
+
+// All the channels a user with these admin channels and roles has access to
+func (ar *AccessRegistry) channelsOf(adminChannels, roles []string) []string {
+	channels := append([]string{}, adminChannels...)
+	for _, role := range roles {
+		for _, channel := range ar.Roles[role] {
+			if !contains(channels, channel) {
+				channels = append(channels, channel)
+			}
+		}
+	}
+	return channels
+}
+
+func (s *accessSubscriber) access() (adminChannels, roles []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.adminChannels, s.roles
+}
+
+func (s *accessSubscriber) setAccess(adminChannels, roles []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.adminChannels = adminChannels
+	s.roles = roles
+}
+
+// Note the channels that are about to be granted and revoked, before the user is saved,
+// so that the reader doesn't fail on docs from them that arrive straight away
+func (s *accessSubscriber) expect(granted, revoked []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, channel := range granted {
+		s.everGranted[channel] = true
+	}
+	for _, channel := range revoked {
+		s.everRevoked[channel] = true
+	}
+}
+
+// Every channel the reader has had access to
+func (s *accessSubscriber) channelsEverGranted() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	channels := []string{}
+	for channel := range s.everGranted {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// Whether the reader has lost access to all of the channels at some point
+func (s *accessSubscriber) everRevokedAll(channels []string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, channel := range channels {
+		if !s.everRevoked[channel] {
+			return false
+		}
+	}
+	return true
+}
+
+// Tell the reader about a change, unless it has stopped
+func (s *accessSubscriber) notify(ctx context.Context, change AccessChange) {
+	select {
+	case s.changes <- change:
+	case <-s.done:
+	case <-ctx.Done():
+	}
+}
+
+type AccessChurnerSpec struct {
+	DelayBetweenChanges time.Duration // Delay between changes to the readers' access
+	ChannelNames        []string      // The channels that can be granted
+}
+
+// Grants and revokes the readers' channels and roles through the admin _user endpoint,
+// one reader at a time, until the run is over.  Each change is either granting a
+// channel, revoking one (a reader always keeps at least one of its own), or adding or
+// removing a role.
+type AccessChurner struct {
+	Agent
+	AccessChurnerSpec
+	Registry   *AccessRegistry
+	rng        *rand.Rand
+	numChanges int
+}
+
+func NewAccessChurner(agentSpec AgentSpec, spec AccessChurnerSpec, registry *AccessRegistry, rng *rand.Rand) *AccessChurner {
+	return &AccessChurner{
+		Agent: Agent{
+			AgentSpec: agentSpec,
+		},
+		AccessChurnerSpec: spec,
+		Registry:          registry,
+		rng:               rng,
+	}
+}
+
+// Main loop of the churner goroutine.  Runs until ctx is done.
+func (c *AccessChurner) Run(ctx context.Context) {
+
+	defer c.FinishedWg.Done()
+
+	requestCtx, cancelRequests := c.requestContext(ctx)
+	defer cancelRequests()
+
+	accessDataStore, ok := c.DataStore.(AccessDataStore)
+	if !ok {
+		c.reportError("change_access", fmt.Errorf("The data store can't change the access of users"))
+		return
+	}
+
+	for {
+
+		sleepContext(ctx, c.DelayBetweenChanges)
+		if ctx.Err() != nil {
+			logger.Info("Access churner stopped", "agent.ID", c.ID, "numchanges", c.numChanges)
+			return
+		}
+
+		subscriber := c.Registry.acquire(c.rng)
+		if subscriber == nil {
+			sleepContext(ctx, accessChurnerIdleInterval)
+			continue
+		}
+		err := c.changeAccess(ctx, requestCtx, accessDataStore, subscriber)
+		c.Registry.release(subscriber)
+		if err != nil {
+			logger.Error("Error changing access", "agent.ID", c.ID, "username", subscriber.username, "err", err)
+			if c.reportError("change_access", err) {
+				return
+			}
+			continue
+		}
+		c.Errors.RecordSuccess()
+
+	}
+
+}
+
+// Make one change to the reader's access, and tell the reader about it
+func (c *AccessChurner) changeAccess(ctx, requestCtx context.Context, accessDataStore AccessDataStore, subscriber *accessSubscriber) error {
+
+	adminChannels, roles := subscriber.access()
+	newAdminChannels, newRoles, isGrant, ok := c.nextAccess(adminChannels, roles)
+	if !ok {
+		logger.Debug("No change possible to access", "agent.ID", c.ID, "username", subscriber.username)
+		return nil
+	}
+
+	before := c.Registry.channelsOf(adminChannels, roles)
+	after := c.Registry.channelsOf(newAdminChannels, newRoles)
+	change := AccessChange{
+		Granted:        channelsNotIn(after, before),
+		Revoked:        channelsNotIn(before, after),
+		ChannelsAfter:  after,
+		BackfillDocIds: []string{},
+	}
+	subscriber.expect(change.Granted, change.Revoked)
+
+	if len(change.Granted) > 0 {
+		backfillDocIds, err := accessDataStore.ChannelDocIDs(requestCtx, change.Granted)
+		if err != nil {
+			return err
+		}
+		change.BackfillDocIds = backfillDocIds
+	}
+
+	change.ChangedAt = time.Now()
+	if err := accessDataStore.UpdateUserAccess(requestCtx, subscriber.username, newAdminChannels, newRoles); err != nil {
+		return err
+	}
+	subscriber.setAccess(newAdminChannels, newRoles)
+	c.numChanges++
+
+	if c.Metrics != nil {
+		if isGrant {
+			c.Metrics.Counter("access_grants", 1)
+		} else {
+			c.Metrics.Counter("access_revocations", 1)
+		}
+	}
+	logger.Debug(
+		"Changed access",
+		"agent.ID", c.ID,
+		"username", subscriber.username,
+		"adminchannels", newAdminChannels,
+		"roles", newRoles,
+		"granted", change.Granted,
+		"revoked", change.Revoked,
+	)
+
+	subscriber.notify(ctx, change)
+	return nil
+
+}
+
+// Pick the next change to a reader's admin channels and roles, and whether it's a grant
+// (rather than a revocation).  Returns false if there's no change to make, which is
+// when the reader already has the only channel and there are no roles.
+func (c *AccessChurner) nextAccess(adminChannels, roles []string) (newAdminChannels, newRoles []string, isGrant, ok bool) {
+
+	const (
+		grantChannel  = "grant_channel"
+		revokeChannel = "revoke_channel"
+		addRole       = "add_role"
+		removeRole    = "remove_role"
+	)
+
+	roleNames := c.Registry.roleNames()
+	kinds := []string{}
+	if len(adminChannels) < len(c.ChannelNames) {
+		kinds = append(kinds, grantChannel)
+	}
+	if len(adminChannels) > 1 {
+		kinds = append(kinds, revokeChannel)
+	}
+	if len(roles) < len(roleNames) {
+		kinds = append(kinds, addRole)
+	}
+	if len(roles) > 0 {
+		kinds = append(kinds, removeRole)
+	}
+	if len(kinds) == 0 {
+		return adminChannels, roles, false, false
+	}
+
+	newAdminChannels, newRoles = adminChannels, roles
+	switch kinds[c.rng.Intn(len(kinds))] {
+	case grantChannel:
+		newAdminChannels = append(append([]string{}, adminChannels...), pickOne(channelsNotIn(c.ChannelNames, adminChannels), c.rng))
+		isGrant = true
+	case revokeChannel:
+		newAdminChannels = channelsNotIn(adminChannels, []string{pickOne(adminChannels, c.rng)})
+	case addRole:
+		newRoles = append(append([]string{}, roles...), pickOne(channelsNotIn(roleNames, roles), c.rng))
+		isGrant = true
+	case removeRole:
+		newRoles = channelsNotIn(roles, []string{pickOne(roles, c.rng)})
+	}
+	return newAdminChannels, newRoles, isGrant, true
+
+}
+
+func pickOne(strs []string, rng *rand.Rand) string {
+	return strs[rng.Intn(len(strs))]
+}
+
+// The strings in a that aren't in b, in the order they're in a
+func channelsNotIn(a, b []string) []string {
+	notIn := []string{}
+	for _, s := range a {
+		if !contains(b, s) {
+			notIn = append(notIn, s)
+		}
+	}
+	return notIn
+}
@@ -0,0 +1,46 @@
+package sgload
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestAccessChurnerNextAccess(t *testing.T) {
+
+	newChurner := func(channelNames []string, roles map[string][]string) *AccessChurner {
+		return NewAccessChurner(
+			AgentSpec{},
+			AccessChurnerSpec{ChannelNames: channelNames},
+			NewAccessRegistry(roles, time.Minute),
+			rand.New(rand.NewSource(1)),
+		)
+	}
+
+	// A reader that already has the only channel, with no roles, can't be changed
+	churner := newChurner([]string{"A"}, map[string][]string{})
+	if _, _, _, ok := churner.nextAccess([]string{"A"}, []string{}); ok {
+		t.Fatalf("Expected no change with a single channel and no roles")
+	}
+
+	// With a role as well, the only change is to add it, and then to remove it
+	churner = newChurner([]string{"A"}, map[string][]string{"role": {"A"}})
+	adminChannels, roles, isGrant, ok := churner.nextAccess([]string{"A"}, []string{})
+	if !ok || !isGrant || len(adminChannels) != 1 || len(roles) != 1 {
+		t.Fatalf("Expected the role to be added, got %v %v (grant: %v, ok: %v)", adminChannels, roles, isGrant, ok)
+	}
+	adminChannels, roles, isGrant, ok = churner.nextAccess(adminChannels, roles)
+	if !ok || isGrant || len(adminChannels) != 1 || len(roles) != 0 {
+		t.Fatalf("Expected the role to be removed, got %v %v (grant: %v, ok: %v)", adminChannels, roles, isGrant, ok)
+	}
+
+	// A reader never loses its last admin channel
+	churner = newChurner([]string{"A", "B"}, map[string][]string{})
+	for i := 0; i < 20; i++ {
+		adminChannels, _, _, ok = churner.nextAccess(adminChannels, []string{})
+		if !ok || len(adminChannels) == 0 {
+			t.Fatalf("Expected a change that leaves an admin channel, got %v (ok: %v)", adminChannels, ok)
+		}
+	}
+
+}
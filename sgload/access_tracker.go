@@ -0,0 +1,200 @@
+package sgload
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Keeps track of the docs a reader has access to, so that when its access changes it
+// can check that its changes feed catches up, and time how long that takes: the docs of
+// granted channels have to be backfilled, and the docs only in revoked channels removed.
+// Only used by the reader's main loop, apart from the subscriber.
+type accessTracker struct {
+	subscriber  *accessSubscriber
+	timeout     time.Duration
+	metrics     MetricsSink
+	visibleAt   map[string]time.Time // When each doc the reader has access to last arrived
+	removedAt   map[string]time.Time // When each doc the reader lost access to was removed
+	docChannels map[string][]string  // The channels of each doc, from when it last arrived
+	pending     []*pendingAccessChange
+}
+
+// The docs a change to the reader's access is still waiting for
+type pendingAccessChange struct {
+	change      AccessChange
+	revoke      bool            // Whether the change is waiting for the docs of revoked channels to be removed, rather than those of granted ones to be backfilled
+	channels    []string        // The channels granted or revoked
+	waitingFor  map[string]bool // The IDs of the docs that haven't arrived, or been removed, yet
+	lastArrived time.Time       // When the last of the docs that has arrived (or been removed) did
+}
+
+func newAccessTracker(subscriber *accessSubscriber, timeout time.Duration, metrics MetricsSink) *accessTracker {
+	return &accessTracker{
+		subscriber:  subscriber,
+		timeout:     timeout,
+		metrics:     metrics,
+		visibleAt:   map[string]time.Time{},
+		removedAt:   map[string]time.Time{},
+		docChannels: map[string][]string{},
+	}
+}
+
+// Start waiting for the docs of a change.  Earlier changes that it undoes stop waiting,
+// since their docs might never arrive, or be removed, now.
+func (t *accessTracker) accessChanged(change AccessChange) {
+
+	stillPending := []*pendingAccessChange{}
+	for _, p := range t.pending {
+		undone := change.Revoked
+		if p.revoke {
+			undone = change.Granted
+		}
+		if !intersects(p.channels, undone) {
+			stillPending = append(stillPending, p)
+		}
+	}
+	t.pending = stillPending
+
+	if len(change.Granted) > 0 {
+		p := &pendingAccessChange{change: change, channels: change.Granted, waitingFor: map[string]bool{}}
+		for _, docId := range change.BackfillDocIds {
+			visibleAt, visible := t.visibleAt[docId]
+			switch {
+			case !visible:
+				p.waitingFor[docId] = true
+			case visibleAt.After(change.ChangedAt):
+				p.arrived(visibleAt)
+			}
+		}
+		t.pending = append(t.pending, p)
+	}
+
+	if len(change.Revoked) > 0 {
+		p := &pendingAccessChange{change: change, revoke: true, channels: change.Revoked, waitingFor: map[string]bool{}}
+		for docId := range t.visibleAt {
+			docChannels := t.docChannels[docId]
+			if intersects(docChannels, change.Revoked) && !intersects(docChannels, change.ChannelsAfter) {
+				p.waitingFor[docId] = true
+			}
+		}
+		for docId, removedAt := range t.removedAt {
+			if removedAt.After(change.ChangedAt) && intersects(t.docChannels[docId], change.Revoked) {
+				p.arrived(removedAt)
+			}
+		}
+		t.pending = append(t.pending, p)
+	}
+
+	t.finishPending()
+
+}
+
+// Record the docs that arrived on the changes feed, with their channels, and the
+// docs that were removed from it
+func (t *accessTracker) docsArrived(arrivals map[string]time.Time, docChannels map[string][]string, removals Removals) {
+
+	for docId, channels := range docChannels {
+		t.visibleAt[docId] = arrivals[docId]
+		t.docChannels[docId] = channels
+		delete(t.removedAt, docId)
+	}
+	for docId := range removals {
+		t.removedAt[docId] = arrivals[docId]
+		delete(t.visibleAt, docId)
+	}
+	if t.metrics != nil && len(removals) > 0 {
+		t.metrics.Counter("access_docs_removed", len(removals))
+	}
+
+	for _, p := range t.pending {
+		for docId := range p.waitingFor {
+			arrivedAt, ok := t.visibleAt[docId]
+			if p.revoke {
+				arrivedAt, ok = t.removedAt[docId]
+			}
+			if !ok {
+				continue
+			}
+			delete(p.waitingFor, docId)
+			p.arrived(arrivedAt)
+			if !p.revoke && t.metrics != nil {
+				t.metrics.Counter("access_docs_backfilled", 1)
+			}
+		}
+	}
+
+	t.finishPending()
+
+}
+
+// Push how long the changes that aren't waiting for anything any more took to show up
+// on the changes feed, and stop tracking them
+func (t *accessTracker) finishPending() {
+
+	stillPending := []*pendingAccessChange{}
+	for _, p := range t.pending {
+		if len(p.waitingFor) > 0 {
+			stillPending = append(stillPending, p)
+			continue
+		}
+		if t.metrics == nil || p.lastArrived.IsZero() {
+			// No docs were affected, so there's nothing to time
+			continue
+		}
+		delta := p.lastArrived.Sub(p.change.ChangedAt)
+		if delta < 0 {
+			delta = 0
+		}
+		if p.revoke {
+			t.metrics.Timing("access_revoke_visibility", delta)
+		} else {
+			t.metrics.Timing("access_grant_visibility", delta)
+		}
+	}
+	t.pending = stillPending
+
+}
+
+// The changes which have been waiting for longer than the timeout, which are errors.
+// They stop being tracked.
+func (t *accessTracker) overdue(now time.Time) []error {
+
+	errs := []error{}
+	stillPending := []*pendingAccessChange{}
+	for _, p := range t.pending {
+		if now.Sub(p.change.ChangedAt) <= t.timeout {
+			stillPending = append(stillPending, p)
+			continue
+		}
+		waitingFor := []string{}
+		for docId := range p.waitingFor {
+			waitingFor = append(waitingFor, docId)
+		}
+		sort.Strings(waitingFor)
+		if p.revoke {
+			errs = append(errs, fmt.Errorf("%d docs weren't removed within %v of revoking channels %v, eg %s", len(waitingFor), t.timeout, p.channels, waitingFor[0]))
+		} else {
+			errs = append(errs, fmt.Errorf("%d docs weren't backfilled within %v of granting channels %v, eg %s", len(waitingFor), t.timeout, p.channels, waitingFor[0]))
+		}
+	}
+	t.pending = stillPending
+	return errs
+
+}
+
+func (p *pendingAccessChange) arrived(arrivedAt time.Time) {
+	if arrivedAt.After(p.lastArrived) {
+		p.lastArrived = arrivedAt
+	}
+}
+
+// Whether any of a is in b
+func intersects(a, b []string) bool {
+	for _, s := range a {
+		if contains(b, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package sgload
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessTrackerGrantsAndRevocations(t *testing.T) {
+
+	registry := NewAccessRegistry(map[string][]string{}, time.Minute)
+	subscriber := registry.register("reader", []string{"A"})
+	metrics := newCountingMetricsSink()
+	tracker := newAccessTracker(subscriber, time.Minute, metrics)
+
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	// The reader has docs in A, and one in both A and B
+	tracker.docsArrived(
+		map[string]time.Time{"inA": at(0), "inAB": at(0)},
+		map[string][]string{"inA": {"A"}, "inAB": {"A", "B"}},
+		nil,
+	)
+
+	// Granting B waits for its docs the reader doesn't have yet.  One arrives before
+	// the reader hears about the grant, which still counts.
+	tracker.docsArrived(map[string]time.Time{"inB1": at(20)}, map[string][]string{"inB1": {"B"}}, nil)
+	tracker.accessChanged(AccessChange{ChangedAt: at(10), Granted: []string{"B"}, ChannelsAfter: []string{"A", "B"}, BackfillDocIds: []string{"inAB", "inB1", "inB2"}})
+	if len(tracker.pending) != 1 {
+		t.Fatalf("Expected the grant to wait for inB2, got %d pending changes", len(tracker.pending))
+	}
+	tracker.docsArrived(map[string]time.Time{"inB2": at(50)}, map[string][]string{"inB2": {"B"}}, nil)
+	if len(tracker.pending) != 0 {
+		t.Fatalf("Expected the grant to be finished once inB2 arrived, got %d pending changes", len(tracker.pending))
+	}
+	if metrics.timingCount("access_grant_visibility") != 1 || metrics.counter("access_docs_backfilled") != 1 {
+		t.Fatalf("Expected the grant's visibility to be timed once, with 1 doc backfilled, got %d timings and %d docs", metrics.timingCount("access_grant_visibility"), metrics.counter("access_docs_backfilled"))
+	}
+
+	// Revoking A waits for the docs only in A to be removed, but not inAB, which is still in B
+	tracker.accessChanged(AccessChange{ChangedAt: at(100), Revoked: []string{"A"}, ChannelsAfter: []string{"B"}})
+	if len(tracker.pending) != 1 || len(tracker.pending[0].waitingFor) != 1 || !tracker.pending[0].waitingFor["inA"] {
+		t.Fatalf("Expected the revocation to wait for inA only, got %+v", tracker.pending)
+	}
+	tracker.docsArrived(map[string]time.Time{"inA": at(120)}, nil, Removals{"inA": {"A"}})
+	if len(tracker.pending) != 0 || metrics.timingCount("access_revoke_visibility") != 1 {
+		t.Fatalf("Expected the revocation to be timed once inA was removed, got %d pending changes", len(tracker.pending))
+	}
+
+	// Revoking B and then granting it again before the docs are removed undoes the revocation
+	tracker.accessChanged(AccessChange{ChangedAt: at(200), Revoked: []string{"B"}, ChannelsAfter: []string{}})
+	tracker.accessChanged(AccessChange{ChangedAt: at(210), Granted: []string{"B"}, ChannelsAfter: []string{"B"}, BackfillDocIds: []string{"inAB", "inB1", "inB2"}})
+	if len(tracker.pending) != 0 {
+		t.Fatalf("Expected the revocation to be undone, and nothing to backfill, got %d pending changes", len(tracker.pending))
+	}
+
+	// A grant whose docs never arrive is overdue once the timeout has passed
+	tracker.accessChanged(AccessChange{ChangedAt: at(300), Granted: []string{"C"}, ChannelsAfter: []string{"B", "C"}, BackfillDocIds: []string{"inC"}})
+	if errs := tracker.overdue(at(300).Add(time.Second)); len(errs) != 0 {
+		t.Fatalf("Expected nothing to be overdue before the timeout, got %v", errs)
+	}
+	errs := tracker.overdue(at(300).Add(2 * time.Minute))
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "inC") {
+		t.Fatalf("Expected the grant of C to be overdue waiting for inC, got %v", errs)
+	}
+	if len(tracker.pending) != 0 {
+		t.Fatalf("Expected overdue changes to stop being tracked, got %d pending changes", len(tracker.pending))
+	}
+
+}
@@ -0,0 +1,90 @@
+package sgload
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+type AccessLoadRunner struct {
+	LoadRunner
+	AccessLoadSpec AccessLoadSpec
+	Registry       *AccessRegistry // The readers whose access the churners change
+}
+
+// The channels of each of the roles the churners give the readers.  Role i gets
+// NumChansPerRole channels, starting from channel i*NumChansPerRole, so that the
+// roles between them cover as many of the channels as they can.
+func (alr AccessLoadRunner) roles() map[string][]string {
+
+	channelNames := alr.generateChannelNames()
+	roles := map[string][]string{}
+	for roleId := 0; roleId < alr.AccessLoadSpec.NumRoles; roleId++ {
+		roleChannels := []string{}
+		for i := 0; i < alr.AccessLoadSpec.NumChansPerRole; i++ {
+			roleChannels = append(roleChannels, channelNames[(roleId*alr.AccessLoadSpec.NumChansPerRole+i)%len(channelNames)])
+		}
+		roles[fmt.Sprintf("role-%d-%s", roleId, alr.LoadSpec.TestSessionID)] = roleChannels
+	}
+	return roles
+
+}
+
+// Create the roles in the registry, which has to be done before the churners give them to readers
+func (alr AccessLoadRunner) createRoles(ctx context.Context) error {
+
+	accessDataStore, ok := alr.createDataStore().(AccessDataStore)
+	if !ok {
+		return fmt.Errorf("The data store can't create roles")
+	}
+	for _, roleName := range alr.Registry.roleNames() {
+		if err := accessDataStore.PutRole(ctx, roleName, alr.Registry.Roles[roleName]); err != nil {
+			return fmt.Errorf("Error creating role %s: %v", roleName, err)
+		}
+		logger.Info("Created SG role", "role", roleName, "channels", alr.Registry.Roles[roleName])
+	}
+	return nil
+
+}
+
+// Create the roles, then start the churners, which run until ctx is done
+func (alr AccessLoadRunner) startAccessChurners(ctx context.Context, wg *sync.WaitGroup) error {
+
+	if err := alr.createRoles(ctx); err != nil {
+		return err
+	}
+
+	for userId := 0; userId < alr.AccessLoadSpec.NumAccessChurners; userId++ {
+		churner := alr.newAccessChurner(userId, wg)
+		go churner.Run(ctx)
+	}
+	return nil
+
+}
+
+// Create a churner with its own data store, which calls wg.Done() once it has finished
+func (alr AccessLoadRunner) newAccessChurner(userId int, wg *sync.WaitGroup) *AccessChurner {
+
+	churner := NewAccessChurner(
+		AgentSpec{
+			FinishedWg:            wg,
+			ID:                    userId,
+			DataStore:             alr.createDataStore(),
+			ExpvarProgressEnabled: alr.LoadSpec.ExpvarProgressEnabled,
+			Errors:                alr.Errors,
+			DrainTimeout:          alr.LoadSpec.DrainTimeout,
+			OpenEnded:             true,
+		},
+		AccessChurnerSpec{
+			DelayBetweenChanges: alr.AccessLoadSpec.DelayBetweenChanges,
+			ChannelNames:        alr.generateChannelNames(),
+		},
+		alr.Registry,
+		alr.LoadSpec.agentRand(USER_PREFIX_ACCESS_CHURNER, userId),
+	)
+	churner.SetMetricsSink(alr.Metrics)
+	wg.Add(1)
+
+	return churner
+
+}
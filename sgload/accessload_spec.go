@@ -0,0 +1,81 @@
+package sgload
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	defaultAccessVisibilityTimeout = 30 * time.Second
+)
+
+type AccessLoadSpec struct {
+	LoadSpec            `yaml:"-"`
+	NumAccessChurners   int           `yaml:"num_churners"`          // The number of churner goroutines, which grant and revoke the readers' channels and roles while the run goes on
+	DelayBetweenChanges time.Duration `yaml:"delay_between_changes"` // How long each churner waits between changes to a reader's access
+	NumRoles            int           `yaml:"num_roles"`             // How many roles the churners create and give to (and take from) the readers.  If 0, they only change admin channels
+	NumChansPerRole     int           `yaml:"num_chans_per_role"`    // How many channels each role has
+	VisibilityTimeout   time.Duration `yaml:"visibility_timeout"`    // How long readers wait for the docs of a granted channel to be backfilled, or those of a revoked one to be removed, before it's an error.  Defaults to 30s
+}
+
+func (als AccessLoadSpec) Validate() error {
+
+	if err := als.LoadSpec.Validate(); err != nil {
+		return err
+	}
+
+	if als.NumAccessChurners < 0 {
+		return fieldError("access.num_churners", "NumAccessChurners must not be negative")
+	}
+	if als.DelayBetweenChanges < 0 {
+		return fieldError("access.delay_between_changes", "DelayBetweenChanges must not be negative")
+	}
+	if als.VisibilityTimeout < 0 {
+		return fieldError("access.visibility_timeout", "VisibilityTimeout must not be negative")
+	}
+	if als.NumRoles < 0 {
+		return fieldError("access.num_roles", "NumRoles must not be negative")
+	}
+	if als.NumRoles > 0 && (als.NumChansPerRole <= 0 || als.NumChansPerRole > als.NumChannels) {
+		return fieldError("access.num_chans_per_role", "NumChansPerRole must be between 1 and the number of channels (%d)", als.NumChannels)
+	}
+
+	if als.NumAccessChurners == 0 {
+		return nil
+	}
+
+	// With a single channel, which every reader already has, and no roles, there's
+	// nothing to grant or revoke
+	if als.NumChannels <= 1 && als.NumRoles == 0 {
+		return fieldError("access.num_churners", "Needs more than one channel, or some roles, to change the readers' access")
+	}
+
+	// Only the REST changes feeds say which docs were removed, and the simulator and
+	// Sync Gateway only change access in the default collection the same way
+	if als.Protocol == PROTOCOL_BLIP {
+		return fieldError("access.num_churners", "Can't be used with the %s protocol", PROTOCOL_BLIP)
+	}
+	if als.MockDataStore {
+		return fieldError("access.num_churners", "Can't be used with the mock data store, which has no users")
+	}
+	keyspaces, _ := parseKeyspaces(als.Keyspaces)
+	if len(keyspaces) > 1 || !keyspaces[0].IsDefault() {
+		return fieldError("access.num_churners", "Only the default collection is supported")
+	}
+
+	return nil
+}
+
+func (als AccessLoadSpec) visibilityTimeout() time.Duration {
+	if als.VisibilityTimeout == 0 {
+		return defaultAccessVisibilityTimeout
+	}
+	return als.VisibilityTimeout
+}
+
+// Validate this spec or panic
+func (als AccessLoadSpec) MustValidate() {
+	if err := als.Validate(); err != nil {
+		log.Panicf("Invalid AccessLoadSpec: %+v. Error: %v", als, err)
+	}
+}
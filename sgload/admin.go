@@ -0,0 +1,139 @@
+package sgload
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// How sgload authenticates to the Sync Gateway admin API, which Sync Gateway 3.x
+// protects with the credentials of a Couchbase Server user, and how it verifies the
+// admin API's certificate if it's served over https
+type AdminSpec struct {
+	Username string  `yaml:"username"` // If set, admin requests are sent with basic auth as this user
+	Password string  `yaml:"password"` // The password of Username
+	TLS      TLSSpec `yaml:"tls"`      // If none of it is set, the admin API is connected to like the public API, with load.tls
+}
+
+func (as AdminSpec) Validate() error {
+
+	if as.Password != "" && as.Username == "" {
+		return fieldError("load.admin.username", "A username is needed with the admin password")
+	}
+	return as.TLS.validate("load.admin.tls")
+
+}
+
+// Keeps the password out of the logs, which print the load spec
+func (as AdminSpec) String() string {
+	password := ""
+	if as.Password != "" {
+		password = "xxxxx"
+	}
+	return fmt.Sprintf("{Username:%s Password:%s TLS:%+v}", as.Username, password, as.TLS)
+}
+
+// The TLS spec for the admin API: its own, or the public API's if it has none
+func (as AdminSpec) tlsSpec(publicTLS TLSSpec) TLSSpec {
+	if as.TLS == (TLSSpec{}) {
+		return publicTLS
+	}
+	return as.TLS
+}
+
+// Create the client for admin requests: creating users, and during the run the access
+// churners' _user updates and admin changes feeds, and the deleters' purges.  Its
+// connections are deliberately left out of http_connections_* and the connection
+// progress stats, which only count the agents' connections to the public API.
+func newAdminHTTPClient(metrics MetricsSink, tlsSpec TLSSpec) (*retryablehttp.Client, error) {
+
+	tlsConfig, err := tlsSpec.Config()
+	if err != nil {
+		return nil, err
+	}
+	transport := transportWithConnPool(100)
+	transport.TLSClientConfig = tlsConfig
+	return newSgHttpClient(metrics, keepIdleConnections{transport}), nil
+
+}
+
+// The admin API URL of the database.  Unless it was given explicitly, it's the public
+// URL with the admin port.
+func (s SGDataStore) sgAdminURL() (string, error) {
+
+	if s.SyncGatewayAdminUrl != "" {
+		return s.SyncGatewayAdminUrl, nil
+	}
+
+	parsedSgUrl, err := url.Parse(s.SyncGatewayUrl)
+	if err != nil {
+		return "", err
+	}
+	if parsedSgUrl.Host == "" {
+		return "", fmt.Errorf("No host in Sync Gateway URL %q", s.SyncGatewayUrl)
+	}
+	parsedSgUrl.Host = net.JoinHostPort(parsedSgUrl.Hostname(), strconv.Itoa(s.SyncGatewayAdminPort))
+	return parsedSgUrl.String(), nil
+
+}
+
+// A request to the endpoint of the admin API, with the admin credentials if there are
+// any.  A trailing slash on the endpoint is kept.
+func (s SGDataStore) newAdminRequest(ctx context.Context, method, endpoint string, body interface{}) (*retryablehttp.Request, error) {
+
+	adminUrl, err := s.sgAdminURL()
+	if err != nil {
+		return nil, err
+	}
+	return s.newAdminRequestTo(ctx, method, adminUrl, endpoint, body)
+
+}
+
+// A request to the endpoint of the keyspace the data store works on, on the admin API
+func (s SGDataStore) newKeyspaceAdminRequest(ctx context.Context, method, endpoint string, body interface{}) (*retryablehttp.Request, error) {
+
+	adminUrl, err := s.sgAdminURL()
+	if err != nil {
+		return nil, err
+	}
+	keyspaceAdminUrl, err := s.Keyspace.url(adminUrl)
+	if err != nil {
+		return nil, err
+	}
+	return s.newAdminRequestTo(ctx, method, keyspaceAdminUrl, endpoint, body)
+
+}
+
+func (s SGDataStore) newAdminRequestTo(ctx context.Context, method, adminUrl, endpoint string, body interface{}) (*retryablehttp.Request, error) {
+
+	endpointUrl, err := addEndpointToUrl(adminUrl, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(endpoint, "/") {
+		endpointUrl = addTrailingSlash(endpointUrl)
+	}
+
+	req, err := newRetryableRequest(ctx, method, endpointUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	if s.AdminCreds.Username != "" {
+		req.SetBasicAuth(s.AdminCreds.Username, s.AdminCreds.Password)
+	}
+	return req, nil
+
+}
+
+func (s SGDataStore) adminHTTPClient() *retryablehttp.Client {
+	if s.AdminHTTPClient != nil {
+		return s.AdminHTTPClient
+	}
+	return s.httpClient()
+}
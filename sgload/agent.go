@@ -1,12 +1,13 @@
 package sgload
 
 import (
+	"context"
 	"expvar"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/abiosoft/semaphore"
-	"github.com/peterbourgon/g2s"
 )
 
 var (
@@ -26,25 +27,36 @@ type AgentSpec struct {
 	ExpvarProgressEnabled   bool            // Whether to publish reader/writer/updater progress to expvars
 	MaxConcurrentCreateUser int             // The maximum number of concurrent outstanding createuser requests.  0 means no maximum
 	AllSGUsersCreated       *sync.WaitGroup // Wait Group to allow waiting until all SG users created before applying load
+	Errors                  *ErrorCollector // Where failed operations are reported.  Shared among all agents in a run
+	DrainTimeout            time.Duration   // Once the run is stopped, how long in-flight requests get to finish before they're cancelled
+	OpenEnded               bool            // If true, keep going until the run is stopped rather than until a fixed number of docs are done
+	Keyspaces               []Keyspace      // The collections docs are spread across.  If empty, the default collection
+	DocGenerator            DocGenerator    // Generates the bodies of the docs written and updated.  If nil, the data store adds filler bodies
 }
 
 // Contains common fields and functionality between readers and writers
 type Agent struct {
 	AgentSpec
-	StatsdClient        g2s.Statter          // The statsd client instance to use to push stats to statdsd
+	Metrics             MetricsSink          // Where to push metrics (statsd, Prometheus, etc)
 	ExpVarStats         ExpVarStatsCollector // The expvar progress stats map for this agent
 	CreateUserSemaphore *semaphore.Semaphore // Semaphore to ensure max # of concrrent createuser requests
 	CreatedSGUser       bool                 // State to track whether SG user has already been created
+	keyspaceDataStores  map[Keyspace]DataStore
 }
 
-func (a *Agent) createSGUserIfNeeded(channels []string) {
+func (a *Agent) createSGUserIfNeeded(ctx context.Context, channels []string) error {
 
 	if a.CreateDataStoreUser != true {
-		return
+		return nil
 	}
 
 	if a.CreatedSGUser == true {
-		return
+		return nil
+	}
+
+	// Even if creating the user fails, don't leave the other agents waiting on this one forever
+	if a.AllSGUsersCreated != nil {
+		defer a.AllSGUsersCreated.Done()
 	}
 
 	if a.MaxConcurrentCreateUser > 0 {
@@ -57,16 +69,93 @@ func (a *Agent) createSGUserIfNeeded(channels []string) {
 
 	}
 
-	if err := a.DataStore.CreateUser(a.UserCred, channels); err != nil {
-		panic(fmt.Sprintf("Error creating user in datastore.  User: %v, Err: %v", a.UserCred, err))
+	if err := a.DataStore.CreateUser(ctx, a.UserCred, channels); err != nil {
+		return fmt.Errorf("Error creating user in datastore.  User: %v, Err: %v", a.UserCred.Username, err)
 	}
 
 	a.CreatedSGUser = true
 
 	logger.Info("Created SG user", "username", a.UserCred.Username, "channels", channels)
 
-	a.AllSGUsersCreated.Done()
+	return nil
+
+}
+
+// The collections the agent works on, which is just the default one unless the run
+// is spread across several
+func (a *Agent) keyspaces() []Keyspace {
+	if len(a.Keyspaces) == 0 {
+		return []Keyspace{{}}
+	}
+	return a.Keyspaces
+}
+
+// The data store for the docs and changes feed of the keyspace, which shares the
+// user and clients of the agent's DataStore.  Not safe for concurrent use.
+func (a *Agent) keyspaceDataStore(keyspace Keyspace) (DataStore, error) {
+
+	if len(a.Keyspaces) <= 1 && keyspace.IsDefault() {
+		return a.DataStore, nil
+	}
+	if dataStore, ok := a.keyspaceDataStores[keyspace]; ok {
+		return dataStore, nil
+	}
+
+	keyspaceDataStore, ok := a.DataStore.(KeyspaceDataStore)
+	if !ok {
+		return nil, fmt.Errorf("The data store doesn't support keyspaces other than the default collection")
+	}
+	if a.keyspaceDataStores == nil {
+		a.keyspaceDataStores = map[Keyspace]DataStore{}
+	}
+	dataStore := keyspaceDataStore.WithKeyspace(keyspace)
+	a.keyspaceDataStores[keyspace] = dataStore
+	return dataStore, nil
+
+}
 
+// Report a failed operation to the run's error collector.  Returns true if
+// the agent should stop because the error budget has been exceeded.
+func (a *Agent) reportError(operation string, err error) (abort bool) {
+	return a.Errors.RecordError(AgentError{
+		Username:  a.UserCred.Username,
+		Operation: operation,
+		Err:       err,
+	})
+}
+
+// Returns the context to use for datastore requests.  Unlike ctx, it isn't cancelled
+// as soon as the run is stopped: requests already in flight get DrainTimeout to
+// finish, so the agent stops without leaving half-done writes behind.  The
+// returned cancel func must be called when the agent is done.
+func (a *Agent) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+
+	requestCtx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-requestCtx.Done():
+			return
+		}
+		select {
+		case <-time.After(a.DrainTimeout):
+			logger.Warn("Cancelling in-flight requests after drain timeout", "username", a.Username, "draintimeout", a.DrainTimeout)
+			cancel()
+		case <-requestCtx.Done():
+		}
+	}()
+
+	return requestCtx, cancel
+
+}
+
+// Sleep for the given duration, or until ctx is done
+func sleepContext(ctx context.Context, duration time.Duration) {
+	select {
+	case <-time.After(duration):
+	case <-ctx.Done():
+	}
 }
 
 func (a *Agent) waitUntilAllSGUsersCreated() {
@@ -75,8 +164,8 @@ func (a *Agent) waitUntilAllSGUsersCreated() {
 	a.AllSGUsersCreated.Wait()
 }
 
-func (a *Agent) SetStatsdClient(statsdClient g2s.Statter) {
-	a.StatsdClient = statsdClient
+func (a *Agent) SetMetricsSink(metrics MetricsSink) {
+	a.Metrics = metrics
 }
 
 func (a *Agent) setupExpVarStats(expvarMap *expvar.Map) {
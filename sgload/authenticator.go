@@ -0,0 +1,315 @@
+package sgload
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/sgload/jwt"
+)
+
+// How the agents authenticate as their users
+type AuthMode string
+
+const AUTH_MODE_BASIC = AuthMode("basic")     // Basic auth on every request, which Sync Gateway checks the password hash of every time
+const AUTH_MODE_SESSION = AuthMode("session") // Log in once with POST /{db}/_session, and send the session cookie, like the apps do
+const AUTH_MODE_JWT = AuthMode("jwt")         // A bearer token signed with a local key, which Sync Gateway is configured to accept as an OpenID Connect provider
+
+// The name of the cookie that Sync Gateway keeps sessions in
+const sessionCookieName = "SyncGatewaySession"
+
+type AuthSpec struct {
+	Mode AuthMode `yaml:"mode"` // basic (the default), session or jwt
+	JWT  JWTSpec  `yaml:"jwt"`  // How tokens are signed, for the jwt mode
+}
+
+func (as AuthSpec) Validate() error {
+
+	switch as.Mode {
+	case "", AUTH_MODE_BASIC, AUTH_MODE_SESSION:
+	case AUTH_MODE_JWT:
+		return as.JWT.Validate()
+	default:
+		return fieldError("load.auth.mode", "Unknown auth mode %q.  Values: %s, %s, %s", as.Mode, AUTH_MODE_BASIC, AUTH_MODE_SESSION, AUTH_MODE_JWT)
+	}
+	return nil
+
+}
+
+// How the bearer tokens are signed.  Sync Gateway needs an OpenID Connect provider with
+// the same issuer, the audience as its client_id, username_claim "sub", and the public
+// key, which is written to KeySetFile.
+type JWTSpec struct {
+	KeyFile    string        `yaml:"key_file"`    // PEM RSA private key to sign tokens with.  If not set, a new key is generated for the run
+	KeyID      string        `yaml:"key_id"`      // The kid of the key in the tokens and the key set.  Defaults to sgload
+	Issuer     string        `yaml:"issuer"`      // The iss claim.  Defaults to sgload
+	Audience   string        `yaml:"audience"`    // The aud claim.  Defaults to sync_gateway
+	TokenTTL   time.Duration `yaml:"token_ttl"`   // How long each token is valid for.  Defaults to an hour
+	KeySetFile string        `yaml:"keyset_file"` // If set, the public key is written here as a JSON Web Key Set
+}
+
+func (js JWTSpec) Validate() error {
+
+	if js.TokenTTL < 0 {
+		return fieldError("load.auth.jwt.token_ttl", "TokenTTL must not be negative")
+	}
+	if js.KeyFile != "" {
+		if _, err := loadRSAPrivateKey(js.KeyFile); err != nil {
+			return fieldError("load.auth.jwt.key_file", err.Error())
+		}
+	}
+	return nil
+
+}
+
+// Load or generate the signing key, and write out the key set if asked to
+func (js JWTSpec) Signer() (*JWTSigner, error) {
+
+	signer := &JWTSigner{
+		keyID:    js.KeyID,
+		issuer:   js.Issuer,
+		audience: js.Audience,
+		ttl:      js.TokenTTL,
+	}
+	if signer.keyID == "" {
+		signer.keyID = "sgload"
+	}
+	if signer.issuer == "" {
+		signer.issuer = "sgload"
+	}
+	if signer.audience == "" {
+		signer.audience = "sync_gateway"
+	}
+	if signer.ttl == 0 {
+		signer.ttl = time.Hour
+	}
+
+	var err error
+	if js.KeyFile != "" {
+		signer.key, err = loadRSAPrivateKey(js.KeyFile)
+	} else {
+		signer.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if js.KeySetFile != "" {
+		keySet, err := json.MarshalIndent(jwt.PublicKeySet(&signer.key.PublicKey, signer.keyID), "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(js.KeySetFile, keySet, 0644); err != nil {
+			return nil, err
+		}
+		logger.Info("Wrote JWT key set", "keysetfile", js.KeySetFile, "issuer", signer.issuer, "audience", signer.audience)
+	}
+
+	return signer, nil
+
+}
+
+// Reads a PKCS #1 or PKCS #8 RSA private key
+func loadRSAPrivateKey(keyFile string) (*rsa.PrivateKey, error) {
+
+	pemBytes, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM private key found in %s", keyFile)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("The private key in %s isn't an RSA key", keyFile)
+	}
+	return rsaKey, nil
+
+}
+
+// Signs the bearer tokens of all the users in a run
+type JWTSigner struct {
+	key      *rsa.PrivateKey
+	keyID    string
+	issuer   string
+	audience string
+	ttl      time.Duration
+}
+
+// A token for the user, and when it expires
+func (js *JWTSigner) Token(username string) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(js.ttl)
+	token, err := jwt.Sign(jwt.Claims{
+		Issuer:   js.issuer,
+		Subject:  username,
+		Audience: js.audience,
+		IssuedAt: now.Unix(),
+		Expiry:   expires.Unix(),
+	}, js.key, js.keyID)
+	return token, expires, err
+}
+
+// Adds a user's credentials to the requests of a data store
+type Authenticator interface {
+
+	// Add the credentials to the headers of a request, getting them first if needed
+	AddAuth(ctx context.Context, header http.Header) error
+
+	// Forget the credentials that Sync Gateway rejected (eg, an expired session), so
+	// that AddAuth gets new ones.  Returns false if there's no point, eg with basic auth.
+	Renew() bool
+}
+
+// Creates the authenticator of a data store when its user is set
+type AuthenticatorFactory func(s SGDataStore, u UserCred) Authenticator
+
+type basicAuthenticator struct {
+	userCreds UserCred
+}
+
+func (ba basicAuthenticator) AddAuth(ctx context.Context, header http.Header) error {
+	auth := base64.StdEncoding.EncodeToString([]byte(ba.userCreds.Username + ":" + ba.userCreds.Password))
+	header.Set("Authorization", "Basic "+auth)
+	return nil
+}
+
+func (ba basicAuthenticator) Renew() bool {
+	return false
+}
+
+// Logs in once with POST /{db}/_session, and sends the session cookie from then on.
+// Logging in is timed as auth_login.
+type sessionAuthenticator struct {
+	dataStore SGDataStore
+	mutex     sync.Mutex
+	cookie    *http.Cookie // Nil until logged in, and after the session has been rejected
+}
+
+func newSessionAuthenticator(s SGDataStore, u UserCred) Authenticator {
+	return &sessionAuthenticator{dataStore: s}
+}
+
+func (sa *sessionAuthenticator) AddAuth(ctx context.Context, header http.Header) error {
+
+	sa.mutex.Lock()
+	defer sa.mutex.Unlock()
+
+	if sa.cookie == nil {
+		cookie, err := sa.login(ctx)
+		if err != nil {
+			return err
+		}
+		sa.cookie = cookie
+	}
+	header.Set("Cookie", fmt.Sprintf("%s=%s", sa.cookie.Name, sa.cookie.Value))
+	return nil
+
+}
+
+func (sa *sessionAuthenticator) Renew() bool {
+	sa.mutex.Lock()
+	defer sa.mutex.Unlock()
+	sa.cookie = nil
+	return true
+}
+
+func (sa *sessionAuthenticator) login(ctx context.Context) (*http.Cookie, error) {
+
+	s := sa.dataStore
+	sessionEndpoint, err := addEndpointToUrl(s.SyncGatewayUrl, "_session")
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := json.Marshal(map[string]string{
+		"name":     s.UserCreds.Username,
+		"password": s.UserCreds.Password,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := newRetryableRequest(ctx, "POST", sessionEndpoint, bytes.NewReader(credentials))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	startTime := time.Now()
+	resp, err := s.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer drainAndClose(resp.Body)
+	s.pushTimingStat("auth_login", time.Since(startTime))
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected response status for POST _session request: %d", resp.StatusCode)
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == sessionCookieName {
+			return cookie, nil
+		}
+	}
+	return nil, fmt.Errorf("No %s cookie in the POST _session response", sessionCookieName)
+
+}
+
+// Sends a bearer token, which is signed again shortly before it expires.  Signing is
+// timed as auth_token.
+type jwtAuthenticator struct {
+	dataStore SGDataStore
+	signer    *JWTSigner
+	mutex     sync.Mutex
+	token     string    // Empty until signed, and after the token has been rejected
+	refreshAt time.Time // When to sign a new token, before the old one expires
+}
+
+func newJWTAuthenticator(s SGDataStore, signer *JWTSigner) Authenticator {
+	return &jwtAuthenticator{dataStore: s, signer: signer}
+}
+
+func (ja *jwtAuthenticator) AddAuth(ctx context.Context, header http.Header) error {
+
+	ja.mutex.Lock()
+	defer ja.mutex.Unlock()
+
+	if ja.token == "" || time.Now().After(ja.refreshAt) {
+		startTime := time.Now()
+		token, expires, err := ja.signer.Token(ja.dataStore.UserCreds.Username)
+		if err != nil {
+			return err
+		}
+		ja.dataStore.pushTimingStat("auth_token", time.Since(startTime))
+		ja.token = token
+		ja.refreshAt = expires.Add(-ja.signer.ttl / 10)
+	}
+	header.Set("Authorization", "Bearer "+ja.token)
+	return nil
+
+}
+
+func (ja *jwtAuthenticator) Renew() bool {
+	ja.mutex.Lock()
+	defer ja.mutex.Unlock()
+	ja.token = ""
+	return true
+}
@@ -0,0 +1,208 @@
+package sgload
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/sgload/jwt"
+	"github.com/couchbaselabs/sgload/sgsimulator"
+)
+
+// Keeps the timing stats like a LatencyRecorder, and adds up the counters
+type countingMetricsSink struct {
+	*LatencyRecorder
+	mutex    sync.Mutex
+	counters map[string]int
+}
+
+func newCountingMetricsSink() *countingMetricsSink {
+	return &countingMetricsSink{LatencyRecorder: NewLatencyRecorder(), counters: map[string]int{}}
+}
+
+func (c *countingMetricsSink) Counter(name string, n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.counters[name] += n
+}
+
+func (c *countingMetricsSink) counter(name string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.counters[name]
+}
+
+func (c *countingMetricsSink) timingCount(name string) int64 {
+	c.LatencyRecorder.mutex.Lock()
+	defer c.LatencyRecorder.mutex.Unlock()
+	if histogram := c.histograms[name]; histogram != nil {
+		return histogram.TotalCount()
+	}
+	return 0
+}
+
+// Returns a data store for a new user with access to channel ABC, which authenticates
+// with the authenticators the factory creates
+func newAuthenticatedDataStore(t *testing.T, dataStore *SGDataStore, username string, newAuthenticator AuthenticatorFactory) (*SGDataStore, *countingMetricsSink) {
+
+	userCreds := UserCred{Username: username, Password: "password"}
+	if err := dataStore.CreateUser(context.Background(), userCreds, []string{"ABC"}); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	metrics := newCountingMetricsSink()
+	userDataStore := *dataStore
+	userDataStore.Metrics = metrics
+	userDataStore.SetAuthenticatorFactory(newAuthenticator)
+	userDataStore.SetUserCreds(userCreds)
+	return &userDataStore, metrics
+
+}
+
+func TestSessionAuthenticator(t *testing.T) {
+
+	_, dataStore, cleanup := newSimulatorDataStore(t, sgsimulator.FaultConfig{})
+	defer cleanup()
+
+	ctx := context.Background()
+	userDataStore, metrics := newAuthenticatedDataStore(t, dataStore, "session-user", newSessionAuthenticator)
+
+	// Logging in happens once, before the first request
+	if _, err := userDataStore.BulkCreateDocuments(ctx, docsToWrite("doc", 2, []string{"ABC"}), true); err != nil {
+		t.Fatalf("Error creating docs: %v", err)
+	}
+	if changes, _, err := userDataStore.Changes(ctx, StringSincer{}, 0, FEED_TYPE_NORMAL); err != nil || len(changes.Results) != 2 {
+		t.Fatalf("Expected 2 changes, got %+v, %v", changes, err)
+	}
+	if logins := metrics.timingCount("auth_login"); logins != 1 {
+		t.Fatalf("Expected to log in once, logged in %d times", logins)
+	}
+
+	// Once the session is deleted, the next request is rejected, and so logs in again
+	adminUrl, err := dataStore.sgAdminURL()
+	if err != nil {
+		t.Fatalf("Error getting admin url: %v", err)
+	}
+	deleteSessionsUrl, err := addEndpointToUrl(adminUrl, "_user/session-user/_session")
+	if err != nil {
+		t.Fatalf("Error getting delete sessions url: %v", err)
+	}
+	req, err := http.NewRequest("DELETE", deleteSessionsUrl, nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Error deleting sessions: %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	if changes, _, err := userDataStore.Changes(ctx, StringSincer{}, 0, FEED_TYPE_NORMAL); err != nil || len(changes.Results) != 2 {
+		t.Fatalf("Expected 2 changes after the session was deleted, got %+v, %v", changes, err)
+	}
+	if logins, renewals := metrics.timingCount("auth_login"), metrics.counter("auth_renewals"); logins != 2 || renewals != 1 {
+		t.Fatalf("Expected to log in again once, got %d logins and %d renewals", logins, renewals)
+	}
+
+	// A wrong password fails to log in
+	wrongPassword := *userDataStore
+	wrongPassword.SetUserCreds(UserCred{Username: "session-user", Password: "wrong"})
+	if _, _, err := wrongPassword.Changes(ctx, StringSincer{}, 0, FEED_TYPE_NORMAL); err == nil {
+		t.Fatalf("Expected error logging in with the wrong password")
+	}
+
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+
+	// The simulator accepts tokens signed with the key in the key set the signer writes
+	keySetFile := filepath.Join(t.TempDir(), "keyset.json")
+	signer, err := JWTSpec{KeySetFile: keySetFile, TokenTTL: time.Minute}.Signer()
+	if err != nil {
+		t.Fatalf("Error creating signer: %v", err)
+	}
+	keySetJSON, err := ioutil.ReadFile(keySetFile)
+	if err != nil {
+		t.Fatalf("Error reading key set: %v", err)
+	}
+	keySet := jwt.KeySet{}
+	if err := json.Unmarshal(keySetJSON, &keySet); err != nil {
+		t.Fatalf("Error parsing key set: %v", err)
+	}
+
+	// The provider is set once the simulator is serving, which it picks up from the next request
+	sim := sgsimulator.NewSGSimulator("db")
+	publicServer := httptest.NewServer(sim.PublicHandler())
+	defer publicServer.Close()
+	adminServer := httptest.NewServer(sim.AdminHandler())
+	defer adminServer.Close()
+	sim.SetJWTProvider(sgsimulator.JWTProvider{Issuer: "sgload", Keys: keySet})
+	adminUrl, _ := url.Parse(adminServer.URL)
+	adminPort, _ := strconv.Atoi(adminUrl.Port())
+	dataStore := NewSGDataStore(publicServer.URL+"/db/", adminPort, NoOpMetricsSink{}, false)
+
+	ctx := context.Background()
+	userDataStore, metrics := newAuthenticatedDataStore(t, dataStore, "jwt-user", func(s SGDataStore, u UserCred) Authenticator {
+		return newJWTAuthenticator(s, signer)
+	})
+
+	// The token is signed once and reused
+	if _, err := userDataStore.BulkCreateDocuments(ctx, docsToWrite("doc", 2, []string{"ABC"}), true); err != nil {
+		t.Fatalf("Error creating docs: %v", err)
+	}
+	if changes, _, err := userDataStore.Changes(ctx, StringSincer{}, 0, FEED_TYPE_NORMAL); err != nil || len(changes.Results) != 2 {
+		t.Fatalf("Expected 2 changes, got %+v, %v", changes, err)
+	}
+	stream, err := userDataStore.OpenChangesStream(ctx, StringSincer{}, FEED_TYPE_WEBSOCKET)
+	if err != nil {
+		t.Fatalf("Error opening websocket changes feed: %v", err)
+	}
+	stream.Close()
+	if signed := metrics.timingCount("auth_token"); signed != 1 {
+		t.Fatalf("Expected to sign one token, signed %d", signed)
+	}
+
+	// Tokens signed with another key are rejected, even after signing a new one
+	otherSigner, err := JWTSpec{}.Signer()
+	if err != nil {
+		t.Fatalf("Error creating signer: %v", err)
+	}
+	otherDataStore, otherMetrics := newAuthenticatedDataStore(t, dataStore, "other-user", func(s SGDataStore, u UserCred) Authenticator {
+		return newJWTAuthenticator(s, otherSigner)
+	})
+	if _, _, err := otherDataStore.Changes(ctx, StringSincer{}, 0, FEED_TYPE_NORMAL); err == nil {
+		t.Fatalf("Expected error with a token signed by another key")
+	}
+	if signed := otherMetrics.timingCount("auth_token"); signed != 2 {
+		t.Fatalf("Expected to sign a new token after the first was rejected, signed %d", signed)
+	}
+
+}
+
+func TestAuthSpecValidate(t *testing.T) {
+
+	badSpecs := []AuthSpec{
+		{Mode: "kerberos"},
+		{Mode: AUTH_MODE_JWT, JWT: JWTSpec{TokenTTL: -time.Minute}},
+		{Mode: AUTH_MODE_JWT, JWT: JWTSpec{KeyFile: filepath.Join(t.TempDir(), "missing.pem")}},
+	}
+	for _, spec := range badSpecs {
+		if err := spec.Validate(); err == nil {
+			t.Fatalf("Expected error validating %+v", spec)
+		}
+	}
+	for _, mode := range []AuthMode{"", AUTH_MODE_BASIC, AUTH_MODE_SESSION, AUTH_MODE_JWT} {
+		if err := (AuthSpec{Mode: mode}).Validate(); err != nil {
+			t.Fatalf("Unexpected error validating auth mode %q: %v", mode, err)
+		}
+	}
+
+}
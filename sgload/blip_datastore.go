@@ -0,0 +1,832 @@
+package sgload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sgreplicate "github.com/couchbaselabs/sg-replicate"
+	"github.com/couchbaselabs/sgload/blip"
+)
+
+// How the agents talk to Sync Gateway
+type ReplicationProtocol string
+
+const PROTOCOL_REST = ReplicationProtocol("rest") // The REST API, like Couchbase Lite 1.x
+const PROTOCOL_BLIP = ReplicationProtocol("blip") // The BLIP replication protocol over /_blipsync, like Couchbase Lite 2.x
+
+var (
+	// How often a reader saves its checkpoint while pulling changes, like Couchbase Lite does
+	blipCheckpointInterval = 5 * time.Second
+
+	// How long to wait for the revisions announced by the changes feed
+	blipRevTimeout = 5 * time.Minute
+)
+
+// A DataStore which talks to Sync Gateway the way Couchbase Lite 2.x does, over a BLIP
+// connection to the database's /_blipsync endpoint.  Every agent has its own data store,
+// and so its own connection, which is opened when it's first needed and reopened if
+// it's closed.
+//
+// Docs are pushed with a proposeChanges request for the batch, followed by a rev request
+// for each revision Sync Gateway doesn't already have.  Attachments are only sent when
+// Sync Gateway asks for them with getAttachment.  With CompressionEnabled, the rev
+// requests are sent compressed.  Whatever Sync Gateway sends compressed is inflated.
+//
+// Changes come from a subChanges subscription, which is continuous for the longpoll feed
+// type.  Sync Gateway sends the changes as changes requests, which Changes() hands out
+// one at a time, and then sends the revisions as rev requests, which BulkGetDocuments()
+// waits for.  Like Couchbase Lite, a reader gets its checkpoint (getCheckpoint) when it
+// starts, and saves it (setCheckpoint) as it goes.
+//
+// Creating users, and getting revisions that weren't announced by the changes feed (eg,
+// the updaters looking up the current revisions of docs) still use the REST API.
+type BlipDataStore struct {
+	*SGDataStore
+
+	mutex   sync.Mutex
+	session *blipSession // The current connection, or nil if there isn't one yet
+
+	checkpointClientID string    // Identifies this client's checkpoint, which is new for every data store like it is for a fresh Couchbase Lite install
+	checkpointRev      string    // The revision of the saved checkpoint, which is needed to update it
+	checkpointedSince  string    // The since value that was last saved in the checkpoint
+	lastCheckpoint     time.Time // When the checkpoint was last saved
+}
+
+func NewBlipDataStore(sgUrl string, sgAdminPort int, metrics MetricsSink, compressionEnabled bool) *BlipDataStore {
+	return &BlipDataStore{
+		SGDataStore:        NewSGDataStore(sgUrl, sgAdminPort, metrics, compressionEnabled),
+		checkpointClientID: fmt.Sprintf("sgload-%s", NewUuid()),
+	}
+}
+
+// The state of a single BLIP connection
+type blipSession struct {
+	conn *blip.Conn
+
+	// Only used by Changes()
+	subscribed bool // Whether there's a subChanges subscription on this connection
+	continuous bool // Whether the subscription keeps going once it's caught up
+
+	changesBatches chan blipChangesBatch // Hands the changes sent by Sync Gateway to Changes()
+
+	mutex       sync.Mutex
+	revs        map[blipRevKey]*blipIncomingRev // The revisions of the latest batch of changes
+	attachments map[string][]byte               // The attachments of the revisions being pushed, by digest
+}
+
+// A changes request from Sync Gateway.  An empty one means that it has sent all the
+// changes there are for now.
+type blipChangesBatch struct {
+	changes  sgreplicate.Changes
+	caughtUp bool
+}
+
+type blipRevKey struct {
+	docID string
+	revID string
+}
+
+// A revision that Sync Gateway was asked for in reply to a changes request
+type blipIncomingRev struct {
+	requested time.Time
+	arrived   chan struct{} // Closed once the revision (or a norev) has arrived
+	once      sync.Once
+	arrivedAt time.Time
+	doc       sgreplicate.Document
+	err       error
+}
+
+// A revision about to be pushed
+type blipOutgoingRev struct {
+	docID       string
+	revID       string
+	history     []string // The ancestors of the revision, newest first
+	deleted     bool
+	body        Document
+	attachments map[string][]byte // Attachment data by digest
+}
+
+// Open a connection to Sync Gateway unless there already is one
+func (b *BlipDataStore) connect(ctx context.Context) (*blipSession, error) {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.session != nil && b.session.conn.Err() == nil {
+		return b.session, nil
+	}
+
+	blipSyncUrl, err := b.blipSyncURL()
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	if err := b.addAuthIfNeeded(ctx, header); err != nil {
+		return nil, err
+	}
+
+	session := &blipSession{
+		changesBatches: make(chan blipChangesBatch),
+		revs:           map[blipRevKey]*blipIncomingRev{},
+		attachments:    map[string][]byte{},
+	}
+
+	startTime := time.Now()
+	conn, err := blip.DialWith(ctx, b.webSocketDialer(), blipSyncUrl, header, session.handleRequest)
+	if err != nil {
+		if handshakeErr, ok := err.(*blip.HandshakeError); ok && handshakeErr.StatusCode == http.StatusUnauthorized {
+			// The next connection attempt will authenticate again
+			b.renewAuth()
+		}
+		return nil, err
+	}
+	b.pushTimingStat("blip_connect", time.Since(startTime))
+
+	session.conn = conn
+	b.session = session
+	return session, nil
+
+}
+
+// Close the connection, eg because a subscription can't pick up where it left off
+func (b *BlipDataStore) disconnect(session *blipSession) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	session.conn.Close()
+	if b.session == session {
+		b.session = nil
+	}
+}
+
+func (b *BlipDataStore) currentSession() *blipSession {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.session
+}
+
+// The ws:// or wss:// URL of the database's /_blipsync endpoint
+func (b *BlipDataStore) blipSyncURL() (string, error) {
+
+	blipSyncUrl, err := addEndpointToUrl(b.SyncGatewayUrl, "_blipsync")
+	if err != nil {
+		return "", err
+	}
+	return webSocketURL(blipSyncUrl)
+
+}
+
+// The ws:// or wss:// equivalent of an http:// or https:// URL
+func webSocketURL(httpUrl string) (string, error) {
+
+	parsedUrl, err := url.Parse(httpUrl)
+	if err != nil {
+		return "", err
+	}
+
+	switch parsedUrl.Scheme {
+	case "http":
+		parsedUrl.Scheme = "ws"
+	case "https":
+		parsedUrl.Scheme = "wss"
+	}
+	return parsedUrl.String(), nil
+
+}
+
+func (b *BlipDataStore) CreateDocument(ctx context.Context, doc Document, attachSizeBytes int, newEdits bool) (DocumentMetadata, error) {
+
+	pushed, err := b.pushRevisions(ctx, []Document{doc}, attachSizeBytes, newEdits, "create_document")
+	if err != nil {
+		return DocumentMetadata{}, err
+	}
+	return pushed[0], nil
+
+}
+
+func (b *BlipDataStore) BulkCreateDocuments(ctx context.Context, docs []Document, newEdits bool) ([]DocumentMetadata, error) {
+
+	// Set the "created_at" timestamp which is used to calculate the
+	// gateload roundtrip time
+	updateCreatedAtTimestamp(docs)
+
+	return b.pushRevisions(ctx, docs, 0, newEdits, "create_document")
+
+}
+
+func (b *BlipDataStore) BulkCreateDocumentsRetry(ctx context.Context, docs []Document, newEdits bool) ([]DocumentMetadata, error) {
+	return bulkCreateDocumentsRetry(ctx, docs, newEdits, b.BulkCreateDocuments, b.Metrics)
+}
+
+// Push tombstones as revisions with the deleted property, like Couchbase Lite does.
+// Purging is an admin request, so it goes over the REST API.
+func (b *BlipDataStore) DeleteDocuments(ctx context.Context, docs []DocumentMetadata) ([]DocumentMetadata, error) {
+	return b.pushRevisions(ctx, newTombstones(docs), 0, true, "delete_document")
+}
+
+// Propose the revisions of the docs to Sync Gateway, and push the ones it wants.  The
+// revisions Sync Gateway already has count as pushed, and the ones it rejects (eg,
+// because they'd be conflicts) have their Error set.  The operation (eg,
+// "create_document") names the stats.
+func (b *BlipDataStore) pushRevisions(ctx context.Context, docs []Document, attachSizeBytes int, newEdits bool, operation string) ([]DocumentMetadata, error) {
+
+	defer b.pushCounter(operation+"_counter", len(docs))
+
+	session, err := b.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	revs := []blipOutgoingRev{}
+	proposals := [][]interface{}{}
+	for _, doc := range docs {
+		rev, err := newBlipOutgoingRev(doc, attachSizeBytes, newEdits)
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, rev)
+		proposals = append(proposals, rev.proposal())
+	}
+
+	session.addAttachments(revs)
+	defer session.removeAttachments(revs)
+
+	startTime := time.Now()
+
+	request := blip.NewRequest("proposeChanges")
+	if err := request.SetJSONBody(proposals); err != nil {
+		return nil, err
+	}
+	response, err := session.conn.SendAndWait(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	// A status for each proposed revision, where trailing zeroes may be left out
+	statuses := []int{}
+	if len(response.Body) > 0 {
+		if err := response.ReadJSONBody(&statuses); err != nil {
+			return nil, fmt.Errorf("Invalid proposeChanges response: %v", err)
+		}
+	}
+
+	// Send all the revisions before waiting for Sync Gateway to acknowledge them
+	pushed := make([]DocumentMetadata, len(revs))
+	replies := make([]<-chan *blip.Message, len(revs))
+	for i, rev := range revs {
+
+		pushed[i] = DocumentMetadata{
+			DocumentRevisionPair: sgreplicate.DocumentRevisionPair{
+				Id:       rev.docID,
+				Revision: rev.revID,
+			},
+			Channels: docs[i].channelNames(),
+		}
+
+		status := 0
+		if i < len(statuses) {
+			status = statuses[i]
+		}
+		switch status {
+		case 0:
+			request := rev.message()
+			request.Compressed = b.CompressionEnabled
+			reply, err := session.conn.Send(request)
+			if err != nil {
+				return nil, err
+			}
+			replies[i] = reply
+		case http.StatusNotModified:
+			// Sync Gateway already has this revision
+		default:
+			pushed[i].Status = status
+			pushed[i].Error = http.StatusText(status)
+			pushed[i].Reason = "Proposed revision was rejected"
+		}
+	}
+
+	for i, reply := range replies {
+		if reply == nil {
+			continue
+		}
+		select {
+		case response := <-reply:
+			if err := response.Err(); err != nil {
+				pushed[i].Error = err.Error()
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-session.conn.Done():
+			return nil, session.conn.Err()
+		}
+	}
+
+	b.pushTimingStat(operation, timeDeltaPerDocument(len(docs), time.Since(startTime)))
+
+	return pushed, nil
+
+}
+
+// Prepare a doc to be pushed.  With newEdits, the revision is generated as a child
+// of the doc's _rev, otherwise the doc's _rev and _revisions are pushed as they are.
+func newBlipOutgoingRev(doc Document, attachSizeBytes int, newEdits bool) (blipOutgoingRev, error) {
+
+	// Unlike the REST API, Sync Gateway doesn't assign IDs to the docs that are pushed
+	if doc.Id() == "" {
+		doc.SetId(NewUuid())
+	}
+	if deleted, _ := doc["_deleted"].(bool); !deleted {
+		doc.addBodyIfMissing()
+	}
+
+	rev := blipOutgoingRev{
+		docID:       doc.Id(),
+		attachments: map[string][]byte{},
+	}
+
+	generation, _ := parseRevID(doc.Revision())
+	if newEdits {
+		generation++
+	}
+
+	// Attachments are only sent if Sync Gateway asks for them, so the rev just has the metadata
+	if attachSizeBytes > 0 {
+		attachmentContent := doc.GenerateHtmlAttachmentContent(attachSizeBytes)
+		digest := sha1DigestKey(attachmentContent)
+		rev.attachments[digest] = attachmentContent
+		doc["_attachments"] = map[string]interface{}{
+			"my_attachment": map[string]interface{}{
+				"content_type": "text/html",
+				"digest":       digest,
+				"length":       len(attachmentContent),
+				"revpos":       generation,
+				"stub":         true,
+			},
+		}
+	}
+
+	if newEdits {
+		parentRevID := doc.Revision()
+		rev.revID = createRevID(generation, parentRevID, doc)
+		if parentRevID != "" {
+			rev.history = []string{parentRevID}
+		}
+	} else {
+		rev.revID = doc.Revision()
+		revisions, ok := doc["_revisions"].(Document)
+		if !ok {
+			return rev, fmt.Errorf("Doc %s has no _revisions to push with new_edits=false", rev.docID)
+		}
+		start, _ := revisions["start"].(int)
+		digests, _ := revisions["ids"].([]string)
+		for i := 1; i < len(digests); i++ {
+			rev.history = append(rev.history, fmt.Sprintf("%d-%s", start-i, digests[i]))
+		}
+	}
+
+	rev.body = stripSpecialProperties(doc)
+	if deleted, _ := rev.body["_deleted"].(bool); deleted {
+		rev.deleted = true
+		delete(rev.body, "_deleted")
+	}
+
+	return rev, nil
+
+}
+
+// The entry for this revision in a proposeChanges request: the doc ID, the revision ID,
+// and the revision it replaces on Sync Gateway, which is its oldest known ancestor
+func (r blipOutgoingRev) proposal() []interface{} {
+	proposal := []interface{}{r.docID, r.revID}
+	if len(r.history) > 0 {
+		proposal = append(proposal, r.history[len(r.history)-1])
+	}
+	return proposal
+}
+
+func (r blipOutgoingRev) message() *blip.Message {
+	request := blip.NewRequest("rev")
+	request.Properties["id"] = r.docID
+	request.Properties["rev"] = r.revID
+	request.Properties["history"] = strings.Join(r.history, ",")
+	if r.deleted {
+		request.Properties["deleted"] = "1"
+	}
+	request.Body = canonicalEncoding(r.body)
+	return request
+}
+
+func (b *BlipDataStore) Changes(ctx context.Context, sinceVal Sincer, limit int, feedType ChangesFeedType) (changes sgreplicate.Changes, newSinceVal Sincer, err error) {
+
+	session, err := b.connect(ctx)
+	if err != nil {
+		return sgreplicate.Changes{}, sinceVal, err
+	}
+
+	// The reader has finished with the changes up to sinceVal
+	b.maybeSaveCheckpoint(ctx, session, sinceVal)
+
+	if !session.subscribed {
+		if err := b.subscribeToChanges(ctx, session, sinceVal, limit, feedType == FEED_TYPE_LONGPOLL); err != nil {
+			return sgreplicate.Changes{}, sinceVal, err
+		}
+	}
+
+	startTime := time.Now()
+	for {
+		select {
+		case batch := <-session.changesBatches:
+			if batch.caughtUp && session.continuous {
+				// Like a longpoll, keep waiting until there are changes
+				continue
+			}
+			b.pushTimingStat("changes_feed", time.Since(startTime))
+			if batch.caughtUp {
+				// The subscription is over, so the next call starts a new one
+				session.subscribed = false
+				return sgreplicate.Changes{}, sinceVal, nil
+			}
+			session.expectRevisions(batch.changes)
+			return batch.changes, StringSincer{Since: batch.changes.LastSequence.(string)}, nil
+		case <-ctx.Done():
+			// The subscription can't pick up where it left off, so start over next time
+			b.disconnect(session)
+			return sgreplicate.Changes{}, sinceVal, ctx.Err()
+		case <-session.conn.Done():
+			b.disconnect(session)
+			return sgreplicate.Changes{}, sinceVal, session.conn.Err()
+		}
+	}
+
+}
+
+// Ask Sync Gateway to start sending changes, from the reader's since value if it has
+// one, otherwise from the checkpoint
+func (b *BlipDataStore) subscribeToChanges(ctx context.Context, session *blipSession, sinceVal Sincer, limit int, continuous bool) error {
+
+	if sinceVal.Empty() {
+		checkpointSince, err := b.getCheckpoint(ctx, session)
+		if err != nil {
+			return err
+		}
+		sinceVal = checkpointSince
+	}
+
+	request := blip.NewRequest("subChanges")
+	if !sinceVal.Empty() {
+		request.Properties["since"] = sinceProperty(sinceVal)
+	}
+	if limit > 0 {
+		request.Properties["batch"] = strconv.Itoa(limit)
+	}
+	if continuous {
+		request.Properties["continuous"] = "true"
+	}
+
+	if _, err := session.conn.SendAndWait(ctx, request); err != nil {
+		return err
+	}
+	session.subscribed = true
+	session.continuous = continuous
+	return nil
+
+}
+
+// The since property is JSON, so sequences which aren't plain numbers are quoted
+func sinceProperty(sinceVal Sincer) string {
+	since := sinceVal.String()
+	if _, err := strconv.ParseUint(since, 10, 64); err == nil {
+		return since
+	}
+	quoted, _ := json.Marshal(since)
+	return string(quoted)
+}
+
+// The body of a checkpoint.  Couchbase Lite also keeps its local sequence, but only
+// the remote one matters for pulling.
+type blipCheckpoint struct {
+	Remote string `json:"remote"`
+}
+
+func (b *BlipDataStore) getCheckpoint(ctx context.Context, session *blipSession) (Sincer, error) {
+
+	request := blip.NewRequest("getCheckpoint")
+	request.Properties["client"] = b.checkpointClientID
+
+	startTime := time.Now()
+	response, err := session.conn.SendAndWait(ctx, request)
+	if blipErr, ok := err.(*blip.Error); ok && blipErr.Code == http.StatusNotFound {
+		return StringSincer{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.pushTimingStat("get_checkpoint", time.Since(startTime))
+
+	checkpoint := blipCheckpoint{}
+	if err := response.ReadJSONBody(&checkpoint); err != nil {
+		return nil, fmt.Errorf("Invalid checkpoint: %v", err)
+	}
+	b.checkpointRev = response.Properties["rev"]
+	b.checkpointedSince = checkpoint.Remote
+	return StringSincer{Since: checkpoint.Remote}, nil
+
+}
+
+// Save the since value in the checkpoint if it's changed, but no more often than
+// blipCheckpointInterval.  Failing to save it doesn't stop the reader.
+func (b *BlipDataStore) maybeSaveCheckpoint(ctx context.Context, session *blipSession, sinceVal Sincer) {
+
+	if sinceVal.Empty() || sinceVal.String() == b.checkpointedSince || time.Since(b.lastCheckpoint) < blipCheckpointInterval {
+		return
+	}
+
+	request := blip.NewRequest("setCheckpoint")
+	request.Properties["client"] = b.checkpointClientID
+	if b.checkpointRev != "" {
+		request.Properties["rev"] = b.checkpointRev
+	}
+	if err := request.SetJSONBody(blipCheckpoint{Remote: sinceVal.String()}); err != nil {
+		logger.Warn("Error encoding checkpoint", "since", sinceVal, "error", err)
+		return
+	}
+
+	startTime := time.Now()
+	response, err := session.conn.SendAndWait(ctx, request)
+	if err != nil {
+		logger.Warn("Error saving checkpoint", "since", sinceVal, "user", b.UserCreds.Username, "error", err)
+		return
+	}
+	b.pushTimingStat("set_checkpoint", time.Since(startTime))
+
+	b.checkpointRev = response.Properties["rev"]
+	b.checkpointedSince = sinceVal.String()
+	b.lastCheckpoint = time.Now()
+
+}
+
+// Wait for the revisions that were announced by the latest batch of changes.  Any
+// others are fetched with the REST API.
+func (b *BlipDataStore) BulkGetDocuments(ctx context.Context, r sgreplicate.BulkGetRequest) ([]sgreplicate.Document, error) {
+
+	session := b.currentSession()
+	if session == nil || !session.expectingRevisions(r.Docs) {
+		return b.SGDataStore.BulkGetDocuments(ctx, r)
+	}
+
+	defer b.pushCounter("get_document_counter", len(r.Docs))
+
+	timeout := time.After(blipRevTimeout)
+	documents := []sgreplicate.Document{}
+	for _, docRevPair := range r.Docs {
+
+		rev := session.incomingRevision(docRevPair.Id, docRevPair.Revision)
+		select {
+		case <-rev.arrived:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-session.conn.Done():
+			return nil, session.conn.Err()
+		case <-timeout:
+			return nil, fmt.Errorf("Timed out waiting for rev %s of doc %s", docRevPair.Revision, docRevPair.Id)
+		}
+		session.forgetRevision(docRevPair.Id, docRevPair.Revision)
+		if rev.err != nil {
+			return nil, rev.err
+		}
+
+		// How long it took the revision to arrive once the reader had asked for it
+		delta := rev.arrivedAt.Sub(rev.requested)
+		if delta < 0 {
+			delta = 0
+		}
+		b.pushTimingStat("get_document", delta)
+		documents = append(documents, rev.doc)
+	}
+
+	b.pushGateloadRoundtripStats(documents)
+
+	return documents, nil
+
+}
+
+// Handles the requests Sync Gateway sends over the connection
+func (s *blipSession) handleRequest(conn *blip.Conn, request *blip.Message) *blip.Message {
+	switch request.Profile() {
+	case "changes":
+		return s.handleChanges(conn, request)
+	case "rev":
+		return s.handleRev(conn, request)
+	case "norev":
+		return s.handleNorev(request)
+	case "getAttachment":
+		return s.handleGetAttachment(request)
+	}
+	return request.ErrorResponse(blip.BLIPErrorDomain, http.StatusNotFound, fmt.Sprintf("Unknown profile %q", request.Profile()))
+}
+
+// Each change is [seq, docid, revid], with a trailing true if it's a deletion.  The
+// reply asks for every revision, since the reader doesn't keep any docs.
+func (s *blipSession) handleChanges(conn *blip.Conn, request *blip.Message) *blip.Message {
+
+	rows := [][]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(request.Body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&rows); err != nil {
+		return request.ErrorResponse(blip.HTTPErrorDomain, http.StatusBadRequest, fmt.Sprintf("Invalid changes: %v", err))
+	}
+
+	batch := blipChangesBatch{caughtUp: len(rows) == 0}
+	wanted := []interface{}{}
+	for _, row := range rows {
+		if len(row) < 3 {
+			return request.ErrorResponse(blip.HTTPErrorDomain, http.StatusBadRequest, fmt.Sprintf("Invalid change: %v", row))
+		}
+		docID, _ := row[1].(string)
+		revID, _ := row[2].(string)
+		change := sgreplicate.Change{
+			Sequence:    fmt.Sprintf("%v", row[0]),
+			Id:          docID,
+			ChangedRevs: []sgreplicate.ChangedRev{{Revision: revID}},
+			Deleted:     len(row) > 3 && row[3] == true,
+		}
+		batch.changes.Results = append(batch.changes.Results, change)
+		batch.changes.LastSequence = change.Sequence
+		wanted = append(wanted, []interface{}{})
+	}
+
+	// Only reply once the reader has taken the changes, so that Sync Gateway doesn't
+	// send them any faster than the reader keeps up with
+	select {
+	case s.changesBatches <- batch:
+	case <-conn.Done():
+		return nil
+	}
+
+	response := request.Response()
+	if err := response.SetJSONBody(wanted); err != nil {
+		return request.ErrorResponse(blip.HTTPErrorDomain, http.StatusInternalServerError, err.Error())
+	}
+	return response
+
+}
+
+// A revision the reader asked for.  Its attachments are fetched with getAttachment
+// before it counts as arrived.
+func (s *blipSession) handleRev(conn *blip.Conn, request *blip.Message) *blip.Message {
+
+	docID, revID := request.Properties["id"], request.Properties["rev"]
+	rev := s.incomingRevision(docID, revID)
+
+	body := sgreplicate.DocumentBody{}
+	if err := request.ReadJSONBody(&body); err != nil {
+		rev.arrive(sgreplicate.Document{}, fmt.Errorf("Invalid body for rev %s of doc %s: %v", revID, docID, err))
+		return request.ErrorResponse(blip.HTTPErrorDomain, http.StatusBadRequest, err.Error())
+	}
+	body["_id"] = docID
+	body["_rev"] = revID
+	if deleted := request.Properties["deleted"]; deleted == "1" || deleted == "true" {
+		body["_deleted"] = true
+	}
+
+	attachments, _ := body["_attachments"].(map[string]interface{})
+	for name, rawMeta := range attachments {
+		meta, _ := rawMeta.(map[string]interface{})
+		digest, _ := meta["digest"].(string)
+		getAttachment := blip.NewRequest("getAttachment")
+		getAttachment.Properties["digest"] = digest
+		getAttachment.Properties["docID"] = docID
+		if _, err := conn.SendAndWait(context.Background(), getAttachment); err != nil {
+			rev.arrive(sgreplicate.Document{}, fmt.Errorf("Error getting attachment %s of doc %s: %v", name, docID, err))
+			return request.ErrorResponse(blip.HTTPErrorDomain, http.StatusBadGateway, err.Error())
+		}
+	}
+
+	rev.arrive(sgreplicate.Document{Body: body}, nil)
+	return nil
+
+}
+
+// Sync Gateway can't send a revision the reader asked for, eg because it's been removed
+func (s *blipSession) handleNorev(request *blip.Message) *blip.Message {
+	docID, revID := request.Properties["id"], request.Properties["rev"]
+	err := fmt.Errorf("Sync Gateway couldn't send rev %s of doc %s: %s %s", revID, docID, request.Properties["error"], request.Properties["reason"])
+	s.incomingRevision(docID, revID).arrive(sgreplicate.Document{}, err)
+	return nil
+}
+
+// Sync Gateway wants the data of an attachment of a revision being pushed
+func (s *blipSession) handleGetAttachment(request *blip.Message) *blip.Message {
+
+	s.mutex.Lock()
+	data, ok := s.attachments[request.Properties["digest"]]
+	s.mutex.Unlock()
+
+	if !ok {
+		return request.ErrorResponse(blip.HTTPErrorDomain, http.StatusNotFound, "Unknown attachment")
+	}
+	response := request.Response()
+	response.Body = data
+	return response
+
+}
+
+// Get the revision, which may or may not have arrived yet
+func (s *blipSession) incomingRevision(docID, revID string) *blipIncomingRev {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := blipRevKey{docID: docID, revID: revID}
+	rev, ok := s.revs[key]
+	if !ok {
+		rev = &blipIncomingRev{
+			requested: time.Now(),
+			arrived:   make(chan struct{}),
+		}
+		s.revs[key] = rev
+	}
+	return rev
+
+}
+
+// Keep track of the revisions of a new batch of changes, which Sync Gateway is about
+// to send, and forget about any others that the reader didn't get
+func (s *blipSession) expectRevisions(changes sgreplicate.Changes) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	revs := map[blipRevKey]*blipIncomingRev{}
+	for _, change := range changes.Results {
+		key := blipRevKey{docID: change.Id, revID: change.ChangedRevs[0].Revision}
+		rev, ok := s.revs[key]
+		if !ok {
+			rev = &blipIncomingRev{arrived: make(chan struct{})}
+		}
+		rev.requested = time.Now()
+		revs[key] = rev
+	}
+	s.revs = revs
+
+}
+
+// Whether all of the revisions are on their way from the changes feed
+func (s *blipSession) expectingRevisions(docRevPairs []sgreplicate.DocumentRevisionPair) bool {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, docRevPair := range docRevPairs {
+		if _, ok := s.revs[blipRevKey{docID: docRevPair.Id, revID: docRevPair.Revision}]; !ok {
+			return false
+		}
+	}
+	return true
+
+}
+
+// Stop keeping track of a revision once the reader has it
+func (s *blipSession) forgetRevision(docID, revID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.revs, blipRevKey{docID: docID, revID: revID})
+}
+
+// Only the first time counts, in case Sync Gateway sends the revision twice
+func (r *blipIncomingRev) arrive(doc sgreplicate.Document, err error) {
+	r.once.Do(func() {
+		r.arrivedAt = time.Now()
+		r.doc = doc
+		r.err = err
+		close(r.arrived)
+	})
+}
+
+func (s *blipSession) addAttachments(revs []blipOutgoingRev) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, rev := range revs {
+		for digest, data := range rev.attachments {
+			s.attachments[digest] = data
+		}
+	}
+}
+
+func (s *blipSession) removeAttachments(revs []blipOutgoingRev) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, rev := range revs {
+		for digest := range rev.attachments {
+			delete(s.attachments, digest)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package sgload
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	sgreplicate "github.com/couchbaselabs/sg-replicate"
+	"github.com/couchbaselabs/sgload/sgsimulator"
+)
+
+// Returns a BLIP data store for a new user with access to the given channels, talking
+// to the simulator that dataStore talks to
+func newSimulatorBlipDataStore(t *testing.T, dataStore *SGDataStore, username string, channels []string) *BlipDataStore {
+	blipDataStore := NewBlipDataStore(dataStore.SyncGatewayUrl, dataStore.SyncGatewayAdminPort, NoOpMetricsSink{}, false)
+	userCred := UserCred{Username: username, Password: "password"}
+	if err := blipDataStore.CreateUser(context.Background(), userCred, channels); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	blipDataStore.SetUserCreds(userCred)
+	return blipDataStore
+}
+
+func docsToWrite(prefix string, numDocs int, channels []string) []Document {
+	docs := []Document{}
+	for i := 0; i < numDocs; i++ {
+		doc := Document{}
+		doc.SetId(fmt.Sprintf("%s-%d", prefix, i))
+		doc.SetChannels(channels)
+		doc["created_at"] = time.Now().Format(time.RFC3339Nano)
+		doc["bodysize"] = 100
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// Gets the next batch of changes and the docs they refer to, as a reader does
+func pullChanges(t *testing.T, dataStore DataStore, since Sincer, feedType ChangesFeedType) ([]sgreplicate.Document, Sincer) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	changes, newSince, err := dataStore.Changes(ctx, since, 100, feedType)
+	if err != nil {
+		t.Fatalf("Error getting changes: %v", err)
+	}
+	bulkGetRequest, _, err := createBulkGetRequest(changes)
+	if err != nil {
+		t.Fatalf("Error creating bulk get request: %v", err)
+	}
+	docs, err := dataStore.BulkGetDocuments(ctx, bulkGetRequest)
+	if err != nil {
+		t.Fatalf("Error getting docs: %v", err)
+	}
+	return docs, newSince
+}
+
+func TestBlipDataStorePushAndPull(t *testing.T) {
+
+	_, dataStore, cleanup := newSimulatorDataStore(t, sgsimulator.FaultConfig{})
+	defer cleanup()
+
+	ctx := context.Background()
+	writer := newSimulatorBlipDataStore(t, dataStore, "writer", []string{"ABC"})
+	reader := newSimulatorBlipDataStore(t, dataStore, "reader", []string{"ABC"})
+
+	// A single doc with an attachment, which the simulator gets with getAttachment
+	doc := docsToWrite("single", 1, []string{"ABC"})[0]
+	pushed, err := writer.CreateDocument(ctx, doc, 500, true)
+	if err != nil || pushed.Error != "" || !strings.HasPrefix(pushed.Revision, "1-") {
+		t.Fatalf("Error pushing doc: %+v, %v", pushed, err)
+	}
+
+	// A batch of docs, one of which isn't visible to the reader
+	docs := append(docsToWrite("bulk", 3, []string{"ABC"}), docsToWrite("hidden", 1, []string{"XYZ"})...)
+	pushedDocs, err := writer.BulkCreateDocumentsRetry(ctx, docs, true)
+	if err != nil || len(pushedDocs) != 4 {
+		t.Fatalf("Error pushing docs: %v, %v", pushedDocs, err)
+	}
+
+	pulled, since := pullChanges(t, reader, StringSincer{}, FEED_TYPE_LONGPOLL)
+	if len(pulled) != 4 {
+		t.Fatalf("Expected 4 docs, got %d", len(pulled))
+	}
+	for _, pulledDoc := range pulled {
+		if pulledDoc.Body["created_at"] == nil || pulledDoc.Body["_rev"] == nil {
+			t.Fatalf("Unexpected doc body: %v", pulledDoc.Body)
+		}
+		if pulledDoc.Body["_id"] == "single-0" && pulledDoc.Body["_attachments"] == nil {
+			t.Fatalf("Expected doc to have an attachment: %v", pulledDoc.Body)
+		}
+	}
+
+	// Update a doc with new_edits=false and two revisions per update, as the updater does
+	update := docsToWrite("bulk", 1, []string{"ABC"})[0]
+	_, parentDigest := parseRevID(pushedDocs[0].Revision)
+	update.SetRevisions(3, []string{"ccc", "bbb", parentDigest})
+	update.SetRevision("3-ccc")
+	updated, err := writer.BulkCreateDocuments(ctx, []Document{update}, false)
+	if err != nil || len(updated) != 1 || updated[0].Error != "" {
+		t.Fatalf("Error updating doc: %v, %v", updated, err)
+	}
+
+	pulled, _ = pullChanges(t, reader, since, FEED_TYPE_LONGPOLL)
+	if len(pulled) != 1 || pulled[0].Body["_rev"] != "3-ccc" {
+		t.Fatalf("Expected to pull the update, got: %v", pulled)
+	}
+
+	// An update which isn't based on the current revision is rejected
+	conflict := docsToWrite("bulk", 1, []string{"ABC"})[0]
+	conflict.SetRevision(pushedDocs[0].Revision)
+	rejected, err := writer.BulkCreateDocuments(ctx, []Document{conflict}, true)
+	if err != nil || len(rejected) != 1 || rejected[0].Error == "" {
+		t.Fatalf("Expected conflicting update to be rejected, got: %v, %v", rejected, err)
+	}
+
+	// Revisions that weren't announced by the changes feed are looked up with the REST API
+	docRevPairs, err := Updater{Agent: Agent{AgentSpec: AgentSpec{DataStore: reader}}}.LookupCurrentRevisions(ctx, []Document{update})
+	if err != nil || len(docRevPairs) != 1 || docRevPairs[0].Revision != "3-ccc" {
+		t.Fatalf("Expected to look up the current revision, got: %v, %v", docRevPairs, err)
+	}
+
+}
+
+// With compression enabled, the rev requests pushed are compressed, as are those the
+// simulator sends like Sync Gateway, and they carry on one deflate stream per direction
+func TestBlipDataStoreCompression(t *testing.T) {
+
+	_, dataStore, cleanup := newSimulatorDataStore(t, sgsimulator.FaultConfig{})
+	defer cleanup()
+
+	ctx := context.Background()
+	writer := newSimulatorBlipDataStore(t, dataStore, "writer", []string{"ABC"})
+	writer.CompressionEnabled = true
+	reader := newSimulatorBlipDataStore(t, dataStore, "reader", []string{"ABC"})
+
+	since := Sincer(StringSincer{})
+	for i := 0; i < 3; i++ {
+		docs := docsToWrite(fmt.Sprintf("batch%d", i), 5, []string{"ABC"})
+		if pushed, err := writer.BulkCreateDocumentsRetry(ctx, docs, true); err != nil || len(pushed) != 5 {
+			t.Fatalf("Error pushing compressed docs: %v, %v", pushed, err)
+		}
+		var pulled []sgreplicate.Document
+		pulled, since = pullChanges(t, reader, since, FEED_TYPE_LONGPOLL)
+		if len(pulled) != 5 {
+			t.Fatalf("Expected 5 docs in batch %d, got %d", i, len(pulled))
+		}
+		for _, pulledDoc := range pulled {
+			if pulledDoc.Body["created_at"] == nil {
+				t.Fatalf("Unexpected doc body: %v", pulledDoc.Body)
+			}
+		}
+	}
+
+}
+
+func TestBlipDataStoreNormalFeed(t *testing.T) {
+
+	_, dataStore, cleanup := newSimulatorDataStore(t, sgsimulator.FaultConfig{})
+	defer cleanup()
+
+	ctx := context.Background()
+	writer := newSimulatorBlipDataStore(t, dataStore, "writer", []string{"ABC"})
+	reader := newSimulatorBlipDataStore(t, dataStore, "reader", []string{"ABC"})
+
+	if _, err := writer.BulkCreateDocuments(ctx, docsToWrite("doc", 3, []string{"ABC"}), true); err != nil {
+		t.Fatalf("Error pushing docs: %v", err)
+	}
+
+	pulled, since := pullChanges(t, reader, StringSincer{}, FEED_TYPE_NORMAL)
+	if len(pulled) != 3 {
+		t.Fatalf("Expected 3 docs, got %d", len(pulled))
+	}
+
+	// Once the reader is caught up, the normal feed comes back empty rather than waiting
+	pulled, newSince := pullChanges(t, reader, since, FEED_TYPE_NORMAL)
+	if len(pulled) != 0 || !newSince.Equals(since) {
+		t.Fatalf("Expected no more changes, got %d docs, since: %v", len(pulled), newSince)
+	}
+
+	// And the next call starts a new subscription from where the reader got to
+	if _, err := writer.BulkCreateDocuments(ctx, docsToWrite("more", 2, []string{"ABC"}), true); err != nil {
+		t.Fatalf("Error pushing docs: %v", err)
+	}
+	pulled, _ = pullChanges(t, reader, since, FEED_TYPE_NORMAL)
+	if len(pulled) != 2 {
+		t.Fatalf("Expected 2 more docs, got %d", len(pulled))
+	}
+
+}
+
+func TestBlipDataStoreCheckpoint(t *testing.T) {
+
+	defer func(interval time.Duration) { blipCheckpointInterval = interval }(blipCheckpointInterval)
+	blipCheckpointInterval = 0
+
+	_, dataStore, cleanup := newSimulatorDataStore(t, sgsimulator.FaultConfig{})
+	defer cleanup()
+
+	ctx := context.Background()
+	writer := newSimulatorBlipDataStore(t, dataStore, "writer", []string{"ABC"})
+	reader := newSimulatorBlipDataStore(t, dataStore, "reader", []string{"ABC"})
+
+	if _, err := writer.BulkCreateDocuments(ctx, docsToWrite("doc", 3, []string{"ABC"}), true); err != nil {
+		t.Fatalf("Error pushing docs: %v", err)
+	}
+	_, since := pullChanges(t, reader, StringSincer{}, FEED_TYPE_LONGPOLL)
+
+	// The checkpoint is saved when the reader asks for more changes, having
+	// finished with the previous ones
+	if _, err := writer.BulkCreateDocuments(ctx, docsToWrite("more", 1, []string{"ABC"}), true); err != nil {
+		t.Fatalf("Error pushing docs: %v", err)
+	}
+	pullChanges(t, reader, since, FEED_TYPE_LONGPOLL)
+
+	// A reader with the same checkpoint starts from where the first one got to
+	restarted := newSimulatorBlipDataStore(t, dataStore, "reader", []string{"ABC"})
+	restarted.checkpointClientID = reader.checkpointClientID
+	pulled, _ := pullChanges(t, restarted, StringSincer{}, FEED_TYPE_LONGPOLL)
+	if len(pulled) != 1 || pulled[0].Body["_id"] != "more-0" {
+		t.Fatalf("Expected to resume from the checkpoint, got: %v", pulled)
+	}
+
+}
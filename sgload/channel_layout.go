@@ -0,0 +1,272 @@
+package sgload
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+const (
+	CHANNEL_DISTRIBUTION_UNIFORM = "uniform" // Every channel is as likely.  The default.
+	CHANNEL_DISTRIBUTION_ZIPFIAN = "zipfian" // Channel i (from 0) has weight 1/(i+1)^ZipfExponent, so a few are hot and there's a long tail
+	CHANNEL_DISTRIBUTION_HOTSPOT = "hotspot" // HotChannelPercent of the channels get HotDocPercent of the docs between them
+	CHANNEL_DISTRIBUTION_WEIGHTS = "weights" // Each channel has the weight given in Weights
+)
+
+// How the docs are spread across the channels, and how many channels each doc is in
+type ChannelDistributionSpec struct {
+	Distribution      string    `yaml:"distribution"`         // "uniform" (the default), "zipfian", "hotspot" or "weights"
+	ZipfExponent      float64   `yaml:"zipf_exponent"`        // For zipfian.  The higher it is, the more skewed.  Defaults to 1.
+	HotChannelPercent float64   `yaml:"hot_channel_percent"`  // For hotspot.  Defaults to 20.
+	HotDocPercent     float64   `yaml:"hot_doc_percent"`      // For hotspot.  Defaults to 80.
+	Weights           []float64 `yaml:"weights"`              // For weights, one per channel.  They don't have to add up to anything.
+	MinChannelsPerDoc int       `yaml:"min_channels_per_doc"` // Each doc is in between Min and MaxChannelsPerDoc channels, picked uniformly.  Both default to 1.
+	MaxChannelsPerDoc int       `yaml:"max_channels_per_doc"`
+}
+
+func (cds ChannelDistributionSpec) Validate(numChannels int) error {
+
+	switch cds.Distribution {
+	case "", CHANNEL_DISTRIBUTION_UNIFORM, CHANNEL_DISTRIBUTION_ZIPFIAN, CHANNEL_DISTRIBUTION_HOTSPOT:
+		if len(cds.Weights) > 0 {
+			return fieldError("load.channels.weights", "Only used with the %s distribution", CHANNEL_DISTRIBUTION_WEIGHTS)
+		}
+	case CHANNEL_DISTRIBUTION_WEIGHTS:
+		if len(cds.Weights) != numChannels {
+			return fieldError("load.channels.weights", "Needs one weight per channel (%d), got %d", numChannels, len(cds.Weights))
+		}
+		total := 0.0
+		for _, weight := range cds.Weights {
+			if weight < 0 {
+				return fieldError("load.channels.weights", "Weights must not be negative")
+			}
+			total += weight
+		}
+		if total == 0 {
+			return fieldError("load.channels.weights", "At least one weight must be greater than zero")
+		}
+	default:
+		return fieldError(
+			"load.channels.distribution",
+			"Unknown channel distribution %q.  Values: %s, %s, %s, %s",
+			cds.Distribution,
+			CHANNEL_DISTRIBUTION_UNIFORM,
+			CHANNEL_DISTRIBUTION_ZIPFIAN,
+			CHANNEL_DISTRIBUTION_HOTSPOT,
+			CHANNEL_DISTRIBUTION_WEIGHTS,
+		)
+	}
+
+	if cds.ZipfExponent < 0 {
+		return fieldError("load.channels.zipf_exponent", "ZipfExponent must not be negative")
+	}
+	if cds.HotChannelPercent < 0 || cds.HotChannelPercent > 100 {
+		return fieldError("load.channels.hot_channel_percent", "Must be between 0 and 100")
+	}
+	if cds.HotDocPercent < 0 || cds.HotDocPercent > 100 {
+		return fieldError("load.channels.hot_doc_percent", "Must be between 0 and 100")
+	}
+
+	if cds.MinChannelsPerDoc < 0 {
+		return fieldError("load.channels.min_channels_per_doc", "MinChannelsPerDoc must not be negative")
+	}
+	if cds.maxChannelsPerDoc() > numChannels {
+		return fieldError("load.channels.max_channels_per_doc", "MaxChannelsPerDoc must be at most the number of channels (%d)", numChannels)
+	}
+	if cds.minChannelsPerDoc() > cds.maxChannelsPerDoc() {
+		return fieldError("load.channels.min_channels_per_doc", "MinChannelsPerDoc must be at most MaxChannelsPerDoc (%d)", cds.maxChannelsPerDoc())
+	}
+	return nil
+
+}
+
+func (cds ChannelDistributionSpec) minChannelsPerDoc() int {
+	if cds.MinChannelsPerDoc == 0 {
+		return 1
+	}
+	return cds.MinChannelsPerDoc
+}
+
+func (cds ChannelDistributionSpec) maxChannelsPerDoc() int {
+	if cds.MaxChannelsPerDoc == 0 {
+		return cds.minChannelsPerDoc()
+	}
+	return cds.MaxChannelsPerDoc
+}
+
+// Whether every channel gets exactly the same number of docs, as it always did before
+// there were distributions.  That needs the number of docs to divide into the channels.
+func (cds ChannelDistributionSpec) exactlyEven() bool {
+	isUniform := cds.Distribution == "" || cds.Distribution == CHANNEL_DISTRIBUTION_UNIFORM
+	return isUniform && cds.maxChannelsPerDoc() == 1
+}
+
+// The relative weight of each channel
+func (cds ChannelDistributionSpec) channelWeights(numChannels int) []float64 {
+
+	weights := make([]float64, numChannels)
+
+	switch cds.Distribution {
+	case CHANNEL_DISTRIBUTION_ZIPFIAN:
+		exponent := cds.ZipfExponent
+		if exponent == 0 {
+			exponent = 1
+		}
+		for i := range weights {
+			weights[i] = 1 / math.Pow(float64(i+1), exponent)
+		}
+	case CHANNEL_DISTRIBUTION_HOTSPOT:
+		hotChannelPercent, hotDocPercent := cds.HotChannelPercent, cds.HotDocPercent
+		if hotChannelPercent == 0 {
+			hotChannelPercent = 20
+		}
+		if hotDocPercent == 0 {
+			hotDocPercent = 80
+		}
+		numHot := int(math.Ceil(float64(numChannels) * hotChannelPercent / 100))
+		if numHot >= numChannels {
+			numHot = numChannels
+			hotDocPercent = 100
+		}
+		for i := range weights {
+			if i < numHot {
+				weights[i] = hotDocPercent / float64(numHot)
+			} else {
+				weights[i] = (100 - hotDocPercent) / float64(numChannels-numHot)
+			}
+		}
+	case CHANNEL_DISTRIBUTION_WEIGHTS:
+		copy(weights, cds.Weights)
+	default:
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+
+	return weights
+
+}
+
+// Which channels each doc is in.  There's one layout for the whole run: writers look up
+// the channels of the docs they write in it, and readers count how many docs they should
+// see in their channels from it.
+type ChannelLayout struct {
+	channelNames []string
+	docChannels  [][]uint16 // The indexes (into channelNames) of the channels of each doc
+}
+
+// Lay out numDocs docs over the channels.  The same spec, channels and rng seed always
+// give the same layout.
+func newChannelLayout(spec ChannelDistributionSpec, numDocs int, channelNames []string, rng *rand.Rand) *ChannelLayout {
+
+	layout := &ChannelLayout{
+		channelNames: channelNames,
+		docChannels:  make([][]uint16, numDocs),
+	}
+
+	if spec.exactlyEven() && numDocs%len(channelNames) == 0 {
+		for docIndex, chanIndex := range getChannelToDocMapping(numDocs, channelNames, rng) {
+			layout.docChannels[docIndex] = []uint16{chanIndex}
+		}
+		return layout
+	}
+
+	// Pick from the cumulative weights, so the chance of each channel is its share of the total
+	weights := spec.channelWeights(len(channelNames))
+	cumulative := make([]float64, len(weights))
+	total := 0.0
+	for i, weight := range weights {
+		total += weight
+		cumulative[i] = total
+	}
+	pickChannel := func() uint16 {
+		x := rng.Float64() * total
+		chanIndex := sort.Search(len(cumulative), func(i int) bool { return cumulative[i] > x })
+		if chanIndex >= len(cumulative) {
+			chanIndex = len(cumulative) - 1
+		}
+		return uint16(chanIndex)
+	}
+
+	minChannels, maxChannels := spec.minChannelsPerDoc(), spec.maxChannelsPerDoc()
+	numNonZeroWeights := 0
+	for _, weight := range weights {
+		if weight > 0 {
+			numNonZeroWeights++
+		}
+	}
+
+	for docIndex := range layout.docChannels {
+		numChannels := minChannels + rng.Intn(maxChannels-minChannels+1)
+		if numChannels > numNonZeroWeights {
+			// Can't pick more distinct channels than have any chance of being picked
+			numChannels = numNonZeroWeights
+		}
+		docChannels := make([]uint16, 0, numChannels)
+		for len(docChannels) < numChannels {
+			chanIndex := pickChannel()
+			if !containsChannelIndex(docChannels, chanIndex) {
+				docChannels = append(docChannels, chanIndex)
+			}
+		}
+		layout.docChannels[docIndex] = docChannels
+	}
+
+	return layout
+
+}
+
+func containsChannelIndex(chanIndexes []uint16, chanIndex uint16) bool {
+	for _, c := range chanIndexes {
+		if c == chanIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// The names of the channels of the doc at docIndex.  Indexes past the end wrap around,
+// for writers in open-ended runs.
+func (cl *ChannelLayout) channelsOfDoc(docIndex int) []string {
+	chanIndexes := cl.docChannels[docIndex%len(cl.docChannels)]
+	channels := make([]string, len(chanIndexes))
+	for i, chanIndex := range chanIndexes {
+		channels[i] = cl.channelNames[chanIndex]
+	}
+	return channels
+}
+
+// How many docs are in at least one of the channels.  A doc in several of them is only
+// counted once, since a reader only sees it once on its changes feed.
+func (cl *ChannelLayout) numDocsInChannels(channels []string) int {
+
+	chanIndexes := []uint16{}
+	for chanIndex, channelName := range cl.channelNames {
+		if contains(channels, channelName) {
+			chanIndexes = append(chanIndexes, uint16(chanIndex))
+		}
+	}
+
+	numDocs := 0
+	for _, docChannels := range cl.docChannels {
+		for _, chanIndex := range docChannels {
+			if containsChannelIndex(chanIndexes, chanIndex) {
+				numDocs++
+				break
+			}
+		}
+	}
+	return numDocs
+
+}
+
+// The number of docs in each channel, by channel name, for logging the layout
+func (cl *ChannelLayout) numDocsPerChannel() map[string]int {
+	numDocsPerChannel := map[string]int{}
+	for _, docChannels := range cl.docChannels {
+		for _, chanIndex := range docChannels {
+			numDocsPerChannel[cl.channelNames[chanIndex]]++
+		}
+	}
+	return numDocsPerChannel
+}
@@ -0,0 +1,142 @@
+package sgload
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestChannelLayoutDistributions(t *testing.T) {
+
+	channelNames := []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}
+	numDocs := 10000
+
+	uniform := newChannelLayout(ChannelDistributionSpec{}, numDocs, channelNames, rand.New(rand.NewSource(1)))
+	for channel, numDocsInChannel := range uniform.numDocsPerChannel() {
+		if numDocsInChannel != numDocs/len(channelNames) {
+			t.Fatalf("Expected channel %s to have exactly %d docs, got %d", channel, numDocs/len(channelNames), numDocsInChannel)
+		}
+	}
+
+	zipfian := newChannelLayout(ChannelDistributionSpec{Distribution: CHANNEL_DISTRIBUTION_ZIPFIAN}, numDocs, channelNames, rand.New(rand.NewSource(1)))
+	zipfianDocsPerChannel := zipfian.numDocsPerChannel()
+	if zipfianDocsPerChannel["0"] < 2*zipfianDocsPerChannel["3"] || zipfianDocsPerChannel["3"] < zipfianDocsPerChannel["9"] {
+		t.Fatalf("Expected the zipfian channels to get fewer docs down the tail, got %v", zipfianDocsPerChannel)
+	}
+
+	hotspot := newChannelLayout(ChannelDistributionSpec{Distribution: CHANNEL_DISTRIBUTION_HOTSPOT}, numDocs, channelNames, rand.New(rand.NewSource(1)))
+	numHotDocs := hotspot.numDocsInChannels([]string{"0", "1"})
+	if numHotDocs < numDocs*75/100 || numHotDocs > numDocs*85/100 {
+		t.Fatalf("Expected about 80%% of the docs in the 2 hot channels, got %d of %d", numHotDocs, numDocs)
+	}
+
+	weights := newChannelLayout(
+		ChannelDistributionSpec{Distribution: CHANNEL_DISTRIBUTION_WEIGHTS, Weights: []float64{1, 0, 0, 0, 0, 0, 0, 0, 0, 3}},
+		numDocs,
+		channelNames,
+		rand.New(rand.NewSource(1)),
+	)
+	weightsDocsPerChannel := weights.numDocsPerChannel()
+	if len(weightsDocsPerChannel) != 2 || weightsDocsPerChannel["9"] < 2*weightsDocsPerChannel["0"] {
+		t.Fatalf("Expected the docs in channels 0 and 9 only, about 1:3, got %v", weightsDocsPerChannel)
+	}
+
+}
+
+func TestChannelLayoutChannelsPerDoc(t *testing.T) {
+
+	channelNames := []string{"A", "B", "C", "D", "E"}
+	spec := ChannelDistributionSpec{MinChannelsPerDoc: 2, MaxChannelsPerDoc: 3}
+	layout := newChannelLayout(spec, 1000, channelNames, rand.New(rand.NewSource(1)))
+
+	numDocsInA := 0
+	for docIndex := range layout.docChannels {
+		channels := layout.channelsOfDoc(docIndex)
+		if len(channels) < 2 || len(channels) > 3 {
+			t.Fatalf("Expected 2-3 channels for doc %d, got %v", docIndex, channels)
+		}
+		unique := map[string]bool{}
+		for _, channel := range channels {
+			unique[channel] = true
+		}
+		if len(unique) != len(channels) {
+			t.Fatalf("Expected distinct channels for doc %d, got %v", docIndex, channels)
+		}
+		if unique["A"] {
+			numDocsInA++
+		}
+	}
+
+	// Docs in more than one of the reader's channels are only counted once
+	if got := layout.numDocsInChannels([]string{"A"}); got != numDocsInA {
+		t.Fatalf("Expected %d docs in channel A, got %d", numDocsInA, got)
+	}
+	if got := layout.numDocsInChannels(channelNames); got != 1000 {
+		t.Fatalf("Expected all 1000 docs in all the channels, got %d", got)
+	}
+	docsPerChannelTotal := 0
+	for _, numDocs := range layout.numDocsPerChannel() {
+		docsPerChannelTotal += numDocs
+	}
+	if docsPerChannelTotal <= 1000*2 {
+		t.Fatalf("Expected more than 2 channels per doc on average, got %d channel entries", docsPerChannelTotal)
+	}
+
+}
+
+func TestNumDocsExpectedPerReader(t *testing.T) {
+
+	loadSpec := LoadSpec{
+		SyncGatewayUrl: "http://localhost:4984/db/",
+		NumDocs:        1000,
+		NumChannels:    10,
+		TestSessionID:  "test",
+		Channels:       ChannelDistributionSpec{Distribution: CHANNEL_DISTRIBUTION_ZIPFIAN, MaxChannelsPerDoc: 2},
+	}
+	runner := LoadRunner{LoadSpec: loadSpec}
+	runner.CreateChannelLayout()
+	rlr := ReadLoadRunner{LoadRunner: runner}
+
+	// The writers put every doc in the same channels the readers expect them in
+	writers := 4
+	docsPerWriter := loadSpec.NumDocs / writers
+	docsInChannel0 := 0
+	for writerID := 0; writerID < writers; writerID++ {
+		docs := createDocsToWrite("writer", 0, docsPerWriter, 0, "", nil, nil)
+		assignDocsToChannels(docs, runner.ChannelLayout, writerID, docsPerWriter)
+		for _, doc := range docs {
+			if contains(doc["channels"].([]string), "0-test") {
+				docsInChannel0++
+			}
+		}
+	}
+	if got := rlr.numDocsExpectedPerReader([]string{"0-test"}); got != docsInChannel0 {
+		t.Fatalf("Expected a reader of channel 0 to expect the %d docs written to it, got %d", docsInChannel0, got)
+	}
+	if got := rlr.numDocsExpectedPerReader(runner.generateChannelNames()); got != loadSpec.NumDocs {
+		t.Fatalf("Expected a reader of every channel to expect all %d docs, got %d", loadSpec.NumDocs, got)
+	}
+
+}
+
+func TestChannelDistributionSpecValidate(t *testing.T) {
+
+	invalid := map[string]ChannelDistributionSpec{
+		"load.channels.distribution":         {Distribution: "pareto"},
+		"load.channels.weights":              {Distribution: CHANNEL_DISTRIBUTION_WEIGHTS, Weights: []float64{1, 2}},
+		"load.channels.hot_doc_percent":      {Distribution: CHANNEL_DISTRIBUTION_HOTSPOT, HotDocPercent: 120},
+		"load.channels.max_channels_per_doc": {MaxChannelsPerDoc: 4},
+		"load.channels.min_channels_per_doc": {MinChannelsPerDoc: 3, MaxChannelsPerDoc: 2},
+	}
+	for field, spec := range invalid {
+		err := spec.Validate(3)
+		fieldErr, ok := err.(FieldError)
+		if !ok || fieldErr.Field != field {
+			t.Fatalf("Expected an error for %s with %+v, got %v", field, spec, err)
+		}
+	}
+
+	if err := (ChannelDistributionSpec{Distribution: CHANNEL_DISTRIBUTION_WEIGHTS, Weights: []float64{1, 0, 2}, MaxChannelsPerDoc: 3}).Validate(3); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+}
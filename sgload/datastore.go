@@ -1,37 +1,111 @@
 package sgload
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
 	"crypto/sha1"
 	"encoding/base64"
 	sgreplicate "github.com/couchbaselabs/sg-replicate"
-	"crypto/rand"
+	"math/rand"
+	"hash/fnv"
+	"time"
 )
 
+// All calls take a context which cancels the request (and any retries) when done
 type DataStore interface {
 
 	// Creates a new user in the data store (admin port)
-	CreateUser(u UserCred, channelNames []string) error
+	CreateUser(ctx context.Context, u UserCred, channelNames []string) error
 
 	// Create a single document, possibly with attachment if attachSizeBytes > 0
-	CreateDocument(doc Document, attachSizeBytes int, newEdits bool) (DocumentMetadata, error)
+	CreateDocument(ctx context.Context, doc Document, attachSizeBytes int, newEdits bool) (DocumentMetadata, error)
 
 	// Bulk creates a set of documents in the data store
-	BulkCreateDocuments(d []Document, newEdits bool) ([]DocumentMetadata, error)
+	BulkCreateDocuments(ctx context.Context, d []Document, newEdits bool) ([]DocumentMetadata, error)
 
 	// Same as BulkCreateDocuments, but built-in retry for temporary errors
-	BulkCreateDocumentsRetry(d []Document, newEdits bool) ([]DocumentMetadata, error)
+	BulkCreateDocumentsRetry(ctx context.Context, d []Document, newEdits bool) ([]DocumentMetadata, error)
 
 	// Sets the user credentials to use for all subsequent requests
 	SetUserCreds(u UserCred)
 
 	// Get all the changes since the since value
-	Changes(sinceVal Sincer, limit int, feedType ChangesFeedType) (changes sgreplicate.Changes, newSinceVal Sincer, err error)
+	Changes(ctx context.Context, sinceVal Sincer, limit int, feedType ChangesFeedType) (changes sgreplicate.Changes, newSinceVal Sincer, err error)
 
 	// Does a bulk get on docs in bulk get request, discards actual docs
-	BulkGetDocuments(sgreplicate.BulkGetRequest) ([]sgreplicate.Document, error)
+	BulkGetDocuments(ctx context.Context, r sgreplicate.BulkGetRequest) ([]sgreplicate.Document, error)
+
+	// Like BulkGetDocuments, but lists the revisions already pulled of each doc in atts_since,
+	// like a pull replicator does, so attachments that haven't changed since are sent as stubs
+	BulkGetDocumentsAttsSince(ctx context.Context, r sgreplicate.BulkGetRequest, attsSince map[string][]string) ([]sgreplicate.Document, error)
+
+	// Deletes the docs at their current revisions.  The tombstones keep the docs' channels
+	// (and keyspace), so they show up on the changes feeds of the readers of those channels
+	DeleteDocuments(ctx context.Context, docs []DocumentMetadata) ([]DocumentMetadata, error)
+
+	// Purges the docs (admin port), which removes them and their tombstones altogether
+	PurgeDocuments(ctx context.Context, docIds []string) error
+
+	// Returns the revisions of each doc that the data store doesn't have yet (_revs_diff).
+	// Docs which it has all the revisions of are left out.
+	RevsDiff(ctx context.Context, revs map[string][]string) (map[string][]string, error)
+
+	// Gets a replication checkpoint.  One that hasn't been saved yet is returned empty, without an error
+	GetCheckpoint(ctx context.Context, id string) (Checkpoint, error)
+
+	// Saves a replication checkpoint, and returns it with its new revision
+	SetCheckpoint(ctx context.Context, checkpoint Checkpoint) (Checkpoint, error)
+}
+
+// A replicator's checkpoint, saved as a _local doc (which isn't replicated), with the
+// last of its sequences that it has replicated
+type Checkpoint struct {
+	ID           string `json:"-"`              // The doc ID, without the _local/ prefix
+	Rev          string `json:"_rev,omitempty"` // The revision of the saved checkpoint, which is needed to update it
+	LastSequence string `json:"lastSequence"`   // Like Couchbase Lite 1.x
+}
+
+// Implemented by data stores which can hold a changes feed open and deliver changes as they
+// arrive, for the streaming feed types (continuous, websocket and eventsource)
+type ChangesStreamer interface {
+	OpenChangesStream(ctx context.Context, sinceVal Sincer, feedType ChangesFeedType) (*ChangesStream, error)
+}
+
+// Implemented by data stores which can work on the other keyspaces (collections) of
+// the database
+type KeyspaceDataStore interface {
+	WithKeyspace(keyspace Keyspace) DataStore
+}
+
+// The channels each doc on a changes feed was removed from, keyed by doc id
+type Removals map[string][]string
+
+// Implemented by data stores whose changes feeds tell the reader which docs it lost
+// access to, separately from the other changes
+type RemovalsChangesFeed interface {
+	ChangesWithRemovals(ctx context.Context, sinceVal Sincer, limit int, feedType ChangesFeedType) (sgreplicate.Changes, Removals, Sincer, error)
+}
+
+// Implemented by data stores whose changes feeds only say which docs the user lost access
+// to, when its channels are revoked, if they're asked to
+type RevocationsChangesFeed interface {
+	SetRevocations(revocations bool)
+}
+
+// Implemented by data stores which can change the channels users have access to while
+// a run is going, for the access churners
+type AccessDataStore interface {
+
+	// Replace the user's admin channels and roles
+	UpdateUserAccess(ctx context.Context, username string, channelNames []string, roles []string) error
+
+	// Create or replace a role with the given channels
+	PutRole(ctx context.Context, name string, channelNames []string) error
+
+	// The IDs of the docs in any of the channels
+	ChannelDocIDs(ctx context.Context, channelNames []string) ([]string, error)
 }
 
 type UserCred struct {
@@ -72,12 +146,14 @@ type AttachmentMeta struct {
 	Digest      string `json:"digest"`
 }
 
-// Generate an attachment approximately with size specified in approxAttachSizeBytes
+// Generate an attachment approximately with size specified in approxAttachSizeBytes.  The
+// content is derived from the doc ID and the revision being updated (if any), so that
+// seeded runs push the same attachments, but every revision still gets a new one.
 func (d Document) GenerateHtmlAttachmentContent(approxAttachSizeBytes int) []byte {
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%s-%s", d.Id(), d.Revision())
 	b := make([]byte, approxAttachSizeBytes)
-	if _, err := rand.Read(b); err != nil {
-		panic(err)
-	}
+	rand.New(rand.NewSource(int64(hash.Sum64()))).Read(b)
 	s := fmt.Sprintf("%X", b)
 	return []byte(s)
 }
@@ -108,6 +184,13 @@ func (d Document) SetRevision(revision string) {
 	d["_rev"] = revision
 }
 
+// Docs that didn't get a body from a doc generator get a filler body of their "bodysize"
+func (d Document) addBodyIfMissing() {
+	if _, ok := d["body"]; !ok {
+		d["body"] = createBodyContentAsMapWithSize(d.GetBodySizeBytes())
+	}
+}
+
 func (d Document) GetBodySizeBytes() (docSizeBytes int) {
 	docSizeBytes = 1024
 	bodySize, ok := d["bodysize"]
@@ -146,6 +229,47 @@ func (d Document) SetChannels(channels []string) {
 	d["channels"] = channels
 }
 
+// The tombstones which delete the docs at their current revisions
+func newTombstones(docs []DocumentMetadata) []Document {
+	tombstones := []Document{}
+	for _, doc := range docs {
+		tombstone := Document{}
+		tombstone.SetId(doc.Id)
+		tombstone.SetRevision(doc.Revision)
+		tombstone.SetChannels(doc.Channels)
+		tombstone.SetKeyspace(doc.Keyspace)
+		tombstone["_deleted"] = true
+		tombstone["deleted_at"] = time.Now().Format(time.RFC3339Nano)
+		tombstones = append(tombstones, tombstone)
+	}
+	return tombstones
+}
+
+// Whether the doc is a tombstone, as returned by _bulk_get
+func isTombstone(doc sgreplicate.Document) bool {
+	deleted, _ := doc.Body["_deleted"].(bool)
+	return deleted
+}
+
+// The keyspace the doc is written to is kept in its body (unless it's the default
+// collection), so that readers can check it came from the right changes feed
+func (d Document) SetKeyspace(keyspace Keyspace) {
+	if keyspace.IsDefault() {
+		delete(d, "keyspace")
+		return
+	}
+	d["keyspace"] = keyspace.String()
+}
+
+func (d Document) Keyspace() Keyspace {
+	keyspaceName, ok := d["keyspace"].(string)
+	if !ok {
+		return Keyspace{}
+	}
+	keyspace, _ := ParseKeyspace(keyspaceName)
+	return keyspace
+}
+
 type Change interface{} // TODO: spec this out further
 
 type BulkDocs struct {
@@ -174,22 +298,45 @@ func (d Document) channelNames() []string {
 	return channelNames
 }
 
-func docsMustBeInExpectedChannels(docs []sgreplicate.Document, expectedChannels []string) {
+// Readers check that the docs they pull are in at least one of their channels.  Docs
+// can be in other channels as well, if there's more than one channel per doc.
+func docsMustBeInExpectedChannels(docs []sgreplicate.Document, expectedChannels []string) error {
 
 	for _, doc := range docs {
 		channels := doc.Body.ChannelNames()
+		inExpectedChannel := false
 		for _, channel := range channels {
-			if !containedIn(channel, expectedChannels) {
-				panic(
-					fmt.Sprintf("Doc %v has channel %v which is not in expected channels: %v",
-						docs,
-						channel,
-						expectedChannels,
-					),
-				)
+			if containedIn(channel, expectedChannels) {
+				inExpectedChannel = true
+				break
 			}
 		}
+		if !inExpectedChannel {
+			return fmt.Errorf("Doc %v has channels %v, none of which are in expected channels: %v",
+				doc.Body,
+				channels,
+				expectedChannels,
+			)
+		}
+	}
+	return nil
+
+}
+
+// Readers check that the docs on a keyspace's changes feed were written to it
+func docsMustBeInKeyspace(docs []sgreplicate.Document, keyspace Keyspace) error {
+
+	expected := ""
+	if !keyspace.IsDefault() {
+		expected = keyspace.String()
+	}
+	for _, doc := range docs {
+		docKeyspace, _ := doc.Body["keyspace"].(string)
+		if docKeyspace != expected {
+			return fmt.Errorf("Doc %v was written to keyspace %q, but is on the changes feed of %v", doc.Body["_id"], docKeyspace, keyspace)
+		}
 	}
+	return nil
 
 }
 
@@ -0,0 +1,67 @@
+package sgload
+
+import (
+	"sync"
+)
+
+const (
+	USER_PREFIX_DELETER = "deleter"
+)
+
+type DeleteLoadRunner struct {
+	LoadRunner
+	DeleteLoadSpec DeleteLoadSpec
+}
+
+// Create the deleters, which all receive the docs to delete from docsToDelete, and
+// don't purge any tombstones until readersFinished is done
+func (dlr DeleteLoadRunner) createDeleters(wg *sync.WaitGroup, docsToDelete <-chan []DocumentMetadata, readersFinished *sync.WaitGroup) []*Deleter {
+
+	deleters := []*Deleter{}
+
+	for userId := 0; userId < dlr.DeleteLoadSpec.NumDeleters; userId++ {
+		userCred := dlr.LoadSpec.generateUserCred(userId, USER_PREFIX_DELETER)
+		deleter := dlr.newDeleter(userId, userCred, wg, docsToDelete)
+		deleter.ReadersFinished = readersFinished
+		deleters = append(deleters, deleter)
+	}
+
+	return deleters
+
+}
+
+// Create a deleter with its own data store, which will delete the docs it receives
+// on docsToDelete and call wg.Done() once it has finished
+func (dlr DeleteLoadRunner) newDeleter(userId int, userCred UserCred, wg *sync.WaitGroup, docsToDelete <-chan []DocumentMetadata) *Deleter {
+
+	dataStore := dlr.createDataStore()
+	dataStore.SetUserCreds(userCred)
+
+	deleter := NewDeleter(
+		AgentSpec{
+			FinishedWg:              wg,
+			UserCred:                userCred,
+			ID:                      userId,
+			DataStore:               dataStore,
+			BatchSize:               dlr.LoadSpec.BatchSize,
+			ExpvarProgressEnabled:   dlr.LoadSpec.ExpvarProgressEnabled,
+			MaxConcurrentCreateUser: maxConcurrentCreateUser,
+			Errors:                  dlr.Errors,
+			DrainTimeout:            dlr.LoadSpec.DrainTimeout,
+			OpenEnded:               dlr.LoadSpec.OpenEnded(),
+			Keyspaces:               dlr.LoadSpec.keyspaces(),
+		},
+		DeleterSpec{
+			BatchSize:           dlr.LoadSpec.BatchSize,
+			DelayBetweenDeletes: dlr.DeleteLoadSpec.DelayBetweenDeletes,
+			PurgeTombstones:     dlr.DeleteLoadSpec.PurgeTombstones,
+		},
+		docsToDelete,
+	)
+	deleter.SetMetricsSink(dlr.Metrics)
+	deleter.SetCreateUserSemaphore(createUserSemaphore)
+	wg.Add(1)
+
+	return deleter
+
+}
@@ -0,0 +1,36 @@
+package sgload
+
+import (
+	"log"
+	"time"
+)
+
+type DeleteLoadSpec struct {
+	LoadSpec            `yaml:"-"`
+	NumDeleters         int           `yaml:"num_deleters"`          // The number of deleter goroutines, which delete each doc once it has had all its revisions
+	DelayBetweenDeletes time.Duration `yaml:"delay_between_deletes"` // Delay between deletes (subtracting out the time they are blocked during the delete)
+	PurgeTombstones     bool          `yaml:"purge_tombstones"`      // Purge the docs via the admin port once the readers have seen their tombstones
+}
+
+func (dls DeleteLoadSpec) Validate() error {
+	if err := dls.LoadSpec.Validate(); err != nil {
+		return err
+	}
+	if dls.NumDeleters < 0 {
+		return fieldError("delete.num_deleters", "NumDeleters must not be negative")
+	}
+	if dls.DelayBetweenDeletes < 0 {
+		return fieldError("delete.delay_between_deletes", "DelayBetweenDeletes must not be negative")
+	}
+	if dls.PurgeTombstones && dls.NumDeleters == 0 {
+		return fieldError("delete.purge_tombstones", "Needs deleters, since only the docs they delete are purged")
+	}
+	return nil
+}
+
+// Validate this spec or panic
+func (dls DeleteLoadSpec) MustValidate() {
+	if err := dls.Validate(); err != nil {
+		log.Panicf("Invalid DeleteLoadSpec: %+v. Error: %v", dls, err)
+	}
+}
@@ -0,0 +1,343 @@
+package sgload
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// How many times a deleter tries to delete a doc before it gives up on it
+	maxDeleteAttempts = 5
+)
+
+type DeleterSpec struct {
+	BatchSize           int           // How many docs to delete per bulk_docs request
+	DelayBetweenDeletes time.Duration // Delay between deletes (subtracting out the time they are blocked during the delete)
+	PurgeTombstones     bool          // Whether to purge the docs once they've been deleted
+}
+
+// Deletes the docs it receives once they've had all their revisions (from the writers,
+// or the updaters if there are any), leaving tombstones which the readers verify.  If
+// PurgeTombstones is set, it then purges them, which is what compaction eventually
+// does to tombstones on a real Sync Gateway.
+type Deleter struct {
+	Agent
+	DeleterSpec
+
+	DocsToDelete    <-chan []DocumentMetadata // The docs that are ready to be deleted.  The deleter finishes once this is closed and they've all been deleted
+	ReadersFinished *sync.WaitGroup           // If set, tombstones aren't purged until the readers have finished, so that they've seen them first
+
+	pending        []DocumentMetadata    // Docs received which haven't been deleted yet
+	tombstones     map[Keyspace][]string // The IDs of the deleted docs which are still to be purged
+	failedAttempts map[keyspaceDocID]int // How many times each pending doc has failed to be deleted
+	numDocsDeleted int
+	numDocsFailed  int
+}
+
+// A doc ID in a keyspace, since docs in different collections can have the same ID
+type keyspaceDocID struct {
+	Keyspace Keyspace
+	Id       string
+}
+
+func NewDeleter(agentSpec AgentSpec, spec DeleterSpec, docsToDelete <-chan []DocumentMetadata) *Deleter {
+
+	deleter := &Deleter{
+		Agent: Agent{
+			AgentSpec: agentSpec,
+		},
+		DeleterSpec:    spec,
+		DocsToDelete:   docsToDelete,
+		tombstones:     map[Keyspace][]string{},
+		failedAttempts: map[keyspaceDocID]int{},
+	}
+
+	deleter.setupExpVarStats(deletersProgressStats)
+
+	return deleter
+
+}
+
+// Main loop of deleter goroutine.  Runs until DocsToDelete is closed and all the docs
+// received on it have been deleted (and purged, if PurgeTombstones is set), or ctx
+// is done.
+func (d *Deleter) Run(ctx context.Context) {
+
+	defer d.FinishedWg.Done()
+
+	requestCtx, cancelRequests := d.requestContext(ctx)
+	defer cancelRequests()
+
+	if err := d.createSGUserIfNeeded(requestCtx, []string{"*"}); err != nil {
+		d.reportError("create_user", err)
+		return
+	}
+
+	for {
+		if ctx.Err() != nil {
+			logger.Info("Deleter stopped", "agent.ID", d.ID, "numdocs", d.numDocsDeleted)
+			return
+		}
+
+		if len(d.pending) == 0 {
+			if d.DocsToDelete == nil {
+				break
+			}
+			select {
+			case docs, ok := <-d.DocsToDelete:
+				if !ok {
+					// No more docs are coming, so the deleter is done once it's purged
+					d.DocsToDelete = nil
+					continue
+				}
+				d.pending = append(d.pending, docs...)
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		batch, rest := nextDeleteBatch(d.pending, d.BatchSize)
+
+		timeBeforeDelete := time.Now()
+		deleted, failed, err := d.deleteDocs(requestCtx, batch)
+		timeBlockedDuringDelete := time.Since(timeBeforeDelete)
+		if err != nil && requestCtx.Err() != nil {
+			logger.Info("Deleter stopped during delete", "agent.ID", d.ID)
+			return
+		}
+
+		// The docs that failed stay pending, to be tried again, unless they've failed too
+		// many times already
+		retryable, abort := d.retryable(failed)
+		d.pending = append(rest, retryable...)
+		d.recordDeleted(deleted)
+		if abort {
+			return
+		}
+		if err == nil && d.PurgeTombstones && d.OpenEnded {
+			// Readers don't wait for tombstones in an open-ended run, so purge them straight away
+			err = d.purgeTombstones(requestCtx)
+		}
+
+		if err != nil {
+			if d.reportError("delete", err) {
+				return
+			}
+		} else {
+			d.Errors.RecordSuccess()
+		}
+
+		d.maybeDelayBetweenDeletes(ctx, timeBlockedDuringDelete)
+
+	}
+
+	logger.Info("Deleter finished deleting", "agent.ID", d.ID, "numdocs", d.numDocsDeleted, "numfailed", d.numDocsFailed)
+
+	if !d.PurgeTombstones {
+		return
+	}
+
+	if d.ReadersFinished != nil && !waitContext(ctx, d.ReadersFinished) {
+		logger.Info("Deleter stopped before purging", "agent.ID", d.ID)
+		return
+	}
+	if err := d.purgeTombstones(requestCtx); err != nil {
+		d.reportError("purge", err)
+		return
+	}
+	logger.Info("Deleter finished purging", "agent.ID", d.ID, "numdocs", d.numDocsDeleted)
+
+}
+
+// The next docs to delete with one request, which all have to be in the same keyspace
+// as the first, and the docs that are left
+func nextDeleteBatch(pending []DocumentMetadata, batchSize int) (batch, rest []DocumentMetadata) {
+
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	batch = []DocumentMetadata{}
+	rest = []DocumentMetadata{}
+	for _, doc := range pending {
+		if len(batch) < batchSize && doc.Keyspace == pending[0].Keyspace {
+			batch = append(batch, doc)
+		} else {
+			rest = append(rest, doc)
+		}
+	}
+	return batch, rest
+
+}
+
+// Delete the docs, and return the ones that were deleted and the ones that weren't,
+// along with an error if any of them weren't.  A doc that conflicts counts as deleted,
+// since the only revision that can have replaced the one the deleter was given is a
+// tombstone: typically its own, from an earlier attempt whose response was lost.
+func (d *Deleter) deleteDocs(ctx context.Context, docs []DocumentMetadata) (deleted, failed []DocumentMetadata, err error) {
+
+	keyspace := docs[0].Keyspace
+	dataStore, err := d.keyspaceDataStore(keyspace)
+	if err != nil {
+		return nil, docs, err
+	}
+
+	results, err := dataStore.DeleteDocuments(ctx, docs)
+	if err != nil {
+		return nil, docs, err
+	}
+
+	deleted, failedResults := splitSucceededAndFailed(results)
+	conflicts := []DocumentMetadata{}
+	for _, result := range failedResults {
+		if isAlreadyDeleted(result) {
+			conflicts = append(conflicts, result)
+		}
+	}
+	if len(conflicts) > 0 {
+		failedResults = filterDocMetadataExcluding(failedResults, conflicts)
+		deleted = append(deleted, filterDocMetadataIncluding(docs, conflicts)...)
+	}
+	for i := range deleted {
+		deleted[i].Keyspace = keyspace
+	}
+	failed = filterDocMetadataIncluding(docs, failedResults)
+	if len(deleted)+len(failed) != len(docs) {
+		// Any docs missing from the response weren't deleted either
+		failed = filterDocMetadataExcluding(docs, deleted)
+	}
+	if len(failed) > 0 {
+		err = fmt.Errorf("Error deleting %d of %d docs, eg %s: %s", len(failed), len(docs), failed[0].Id, firstError(failedResults))
+	}
+	return deleted, failed, err
+
+}
+
+// Whether a doc's result from _bulk_docs says it's already been deleted
+func isAlreadyDeleted(result DocumentMetadata) bool {
+	return result.Status == http.StatusConflict || result.Error == "conflict" || result.Reason == "deleted"
+}
+
+// The failed docs which are to be tried again.  The ones that have failed
+// maxDeleteAttempts times are given up on, and counted and reported as failed: the
+// readers wait for their tombstones, which will never come, so the error budget has
+// to be what stops the run.  Returns true if the deleter should stop.
+func (d *Deleter) retryable(failed []DocumentMetadata) (retryable []DocumentMetadata, abort bool) {
+	retryable = []DocumentMetadata{}
+	numGivenUp := 0
+	for _, doc := range failed {
+		key := keyspaceDocID{Keyspace: doc.Keyspace, Id: doc.Id}
+		d.failedAttempts[key]++
+		if d.failedAttempts[key] < maxDeleteAttempts {
+			retryable = append(retryable, doc)
+			continue
+		}
+		delete(d.failedAttempts, key)
+		numGivenUp++
+		if d.reportError("delete", fmt.Errorf("Gave up deleting doc %s after %d attempts", doc.Id, maxDeleteAttempts)) {
+			abort = true
+		}
+	}
+	d.numDocsFailed += numGivenUp
+	d.ExpVarStats.Add("NumDocsFailed", int64(numGivenUp))
+	globalProgressStats.Add("TotalNumDocsFailed", int64(numGivenUp))
+	return retryable, abort
+}
+
+func (d *Deleter) recordDeleted(deleted []DocumentMetadata) {
+	for _, doc := range deleted {
+		delete(d.failedAttempts, keyspaceDocID{Keyspace: doc.Keyspace, Id: doc.Id})
+		d.tombstones[doc.Keyspace] = append(d.tombstones[doc.Keyspace], doc.Id)
+	}
+	d.numDocsDeleted += len(deleted)
+	d.ExpVarStats.Add("NumDocsDeleted", int64(len(deleted)))
+	globalProgressStats.Add("TotalNumDocsDeleted", int64(len(deleted)))
+}
+
+// Purge the tombstones of the docs deleted so far, in batches
+func (d *Deleter) purgeTombstones(ctx context.Context) error {
+
+	for keyspace, docIds := range d.tombstones {
+
+		dataStore, err := d.keyspaceDataStore(keyspace)
+		if err != nil {
+			return err
+		}
+
+		for len(docIds) > 0 {
+			batchSize := d.BatchSize
+			if batchSize <= 0 || batchSize > len(docIds) {
+				batchSize = len(docIds)
+			}
+			if err := dataStore.PurgeDocuments(ctx, docIds[:batchSize]); err != nil {
+				d.tombstones[keyspace] = docIds
+				return err
+			}
+			d.ExpVarStats.Add("NumDocsPurged", int64(batchSize))
+			globalProgressStats.Add("TotalNumDocsPurged", int64(batchSize))
+			docIds = docIds[batchSize:]
+		}
+		delete(d.tombstones, keyspace)
+	}
+	return nil
+
+}
+
+func (d *Deleter) maybeDelayBetweenDeletes(ctx context.Context, timeBlockedDuringDelete time.Duration) {
+
+	timeToSleep := d.DelayBetweenDeletes - timeBlockedDuringDelete
+	if timeToSleep > time.Duration(0) {
+		sleepContext(ctx, timeToSleep)
+	}
+
+}
+
+// Filter docs and only include the ones in docsToInclude
+func filterDocMetadataIncluding(docs []DocumentMetadata, docsToInclude []DocumentMetadata) []DocumentMetadata {
+	filteredSet := []DocumentMetadata{}
+	for _, doc := range docs {
+		for _, docToInclude := range docsToInclude {
+			if doc.Id == docToInclude.Id {
+				filteredSet = append(filteredSet, doc)
+				break
+			}
+		}
+	}
+	return filteredSet
+}
+
+// Filter docs and leave out the ones in docsToExclude
+func filterDocMetadataExcluding(docs []DocumentMetadata, docsToExclude []DocumentMetadata) []DocumentMetadata {
+	filteredSet := []DocumentMetadata{}
+	for _, doc := range docs {
+		if len(filterDocMetadataIncluding([]DocumentMetadata{doc}, docsToExclude)) == 0 {
+			filteredSet = append(filteredSet, doc)
+		}
+	}
+	return filteredSet
+}
+
+func firstError(results []DocumentMetadata) string {
+	if len(results) == 0 {
+		return "missing from response"
+	}
+	return fmt.Sprintf("%s %s", results[0].Error, results[0].Reason)
+}
+
+// Wait for the wait group, unless ctx is done first.  Returns false if it didn't wait.
+func waitContext(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
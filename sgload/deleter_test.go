@@ -0,0 +1,192 @@
+package sgload
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/couchbaselabs/sgload/sgsimulator"
+)
+
+func TestNextDeleteBatch(t *testing.T) {
+
+	airline := Keyspace{Scope: "inventory", Collection: "airline"}
+	pending := []DocumentMetadata{
+		{Keyspace: airline},
+		{},
+		{Keyspace: airline},
+		{Keyspace: airline},
+	}
+	for i := range pending {
+		pending[i].Id = string(rune('a' + i))
+	}
+
+	// Only docs in the same keyspace as the first go in the batch
+	batch, rest := nextDeleteBatch(pending, 2)
+	if len(batch) != 2 || batch[0].Id != "a" || batch[1].Id != "c" {
+		t.Fatalf("Unexpected batch: %+v", batch)
+	}
+	if len(rest) != 2 || rest[0].Id != "b" || rest[1].Id != "d" {
+		t.Fatalf("Unexpected rest: %+v", rest)
+	}
+
+	batch, rest = nextDeleteBatch(rest, 0)
+	if len(batch) != 1 || batch[0].Id != "b" || len(rest) != 1 {
+		t.Fatalf("Expected a batch size of 0 to delete one doc at a time, got %+v, %+v", batch, rest)
+	}
+
+}
+
+// Deleted docs show up as tombstones on the changes feed and from _bulk_get, which
+// readers accept at the last generation when there are deleters, and purging removes
+// them altogether
+func TestDeleteAndPurgeDocuments(t *testing.T) {
+
+	_, dataStore, cleanup := newSimulatorDataStore(t, sgsimulator.FaultConfig{})
+	defer cleanup()
+
+	ctx := context.Background()
+	userCreds := UserCred{Username: "deleter", Password: "password"}
+	if err := dataStore.CreateUser(ctx, userCreds, []string{"*"}); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	dataStore.SetUserCreds(userCreds)
+
+	created, err := dataStore.BulkCreateDocuments(ctx, docsToWrite("doc", 3, []string{"ABC"}), true)
+	if err != nil || len(created) != 3 {
+		t.Fatalf("Error creating docs: %+v, %v", created, err)
+	}
+	deleted, err := dataStore.DeleteDocuments(ctx, created)
+	if err != nil || len(deleted) != 3 {
+		t.Fatalf("Error deleting docs: %+v, %v", deleted, err)
+	}
+
+	changes, _, err := dataStore.Changes(ctx, StringSincer{}, 0, FEED_TYPE_NORMAL)
+	if err != nil || len(changes.Results) != 3 {
+		t.Fatalf("Expected the 3 tombstones on the changes feed, got %+v, %v", changes.Results, err)
+	}
+	bulkGetRequest, _, err := createBulkGetRequest(changes)
+	if err != nil {
+		t.Fatalf("Error creating bulk get request: %v", err)
+	}
+	docs, err := dataStore.BulkGetDocuments(ctx, bulkGetRequest)
+	if err != nil {
+		t.Fatalf("Error getting docs: %v", err)
+	}
+
+	reader := NewReader(AgentSpec{})
+	reader.SetNumRevGenerationsExpected(2)
+	if _, err := reader.verifyTombstones(changes, docs); err == nil {
+		t.Fatalf("Expected an error for tombstones when there are no deleters")
+	}
+	reader.SetExpectTombstones(true)
+	numTombstones, err := reader.verifyTombstones(changes, docs)
+	if err != nil || numTombstones != 3 {
+		t.Fatalf("Expected 3 valid tombstones, got %d, %v", numTombstones, err)
+	}
+	reader.SetNumRevGenerationsExpected(3)
+	if _, err := reader.verifyTombstones(changes, docs); err == nil {
+		t.Fatalf("Expected an error for docs deleted before their last generation")
+	}
+
+	// Deleting them again, as a deleter does when the response to its first attempt
+	// is lost, conflicts with the tombstones
+	results, err := dataStore.DeleteDocuments(ctx, created)
+	if err != nil || len(results) != 3 || !isAlreadyDeleted(results[0]) {
+		t.Fatalf("Expected deleting the docs again to conflict, got %+v, %v", results, err)
+	}
+
+	docIds := []string{}
+	for _, doc := range deleted {
+		docIds = append(docIds, doc.Id)
+	}
+	if err := dataStore.PurgeDocuments(ctx, docIds); err != nil {
+		t.Fatalf("Error purging docs: %v", err)
+	}
+	if numDocs := numDocsInChanges(t, dataStore); numDocs != 0 {
+		t.Fatalf("Expected purged docs to be gone from the changes feed, got %d", numDocs)
+	}
+
+}
+
+// A data store whose deletes conflict for some docs and fail for others
+type faultyDeleteDataStore struct {
+	MockDataStore
+	conflictIds map[string]bool
+	failIds     map[string]bool
+	attempts    map[string]int
+}
+
+func (f *faultyDeleteDataStore) DeleteDocuments(ctx context.Context, docs []DocumentMetadata) ([]DocumentMetadata, error) {
+	results := []DocumentMetadata{}
+	for _, doc := range docs {
+		f.attempts[doc.Id]++
+		result := DocumentMetadata{}
+		result.Id = doc.Id
+		switch {
+		case f.conflictIds[doc.Id]:
+			result.Status, result.Error, result.Reason = http.StatusConflict, "conflict", "Document revision conflict"
+		case f.failIds[doc.Id]:
+			result.Status, result.Error, result.Reason = http.StatusInternalServerError, "Internal Server Error", "Injected fault"
+		default:
+			result.Revision = "2-deleted"
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// A doc that conflicts counts as deleted, and one that keeps failing is given up on
+// after maxDeleteAttempts and counted and reported as failed, rather than tried forever
+func TestDeleterGivesUpOnFailedDeletes(t *testing.T) {
+
+	dataStore := &faultyDeleteDataStore{
+		conflictIds: map[string]bool{"conflict": true},
+		failIds:     map[string]bool{"fail": true},
+		attempts:    map[string]int{},
+	}
+	docsToDelete := make(chan []DocumentMetadata, 1)
+	docs := []DocumentMetadata{}
+	for _, docId := range []string{"ok", "conflict", "fail"} {
+		doc := DocumentMetadata{}
+		doc.Id, doc.Revision = docId, "1-abc"
+		docs = append(docs, doc)
+	}
+	docsToDelete <- docs
+	close(docsToDelete)
+
+	numFailedBefore := expvarInt("TotalNumDocsFailed")
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	errorCollector := NewErrorCollector(ErrorBudget{MaxErrors: -1})
+	deleter := NewDeleter(AgentSpec{FinishedWg: wg, DataStore: dataStore, Errors: errorCollector}, DeleterSpec{BatchSize: 3}, docsToDelete)
+	deleter.Run(context.Background())
+
+	if deleter.numDocsDeleted != 2 || deleter.numDocsFailed != 1 {
+		t.Fatalf("Expected 2 docs deleted and 1 failed, got %d and %d", deleter.numDocsDeleted, deleter.numDocsFailed)
+	}
+	if dataStore.attempts["ok"] != 1 || dataStore.attempts["conflict"] != 1 || dataStore.attempts["fail"] != maxDeleteAttempts {
+		t.Fatalf("Expected the failing doc to be tried %d times and the others once, got %v", maxDeleteAttempts, dataStore.attempts)
+	}
+	if numFailed := expvarInt("TotalNumDocsFailed") - numFailedBefore; numFailed != 1 {
+		t.Fatalf("Expected TotalNumDocsFailed to go up by 1, got %d", numFailed)
+	}
+	if err := errorCollector.Err(); err == nil || !strings.Contains(err.Error(), "Gave up deleting doc fail") {
+		t.Fatalf("Expected the doc given up on to be reported, got %v", err)
+	}
+	if len(deleter.tombstones[Keyspace{}]) != 2 {
+		t.Fatalf("Expected the deleted and conflicting docs to be purgeable, got %v", deleter.tombstones)
+	}
+
+}
+
+func expvarInt(name string) int64 {
+	if value, ok := globalProgressStats.Get(name).(*expvar.Int); ok {
+		return value.Value()
+	}
+	return 0
+}
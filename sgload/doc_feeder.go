@@ -1,6 +1,7 @@
 package sgload
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"time"
@@ -11,21 +12,32 @@ import (
 type DocumentMetadata struct {
 	sgreplicate.DocumentRevisionPair
 	Channels []string
+	Keyspace Keyspace // The collection the doc was written to
 }
 
-// Assigns docs to channels with as even of a distribution as possible.
-func assignDocsToChannels(docsToWrite []Document, channelToDocMapping []uint16, channelNames []string) {
+// Assigns docs to their channels in the channel layout.  Each writer has its own
+// approxDocsPerWriter docs of the layout, and when it goes past the end of them
+// (open-ended runs), it wraps around.
+func assignDocsToChannels(docsToWrite []Document, channelLayout *ChannelLayout, writerID, approxDocsPerWriter int) {
 
 	for _, doc := range docsToWrite {
 		perWriterDocCounter := doc["per_writer_doc_counter"].(int)
-		channelIndex := channelToDocMapping[perWriterDocCounter]
-		channelName := channelNames[channelIndex]
-		doc["channels"] = []string{channelName}
+		docIndex := writerID*approxDocsPerWriter + perWriterDocCounter%approxDocsPerWriter
+		doc["channels"] = channelLayout.channelsOfDoc(docIndex)
 	}
 
 }
 
-func createDocsToWrite(writerUsername string, docIdOffset, numDocs, docSizeBytes int, docIdSuffix string) []Document {
+// Puts all the docs in the keyspace.  The doc feeder gives each batch of docs to the next
+// keyspace in turn, so the docs are spread evenly across them but no write spans two.
+func assignDocsToKeyspace(docsToWrite []Document, keyspace Keyspace) {
+	for _, doc := range docsToWrite {
+		doc.SetKeyspace(keyspace)
+	}
+}
+
+// Create the docs with bodies from the doc generator, if there is one
+func createDocsToWrite(writerUsername string, docIdOffset, numDocs, docSizeBytes int, docIdSuffix string, docGenerator DocGenerator, rng *rand.Rand) []Document {
 
 	var d Document
 	docs := []Document{}
@@ -43,6 +55,9 @@ func createDocsToWrite(writerUsername string, docIdOffset, numDocs, docSizeBytes
 		d["per_writer_doc_counter"] = perWriterDocCounter
 		d["bodysize"] = docSizeBytes
 		d["created_at"] = time.Now().Format(time.RFC3339Nano)
+		if docGenerator != nil {
+			d["body"] = docGenerator.GenerateBody(rng, docSizeBytes)
+		}
 		docs = append(docs, Document(d))
 	}
 	return docs
@@ -135,39 +150,55 @@ func breakIntoBatchesCount(batchSize int, totalNum int) (batches []int) {
 
 }
 
-func feedDocsToWriter(writer *Writer, wls WriteLoadSpec, approxDocsPerWriter int, channelNames []string) error {
+func feedDocsToWriter(ctx context.Context, writer *Writer, wls WriteLoadSpec, approxDocsPerWriter int, channelLayout *ChannelLayout) error {
 
 	logger.Debug("Feeding docs to writer", "writer", writer.UserCred.Username)
 
-	channelToDocMapping := getChannelToDocMapping(approxDocsPerWriter, channelNames)
+	rng := wls.agentRand(USER_PREFIX_WRITER, writer.ID)
 
 	docIdOffset := 0
+	keyspaces := writer.keyspaces()
+	numBatchesFed := 0
 
 	// loop over approxDocsPerWriter and push batchSize docs until
-	// no more docs left to push
+	// no more docs left to push.  In an open-ended run, keep doing
+	// that in rounds until the run is stopped.
 	docBatches := breakIntoBatchesCount(writer.BatchSize, approxDocsPerWriter)
-	for _, docBatch := range docBatches {
-
-		// Create Documents
-		docsToWrite := createDocsToWrite(
-			writer.UserCred.Username,
-			docIdOffset,
-			docBatch,
-			wls.DocSizeBytes,
-			wls.TestSessionID,
-		)
-
-		// Assign Docs to Channels (adds doc["channels"] field to each doc)
-		assignDocsToChannels(
-			docsToWrite,
-			channelToDocMapping,
-			channelNames,
-		)
-
-		writer.AddToDataStore(docsToWrite)
+	for round := 0; round == 0 || wls.OpenEnded(); round++ {
+		for _, docBatch := range docBatches {
+
+			// Create Documents
+			docsToWrite := createDocsToWrite(
+				writer.UserCred.Username,
+				docIdOffset,
+				docBatch,
+				wls.DocSizeBytes,
+				wls.TestSessionID,
+				writer.DocGenerator,
+				rng,
+			)
+
+			// Assign Docs to Channels (adds doc["channels"] field to each doc)
+			assignDocsToChannels(
+				docsToWrite,
+				channelLayout,
+				writer.ID,
+				approxDocsPerWriter,
+			)
+
+			assignDocsToKeyspace(
+				docsToWrite,
+				keyspaces[numBatchesFed%len(keyspaces)],
+			)
+
+			if err := writer.AddToDataStore(ctx, docsToWrite); err != nil {
+				return err
+			}
 
-		docIdOffset += docBatch
+			docIdOffset += docBatch
+			numBatchesFed += 1
 
+		}
 	}
 
 	// Send terminal docs which will shutdown writers after they've
@@ -175,9 +206,7 @@ func feedDocsToWriter(writer *Writer, wls WriteLoadSpec, approxDocsPerWriter int
 	logger.Debug("Feeding terminal doc to writer", "writer", writer.Agent.UserCred.Username)
 	d := Document{}
 	d["_terminal"] = true
-	writer.AddToDataStore([]Document{d})
-
-	return nil
+	return writer.AddToDataStore(ctx, []Document{d})
 
 }
 
@@ -185,7 +214,7 @@ func feedDocsToWriter(writer *Writer, wls WriteLoadSpec, approxDocsPerWriter int
 // in an efficient manner.  The length of the returned slice is equal to the number
 // of docs in the docset, and contains the index of the channel the doc belongs in
 // (docs can only be in exactly one channel)
-func getChannelToDocMapping(approxDocsPerWriter int, channelNames []string) []uint16 {
+func getChannelToDocMapping(numDocs int, channelNames []string, rng *rand.Rand) []uint16 {
 
 	// Prevent integer overflow on the uint16 based channel indexes
 	if len(channelNames) > 65535 {
@@ -193,26 +222,26 @@ func getChannelToDocMapping(approxDocsPerWriter int, channelNames []string) []ui
 	}
 
 	// Make sure number docs divide into channels evenly
-	remainder := approxDocsPerWriter % len(channelNames)
+	remainder := numDocs % len(channelNames)
 	if remainder != 0 {
-		panic(fmt.Sprintf("Numdocs (%d) does not divide into num channels evenly (%d)", approxDocsPerWriter, len(channelNames)))
+		panic(fmt.Sprintf("Numdocs (%d) does not divide into num channels evenly (%d)", numDocs, len(channelNames)))
 	}
 
-	desiredNumDocsPerChannel := approxDocsPerWriter / len(channelNames)
+	desiredNumDocsPerChannel := numDocs / len(channelNames)
 	logger.Debug(fmt.Sprintf("Desired num docs per channel: %d", desiredNumDocsPerChannel))
 
 	docsPerChannel := map[int]int{}
 
-	channelToDocMapping := make([]uint16, approxDocsPerWriter)
+	channelToDocMapping := make([]uint16, numDocs)
 
-	for docIndex := 0; docIndex < approxDocsPerWriter; docIndex += 1 {
+	for docIndex := 0; docIndex < numDocs; docIndex += 1 {
 
 		foundChannel := false
 		chanIndex := -1
 
 		for {
 
-			chanIndex = rand.Intn(len(channelNames))
+			chanIndex = rng.Intn(len(channelNames))
 
 			numDocsInChannelSoFar := docsPerChannel[chanIndex]
 
@@ -1,9 +1,16 @@
 package sgload
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestBreakIntoBatches(t *testing.T) {
@@ -104,12 +111,13 @@ func TestFeedDocsToWriter(t *testing.T) {
 	bufChanSize += 1 // terminal doc
 	writer.OutboundDocs = make(chan []Document, bufChanSize)
 
-	channelNames := []string{"ABC", "CBS"}
+	channelLayout := newChannelLayout(ChannelDistributionSpec{}, docsPerWriter, []string{"ABC", "CBS"}, rand.New(rand.NewSource(1)))
 	err := feedDocsToWriter(
+		context.Background(),
 		&writer,
 		writeLoadSpec,
 		docsPerWriter,
-		channelNames,
+		channelLayout,
 	)
 	if err != nil {
 		t.Fatalf("Got error trying to call feedDocsToWriter: %v", err)
@@ -125,6 +133,51 @@ func TestFeedDocsToWriter(t *testing.T) {
 
 }
 
+func TestFeedDocsToWriterOpenEnded(t *testing.T) {
+
+	writer := Writer{}
+	writeLoadSpec := WriteLoadSpec{}
+	writeLoadSpec.Duration = time.Hour
+	writeLoadSpec.TestSessionID = "test"
+
+	docsPerWriter := 10
+	writer.BatchSize = 5
+	writer.OutboundDocs = make(chan []Document)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	feedErr := make(chan error)
+	go func() {
+		feedErr <- feedDocsToWriter(
+			ctx,
+			&writer,
+			writeLoadSpec,
+			docsPerWriter,
+			newChannelLayout(ChannelDistributionSpec{}, docsPerWriter, []string{"ABC", "CBS"}, rand.New(rand.NewSource(1))),
+		)
+	}()
+
+	// Keep receiving docs past docsPerWriter, they should all be new docs
+	docIds := map[string]bool{}
+	for i := 0; i < 3*docsPerWriter/writer.BatchSize; i++ {
+		docSlice := <-writer.OutboundDocs
+		for _, doc := range docSlice {
+			if _, ok := doc["_terminal"]; ok {
+				t.Fatalf("Did not expect terminal doc in open-ended run")
+			}
+			if docIds[doc.Id()] {
+				t.Fatalf("Got doc %v more than once", doc.Id())
+			}
+			docIds[doc.Id()] = true
+		}
+	}
+
+	cancel()
+	if err := <-feedErr; err != context.Canceled {
+		t.Fatalf("Expected feedDocsToWriter to stop with context.Canceled, got: %v", err)
+	}
+
+}
+
 func TestGetChannelToDocMapping(t *testing.T) {
 	numDocs := 100
 	channelNames := []string{
@@ -134,7 +187,7 @@ func TestGetChannelToDocMapping(t *testing.T) {
 		"NBC",
 		"FOX",
 	}
-	channelToDocMapping := getChannelToDocMapping(numDocs, channelNames)
+	channelToDocMapping := getChannelToDocMapping(numDocs, channelNames, rand.New(rand.NewSource(1)))
 	if len(channelToDocMapping) != numDocs {
 		t.Fatalf("Got unexpected len of channelToDocMapping")
 	}
@@ -200,3 +253,76 @@ func absolute(n int) int {
 	}
 	return returnVal
 }
+
+func TestSeededAgentRand(t *testing.T) {
+
+	channelNames := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	loadSpec := LoadSpec{Seed: 42}
+
+	mapping := func(ls LoadSpec, writerID int) string {
+		return fmt.Sprint(getChannelToDocMapping(96, channelNames, ls.agentRand(USER_PREFIX_WRITER, writerID)))
+	}
+	layout := func(ls LoadSpec) string {
+		return fmt.Sprint(newChannelLayout(ChannelDistributionSpec{}, 96, channelNames, ls.channelLayoutRand()).docChannels)
+	}
+	subscriptions := func(ls LoadSpec, readerID int) string {
+		return fmt.Sprint(assignChannelsToReader(3, channelNames, ls.agentRand(USER_PREFIX_READER, readerID)))
+	}
+
+	if mapping(loadSpec, 1) != mapping(loadSpec, 1) {
+		t.Fatalf("Expected the same channel to doc mapping for the same seed and writer")
+	}
+	if mapping(loadSpec, 1) == mapping(loadSpec, 2) {
+		t.Fatalf("Expected a different channel to doc mapping for another writer")
+	}
+	if mapping(loadSpec, 1) == mapping(LoadSpec{Seed: 43}, 1) {
+		t.Fatalf("Expected a different channel to doc mapping for another seed")
+	}
+	if layout(loadSpec) != layout(loadSpec) {
+		t.Fatalf("Expected the same channel layout for the same seed")
+	}
+	if layout(LoadSpec{TestSessionID: "test"}) != layout(LoadSpec{TestSessionID: "test"}) {
+		t.Fatalf("Expected the same channel layout for the same test session ID without a seed")
+	}
+	if subscriptions(loadSpec, 1) != subscriptions(loadSpec, 1) {
+		t.Fatalf("Expected the same reader subscriptions for the same seed and reader")
+	}
+
+	// A template with enough keys that filling them in map order would almost always
+	// differ between two runs
+	templateFile := filepath.Join(t.TempDir(), "template.json")
+	template := `{"a": "{{name}}", "b": "{{int:1:1000}}", "c": "{{uuid}}", "d": "{{float:0:1}}", "e": "{{text:40}}", "f": "{{bool}}", "g": "{{enum:x|y|z}}", "h": "{{name}}", "placed_at": "{{timestamp}}"}`
+	if err := ioutil.WriteFile(templateFile, []byte(template), 0644); err != nil {
+		t.Fatalf("Error writing template: %v", err)
+	}
+	bodies := func(ls LoadSpec, spec DocGeneratorSpec) string {
+		docGenerator, err := spec.DocGenerator(ls.timestampEpoch())
+		if err != nil {
+			t.Fatalf("Error creating the %s doc generator: %v", spec.Type, err)
+		}
+		rng := ls.agentRand(USER_PREFIX_WRITER, 1)
+		bodyBytes, _ := json.Marshal([]interface{}{docGenerator.GenerateBody(rng, 1024), docGenerator.GenerateBody(rng, 1024)})
+		return string(bodyBytes)
+	}
+	for _, spec := range []DocGeneratorSpec{
+		{Type: DOC_GENERATOR_FILLER},
+		{Type: DOC_GENERATOR_RANDOM},
+		{Type: DOC_GENERATOR_NESTED},
+		{Type: DOC_GENERATOR_TEMPLATE, TemplateFile: templateFile},
+	} {
+		if bodies(loadSpec, spec) != bodies(loadSpec, spec) {
+			t.Fatalf("Expected the same %s bodies for the same seed and writer", spec.Type)
+		}
+	}
+	if !strings.Contains(bodies(loadSpec, DocGeneratorSpec{Type: DOC_GENERATOR_TEMPLATE, TemplateFile: templateFile}), `"placed_at":"2019-`) {
+		t.Fatalf("Expected the timestamps of a seeded run to be within the year before %v", seededTimestampEpoch)
+	}
+
+	if NewTestSessionID(42) != NewTestSessionID(42) {
+		t.Fatalf("Expected the same test session ID for the same seed")
+	}
+	if NewTestSessionID(0) == NewTestSessionID(0) {
+		t.Fatalf("Expected a random test session ID without a seed")
+	}
+
+}
@@ -0,0 +1,365 @@
+package sgload
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DOC_GENERATOR_FILLER   = "filler"   // Fields of 100 byte strings of "a", which compress very well.  The default.
+	DOC_GENERATOR_RANDOM   = "random"   // Fields of 100 byte random strings, which hardly compress at all
+	DOC_GENERATOR_NESTED   = "nested"   // An array of nested objects with mixed types, like a list of records in an app
+	DOC_GENERATOR_TEMPLATE = "template" // A JSON template with typed placeholders, like the docs of a real app
+)
+
+// Generates the bodies of the docs that writers create and updaters update.  The body goes
+// in the doc's "body" property, next to the properties sgload uses itself (eg, channels).
+type DocGenerator interface {
+
+	// Returns a body of roughly sizeBytes of JSON, using rng for anything random.  A
+	// template's body is the size the template makes it.
+	GenerateBody(rng *rand.Rand, sizeBytes int) interface{}
+}
+
+// Which kind of doc bodies to generate
+type DocGeneratorSpec struct {
+	Type         string `yaml:"type"`          // "filler" (the default), "random", "nested" or "template"
+	TemplateFile string `yaml:"template_file"` // The JSON template, for the template type.  See templateDocGenerator
+}
+
+func (dgs DocGeneratorSpec) Validate() error {
+
+	switch dgs.Type {
+	case "", DOC_GENERATOR_FILLER, DOC_GENERATOR_RANDOM, DOC_GENERATOR_NESTED:
+		if dgs.TemplateFile != "" {
+			return fieldError("load.doc_generator.template_file", "Only used with the %s type", DOC_GENERATOR_TEMPLATE)
+		}
+	case DOC_GENERATOR_TEMPLATE:
+		if dgs.TemplateFile == "" {
+			return fieldError("load.doc_generator.template_file", "Required for the %s type", DOC_GENERATOR_TEMPLATE)
+		}
+		if _, err := loadTemplateDocGenerator(dgs.TemplateFile); err != nil {
+			return fieldError("load.doc_generator.template_file", err.Error())
+		}
+	default:
+		return fieldError(
+			"load.doc_generator.type",
+			"Unknown doc generator %q.  Values: %s, %s, %s, %s",
+			dgs.Type,
+			DOC_GENERATOR_FILLER,
+			DOC_GENERATOR_RANDOM,
+			DOC_GENERATOR_NESTED,
+			DOC_GENERATOR_TEMPLATE,
+		)
+	}
+	return nil
+
+}
+
+// Create the doc generator, which for a template means loading it.  Timestamps in the
+// bodies are within the year before epoch.
+func (dgs DocGeneratorSpec) DocGenerator(epoch time.Time) (DocGenerator, error) {
+	switch dgs.Type {
+	case DOC_GENERATOR_RANDOM:
+		return randomDocGenerator{}, nil
+	case DOC_GENERATOR_NESTED:
+		return nestedDocGenerator{epoch: epoch}, nil
+	case DOC_GENERATOR_TEMPLATE:
+		docGenerator, err := loadTemplateDocGenerator(dgs.TemplateFile)
+		docGenerator.epoch = epoch
+		return docGenerator, err
+	default:
+		return fillerDocGenerator{}, nil
+	}
+}
+
+// The bodies sgload has always generated
+type fillerDocGenerator struct{}
+
+func (fillerDocGenerator) GenerateBody(rng *rand.Rand, sizeBytes int) interface{} {
+	return createBodyContentAsMapWithSize(sizeBytes)
+}
+
+// Like the filler bodies, but the strings are random, so compression doesn't shrink
+// them much more than it would the likes of encrypted or already compressed data
+type randomDocGenerator struct{}
+
+func (randomDocGenerator) GenerateBody(rng *rand.Rand, sizeBytes int) interface{} {
+	numEntries := int(sizeBytes/100) + 1
+	body := make(map[string]string, numEntries)
+	for i := 0; i < numEntries; i++ {
+		body[fmt.Sprintf("field_%d", i)] = randomString(rng, 100)
+	}
+	return body
+}
+
+// An array of records, each an object with strings, numbers, booleans, a nested object
+// and arrays, which is more like app data for parsing and compression than flat strings
+type nestedDocGenerator struct {
+	epoch time.Time // Timestamps are within the year before
+}
+
+func (g nestedDocGenerator) GenerateBody(rng *rand.Rand, sizeBytes int) interface{} {
+
+	records := []interface{}{}
+	size := 0
+	for size < sizeBytes {
+		record := map[string]interface{}{
+			"id":     rng.Int63(),
+			"name":   randomName(rng),
+			"active": rng.Intn(2) == 0,
+			"score":  rng.Float64() * 100,
+			"tags":   []string{randomWord(rng), randomWord(rng), randomWord(rng)},
+			"address": map[string]interface{}{
+				"street": fmt.Sprintf("%d %s Street", rng.Intn(1000)+1, randomWord(rng)),
+				"city":   randomWord(rng),
+				"geo":    []float64{rng.Float64()*180 - 90, rng.Float64()*360 - 180},
+			},
+			"history": []interface{}{
+				map[string]interface{}{"at": randomTimestamp(rng, g.epoch), "count": rng.Intn(100)},
+				map[string]interface{}{"at": randomTimestamp(rng, g.epoch), "count": rng.Intn(100)},
+			},
+		}
+		recordBytes, _ := json.Marshal(record)
+		size += len(recordBytes)
+		records = append(records, record)
+	}
+	return map[string]interface{}{"records": records}
+
+}
+
+// Fills in a JSON template, in which strings that are placeholders are replaced by a
+// value of their type, eg:
+//
+//	{
+//	  "type": "order",
+//	  "customer": {"name": "{{name}}", "vip": "{{bool}}"},
+//	  "placed_at": "{{timestamp}}",
+//	  "quantity": "{{int:1:10}}",
+//	  "total": "{{float:1:500}}",
+//	  "status": "{{enum:pending|shipped|delivered}}",
+//	  "notes": "{{text:200}}",
+//	  "ref": "{{uuid}}"
+//	}
+//
+// The placeholders are name, timestamp (RFC 3339, within the year before the run started,
+// or before a fixed date with a seed), int:min:max, float:min:max, enum:value|value|...,
+// bool, uuid and text:bytes (random words).  Numbers and booleans are JSON numbers and
+// booleans, not strings.
+type templateDocGenerator struct {
+	template interface{}
+	epoch    time.Time // Timestamps are within the year before
+}
+
+type templatePlaceholder struct {
+	kind     string
+	min, max float64
+	values   []string
+}
+
+func loadTemplateDocGenerator(path string) (templateDocGenerator, error) {
+
+	templateBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return templateDocGenerator{}, err
+	}
+	var raw interface{}
+	if err := json.Unmarshal(templateBytes, &raw); err != nil {
+		return templateDocGenerator{}, fmt.Errorf("Invalid JSON in %s: %v", path, err)
+	}
+	template, err := parseTemplate(raw)
+	if err != nil {
+		return templateDocGenerator{}, fmt.Errorf("Invalid template %s: %v", path, err)
+	}
+	return templateDocGenerator{template: template}, nil
+
+}
+
+// Replace the placeholder strings in the template with templatePlaceholders, so they
+// only need parsing once
+func parseTemplate(raw interface{}) (interface{}, error) {
+	switch value := raw.(type) {
+	case map[string]interface{}:
+		parsed := make(map[string]interface{}, len(value))
+		for key, child := range value {
+			parsedChild, err := parseTemplate(child)
+			if err != nil {
+				return nil, err
+			}
+			parsed[key] = parsedChild
+		}
+		return parsed, nil
+	case []interface{}:
+		parsed := make([]interface{}, len(value))
+		for i, child := range value {
+			parsedChild, err := parseTemplate(child)
+			if err != nil {
+				return nil, err
+			}
+			parsed[i] = parsedChild
+		}
+		return parsed, nil
+	case string:
+		if !strings.HasPrefix(value, "{{") || !strings.HasSuffix(value, "}}") {
+			return value, nil
+		}
+		return parsePlaceholder(strings.TrimSuffix(strings.TrimPrefix(value, "{{"), "}}"))
+	default:
+		return value, nil
+	}
+}
+
+func parsePlaceholder(placeholder string) (templatePlaceholder, error) {
+
+	parts := strings.SplitN(placeholder, ":", 2)
+	parsed := templatePlaceholder{kind: parts[0]}
+	args := ""
+	if len(parts) > 1 {
+		args = parts[1]
+	}
+
+	switch parsed.kind {
+	case "name", "timestamp", "bool", "uuid":
+		if args != "" {
+			return parsed, fmt.Errorf("Placeholder {{%s}} doesn't take arguments", placeholder)
+		}
+	case "int", "float":
+		bounds := strings.Split(args, ":")
+		if len(bounds) != 2 {
+			return parsed, fmt.Errorf("Placeholder {{%s}} needs a min and max, eg {{%s:1:10}}", placeholder, parsed.kind)
+		}
+		var err1, err2 error
+		parsed.min, err1 = strconv.ParseFloat(bounds[0], 64)
+		parsed.max, err2 = strconv.ParseFloat(bounds[1], 64)
+		if err1 != nil || err2 != nil || parsed.max < parsed.min {
+			return parsed, fmt.Errorf("Placeholder {{%s}} has an invalid min and max", placeholder)
+		}
+	case "enum":
+		if args == "" {
+			return parsed, fmt.Errorf("Placeholder {{%s}} needs values, eg {{enum:a|b}}", placeholder)
+		}
+		parsed.values = strings.Split(args, "|")
+	case "text":
+		numBytes, err := strconv.Atoi(args)
+		if err != nil || numBytes <= 0 {
+			return parsed, fmt.Errorf("Placeholder {{%s}} needs a size in bytes, eg {{text:100}}", placeholder)
+		}
+		parsed.max = float64(numBytes)
+	default:
+		return parsed, fmt.Errorf("Unknown placeholder {{%s}}.  Types: name, timestamp, int, float, enum, bool, uuid, text", placeholder)
+	}
+	return parsed, nil
+
+}
+
+func (t templateDocGenerator) GenerateBody(rng *rand.Rand, sizeBytes int) interface{} {
+	return fillTemplate(rng, t.epoch, t.template)
+}
+
+// Objects' keys are filled in sorted order, rather than map order, so that the same rng
+// always fills in the template the same way
+func fillTemplate(rng *rand.Rand, epoch time.Time, template interface{}) interface{} {
+	switch value := template.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		filled := make(map[string]interface{}, len(value))
+		for _, key := range keys {
+			filled[key] = fillTemplate(rng, epoch, value[key])
+		}
+		return filled
+	case []interface{}:
+		filled := make([]interface{}, len(value))
+		for i, child := range value {
+			filled[i] = fillTemplate(rng, epoch, child)
+		}
+		return filled
+	case templatePlaceholder:
+		return value.generate(rng, epoch)
+	default:
+		return value
+	}
+}
+
+func (p templatePlaceholder) generate(rng *rand.Rand, epoch time.Time) interface{} {
+	switch p.kind {
+	case "name":
+		return randomName(rng)
+	case "timestamp":
+		return randomTimestamp(rng, epoch)
+	case "int":
+		return int64(p.min) + rng.Int63n(int64(p.max)-int64(p.min)+1)
+	case "float":
+		return p.min + rng.Float64()*(p.max-p.min)
+	case "enum":
+		return p.values[rng.Intn(len(p.values))]
+	case "bool":
+		return rng.Intn(2) == 0
+	case "uuid":
+		return randomUuid(rng)
+	case "text":
+		return randomText(rng, int(p.max))
+	}
+	return nil
+}
+
+var (
+	firstNames = []string{"Alice", "Bob", "Carmen", "Dmitri", "Emeka", "Fatima", "Giulia", "Hiro", "Ingrid", "Jamal", "Keiko", "Luis", "Mei", "Nadia", "Oscar", "Priya"}
+	lastNames  = []string{"Anderson", "Brown", "Chen", "Diaz", "Eriksson", "Fernandes", "Garcia", "Haddad", "Ivanova", "Johnson", "Kim", "Lopez", "Müller", "Nguyen", "Okafor", "Patel"}
+	words      = []string{"alpha", "bravo", "cobalt", "delta", "ember", "falcon", "garnet", "harbor", "indigo", "juniper", "kestrel", "lumen", "meadow", "nectar", "orbit", "pepper", "quartz", "river", "saffron", "tundra"}
+)
+
+func randomName(rng *rand.Rand) string {
+	return firstNames[rng.Intn(len(firstNames))] + " " + lastNames[rng.Intn(len(lastNames))]
+}
+
+func randomWord(rng *rand.Rand) string {
+	return words[rng.Intn(len(words))]
+}
+
+// Random words, up to numBytes long
+func randomText(rng *rand.Rand, numBytes int) string {
+	text := ""
+	for {
+		next := randomWord(rng)
+		if text != "" {
+			next = " " + next
+		}
+		if len(text)+len(next) > numBytes {
+			return text
+		}
+		text += next
+	}
+}
+
+// A time within the year before epoch
+func randomTimestamp(rng *rand.Rand, epoch time.Time) string {
+	year := int64(365 * 24 * time.Hour)
+	return epoch.Add(-time.Duration(rng.Int63n(year))).Format(time.RFC3339)
+}
+
+// A random string of the given length, drawn from the characters of base64
+func randomString(rng *rand.Rand, length int) string {
+	b := make([]byte, length)
+	rng.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)[:length]
+}
+
+// A version 4 UUID from rng, rather than from crypto/rand like NewUuid
+func randomUuid(rng *rand.Rand) string {
+	b := make([]byte, 16)
+	rng.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
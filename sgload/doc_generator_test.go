@@ -0,0 +1,115 @@
+package sgload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The size of the body as JSON, and gzipped
+func bodySizes(t *testing.T, body interface{}) (int, int) {
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("Error marshalling body: %v", err)
+	}
+	compressed := &bytes.Buffer{}
+	writer := gzip.NewWriter(compressed)
+	writer.Write(bodyBytes)
+	writer.Close()
+	return len(bodyBytes), compressed.Len()
+}
+
+func TestDocGenerators(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(1))
+	sizeBytes := 4096
+
+	fillerSize, fillerCompressed := bodySizes(t, fillerDocGenerator{}.GenerateBody(rng, sizeBytes))
+	randomSize, randomCompressed := bodySizes(t, randomDocGenerator{}.GenerateBody(rng, sizeBytes))
+	nestedSize, _ := bodySizes(t, nestedDocGenerator{}.GenerateBody(rng, sizeBytes))
+
+	for name, size := range map[string]int{"filler": fillerSize, "random": randomSize, "nested": nestedSize} {
+		if size < sizeBytes || size > 2*sizeBytes {
+			t.Fatalf("Expected the %s body to be about %d bytes, got %d", name, sizeBytes, size)
+		}
+	}
+	if randomCompressed < 5*fillerCompressed {
+		t.Fatalf("Expected the random body to compress much less than the filler: %d vs %d bytes", randomCompressed, fillerCompressed)
+	}
+
+}
+
+func TestTemplateDocGenerator(t *testing.T) {
+
+	templateFile := filepath.Join(t.TempDir(), "template.json")
+	template := `{
+		"type": "order",
+		"customer": {"name": "{{name}}", "vip": "{{bool}}"},
+		"items": [{"quantity": "{{int:1:3}}", "price": "{{float:1:2}}"}],
+		"status": "{{enum:pending|shipped}}",
+		"placed_at": "{{timestamp}}",
+		"notes": "{{text:20}}",
+		"ref": "{{uuid}}"
+	}`
+	if err := ioutil.WriteFile(templateFile, []byte(template), 0644); err != nil {
+		t.Fatalf("Error writing template: %v", err)
+	}
+
+	spec := DocGeneratorSpec{Type: DOC_GENERATOR_TEMPLATE, TemplateFile: templateFile}
+	if err := spec.Validate(); err != nil {
+		t.Fatalf("Unexpected error validating template: %v", err)
+	}
+	docGenerator, err := spec.DocGenerator(time.Now())
+	if err != nil {
+		t.Fatalf("Error loading template: %v", err)
+	}
+
+	// Round trip through JSON, like the body that gets written
+	bodyBytes, _ := json.Marshal(docGenerator.GenerateBody(rand.New(rand.NewSource(1)), 0))
+	body := map[string]interface{}{}
+	if err := json.Unmarshal(bodyBytes, &body); err != nil {
+		t.Fatalf("Error unmarshalling body: %v", err)
+	}
+
+	if body["type"] != "order" {
+		t.Fatalf("Expected the literal values to be kept, got %v", body["type"])
+	}
+	customer := body["customer"].(map[string]interface{})
+	if name, _ := customer["name"].(string); name == "" {
+		t.Fatalf("Expected a name, got %v", customer["name"])
+	}
+	if _, ok := customer["vip"].(bool); !ok {
+		t.Fatalf("Expected a bool, got %v", customer["vip"])
+	}
+	item := body["items"].([]interface{})[0].(map[string]interface{})
+	if quantity, _ := item["quantity"].(float64); quantity < 1 || quantity > 3 || quantity != float64(int(quantity)) {
+		t.Fatalf("Expected an int between 1 and 3, got %v", item["quantity"])
+	}
+	if price, _ := item["price"].(float64); price < 1 || price > 2 {
+		t.Fatalf("Expected a float between 1 and 2, got %v", item["price"])
+	}
+	if status := body["status"]; status != "pending" && status != "shipped" {
+		t.Fatalf("Expected one of the enum values, got %v", status)
+	}
+	if notes, _ := body["notes"].(string); notes == "" || len(notes) > 20 {
+		t.Fatalf("Expected up to 20 bytes of text, got %q", notes)
+	}
+	if ref, _ := body["ref"].(string); len(ref) != 36 {
+		t.Fatalf("Expected a uuid, got %v", body["ref"])
+	}
+
+	for _, placeholder := range []string{"{{nope}}", "{{int:5}}", "{{int:5:1}}", "{{enum:}}", "{{name:x}}", "{{text:0}}"} {
+		if err := ioutil.WriteFile(templateFile, []byte(`{"field": "`+placeholder+`"}`), 0644); err != nil {
+			t.Fatalf("Error writing template: %v", err)
+		}
+		if err := spec.Validate(); err == nil {
+			t.Fatalf("Expected an error for the placeholder %s", placeholder)
+		}
+	}
+
+}
@@ -0,0 +1,157 @@
+package sgload
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	// Don't judge MaxErrorPercent until at least this many operations have
+	// completed, otherwise a single early failure would abort the run
+	minOpsForErrorPercent = 100
+
+	// Only keep this many errors around for reporting, to bound memory use on long runs
+	maxErrorsRetained = 20
+)
+
+// Decides how many failed operations a run tolerates before it is aborted
+type ErrorBudget struct {
+	MaxErrors       int     // Abort once more than this many operations have failed.  Negative means no maximum
+	MaxErrorPercent float64 // If > 0, abort once more than this percentage of operations have failed
+}
+
+// An error encountered by an agent while performing an operation
+type AgentError struct {
+	Username  string // The agent's user
+	Operation string // eg, "write", "read", "update", "create_user"
+	Err       error
+}
+
+func (e AgentError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Username, e.Operation, e.Err)
+}
+
+// The error returned from a runner when any of its agents failed
+type RunError struct {
+	NumFailed int     // The number of failed operations
+	NumOps    int     // The total number of operations, failed or not
+	Aborted   bool    // Whether the run was stopped early because the error budget was exceeded
+	Errors    []error // The first few errors, in the order they happened
+}
+
+func (e RunError) Error() string {
+	msg := fmt.Sprintf("%d of %d operations failed", e.NumFailed, e.NumOps)
+	if e.Aborted {
+		msg += " (run aborted, error budget exceeded)"
+	}
+	errStrs := []string{}
+	for _, err := range e.Errors {
+		errStrs = append(errStrs, err.Error())
+	}
+	return fmt.Sprintf("%s: %s", msg, strings.Join(errStrs, "; "))
+}
+
+// Agents report the outcome of their operations to a shared ErrorCollector, which
+// aborts the run once the error budget is exceeded.  A nil *ErrorCollector
+// ignores everything, which is handy for tests that drive agents directly.
+type ErrorCollector struct {
+	Budget ErrorBudget
+
+	mutex     sync.Mutex
+	numOps    int
+	numFailed int
+	errors    []error
+	aborted   bool
+	abortChan chan struct{}
+}
+
+func NewErrorCollector(budget ErrorBudget) *ErrorCollector {
+	return &ErrorCollector{
+		Budget:    budget,
+		abortChan: make(chan struct{}),
+	}
+}
+
+func (c *ErrorCollector) RecordSuccess() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.numOps++
+}
+
+// Record a failed operation.  Returns true if the run should be aborted.
+func (c *ErrorCollector) RecordError(err error) (abort bool) {
+	if c == nil {
+		return false
+	}
+
+	logger.Error("Agent operation failed", "error", err)
+	globalProgressStats.Add("TotalNumErrors", 1)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.numOps++
+	c.numFailed++
+	if len(c.errors) < maxErrorsRetained {
+		c.errors = append(c.errors, err)
+	}
+
+	if !c.aborted && c.budgetExceeded() {
+		logger.Crit("Error budget exceeded, aborting run", "numfailed", c.numFailed, "numops", c.numOps, "budget", c.Budget)
+		c.aborted = true
+		close(c.abortChan)
+	}
+
+	return c.aborted
+}
+
+// Must be called with the lock held
+func (c *ErrorCollector) budgetExceeded() bool {
+	if c.Budget.MaxErrors >= 0 && c.numFailed > c.Budget.MaxErrors {
+		return true
+	}
+	if c.Budget.MaxErrorPercent > 0 && c.numOps >= minOpsForErrorPercent {
+		failedPercent := 100 * float64(c.numFailed) / float64(c.numOps)
+		return failedPercent > c.Budget.MaxErrorPercent
+	}
+	return false
+}
+
+// Returns a channel which is closed when the run is aborted
+func (c *ErrorCollector) Aborted() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	return c.abortChan
+}
+
+func (c *ErrorCollector) IsAborted() bool {
+	select {
+	case <-c.Aborted():
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns a *RunError describing the failures so far, or nil if nothing failed
+func (c *ErrorCollector) Err() error {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.numFailed == 0 {
+		return nil
+	}
+	return RunError{
+		NumFailed: c.numFailed,
+		NumOps:    c.numOps,
+		Aborted:   c.aborted,
+		Errors:    append([]error{}, c.errors...),
+	}
+}
@@ -0,0 +1,76 @@
+package sgload
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestErrorCollectorMaxErrors(t *testing.T) {
+
+	errorCollector := NewErrorCollector(ErrorBudget{MaxErrors: 2})
+
+	for i := 0; i < 2; i++ {
+		if abort := errorCollector.RecordError(fmt.Errorf("error %d", i)); abort {
+			t.Fatalf("Should not abort after %d errors", i+1)
+		}
+	}
+	if errorCollector.IsAborted() {
+		t.Fatalf("Should not be aborted yet")
+	}
+
+	if abort := errorCollector.RecordError(fmt.Errorf("error 2")); !abort {
+		t.Fatalf("Should abort once MaxErrors is exceeded")
+	}
+	if !errorCollector.IsAborted() {
+		t.Fatalf("Expected Aborted() channel to be closed")
+	}
+
+	runErr, ok := errorCollector.Err().(RunError)
+	if !ok {
+		t.Fatalf("Expected a RunError, got %v", errorCollector.Err())
+	}
+	if runErr.NumFailed != 3 || !runErr.Aborted || len(runErr.Errors) != 3 {
+		t.Fatalf("Unexpected RunError: %+v", runErr)
+	}
+
+}
+
+func TestErrorCollectorMaxErrorPercent(t *testing.T) {
+
+	errorCollector := NewErrorCollector(ErrorBudget{MaxErrors: -1, MaxErrorPercent: 10})
+
+	// Errors before minOpsForErrorPercent operations don't abort the run
+	for i := 0; i < 20; i++ {
+		errorCollector.RecordError(fmt.Errorf("error %d", i))
+	}
+	if errorCollector.IsAborted() {
+		t.Fatalf("Should not abort before %d operations", minOpsForErrorPercent)
+	}
+
+	for i := 0; i < 180; i++ {
+		errorCollector.RecordSuccess()
+	}
+
+	// 21 of 201 is just over 10%
+	if abort := errorCollector.RecordError(fmt.Errorf("error 20")); !abort {
+		t.Fatalf("Should abort once MaxErrorPercent is exceeded")
+	}
+
+}
+
+func TestErrorCollectorNoErrors(t *testing.T) {
+
+	errorCollector := NewErrorCollector(ErrorBudget{})
+	errorCollector.RecordSuccess()
+	if err := errorCollector.Err(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// A nil collector ignores everything
+	var nilCollector *ErrorCollector
+	nilCollector.RecordError(fmt.Errorf("ignored"))
+	if nilCollector.IsAborted() || nilCollector.Err() != nil {
+		t.Fatalf("Nil collector should never abort or fail")
+	}
+
+}
@@ -1,11 +1,16 @@
 package sgload
 
-import "expvar"
+import (
+	"expvar"
+	"fmt"
+	"io"
+)
 
 var (
 	writersProgressStats  *expvar.Map
 	readersProgressStats  *expvar.Map
 	updatersProgressStats *expvar.Map
+	deletersProgressStats *expvar.Map
 	globalProgressStats   *expvar.Map
 )
 
@@ -13,6 +18,7 @@ func init() {
 	writersProgressStats = expvar.NewMap("writers")
 	readersProgressStats = expvar.NewMap("readers")
 	updatersProgressStats = expvar.NewMap("updaters")
+	deletersProgressStats = expvar.NewMap("deleters")
 	globalProgressStats = expvar.NewMap("sgload")
 }
 
@@ -30,3 +36,12 @@ type NoOpExpvarStatsCollector struct{}
 func (e NoOpExpvarStatsCollector) Set(key string, av expvar.Var) {}
 
 func (e NoOpExpvarStatsCollector) Add(key string, delta int64) {}
+
+// Write the global progress stats (docs pushed, revs pulled and updated, errors, etc)
+// so there's a record of what was done, even if the run was interrupted
+func WriteProgressSummary(w io.Writer) {
+	fmt.Fprintln(w, "sgload progress:")
+	globalProgressStats.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "  %s: %s\n", kv.Key, kv.Value)
+	})
+}
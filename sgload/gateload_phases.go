@@ -0,0 +1,304 @@
+package sgload
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	USER_PREFIX_UPDATER = "updater"
+)
+
+var (
+	// While a phase is ramping, how often to start or stop agents to keep up with the ramp
+	phaseRampInterval = 100 * time.Millisecond
+)
+
+// The running agents of one kind (eg, the writers) in a phased run, which are started
+// and stopped to match the number each phase asks for.  Every agent that is started
+// gets a new ID, and therefore its own user and doc IDs.
+type agentPool struct {
+	kind       string                            // eg, "writers"
+	numAgents  func(phase PhaseSpec) *int        // The number of agents the phase asks for, or nil to keep them as they are
+	startAgent func(ctx context.Context, id int) // Start an agent with the given ID, which runs until ctx is done
+	cancels    []context.CancelFunc              // Stops each of the running agents, in the order they were started
+	nextID     int
+}
+
+func (p *agentPool) size() int {
+	return len(p.cancels)
+}
+
+// Start or stop agents until numAgents are running.  The most recently started agents are stopped first.
+func (p *agentPool) resize(ctx context.Context, numAgents int) {
+
+	for len(p.cancels) < numAgents {
+		agentCtx, cancel := context.WithCancel(ctx)
+		p.startAgent(agentCtx, p.nextID)
+		p.nextID++
+		p.cancels = append(p.cancels, cancel)
+	}
+
+	for len(p.cancels) > numAgents {
+		last := len(p.cancels) - 1
+		p.cancels[last]()
+		p.cancels = p.cancels[:last]
+	}
+
+}
+
+// How many agents should be running at the given point of a linear ramp from
+// "from" agents to "to" agents over the given duration
+func rampedNumAgents(from, to int, elapsed, duration time.Duration) int {
+	if elapsed >= duration {
+		return to
+	}
+	return from + int(float64(to-from)*float64(elapsed)/float64(duration))
+}
+
+// A MetricsSink which only keeps the timing stats of the current phase, so that
+// they can be reported separately for each phase
+type phaseLatencyRecorder struct {
+	mutex   sync.Mutex
+	current *LatencyRecorder
+}
+
+func newPhaseLatencyRecorder() *phaseLatencyRecorder {
+	return &phaseLatencyRecorder{
+		current: NewLatencyRecorder(),
+	}
+}
+
+func (p *phaseLatencyRecorder) Timing(name string, d time.Duration) {
+	p.mutex.Lock()
+	current := p.current
+	p.mutex.Unlock()
+	current.Timing(name, d)
+}
+
+func (p *phaseLatencyRecorder) Counter(name string, n int) {}
+
+func (p *phaseLatencyRecorder) Gauge(name string, value float64) {}
+
+// Start recording the timings of the next phase, and return the ones of the phase that just finished
+func (p *phaseLatencyRecorder) nextPhase() *LatencyRecorder {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	finished := p.current
+	p.current = NewLatencyRecorder()
+	return finished
+}
+
+// The current value of each of the global progress stats that is a counter
+func progressStatsSnapshot() map[string]int64 {
+	snapshot := map[string]int64{}
+	globalProgressStats.Do(func(kv expvar.KeyValue) {
+		if counter, ok := kv.Value.(*expvar.Int); ok {
+			snapshot[kv.Key] = counter.Value()
+		}
+	})
+	return snapshot
+}
+
+// In a phased run agents start at different times, so rather than waiting for
+// all the users to be created, each agent only waits for its own
+func usersCreatedWaitGroup(createUser bool) *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
+	if createUser {
+		wg.Add(1)
+	}
+	return wg
+}
+
+// Pass the docs pushed by the writers on to the updaters.  If the updaters aren't
+// keeping up, or none are running in the current phase, the docs are dropped
+// rather than holding up the writers.
+func forwardPushedDocs(ctx context.Context, pushedDocs <-chan []DocumentMetadata, docsToUpdate chan<- []DocumentMetadata) {
+	for {
+		select {
+		case docs := <-pushedDocs:
+			select {
+			case docsToUpdate <- docs:
+			default:
+				globalProgressStats.Add("TotalNumDocsNotUpdated", int64(len(docs)))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Runs the phases one after another, starting and stopping writers, readers and
+// updaters as each phase asks, until the last phase is over or ctx is done.  The
+// latencies and progress of each phase are reported when it ends, as well as
+// those of the whole run at the end.
+func (glr GateLoadRunner) runPhases(ctx context.Context) error {
+
+	defer glr.reportLatencies("gateload", time.Now())
+
+	runCtx, cancel := glr.runContext(ctx)
+	defer cancel()
+
+	logger.Info(
+		"Running phased Gateload Scenario",
+		"numphases",
+		len(glr.GateLoadSpec.Phases),
+		"duration",
+		glr.GateLoadSpec.phasesDuration(),
+		"numchannels",
+		glr.GateLoadSpec.NumChannels,
+	)
+
+	// The agents don't stop on their own once they've done a fixed amount of
+	// work, since it's up to the phases to stop them
+	runDuration := glr.GateLoadSpec.phasesDuration()
+	glr.WriteLoadRunner.LoadSpec.Duration = runDuration
+	glr.WriteLoadRunner.WriteLoadSpec.Duration = runDuration
+	glr.ReadLoadRunner.LoadSpec.Duration = runDuration
+	glr.UpdateLoadRunner.LoadSpec.Duration = runDuration
+
+	// The agents also push their timings to the current phase
+	phaseLatencies := newPhaseLatencyRecorder()
+	agentMetrics := MultiMetricsSink{glr.Metrics, phaseLatencies}
+	glr.WriteLoadRunner.Metrics = agentMetrics
+	glr.ReadLoadRunner.Metrics = agentMetrics
+	glr.UpdateLoadRunner.Metrics = agentMetrics
+	glr.AccessLoadRunner.Metrics = agentMetrics
+
+	channelNames := glr.generateChannelNames()
+	docsPerWriter := glr.WriteLoadSpec.NumDocs / glr.WriteLoadSpec.NumWriters
+
+	var writerPushedDocs chan []DocumentMetadata
+	if glr.GateLoadSpec.phasesHaveUpdaters() {
+		writerPushedDocs = make(chan []DocumentMetadata)
+		go forwardPushedDocs(runCtx, writerPushedDocs, glr.PushedDocs)
+	}
+
+	// Wait group to see when all the agents that were started have finished
+	var agentsFinished sync.WaitGroup
+
+	writers := &agentPool{
+		kind:      "writers",
+		numAgents: func(phase PhaseSpec) *int { return phase.Writers },
+		startAgent: func(ctx context.Context, id int) {
+			userCred := glr.LoadSpec.generateUserCred(id, USER_PREFIX_WRITER)
+			writer := glr.WriteLoadRunner.newWriter(id, userCred, &agentsFinished, usersCreatedWaitGroup(glr.WriteLoadSpec.CreateWriters), nil)
+			if writerPushedDocs != nil {
+				writer.PushedDocs = writerPushedDocs
+			}
+			go writer.Run(ctx)
+			go feedDocsToWriter(ctx, writer, glr.WriteLoadRunner.WriteLoadSpec, docsPerWriter, glr.ChannelLayout)
+		},
+	}
+
+	readers := &agentPool{
+		kind:      "readers",
+		numAgents: func(phase PhaseSpec) *int { return phase.Readers },
+		startAgent: func(ctx context.Context, id int) {
+			userCred := glr.LoadSpec.generateUserCred(id, USER_PREFIX_READER)
+			sgChannels := assignChannelsToReader(glr.ReadLoadSpec.NumChansPerReader, channelNames, glr.LoadSpec.agentRand(USER_PREFIX_READER, id))
+			reader := glr.ReadLoadRunner.newReader(id, userCred, &agentsFinished, usersCreatedWaitGroup(glr.ReadLoadSpec.CreateReaders), sgChannels, 0)
+			go reader.Run(ctx)
+		},
+	}
+
+	// Unlike in the unphased run, there can be more updaters than writers, so
+	// updaters have their own users.  These are created along with the writers.
+	updaters := &agentPool{
+		kind:      "updaters",
+		numAgents: func(phase PhaseSpec) *int { return phase.Updaters },
+		startAgent: func(ctx context.Context, id int) {
+			userCred := glr.LoadSpec.generateUserCred(id, USER_PREFIX_UPDATER)
+			updater := glr.UpdateLoadRunner.newUpdater(id, userCred, &agentsFinished, 0, glr.PushedDocs)
+			updater.CreateDataStoreUser = glr.WriteLoadSpec.CreateWriters
+			go updater.Run(ctx)
+		},
+	}
+
+	// The churners run through all the phases, changing the access of whichever readers are running
+	if glr.AccessLoadSpec.NumAccessChurners > 0 {
+		if err := glr.startAccessChurners(runCtx, &agentsFinished); err != nil {
+			return err
+		}
+	}
+
+	pools := []*agentPool{writers, readers, updaters}
+	for index, phase := range glr.GateLoadSpec.Phases {
+		if runCtx.Err() != nil {
+			break
+		}
+		glr.runPhase(runCtx, index, phase, pools, phaseLatencies)
+	}
+
+	// Stop all the agents.  They get DrainTimeout to finish their in-flight requests.
+	logger.Info("Phases finished, stopping agents")
+	cancel()
+	agentsFinished.Wait()
+	logger.Info("Agents stopped")
+
+	return glr.runResult(ctx)
+
+}
+
+// Run a single phase: start or stop agents to get to the numbers it asks for (gradually,
+// if it ramps), wait until it's over, and report its latencies and progress
+func (glr GateLoadRunner) runPhase(ctx context.Context, index int, phase PhaseSpec, pools []*agentPool, phaseLatencies *phaseLatencyRecorder) {
+
+	name := phase.nameOrDefault(index)
+	started := time.Now()
+	progressAtStart := progressStatsSnapshot()
+
+	numAgentsAtStart := map[*agentPool]int{}
+	logCtx := []interface{}{"phase", name, "duration", phase.Duration, "ramp", phase.Ramp}
+	for _, pool := range pools {
+		numAgentsAtStart[pool] = pool.size()
+		if numAgents := pool.numAgents(phase); numAgents != nil {
+			logCtx = append(logCtx, pool.kind, fmt.Sprintf("%d -> %d", pool.size(), *numAgents))
+		}
+	}
+	logger.Info("Starting phase", logCtx...)
+
+	for {
+
+		elapsed := time.Since(started)
+		for _, pool := range pools {
+			numAgents := pool.numAgents(phase)
+			if numAgents == nil {
+				continue
+			}
+			if phase.Ramp {
+				pool.resize(ctx, rampedNumAgents(numAgentsAtStart[pool], *numAgents, elapsed, phase.Duration))
+			} else {
+				pool.resize(ctx, *numAgents)
+			}
+			glr.Metrics.Gauge(fmt.Sprintf("num_%s", pool.kind), float64(pool.size()))
+		}
+
+		remaining := phase.Duration - elapsed
+		if remaining <= 0 {
+			break
+		}
+		if phase.Ramp && remaining > phaseRampInterval {
+			remaining = phaseRampInterval
+		}
+		sleepContext(ctx, remaining)
+		if ctx.Err() != nil {
+			logger.Info("Phase stopped", "phase", name)
+			break
+		}
+
+	}
+
+	// Unlike the latencies, the progress stats are totals, so only report how much they went up during the phase
+	report := phaseLatencies.nextPhase().Report(fmt.Sprintf("gateload phase %s", name), time.Since(started))
+	for key, value := range progressStatsSnapshot() {
+		report.Progress[key] = json.RawMessage(strconv.FormatInt(value-progressAtStart[key], 10))
+	}
+	glr.writeReport(report)
+
+}
@@ -0,0 +1,108 @@
+package sgload
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRampedNumAgents(t *testing.T) {
+
+	duration := 10 * time.Second
+
+	rampTests := []struct {
+		from, to int
+		elapsed  time.Duration
+		expected int
+	}{
+		{0, 1000, 0, 0},
+		{0, 1000, 5 * time.Second, 500},
+		{0, 1000, 9999 * time.Millisecond, 999},
+		{0, 1000, duration, 1000},
+		{0, 1000, 2 * duration, 1000},
+		{100, 0, 5 * time.Second, 50},
+		{100, 0, duration, 0},
+		{10, 10, 5 * time.Second, 10},
+	}
+
+	for _, rampTest := range rampTests {
+		numAgents := rampedNumAgents(rampTest.from, rampTest.to, rampTest.elapsed, duration)
+		if numAgents != rampTest.expected {
+			t.Fatalf("Ramping from %d to %d, expected %d agents after %v, got %d", rampTest.from, rampTest.to, rampTest.expected, rampTest.elapsed, numAgents)
+		}
+	}
+
+}
+
+func TestAgentPoolResize(t *testing.T) {
+
+	agentCtxs := map[int]context.Context{}
+	pool := &agentPool{
+		kind: "writers",
+		startAgent: func(ctx context.Context, id int) {
+			agentCtxs[id] = ctx
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pool.resize(ctx, 3)
+	if pool.size() != 3 || len(agentCtxs) != 3 {
+		t.Fatalf("Expected 3 agents to be started, got %d", len(agentCtxs))
+	}
+
+	// The most recently started agents are stopped first
+	pool.resize(ctx, 1)
+	if pool.size() != 1 {
+		t.Fatalf("Expected 1 agent running, got %d", pool.size())
+	}
+	if agentCtxs[0].Err() != nil || agentCtxs[1].Err() == nil || agentCtxs[2].Err() == nil {
+		t.Fatalf("Expected agents 1 and 2 to be stopped and agent 0 to keep running")
+	}
+
+	// New agents get new IDs rather than reusing the ones of stopped agents
+	pool.resize(ctx, 2)
+	if _, ok := agentCtxs[3]; !ok || pool.size() != 2 {
+		t.Fatalf("Expected agent 3 to be started, got agents: %v", agentCtxs)
+	}
+
+	cancel()
+	if agentCtxs[0].Err() == nil || agentCtxs[3].Err() == nil {
+		t.Fatalf("Expected all agents to be stopped along with the run")
+	}
+
+}
+
+func TestForwardPushedDocsDropsWhenFull(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pushedDocs := make(chan []DocumentMetadata)
+	docsToUpdate := make(chan []DocumentMetadata, 1)
+	go forwardPushedDocs(ctx, pushedDocs, docsToUpdate)
+
+	numNotUpdatedBefore := progressStatsSnapshot()["TotalNumDocsNotUpdated"]
+
+	// Nothing is taking docs to update, but the writers are never held up
+	for i := 0; i < 3; i++ {
+		select {
+		case pushedDocs <- []DocumentMetadata{{}, {}}:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Writer was held up pushing docs")
+		}
+	}
+	cancel()
+
+	if len(docsToUpdate) != 1 {
+		t.Fatalf("Expected 1 batch of docs to be forwarded, got %d", len(docsToUpdate))
+	}
+
+	// The last batch may still be on its way when the forwarder is stopped
+	numNotUpdated := progressStatsSnapshot()["TotalNumDocsNotUpdated"] - numNotUpdatedBefore
+	if numNotUpdated < 2 || numNotUpdated > 4 {
+		t.Fatalf("Expected 2-4 docs to be dropped, got %d", numNotUpdated)
+	}
+
+}
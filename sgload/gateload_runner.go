@@ -1,8 +1,10 @@
 package sgload
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/couchbaselabs/sg-replicate"
 )
@@ -12,8 +14,11 @@ type GateLoadRunner struct {
 	WriteLoadRunner
 	ReadLoadRunner
 	UpdateLoadRunner
+	DeleteLoadRunner
+	AccessLoadRunner
 	GateLoadSpec GateLoadSpec
 	PushedDocs   chan []DocumentMetadata
+	DocsToDelete chan []DocumentMetadata // Docs that have had all their revisions, for the deleters
 }
 
 func NewGateLoadRunner(gls GateLoadSpec) *GateLoadRunner {
@@ -23,7 +28,12 @@ func NewGateLoadRunner(gls GateLoadSpec) *GateLoadRunner {
 	loadRunner := LoadRunner{
 		LoadSpec: gls.LoadSpec,
 	}
-	loadRunner.CreateStatsdClient()
+	loadRunner.CreateMetricsSinks()
+	loadRunner.CreateHTTPClient()
+	loadRunner.CreateAuthenticatorFactory()
+	loadRunner.CreateDocGenerator()
+	loadRunner.CreateChannelLayout()
+	loadRunner.CreateErrorCollector()
 
 	writeLoadRunner := WriteLoadRunner{
 		LoadRunner:    loadRunner,
@@ -40,6 +50,21 @@ func NewGateLoadRunner(gls GateLoadSpec) *GateLoadRunner {
 		UpdateLoadSpec: gls.UpdateLoadSpec,
 	}
 
+	deleteLoadRunner := DeleteLoadRunner{
+		LoadRunner:     loadRunner,
+		DeleteLoadSpec: gls.DeleteLoadSpec,
+	}
+
+	accessLoadRunner := AccessLoadRunner{
+		LoadRunner:     loadRunner,
+		AccessLoadSpec: gls.AccessLoadSpec,
+	}
+	if gls.AccessLoadSpec.NumAccessChurners > 0 {
+		registry := NewAccessRegistry(accessLoadRunner.roles(), gls.AccessLoadSpec.visibilityTimeout())
+		accessLoadRunner.Registry = registry
+		readLoadRunner.AccessRegistry = registry
+	}
+
 	// TODO: this might need to have a proper queue rather than a buffered channel.
 	// The problem with a buffered channel is that we have to pre-allocate the queue
 	// to the high water mark, whereas a queue can grow as needed
@@ -50,13 +75,27 @@ func NewGateLoadRunner(gls GateLoadSpec) *GateLoadRunner {
 		WriteLoadRunner:  writeLoadRunner,
 		ReadLoadRunner:   readLoadRunner,
 		UpdateLoadRunner: updateLoadRunner,
+		DeleteLoadRunner: deleteLoadRunner,
+		AccessLoadRunner: accessLoadRunner,
 		GateLoadSpec:     gls,
 		PushedDocs:       make(chan []DocumentMetadata, pushedDocsBufferedChannelSize),
+		DocsToDelete:     make(chan []DocumentMetadata, pushedDocsBufferedChannelSize),
 	}
 
 }
 
-func (glr GateLoadRunner) Run() error {
+// Runs the writers, readers, updaters and deleters until they've all finished, or ctx is done.
+// If the spec has phases, they decide which agents run when instead (see runPhases).
+func (glr GateLoadRunner) Run(ctx context.Context) error {
+
+	if len(glr.GateLoadSpec.Phases) > 0 {
+		return glr.runPhases(ctx)
+	}
+
+	defer glr.reportLatencies("gateload", time.Now())
+
+	runCtx, cancel := glr.runContext(ctx)
+	defer cancel()
 
 	logger.Info(
 		"Running Gateload Scenario",
@@ -68,6 +107,10 @@ func (glr GateLoadRunner) Run() error {
 		glr.GateLoadSpec.NumReaders,
 		"numupdaters",
 		glr.GateLoadSpec.NumUpdaters,
+		"numdeleters",
+		glr.GateLoadSpec.NumDeleters,
+		"numaccesschurners",
+		glr.GateLoadSpec.NumAccessChurners,
 		"numchannels",
 		glr.GateLoadSpec.NumChannels,
 		"numrevsperdoc",
@@ -81,6 +124,7 @@ func (glr GateLoadRunner) Run() error {
 	// Start Writers
 	logger.Info("Starting writers")
 	writerWaitGroup, writers, err := glr.startWriters(
+		runCtx,
 		waitForAllSGUsersCreated,
 		glr.pushToUpdaters(),
 	)
@@ -90,14 +134,13 @@ func (glr GateLoadRunner) Run() error {
 
 	// Start Readers
 	logger.Info("Starting readers")
-	readerWaitGroup, err := glr.startReaders(waitForAllSGUsersCreated)
+	readerWaitGroup, err := glr.startReaders(runCtx, waitForAllSGUsersCreated)
 	if err != nil {
 		return err
 	}
 
 	// Start Doc Feeder
 	logger.Info("Starting docfeeder")
-	channelNames := glr.generateChannelNames()
 	writerCreds := getWriterCreds(writers)
 
 	// Set docs expected on writers
@@ -110,10 +153,11 @@ func (glr GateLoadRunner) Run() error {
 
 	// Start doc feeders
 	err = glr.startDocFeeders(
+		runCtx,
 		writers,
 		glr.WriteLoadSpec,
 		approxDocsPerWriter,
-		channelNames,
+		glr.ChannelLayout,
 	)
 	if err != nil {
 		return err
@@ -122,6 +166,7 @@ func (glr GateLoadRunner) Run() error {
 	// Start updaters
 	logger.Info("Starting updaters")
 	updaterWaitGroup, _, err := glr.startUpdaters(
+		runCtx,
 		writerCreds,
 		glr.UpdateLoadSpec.NumDocs,
 	)
@@ -129,6 +174,19 @@ func (glr GateLoadRunner) Run() error {
 		return err
 	}
 
+	// Start deleters
+	logger.Info("Starting deleters")
+	deleterWaitGroup := glr.startDeleters(runCtx, readerWaitGroup)
+
+	// Start access churners
+	var churnerWaitGroup sync.WaitGroup
+	if glr.AccessLoadSpec.NumAccessChurners > 0 {
+		logger.Info("Starting access churners")
+		if err := glr.startAccessChurners(runCtx, &churnerWaitGroup); err != nil {
+			return err
+		}
+	}
+
 	// Wait until writers finish
 	logger.Info("Wait until writers finish")
 	if err := glr.waitUntilWritersFinish(writerWaitGroup); err != nil {
@@ -136,24 +194,43 @@ func (glr GateLoadRunner) Run() error {
 	}
 	logger.Info("Writers finished")
 
+	// No more docs will be pushed, so let the updaters know in case some
+	// writes failed and they will never receive all the docs they expected
+	close(glr.PushedDocs)
+
 	// Wait until readers finish
 	logger.Info("Wait until readers finish")
 	readerWaitGroup.Wait()
 	logger.Info("Readers finished")
 
+	// The churners run as long as the readers
+	churnerWaitGroup.Wait()
+
 	// Wait until updaters finish
-	// Close glr.PushedDocs channel
 	logger.Info("Wait until updaters finish")
 	updaterWaitGroup.Wait()
 	logger.Info("Updaters finished")
 
-	return nil
+	// No more docs will be pushed to the deleters either, so they can finish
+	// once they've deleted (and purged) what they've got
+	close(glr.DocsToDelete)
+	logger.Info("Wait until deleters finish")
+	deleterWaitGroup.Wait()
+	logger.Info("Deleters finished")
+
+	return glr.runResult(ctx)
 }
 
 func (glr GateLoadRunner) pushToUpdaters() bool {
 	return (glr.UpdateLoadSpec.NumUpdaters > 0)
 }
 
+// Docs go to the deleters after their last revision: straight from the writers
+// if there are no updaters, otherwise from the updaters
+func (glr GateLoadRunner) pushToDeleters() bool {
+	return (glr.DeleteLoadSpec.NumDeleters > 0)
+}
+
 func (glr GateLoadRunner) CreateAllSGUsersWaitGroup() *sync.WaitGroup {
 	numAgents := glr.WriteLoadSpec.NumWriters + glr.ReadLoadSpec.NumReaders
 	wg := &sync.WaitGroup{}
@@ -177,18 +254,21 @@ func getWriterCreds(writers []*Writer) []UserCred {
 	return writerCreds
 }
 
-func (glr GateLoadRunner) startUpdaters(agentCreds []UserCred, numUniqueDocsToUpdate int) (*sync.WaitGroup, []*Updater, error) {
+func (glr GateLoadRunner) startUpdaters(ctx context.Context, agentCreds []UserCred, numUniqueDocsToUpdate int) (*sync.WaitGroup, []*Updater, error) {
 
 	// Create a wait group to see when all the updater goroutines have finished
 	var wg sync.WaitGroup
 
 	// Create updater goroutines
-	updaters, err := glr.createUpdaters(&wg, agentCreds, numUniqueDocsToUpdate, glr.PushedDocs)
+	updaters, err := glr.createUpdaters(ctx, &wg, agentCreds, numUniqueDocsToUpdate, glr.PushedDocs)
 	if err != nil {
 		return nil, nil, err
 	}
 	for _, updater := range updaters {
-		go updater.Run()
+		if glr.pushToDeleters() {
+			updater.FinishedDocs = glr.DocsToDelete
+		}
+		go updater.Run(ctx)
 	}
 
 	return &wg, updaters, nil
@@ -209,7 +289,7 @@ func findAgentAssignedToDoc(d sgreplicate.DocumentRevisionPair, docsToChannelsAn
 
 }
 
-func (glr GateLoadRunner) startWriters(waitForAllSGUsersCreated *sync.WaitGroup, pushToUpdaters bool) (*sync.WaitGroup, []*Writer, error) {
+func (glr GateLoadRunner) startWriters(ctx context.Context, waitForAllSGUsersCreated *sync.WaitGroup, pushToUpdaters bool) (*sync.WaitGroup, []*Writer, error) {
 
 	// Create a wait group to see when all the writer goroutines have finished
 	wg := sync.WaitGroup{}
@@ -231,14 +311,16 @@ func (glr GateLoadRunner) startWriters(waitForAllSGUsersCreated *sync.WaitGroup,
 		// start updating it.
 		if pushToUpdaters {
 			writer.PushedDocs = glr.PushedDocs
+		} else if glr.pushToDeleters() {
+			writer.PushedDocs = glr.DocsToDelete
 		}
-		go writer.Run()
+		go writer.Run(ctx)
 	}
 
 	return &wg, writers, nil
 }
 
-func (glr GateLoadRunner) startReaders(waitForAllSGUsersCreated *sync.WaitGroup) (*sync.WaitGroup, error) {
+func (glr GateLoadRunner) startReaders(ctx context.Context, waitForAllSGUsersCreated *sync.WaitGroup) (*sync.WaitGroup, error) {
 
 	wg := sync.WaitGroup{}
 
@@ -252,12 +334,27 @@ func (glr GateLoadRunner) startReaders(waitForAllSGUsersCreated *sync.WaitGroup)
 	}
 	for _, reader := range readers {
 
-		go reader.Run()
+		go reader.Run(ctx)
 	}
 
 	return &wg, nil
 }
 
+// Start the deleters, which purge their tombstones (if asked to) only once readersFinished
+// is done, so that the readers have seen them
+func (glr GateLoadRunner) startDeleters(ctx context.Context, readersFinished *sync.WaitGroup) *sync.WaitGroup {
+
+	wg := sync.WaitGroup{}
+
+	deleters := glr.createDeleters(&wg, glr.DocsToDelete, readersFinished)
+	for _, deleter := range deleters {
+		deleter.CreateDataStoreUser = glr.WriteLoadSpec.CreateWriters
+		go deleter.Run(ctx)
+	}
+
+	return &wg
+}
+
 func (glr GateLoadRunner) waitUntilWritersFinish(writerWaitGroup *sync.WaitGroup) error {
 	writerWaitGroup.Wait()
 	return nil
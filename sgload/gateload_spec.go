@@ -1,8 +1,8 @@
 package sgload
 
 import (
-	"fmt"
 	"log"
+	"time"
 )
 
 type GateLoadSpec struct {
@@ -10,6 +10,13 @@ type GateLoadSpec struct {
 	WriteLoadSpec
 	ReadLoadSpec
 	UpdateLoadSpec
+	DeleteLoadSpec
+	AccessLoadSpec
+
+	// If set, the run goes through these phases, which decide how many writers,
+	// readers and updaters are running at any time, rather than running
+	// NumWriters, NumReaders and NumUpdaters until NumDocs are done
+	Phases []PhaseSpec
 }
 
 func (gls GateLoadSpec) Validate() error {
@@ -30,16 +37,125 @@ func (gls GateLoadSpec) Validate() error {
 		return err
 	}
 
+	if err := gls.DeleteLoadSpec.Validate(); err != nil {
+		return err
+	}
+
+	if err := gls.AccessLoadSpec.Validate(); err != nil {
+		return err
+	}
+
+	if err := gls.validateAccessChurners(); err != nil {
+		return err
+	}
+
+	if gls.UpdateLoadSpec.conflicts() && gls.DeleteLoadSpec.NumDeleters > 0 {
+		return fieldError("update.num_conflict_branches", "Can't be used with deleters, which would only delete one of the branches")
+	}
+
+	if len(gls.Phases) > 0 {
+		return gls.validatePhases()
+	}
+
 	// Currently we need at least as many writers as updaters, since
 	// they use writer credentials, and if more updaters than writers
 	// the writer creds will be non-existent for some updaters
 	if gls.UpdateLoadSpec.NumUpdaters > gls.WriteLoadSpec.NumWriters {
-		return fmt.Errorf("Need at least as many writers as updaters")
+		return fieldError("update.num_updaters", "Need at least as many writers as updaters")
+	}
+
+	return nil
+}
+
+func (gls GateLoadSpec) validatePhases() error {
+
+	if gls.LoadSpec.Duration > 0 {
+		return fieldError("load.duration", "Can't be used with phases, since the run lasts as long as the phases")
+	}
+
+	if gls.WriteLoadSpec.TargetOpsPerSec > 0 {
+		return fieldError("write.target_ops_per_sec", "Can't be used with phases, since the number of writers changes")
+	}
+
+	if gls.DeleteLoadSpec.NumDeleters > 0 {
+		return fieldError("delete.num_deleters", "Can't be used with phases yet")
+	}
+
+	if gls.UpdateLoadSpec.conflicts() {
+		return fieldError("update.num_conflict_branches", "Can't be used with phases yet")
+	}
+
+	hasReaders := false
+	for index, phase := range gls.Phases {
+		if err := phase.Validate(index); err != nil {
+			return err
+		}
+		hasReaders = hasReaders || (phase.Readers != nil && *phase.Readers > 0)
+	}
+
+	if hasReaders && (gls.ReadLoadSpec.NumChansPerReader <= 0 || gls.ReadLoadSpec.NumChansPerReader > gls.NumChannels) {
+		return fieldError("read.num_chans_per_reader", "NumChansPerReader must be between 1 and the number of channels (%d)", gls.NumChannels)
 	}
 
 	return nil
 }
 
+// The churners change the readers' access while they follow their changes feeds, so
+// they need readers, and a run that goes on until it's stopped rather than until the
+// readers have pulled a fixed set of docs
+func (gls GateLoadSpec) validateAccessChurners() error {
+
+	if gls.AccessLoadSpec.NumAccessChurners == 0 {
+		return nil
+	}
+
+	hasReaders := gls.ReadLoadSpec.NumReaders > 0
+	for _, phase := range gls.Phases {
+		hasReaders = hasReaders || (phase.Readers != nil && *phase.Readers > 0)
+	}
+	if !hasReaders {
+		return fieldError("access.num_churners", "Need readers, whose access the churners change")
+	}
+	if gls.LoadSpec.Duration == 0 && len(gls.Phases) == 0 {
+		return fieldError("access.num_churners", "Needs a duration or phases, since readers can't know how many docs to expect")
+	}
+
+	return nil
+}
+
+// How long a phased run lasts
+func (gls GateLoadSpec) phasesDuration() time.Duration {
+	duration := time.Duration(0)
+	for _, phase := range gls.Phases {
+		duration += phase.Duration
+	}
+	return duration
+}
+
+// Whether any of the phases of a phased run starts updaters
+func (gls GateLoadSpec) phasesHaveUpdaters() bool {
+	for _, phase := range gls.Phases {
+		if phase.Updaters != nil && *phase.Updaters > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// The generation readers can expect each doc to reach: one rev from the writer,
+// plus one per update if there are any updaters, plus the tombstone if there are
+// any deleters
+func (gls GateLoadSpec) numRevGenerationsExpected() int {
+	numRevGenerationsExpected := 1
+	if gls.UpdateLoadSpec.NumUpdaters > 0 {
+		numRevGenerationsExpected += gls.UpdateLoadSpec.NumUpdatesPerDoc
+	}
+	if gls.DeleteLoadSpec.NumDeleters > 0 {
+		numRevGenerationsExpected++
+	}
+	return numRevGenerationsExpected
+}
+
 // Validate this spec or panic
 func (gls GateLoadSpec) MustValidate() {
 	if err := gls.Validate(); err != nil {
@@ -0,0 +1,327 @@
+package sgload
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/go-retryablehttp"
+	"golang.org/x/net/http2"
+)
+
+// How the agents connect to Sync Gateway.  By default they all share one client and
+// connection pool, which is efficient but doesn't look like separate devices to Sync
+// Gateway or to a load balancer in front of it.
+type HTTPClientSpec struct {
+	PerAgent            bool          `yaml:"per_agent"`               // Give each agent its own client, transport and connection pool, like a separate device
+	MaxConnsPerHost     int           `yaml:"max_conns_per_host"`      // If > 0, the most connections (in use or idle) each client opens to Sync Gateway
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"` // How many idle connections each client keeps for reuse.  Defaults to 1000 for the shared client and 2 per agent
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`       // How long an idle connection is kept before it's closed.  Defaults to 90s
+	DisableKeepAlives   bool          `yaml:"disable_keep_alives"`     // Open a new connection for every request
+	HTTP2               bool          `yaml:"http2"`                   // Use HTTP/2: negotiated with TLS for https URLs, or with prior knowledge (h2c) for http URLs
+}
+
+// Validate the spec for clients of Sync Gateway at the given URL
+func (hcs HTTPClientSpec) Validate(sgUrl string) error {
+
+	if hcs.MaxConnsPerHost < 0 {
+		return fieldError("load.http_client.max_conns_per_host", "MaxConnsPerHost must not be negative")
+	}
+	if hcs.MaxIdleConnsPerHost < 0 {
+		return fieldError("load.http_client.max_idle_conns_per_host", "MaxIdleConnsPerHost must not be negative")
+	}
+	if hcs.IdleConnTimeout < 0 {
+		return fieldError("load.http_client.idle_conn_timeout", "IdleConnTimeout must not be negative")
+	}
+	if hcs.HTTP2 && hcs.DisableKeepAlives {
+		return fieldError("load.http_client.disable_keep_alives", "Keep-alives can't be disabled with HTTP/2, which multiplexes requests over one connection")
+	}
+
+	// The h2c transport has none of the standard library transport's pool limits
+	if hcs.priorKnowledge(sgUrl) {
+		switch {
+		case hcs.MaxConnsPerHost > 0:
+			return fieldError("load.http_client.max_conns_per_host", "Can't be used with HTTP/2 over plain http")
+		case hcs.MaxIdleConnsPerHost > 0:
+			return fieldError("load.http_client.max_idle_conns_per_host", "Can't be used with HTTP/2 over plain http")
+		case hcs.IdleConnTimeout > 0:
+			return fieldError("load.http_client.idle_conn_timeout", "Can't be used with HTTP/2 over plain http")
+		}
+	}
+	return nil
+
+}
+
+// Whether the clients use HTTP/2 with prior knowledge (h2c), which is how they speak
+// HTTP/2 to a Sync Gateway URL that isn't https
+func (hcs HTTPClientSpec) priorKnowledge(sgUrl string) bool {
+	return hcs.HTTP2 && !strings.HasPrefix(sgUrl, "https")
+}
+
+// Create the transport for a client, for Sync Gateway at the given URL.  Every
+// connection it opens is counted, and so is the TLS handshake of https connections.
+func newSgTransport(spec HTTPClientSpec, tlsConfig *tls.Config, sgUrl string, metrics MetricsSink) http.RoundTripper {
+
+	if spec.priorKnowledge(sgUrl) {
+		// h2c, which the standard library transport doesn't speak
+		transport := &http2.Transport{AllowHTTP: true}
+		transport.ConnPool = newH2CConnPool(transport, newConnCountingDialer(metrics, nil))
+		return transport
+	}
+
+	if spec.HTTP2 {
+		// The transport only offers HTTP/2 itself when it does the TLS handshake
+		tlsConfig = tlsConfigOrDefault(tlsConfig)
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	dialer := newConnCountingDialer(metrics, tlsConfig)
+
+	maxIdleConnsPerHost := spec.MaxIdleConnsPerHost
+	if maxIdleConnsPerHost == 0 {
+		maxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+		if !spec.PerAgent {
+			maxIdleConnsPerHost = 1000
+		}
+	}
+
+	transport := transportWithConnPool(maxIdleConnsPerHost)
+	transport.DialContext = dialer.DialContext
+	transport.DialTLSContext = dialer.DialTLSContext
+	transport.MaxConnsPerHost = spec.MaxConnsPerHost
+	transport.DisableKeepAlives = spec.DisableKeepAlives
+	transport.ForceAttemptHTTP2 = spec.HTTP2
+	if spec.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = spec.IdleConnTimeout
+	}
+	return transport
+
+}
+
+// The connections of an h2c transport.  It dials them itself, rather than leaving it to
+// the transport's DialTLS, so that it can dial with the request's context: a connect
+// that hangs is then given up on when the run is stopped.
+type h2cConnPool struct {
+	transport *http2.Transport
+	dialer    *connCountingDialer
+	dialing   chan struct{} // Held while dialing, so that concurrent requests share the new connection rather than each dialing one
+	mutex     sync.Mutex
+	conns     map[string][]*http2.ClientConn // The open connections, by host and port
+}
+
+func newH2CConnPool(transport *http2.Transport, dialer *connCountingDialer) *h2cConnPool {
+	return &h2cConnPool{
+		transport: transport,
+		dialer:    dialer,
+		dialing:   make(chan struct{}, 1),
+		conns:     map[string][]*http2.ClientConn{},
+	}
+}
+
+func (p *h2cConnPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+
+	if cc := p.usableConn(addr); cc != nil {
+		return cc, nil
+	}
+
+	ctx := req.Context()
+	select {
+	case p.dialing <- struct{}{}:
+		defer func() { <-p.dialing }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// Another request may have dialed one while this one waited
+	if cc := p.usableConn(addr); cc != nil {
+		return cc, nil
+	}
+
+	conn, err := p.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := p.transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.conns[addr] = append(p.conns[addr], cc)
+	return cc, nil
+
+}
+
+// An open connection to addr which can take another request, or nil if there's none
+func (p *h2cConnPool) usableConn(addr string) *http2.ClientConn {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, cc := range p.conns[addr] {
+		if cc.CanTakeNewRequest() {
+			return cc
+		}
+	}
+	return nil
+}
+
+// Forget a connection which is closed or going away
+func (p *h2cConnPool) MarkDead(dead *http2.ClientConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for addr, conns := range p.conns {
+		for i, cc := range conns {
+			if cc == dead {
+				p.conns[addr] = append(conns[:i], conns[i+1:]...)
+				if len(p.conns[addr]) == 0 {
+					delete(p.conns, addr)
+				}
+				return
+			}
+		}
+	}
+}
+
+// A copy of the config that can be changed, or a new default one
+func tlsConfigOrDefault(tlsConfig *tls.Config) *tls.Config {
+	if tlsConfig == nil {
+		return &tls.Config{}
+	}
+	return tlsConfig.Clone()
+}
+
+var (
+	// The number of connections to Sync Gateway that are open right now, across all the clients
+	numConnectionsOpen int64
+)
+
+// Dials connections to Sync Gateway, and keeps count of them in the progress stats
+// and metrics
+type connCountingDialer struct {
+	dialer    *net.Dialer
+	metrics   MetricsSink
+	tlsConfig *tls.Config // For https connections, or nil for the defaults
+}
+
+func newConnCountingDialer(metrics MetricsSink, tlsConfig *tls.Config) *connCountingDialer {
+	return &connCountingDialer{
+		dialer:    &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		metrics:   metrics,
+		tlsConfig: tlsConfig,
+	}
+}
+
+func (d *connCountingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	globalProgressStats.Add("TotalNumConnectionsOpened", 1)
+	d.connectionsChanged(1)
+	if d.metrics != nil {
+		d.metrics.Counter("http_connections_opened", 1)
+	}
+
+	return &countedConn{Conn: conn, dialer: d}, nil
+
+}
+
+// Dial a connection and do the TLS handshake, which is timed as tls_handshake
+func (d *connCountingDialer) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := tlsConfigOrDefault(d.tlsConfig)
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConfig.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	startTime := time.Now()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if d.metrics != nil {
+		d.metrics.Timing("tls_handshake", time.Since(startTime))
+	}
+
+	return tlsConn, nil
+
+}
+
+func (d *connCountingDialer) connectionsChanged(delta int64) {
+	numOpen := atomic.AddInt64(&numConnectionsOpen, delta)
+	globalProgressStats.Add("NumConnectionsOpen", delta)
+	if d.metrics != nil {
+		d.metrics.Gauge("http_connections_open", float64(numOpen))
+	}
+}
+
+type countedConn struct {
+	net.Conn
+	dialer    *connCountingDialer
+	closeOnce sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.dialer.connectionsChanged(-1)
+	})
+	return c.Conn.Close()
+}
+
+// A websocket dialer whose connections are counted like those of the HTTP clients,
+// and whose TLS handshakes are timed
+func (s SGDataStore) webSocketDialer() websocket.Dialer {
+	dialer := newConnCountingDialer(s.Metrics, s.TLSConfig)
+	return websocket.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		NetDialContext:    dialer.DialContext,
+		NetDialTLSContext: dialer.DialTLSContext,
+	}
+}
+
+// Hides the transport's CloseIdleConnections from the client, so that the connection
+// pool is kept
+type keepIdleConnections struct {
+	transport http.RoundTripper
+}
+
+func (k keepIdleConnections) RoundTrip(req *http.Request) (*http.Response, error) {
+	return k.transport.RoundTrip(req)
+}
+
+// Read what's left of a response body before closing it, eg the newline after the
+// JSON that a decoder stops at, so that the connection can be reused
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(ioutil.Discard, body)
+	body.Close()
+}
+
+// Create the client that the data stores of the agents share, or one for a single
+// agent if they each get their own
+func (lr *LoadRunner) newHTTPClient() *retryablehttp.Client {
+	return newSgHttpClient(
+		lr.Metrics,
+		newSgTransport(lr.LoadSpec.HTTPClient, lr.TLSConfig, lr.LoadSpec.SyncGatewayUrl, lr.Metrics),
+	)
+}
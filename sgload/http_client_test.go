@@ -0,0 +1,152 @@
+package sgload
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/sgload/sgsimulator"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func totalNumConnectionsOpened() int64 {
+	if opened, ok := globalProgressStats.Get("TotalNumConnectionsOpened").(*expvar.Int); ok {
+		return opened.Value()
+	}
+	return 0
+}
+
+func TestHTTPClientSpecValidate(t *testing.T) {
+
+	const (
+		httpUrl  = "http://localhost:4984/db"
+		httpsUrl = "https://localhost:4984/db"
+	)
+
+	badSpecs := []HTTPClientSpec{
+		{MaxConnsPerHost: -1},
+		{MaxIdleConnsPerHost: -1},
+		{IdleConnTimeout: -1},
+		{HTTP2: true, DisableKeepAlives: true},
+	}
+	for _, spec := range badSpecs {
+		if err := spec.Validate(httpsUrl); err == nil {
+			t.Fatalf("Expected error validating %+v", spec)
+		}
+	}
+	if err := (HTTPClientSpec{PerAgent: true, MaxConnsPerHost: 2, HTTP2: true}).Validate(httpsUrl); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The h2c transport used for HTTP/2 over plain http doesn't have the pool limits
+	badH2CSpecs := []HTTPClientSpec{
+		{HTTP2: true, MaxConnsPerHost: 2},
+		{HTTP2: true, MaxIdleConnsPerHost: 2},
+		{HTTP2: true, IdleConnTimeout: time.Minute},
+	}
+	for _, spec := range badH2CSpecs {
+		if err := spec.Validate(httpUrl); err == nil {
+			t.Fatalf("Expected error validating %+v for %s", spec, httpUrl)
+		}
+		spec.HTTP2 = false
+		if err := spec.Validate(httpUrl); err != nil {
+			t.Fatalf("Unexpected error validating %+v: %v", spec, err)
+		}
+	}
+
+}
+
+func TestPerAgentHTTPClients(t *testing.T) {
+
+	_, dataStore, cleanup := newSimulatorDataStore(t, sgsimulator.FaultConfig{})
+	defer cleanup()
+
+	// The agents' data stores make one request after another, so with a shared client
+	// they all use the same connection, but with a client each they have one each
+	for _, perAgent := range []bool{false, true} {
+
+		lr := LoadRunner{
+			LoadSpec: LoadSpec{
+				SyncGatewayUrl:       dataStore.SyncGatewayUrl,
+				SyncGatewayAdminPort: dataStore.SyncGatewayAdminPort,
+				HTTPClient:           HTTPClientSpec{PerAgent: perAgent},
+			},
+			Metrics: NoOpMetricsSink{},
+		}
+		lr.CreateHTTPClient()
+
+		openedBefore := totalNumConnectionsOpened()
+		for i := 0; i < 3; i++ {
+			agentDataStore := lr.createDataStore()
+			if _, _, err := agentDataStore.Changes(context.Background(), StringSincer{}, 0, FEED_TYPE_NORMAL); err != nil {
+				t.Fatalf("Error getting changes: %v", err)
+			}
+		}
+
+		expected := int64(1)
+		if perAgent {
+			expected = 3
+		}
+		if opened := totalNumConnectionsOpened() - openedBefore; opened != expected {
+			t.Fatalf("Expected %d connections to be opened with per agent clients %v, got %d", expected, perAgent, opened)
+		}
+	}
+
+}
+
+func TestHTTP2PriorKnowledge(t *testing.T) {
+
+	// Count the requests that arrive over HTTP/2
+	var numHTTP2Requests int64
+	sim := sgsimulator.NewSGSimulator("db")
+	handler := sim.PublicHandler()
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor == 2 {
+			atomic.AddInt64(&numHTTP2Requests, 1)
+		}
+		handler.ServeHTTP(w, req)
+	}), &http2.Server{}))
+	defer server.Close()
+
+	dataStore := NewSGDataStore(server.URL+"/db/", 0, NoOpMetricsSink{}, false)
+	dataStore.SetHTTPClient(newSgHttpClient(
+		NoOpMetricsSink{},
+		newSgTransport(HTTPClientSpec{HTTP2: true}, nil, dataStore.SyncGatewayUrl, NoOpMetricsSink{}),
+	))
+
+	ctx := context.Background()
+	if _, err := dataStore.BulkCreateDocuments(ctx, docsToWrite("doc", 3, []string{"ABC"}), true); err != nil {
+		t.Fatalf("Error creating docs: %v", err)
+	}
+	changes, _, err := dataStore.Changes(ctx, StringSincer{}, 0, FEED_TYPE_NORMAL)
+	if err != nil || len(changes.Results) != 3 {
+		t.Fatalf("Expected 3 changes, got %+v, %v", changes, err)
+	}
+	if atomic.LoadInt64(&numHTTP2Requests) != 2 {
+		t.Fatalf("Expected both requests to use HTTP/2, got %d", numHTTP2Requests)
+	}
+
+	// A new transport dials with the request's context, so once that's done it doesn't
+	// connect at all
+	transport := newSgTransport(HTTPClientSpec{HTTP2: true}, nil, dataStore.SyncGatewayUrl, NoOpMetricsSink{})
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	req, err := http.NewRequestWithContext(cancelledCtx, "GET", server.URL+"/db/", nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	openedBefore := totalNumConnectionsOpened()
+	if resp, err := transport.RoundTrip(req); err == nil {
+		resp.Body.Close()
+		t.Fatalf("Expected a request with a cancelled context to fail")
+	}
+	if opened := totalNumConnectionsOpened() - openedBefore; opened != 0 {
+		t.Fatalf("Expected no connection to be opened for a cancelled request, got %d", opened)
+	}
+
+}
@@ -0,0 +1,170 @@
+package sgload
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The name of the default scope, and of the default collection in it
+const defaultScopeOrCollection = "_default"
+
+// The characters Sync Gateway allows in scope and collection names
+var keyspaceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_%-]{1,251}$`)
+
+// A Sync Gateway 3.1+ keyspace: a collection in a scope of the database, whose docs,
+// changes feed and channel grants are separate from the other collections'.  The
+// zero value is the default collection, which is the database itself.
+type Keyspace struct {
+	Scope      string
+	Collection string
+}
+
+// Parse "scope.collection", or "collection" for a collection in the default scope
+func ParseKeyspace(keyspace string) (Keyspace, error) {
+
+	parts := strings.Split(keyspace, ".")
+	if len(parts) == 1 {
+		parts = []string{defaultScopeOrCollection, parts[0]}
+	}
+	if len(parts) != 2 {
+		return Keyspace{}, fmt.Errorf("Keyspace %q isn't of the form scope.collection", keyspace)
+	}
+	for _, name := range parts {
+		if !keyspaceNamePattern.MatchString(name) {
+			return Keyspace{}, fmt.Errorf("Keyspace %q has an invalid scope or collection name %q", keyspace, name)
+		}
+	}
+
+	if parts[0] == defaultScopeOrCollection && parts[1] == defaultScopeOrCollection {
+		return Keyspace{}, nil
+	}
+	return Keyspace{Scope: parts[0], Collection: parts[1]}, nil
+
+}
+
+func (k Keyspace) IsDefault() bool {
+	return k == Keyspace{}
+}
+
+// scope.collection, which is how keyspaces are named in stats and doc bodies
+func (k Keyspace) String() string {
+	if k.IsDefault() {
+		return defaultScopeOrCollection + "." + defaultScopeOrCollection
+	}
+	return k.Scope + "." + k.Collection
+}
+
+// The URL of the keyspace, given the URL of its database.  The database segment of the
+// path becomes db.scope.collection, eg http://localhost:4984/db/ becomes
+// http://localhost:4984/db.inventory.airline/
+func (k Keyspace) url(dbUrl string) (string, error) {
+
+	if k.IsDefault() {
+		return dbUrl, nil
+	}
+
+	parsedUrl, err := url.Parse(dbUrl)
+	if err != nil {
+		return "", err
+	}
+	trailingSlash := strings.HasSuffix(parsedUrl.Path, "/")
+	dbPath := strings.TrimSuffix(parsedUrl.Path, "/")
+	if dbPath == "" {
+		return "", fmt.Errorf("No database in Sync Gateway URL %q", dbUrl)
+	}
+
+	parsedUrl.Path = dbPath + "." + k.String()
+	if trailingSlash {
+		parsedUrl.Path += "/"
+	}
+	return parsedUrl.String(), nil
+
+}
+
+// Parse the keyspaces of a load spec, which must not repeat.  None means the default
+// collection only.
+func parseKeyspaces(keyspaces []string) ([]Keyspace, error) {
+
+	if len(keyspaces) == 0 {
+		return []Keyspace{{}}, nil
+	}
+
+	parsed := []Keyspace{}
+	seen := map[Keyspace]bool{}
+	for _, keyspace := range keyspaces {
+		ks, err := ParseKeyspace(keyspace)
+		if err != nil {
+			return nil, err
+		}
+		if seen[ks] {
+			return nil, fmt.Errorf("Keyspace %q is listed more than once", keyspace)
+		}
+		seen[ks] = true
+		parsed = append(parsed, ks)
+	}
+	return parsed, nil
+
+}
+
+// Pushes each counter and timing under its own name, for the totals, and again tagged
+// with the keyspace as name.scope.collection (eg, "create_document.inventory.airline"),
+// which statsd nests under the total and Prometheus has as another name label.  Gauges
+// (eg, the number of open connections) are for the whole run, so they aren't tagged.
+type keyspaceMetricsSink struct {
+	MetricsSink
+	keyspace Keyspace
+}
+
+// The sink for the metrics of a keyspace, which only tags them if the run is spread
+// across several keyspaces or isn't using the default one
+func newKeyspaceMetricsSink(metrics MetricsSink, keyspace Keyspace, numKeyspaces int) MetricsSink {
+	if metrics == nil || (keyspace.IsDefault() && numKeyspaces <= 1) {
+		return metrics
+	}
+	return keyspaceMetricsSink{MetricsSink: metrics, keyspace: keyspace}
+}
+
+func (k keyspaceMetricsSink) tagged(name string) string {
+	return name + "." + k.keyspace.String()
+}
+
+func (k keyspaceMetricsSink) Counter(name string, n int) {
+	k.MetricsSink.Counter(name, n)
+	k.MetricsSink.Counter(k.tagged(name), n)
+}
+
+func (k keyspaceMetricsSink) Timing(name string, d time.Duration) {
+	k.MetricsSink.Timing(name, d)
+	k.MetricsSink.Timing(k.tagged(name), d)
+}
+
+// Grant the channels in a user doc for the admin _user endpoint: as admin_channels for
+// the default collection, and under collection_access for the others
+func addChannelGrants(userDoc map[string]interface{}, keyspaces []Keyspace, channelNames []string) {
+
+	if len(keyspaces) == 0 {
+		userDoc["admin_channels"] = channelNames
+		return
+	}
+
+	collectionAccess := map[string]map[string]interface{}{}
+	for _, keyspace := range keyspaces {
+		if keyspace.IsDefault() {
+			userDoc["admin_channels"] = channelNames
+			continue
+		}
+		if collectionAccess[keyspace.Scope] == nil {
+			collectionAccess[keyspace.Scope] = map[string]interface{}{}
+		}
+		collectionAccess[keyspace.Scope][keyspace.Collection] = map[string]interface{}{
+			"admin_channels": channelNames,
+		}
+	}
+	if len(collectionAccess) > 0 {
+		userDoc["collection_access"] = collectionAccess
+	}
+
+}
@@ -0,0 +1,129 @@
+package sgload
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/couchbaselabs/sgload/sgsimulator"
+)
+
+func TestParseKeyspace(t *testing.T) {
+
+	tests := []struct {
+		keyspace string
+		expected Keyspace
+		valid    bool
+	}{
+		{"inventory.airline", Keyspace{Scope: "inventory", Collection: "airline"}, true},
+		{"airline", Keyspace{Scope: "_default", Collection: "airline"}, true},
+		{"_default._default", Keyspace{}, true},
+		{"_default", Keyspace{}, true},
+		{"a.b.c", Keyspace{}, false},
+		{"inventory.", Keyspace{}, false},
+		{"inventory.air line", Keyspace{}, false},
+	}
+
+	for _, test := range tests {
+		keyspace, err := ParseKeyspace(test.keyspace)
+		if (err == nil) != test.valid {
+			t.Fatalf("Unexpected error parsing %q: %v", test.keyspace, err)
+		}
+		if keyspace != test.expected {
+			t.Fatalf("Expected %q to parse as %+v, got %+v", test.keyspace, test.expected, keyspace)
+		}
+	}
+
+	if _, err := parseKeyspaces([]string{"inventory.airline", "inventory.airline"}); err == nil {
+		t.Fatalf("Expected an error for a repeated keyspace")
+	}
+
+}
+
+func TestKeyspaceURL(t *testing.T) {
+
+	keyspace := Keyspace{Scope: "inventory", Collection: "airline"}
+
+	keyspaceUrl, err := keyspace.url("http://localhost:4984/db/")
+	if err != nil || keyspaceUrl != "http://localhost:4984/db.inventory.airline/" {
+		t.Fatalf("Unexpected url: %v, %v", keyspaceUrl, err)
+	}
+
+	keyspaceUrl, err = keyspace.url("https://sg:4984/db")
+	if err != nil || keyspaceUrl != "https://sg:4984/db.inventory.airline" {
+		t.Fatalf("Unexpected url: %v, %v", keyspaceUrl, err)
+	}
+
+	keyspaceUrl, err = Keyspace{}.url("http://localhost:4984/db/")
+	if err != nil || keyspaceUrl != "http://localhost:4984/db/" {
+		t.Fatalf("The default collection should be the database itself, got %v, %v", keyspaceUrl, err)
+	}
+
+	if _, err := keyspace.url("http://localhost:4984/"); err == nil {
+		t.Fatalf("Expected an error for a URL without a database")
+	}
+
+}
+
+// Docs written to a collection are only on its changes feed, and users only see the
+// channels they were granted in it
+func TestKeyspaceDataStores(t *testing.T) {
+
+	sim := sgsimulator.NewSGSimulator("db")
+	if err := sim.AddCollection("inventory.airline"); err != nil {
+		t.Fatalf("Error adding collection: %v", err)
+	}
+	publicServer := httptest.NewServer(sim.PublicHandler())
+	defer publicServer.Close()
+	adminServer := httptest.NewServer(sim.AdminHandler())
+	defer adminServer.Close()
+
+	adminUrl, err := url.Parse(adminServer.URL)
+	if err != nil {
+		t.Fatalf("Error parsing admin url: %v", err)
+	}
+	adminPort, err := strconv.Atoi(adminUrl.Port())
+	if err != nil {
+		t.Fatalf("Error parsing admin port: %v", err)
+	}
+
+	airline := Keyspace{Scope: "inventory", Collection: "airline"}
+	metrics := newCountingMetricsSink()
+	dataStore := NewSGDataStore(publicServer.URL+"/db/", adminPort, metrics, false)
+	dataStore.SetKeyspaces([]Keyspace{{}, airline})
+
+	ctx := context.Background()
+	userCreds := UserCred{Username: "user", Password: "password"}
+	if err := dataStore.CreateUser(ctx, userCreds, []string{"ABC"}); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	dataStore.SetUserCreds(userCreds)
+
+	airlineDataStore := dataStore.WithKeyspace(airline)
+	docs := docsToWrite("airline", 3, []string{"ABC"})
+	for _, doc := range docs {
+		doc.SetKeyspace(airline)
+	}
+	if _, err := airlineDataStore.BulkCreateDocuments(ctx, docs, true); err != nil {
+		t.Fatalf("Error creating docs: %v", err)
+	}
+	if _, err := airlineDataStore.BulkCreateDocuments(ctx, docsToWrite("hidden", 2, []string{"XYZ"}), true); err != nil {
+		t.Fatalf("Error creating docs: %v", err)
+	}
+
+	changes, _, err := airlineDataStore.Changes(ctx, StringSincer{}, 0, FEED_TYPE_NORMAL)
+	if err != nil || len(changes.Results) != 3 {
+		t.Fatalf("Expected the 3 docs in the user's channel on the collection's changes feed, got %+v, %v", changes.Results, err)
+	}
+	changes, _, err = dataStore.Changes(ctx, StringSincer{}, 0, FEED_TYPE_NORMAL)
+	if err != nil || len(changes.Results) != 0 {
+		t.Fatalf("Expected no docs on the default collection's changes feed, got %+v, %v", changes.Results, err)
+	}
+
+	if metrics.timingCount("create_document."+airline.String()) == 0 {
+		t.Fatalf("Expected the collection's timings to be tagged with it")
+	}
+
+}
@@ -0,0 +1,186 @@
+package sgload
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	hdrhistogram "github.com/HdrHistogram/hdrhistogram-go"
+)
+
+const (
+	// Latencies are recorded in microseconds, from 1us up to an hour, with 3 significant digits
+	latencyHistogramMinMicros = 1
+	latencyHistogramMaxMicros = int64(time.Hour / time.Microsecond)
+	latencyHistogramSigFigs   = 3
+)
+
+var (
+	// Reports of all the runs that finished in this process (eg, the writeload run
+	// by readload before the readers start), which are all written to the report file
+	finishedRunReports      = []RunReport{}
+	finishedRunReportsMutex sync.Mutex
+)
+
+// A MetricsSink which keeps an HDR histogram of every timing stat (create_document,
+// changes_feed, get_document, etc) in process, so percentiles can be reported at the
+// end of the run without a statsd/graphite stack.  Counters and gauges are ignored.
+type LatencyRecorder struct {
+	mutex      sync.Mutex
+	histograms map[string]*hdrhistogram.Histogram
+}
+
+func NewLatencyRecorder() *LatencyRecorder {
+	return &LatencyRecorder{
+		histograms: map[string]*hdrhistogram.Histogram{},
+	}
+}
+
+func (l *LatencyRecorder) Timing(name string, d time.Duration) {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	histogram, ok := l.histograms[name]
+	if !ok {
+		histogram = hdrhistogram.New(latencyHistogramMinMicros, latencyHistogramMaxMicros, latencyHistogramSigFigs)
+		l.histograms[name] = histogram
+	}
+
+	micros := int64(d / time.Microsecond)
+	if micros > latencyHistogramMaxMicros {
+		micros = latencyHistogramMaxMicros
+	}
+	histogram.RecordValue(micros)
+
+}
+
+func (l *LatencyRecorder) Counter(name string, n int) {}
+
+func (l *LatencyRecorder) Gauge(name string, value float64) {}
+
+// The latency percentiles of a single operation (timing stat), in milliseconds
+type OperationLatency struct {
+	Operation string  `json:"operation"`
+	Count     int64   `json:"count"`
+	OpsPerSec float64 `json:"ops_per_sec"`
+	P50       float64 `json:"p50_ms"`
+	P90       float64 `json:"p90_ms"`
+	P99       float64 `json:"p99_ms"`
+	P999      float64 `json:"p999_ms"`
+	Max       float64 `json:"max_ms"`
+}
+
+// Summary of a finished run
+type RunReport struct {
+	Run            string                     `json:"run"`
+	ElapsedSeconds float64                    `json:"elapsed_seconds"`
+	Operations     []OperationLatency         `json:"operations"`
+	Progress       map[string]json.RawMessage `json:"progress"` // The global progress stats (docs pushed, revs pulled, etc)
+}
+
+// Compute the percentiles and throughput (over the given elapsed time) of every timing stat recorded so far
+func (l *LatencyRecorder) Report(run string, elapsed time.Duration) RunReport {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	report := RunReport{
+		Run:            run,
+		ElapsedSeconds: elapsed.Seconds(),
+		Operations:     []OperationLatency{},
+		Progress:       map[string]json.RawMessage{},
+	}
+
+	for operation, histogram := range l.histograms {
+		opsPerSec := 0.0
+		if elapsed > 0 {
+			opsPerSec = float64(histogram.TotalCount()) / elapsed.Seconds()
+		}
+		report.Operations = append(report.Operations, OperationLatency{
+			Operation: operation,
+			Count:     histogram.TotalCount(),
+			OpsPerSec: opsPerSec,
+			P50:       microsToMillis(histogram.ValueAtQuantile(50)),
+			P90:       microsToMillis(histogram.ValueAtQuantile(90)),
+			P99:       microsToMillis(histogram.ValueAtQuantile(99)),
+			P999:      microsToMillis(histogram.ValueAtQuantile(99.9)),
+			Max:       microsToMillis(histogram.Max()),
+		})
+	}
+	sort.Slice(report.Operations, func(i, j int) bool {
+		return report.Operations[i].Operation < report.Operations[j].Operation
+	})
+
+	globalProgressStats.Do(func(kv expvar.KeyValue) {
+		report.Progress[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+
+	return report
+
+}
+
+func microsToMillis(micros int64) float64 {
+	return float64(micros) / 1000.0
+}
+
+// Print a table with a row for each operation
+func (r RunReport) WriteTable(w io.Writer) {
+
+	fmt.Fprintf(w, "%s latencies (ms) over %v:\n", r.Run, time.Duration(r.ElapsedSeconds*float64(time.Second)).Round(time.Millisecond))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "operation\tcount\tops/sec\tp50\tp90\tp99\tp999\tmax\t")
+	for _, op := range r.Operations {
+		fmt.Fprintf(
+			tw,
+			"%s\t%d\t%.1f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t\n",
+			op.Operation,
+			op.Count,
+			op.OpsPerSec,
+			op.P50,
+			op.P90,
+			op.P99,
+			op.P999,
+			op.Max,
+		)
+	}
+	tw.Flush()
+
+}
+
+// Add the report to the ones from the runs that finished earlier, and if reportFile
+// is set, write them all to it as JSON
+func addRunReport(report RunReport, reportFile string) error {
+
+	finishedRunReportsMutex.Lock()
+	defer finishedRunReportsMutex.Unlock()
+
+	finishedRunReports = append(finishedRunReports, report)
+
+	if reportFile == "" {
+		return nil
+	}
+
+	reportJson, err := json.MarshalIndent(
+		struct {
+			Runs []RunReport `json:"runs"`
+		}{
+			Runs: finishedRunReports,
+		},
+		"",
+		"  ",
+	)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(reportFile, reportJson, 0644)
+
+}
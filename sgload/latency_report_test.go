@@ -0,0 +1,92 @@
+package sgload
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLatencyRecorderReport(t *testing.T) {
+
+	recorder := NewLatencyRecorder()
+	for i := 1; i <= 1000; i++ {
+		recorder.Timing("get_document", time.Duration(i)*time.Millisecond)
+	}
+	recorder.Timing("create_document", time.Millisecond)
+	recorder.Timing("create_document", 3*time.Millisecond)
+
+	report := recorder.Report("readload", 10*time.Second)
+	if len(report.Operations) != 2 {
+		t.Fatalf("Expected 2 operations, got: %+v", report.Operations)
+	}
+
+	// Sorted by operation name
+	createDoc, getDoc := report.Operations[0], report.Operations[1]
+	if createDoc.Operation != "create_document" || createDoc.Count != 2 || !withinHistogramPrecision(createDoc.Max, 3) {
+		t.Fatalf("Unexpected create_document latencies: %+v", createDoc)
+	}
+	if getDoc.Count != 1000 || getDoc.OpsPerSec != 100 {
+		t.Fatalf("Unexpected get_document count or throughput: %+v", getDoc)
+	}
+
+	expected := map[string][2]float64{
+		"p50":  {getDoc.P50, 500},
+		"p90":  {getDoc.P90, 900},
+		"p99":  {getDoc.P99, 990},
+		"p999": {getDoc.P999, 999},
+		"max":  {getDoc.Max, 1000},
+	}
+	for name, actualAndExpected := range expected {
+		actual, expected := actualAndExpected[0], actualAndExpected[1]
+		if !withinHistogramPrecision(actual, expected) {
+			t.Fatalf("Expected get_document %s to be about %v ms, got %v", name, expected, actual)
+		}
+	}
+
+}
+
+// Whether the values are equal to within the 3 significant digits the histograms keep
+func withinHistogramPrecision(actual, expected float64) bool {
+	return actual >= expected*0.999 && actual <= expected*1.001
+}
+
+func TestAddRunReportWritesAllRuns(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "sgload")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	reportFile := filepath.Join(tempDir, "report.json")
+
+	numRunsBefore := len(finishedRunReports)
+
+	if err := addRunReport(RunReport{Run: "writeload"}, reportFile); err != nil {
+		t.Fatalf("Error adding report: %v", err)
+	}
+	if err := addRunReport(RunReport{Run: "readload"}, reportFile); err != nil {
+		t.Fatalf("Error adding report: %v", err)
+	}
+
+	reportJson, err := ioutil.ReadFile(reportFile)
+	if err != nil {
+		t.Fatalf("Error reading report file: %v", err)
+	}
+	reports := struct {
+		Runs []RunReport `json:"runs"`
+	}{}
+	if err := json.Unmarshal(reportJson, &reports); err != nil {
+		t.Fatalf("Error unmarshalling report file: %v", err)
+	}
+
+	if len(reports.Runs) != numRunsBefore+2 {
+		t.Fatalf("Expected %d runs in report file, got %d", numRunsBefore+2, len(reports.Runs))
+	}
+	if reports.Runs[len(reports.Runs)-1].Run != "readload" {
+		t.Fatalf("Expected the last run to be readload, got: %+v", reports.Runs)
+	}
+
+}
@@ -1,58 +1,220 @@
 package sgload
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"os"
+	"time"
 
-	"github.com/peterbourgon/g2s"
+	"github.com/hashicorp/go-retryablehttp"
 )
 
 type LoadRunner struct {
-	LoadSpec     LoadSpec
-	StatsdClient g2s.Statter
+	LoadSpec         LoadSpec
+	Metrics          MetricsSink           // Where agents and data stores push metrics.  Includes Latencies, as well as statsd and Prometheus if enabled
+	Latencies        *LatencyRecorder      // Keeps histograms of the timing stats, for the end of run report
+	Errors           *ErrorCollector       // Shared by all agents in the run, so they can report errors and be aborted
+	HTTPClient       *retryablehttp.Client // Shared by the agents' data stores, unless each agent gets its own
+	TLSConfig        *tls.Config           // For connections to an https Sync Gateway
+	AdminHTTPClient  *retryablehttp.Client // For admin requests, such as creating users
+	NewAuthenticator AuthenticatorFactory  // How the agents' data stores authenticate as their users, or nil for basic auth
+	DocGenerator     DocGenerator          // Generates the bodies of the docs the writers and updaters write
+	ChannelLayout    *ChannelLayout        // Which channels each doc is in
 }
 
-func (lr *LoadRunner) CreateStatsdClient() {
+func (lr *LoadRunner) CreateErrorCollector() {
+	lr.Errors = NewErrorCollector(lr.LoadSpec.ErrorBudget())
+}
 
-	var statsdClient g2s.Statter
-	var err error
+// Create the metrics sinks: the in-process latency histograms are always kept, and
+// metrics are also pushed to statsd and/or Prometheus if they are enabled
+func (lr *LoadRunner) CreateMetricsSinks() {
+
+	lr.Latencies = NewLatencyRecorder()
+	sinks := MultiMetricsSink{lr.Latencies}
 
 	if lr.LoadSpec.StatsdEnabled {
-		// statsClient *should* be safe to be shared among multiple
-		// goroutines, based on fact that connection returned from Dial
-		if lr.LoadSpec.StatsdPrefix != "" {
-			statsdClient, err = g2s.DialWithPrefix("udp", lr.LoadSpec.StatsdEndpoint, lr.LoadSpec.StatsdPrefix)
-		} else {
-			statsdClient, err = g2s.Dial("udp", lr.LoadSpec.StatsdEndpoint)
+		statsdSink, err := NewStatsdMetricsSink(lr.LoadSpec.StatsdEndpoint, lr.LoadSpec.StatsdPrefix)
+		if err != nil {
+			panic("Couldn't connect to statsd!")
 		}
+		sinks = append(sinks, statsdSink)
+	}
+
+	if lr.LoadSpec.PrometheusEnabled {
+		sinks = append(sinks, SharedPrometheusMetricsSink())
+	}
+
+	lr.Metrics = sinks
+
+}
+
+// Create the HTTP client the agents share, unless they each get their own, and the
+// one for admin requests.  Needs the metrics sinks, to count retries and connections.
+func (lr *LoadRunner) CreateHTTPClient() {
+
+	tlsConfig, err := lr.LoadSpec.TLS.Config()
+	if err != nil {
+		panic(fmt.Sprintf("Couldn't load the TLS certificates: %v", err))
+	}
+	lr.TLSConfig = tlsConfig
+
+	if !lr.LoadSpec.HTTPClient.PerAgent {
+		lr.HTTPClient = lr.newHTTPClient()
+	}
+
+	lr.AdminHTTPClient, err = newAdminHTTPClient(lr.Metrics, lr.LoadSpec.Admin.tlsSpec(lr.LoadSpec.TLS))
+	if err != nil {
+		panic(fmt.Sprintf("Couldn't load the admin TLS certificates: %v", err))
+	}
+}
 
+// Create the authenticators of the auth mode, which for jwt means loading or
+// generating the signing key
+func (lr *LoadRunner) CreateAuthenticatorFactory() {
+
+	switch lr.LoadSpec.Auth.Mode {
+	case AUTH_MODE_SESSION:
+		lr.NewAuthenticator = newSessionAuthenticator
+	case AUTH_MODE_JWT:
+		signer, err := lr.LoadSpec.Auth.JWT.Signer()
 		if err != nil {
-			panic("Couldn't connect to statsd!")
+			panic(fmt.Sprintf("Couldn't create the JWT signing key: %v", err))
 		}
+		lr.NewAuthenticator = func(s SGDataStore, u UserCred) Authenticator {
+			return newJWTAuthenticator(s, signer)
+		}
+	}
+
+}
+
+// Create the doc generator, which for a template means loading it
+func (lr *LoadRunner) CreateDocGenerator() {
+
+	docGenerator, err := lr.LoadSpec.DocGenerator.DocGenerator(lr.LoadSpec.timestampEpoch())
+	if err != nil {
+		panic(fmt.Sprintf("Couldn't create the doc generator: %v", err))
+	}
+	lr.DocGenerator = docGenerator
+
+}
+
+// Lay out the docs over the channels, which writers and readers both need
+func (lr *LoadRunner) CreateChannelLayout() {
+
+	lr.ChannelLayout = newChannelLayout(
+		lr.LoadSpec.Channels,
+		lr.LoadSpec.NumDocs,
+		lr.generateChannelNames(),
+		lr.LoadSpec.channelLayoutRand(),
+	)
+	logger.Debug("Channel layout", "numDocsPerChannel", lr.ChannelLayout.numDocsPerChannel())
+
+}
+
+// The HTTP client for a new agent's data store
+func (lr LoadRunner) agentHTTPClient() *retryablehttp.Client {
+	if lr.LoadSpec.HTTPClient.PerAgent {
+		return lr.newHTTPClient()
+	}
+	return lr.HTTPClient
+}
+
+// Print the latency percentiles and throughput of every operation since the run was
+// started, and write them to the report file if one was given
+func (lr LoadRunner) reportLatencies(run string, started time.Time) {
+
+	lr.writeReport(lr.Latencies.Report(run, time.Since(started)))
+
+}
+
+// Print the report, and add it to the report file if one was given
+func (lr LoadRunner) writeReport(report RunReport) {
+
+	report.WriteTable(os.Stdout)
+
+	if err := addRunReport(report, lr.LoadSpec.ReportFile); err != nil {
+		logger.Error("Error writing report file", "reportfile", lr.LoadSpec.ReportFile, "error", err)
+	}
+
+}
+
+// Derives the context that agents run with, which is cancelled along with ctx (eg,
+// on SIGINT), as soon as the error budget is exceeded, or when the Duration is up
+func (lr LoadRunner) runContext(ctx context.Context) (context.Context, context.CancelFunc) {
+
+	var runCtx context.Context
+	var cancel context.CancelFunc
+	if lr.LoadSpec.OpenEnded() {
+		logger.Info("Running until duration is up", "duration", lr.LoadSpec.Duration)
+		runCtx, cancel = context.WithTimeout(ctx, lr.LoadSpec.Duration)
 	} else {
-		statsdClient = MockStatter{}
+		runCtx, cancel = context.WithCancel(ctx)
 	}
 
-	lr.StatsdClient = statsdClient
+	go func() {
+		select {
+		case <-lr.Errors.Aborted():
+			cancel()
+		case <-runCtx.Done():
+		}
+	}()
+
+	return runCtx, cancel
 
 }
 
+// The error a runner returns once all of its agents have stopped: the agents'
+// errors if any failed, otherwise ctx.Err() if the run was interrupted
+func (lr LoadRunner) runResult(ctx context.Context) error {
+	if err := lr.Errors.Err(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
 func (lr LoadRunner) createDataStore() DataStore {
 
 	if lr.LoadSpec.MockDataStore {
 		return NewMockDataStore()
 	}
 
+	if lr.LoadSpec.Protocol == PROTOCOL_BLIP {
+		blipDataStore := NewBlipDataStore(
+			lr.LoadSpec.SyncGatewayUrl,
+			lr.LoadSpec.SyncGatewayAdminPort,
+			lr.Metrics,
+			lr.LoadSpec.CompressionEnabled,
+		)
+		blipDataStore.SetHTTPClient(lr.agentHTTPClient())
+		blipDataStore.SetTLSConfig(lr.TLSConfig)
+		blipDataStore.SetAuthenticatorFactory(lr.NewAuthenticator)
+		blipDataStore.SetAdmin(lr.LoadSpec.SyncGatewayAdminUrl, lr.adminCreds(), lr.AdminHTTPClient)
+		blipDataStore.SetKeyspaces(lr.LoadSpec.keyspaces())
+		return blipDataStore
+	}
+
 	sgDataStore := NewSGDataStore(
 		lr.LoadSpec.SyncGatewayUrl,
 		lr.LoadSpec.SyncGatewayAdminPort,
-		lr.StatsdClient,
+		lr.Metrics,
 		lr.LoadSpec.CompressionEnabled,
 	)
+	sgDataStore.SetHTTPClient(lr.agentHTTPClient())
+	sgDataStore.SetTLSConfig(lr.TLSConfig)
+	sgDataStore.SetAuthenticatorFactory(lr.NewAuthenticator)
+	sgDataStore.SetAdmin(lr.LoadSpec.SyncGatewayAdminUrl, lr.adminCreds(), lr.AdminHTTPClient)
+	sgDataStore.SetKeyspaces(lr.LoadSpec.keyspaces())
 
 	return sgDataStore
 
 }
 
+func (lr LoadRunner) adminCreds() UserCred {
+	return UserCred{Username: lr.LoadSpec.Admin.Username, Password: lr.LoadSpec.Admin.Password}
+}
+
 func (lr LoadRunner) generateChannelNames() []string {
 	channelNames := []string{}
 	for i := 0; i < lr.LoadSpec.NumChannels; i++ {
@@ -2,6 +2,9 @@ package sgload
 
 import (
 	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"time"
 
 	"github.com/inconshreveable/log15"
 	"github.com/satori/go.uuid"
@@ -10,61 +13,205 @@ import (
 // This is the specification for this load test scenario.  The values contained
 // here are common to all load test scenarios.
 type LoadSpec struct {
-	SyncGatewayUrl        string    // The Sync Gateway public URL with port and DB, eg "http://localhost:4984/db"
-	SyncGatewayAdminPort  int       // The Sync Gateway admin port, eg, 4985
-	MockDataStore         bool      // If true, will use a MockDataStore instead of a real sync gateway
-	StatsdEnabled         bool      // If true, will push stats to StatsdEndpoint
-	StatsdEndpoint        string    // The endpoint of the statds server, eg localhost:8125
-	StatsdPrefix          string    // The metrics prefix to use (for example, some hosted statsd services require a token)
-	TestSessionID         string    // A unique identifier for this test session.  It's used for creating channel names and possibly more
-	AttachSizeBytes       int       // If > 0, and BatchSize == 1, then it will add attachments of this size during doc creates/updates.
-	BatchSize             int       // How many docs to read (bulk_get) or write (bulk_docs) in bulk
-	NumChannels           int       // How many channels to create/use during this test
-	DocSizeBytes          int       // Doc size in bytes to create during this test
-	NumDocs               int       // Number of docs to read/write during this test
-	CompressionEnabled    bool      // Whether requests and responses should be compressed (when supported)
-	ExpvarProgressEnabled bool      // Whether to publish reader/writer/updater progress to expvars (disabled by default to not bloat expvar json)
-	LogLevel              log15.Lvl // The log level.  Defaults to LvlWarn
+	SyncGatewayUrl        string                  `yaml:"sg_url"`                  // The Sync Gateway public URL with port and DB, eg "http://localhost:4984/db"
+	SyncGatewayAdminPort  int                     `yaml:"sg_admin_port"`           // The Sync Gateway admin port, eg, 4985
+	SyncGatewayAdminUrl   string                  `yaml:"sg_admin_url"`            // The Sync Gateway admin URL with port and DB, eg "https://sg-admin:4985/db".  If set, SyncGatewayAdminPort isn't used
+	MockDataStore         bool                    `yaml:"mock_data_store"`         // If true, will use a MockDataStore instead of a real sync gateway
+	StatsdEnabled         bool                    `yaml:"statsd_enabled"`          // If true, will push stats to StatsdEndpoint
+	StatsdEndpoint        string                  `yaml:"statsd_endpoint"`         // The endpoint of the statds server, eg localhost:8125
+	StatsdPrefix          string                  `yaml:"statsd_prefix"`           // The metrics prefix to use (for example, some hosted statsd services require a token)
+	PrometheusEnabled     bool                    `yaml:"prometheus_enabled"`      // If true, will expose stats to Prometheus on the expvar port (at /metrics)
+	TestSessionID         string                  `yaml:"test_session_id"`         // A unique identifier for this test session.  It's used for creating channel names and possibly more
+	AttachSizeBytes       int                     `yaml:"attach_size_bytes"`       // If > 0, and BatchSize == 1, then it will add attachments of this size during doc creates/updates.
+	BatchSize             int                     `yaml:"batch_size"`              // How many docs to read (bulk_get) or write (bulk_docs) in bulk
+	NumChannels           int                     `yaml:"num_channels"`            // How many channels to create/use during this test
+	DocSizeBytes          int                     `yaml:"doc_size_bytes"`          // Doc size in bytes to create during this test
+	NumDocs               int                     `yaml:"num_docs"`                // Number of docs to read/write during this test
+	CompressionEnabled    bool                    `yaml:"compression_enabled"`     // Whether requests and responses should be compressed (when supported)
+	ExpvarProgressEnabled bool                    `yaml:"expvar_progress_enabled"` // Whether to publish reader/writer/updater progress to expvars (disabled by default to not bloat expvar json)
+	LogLevel              log15.Lvl               `yaml:"-"`                       // The log level.  Defaults to LvlWarn.  Set with "log_level" in scenario files
+	MaxErrors             int                     `yaml:"max_errors"`              // Abort the run once more than this many operations have failed.  Negative means no maximum
+	MaxErrorPercent       float64                 `yaml:"max_error_percent"`       // If > 0, abort the run once more than this percentage of operations have failed
+	DrainTimeout          time.Duration           `yaml:"drain_timeout"`           // Once a run is stopped (eg, SIGINT), how long in-flight requests get to finish before they're cancelled
+	Duration              time.Duration           `yaml:"duration"`                // If > 0, run for this long instead of until NumDocs have been written and read
+	ReportFile            string                  `yaml:"report_file"`             // If set, write the latency percentiles and progress stats of each run to this file as JSON
+	Protocol              ReplicationProtocol     `yaml:"protocol"`                // How the agents talk to Sync Gateway: "rest" (the default) or "blip"
+	HTTPClient            HTTPClientSpec          `yaml:"http_client"`             // How the agents' HTTP connections are pooled and kept alive
+	TLS                   TLSSpec                 `yaml:"tls"`                     // How the agents verify an https Sync Gateway, and the client certificate they present
+	Auth                  AuthSpec                `yaml:"auth"`                    // How the agents authenticate as their users
+	Admin                 AdminSpec               `yaml:"admin"`                   // How sgload authenticates to the admin API, and verifies its certificate
+	Keyspaces             []string                `yaml:"keyspaces"`               // The collections (Sync Gateway 3.1+) to spread docs across, as "scope.collection".  If empty, the default collection
+	DocGenerator          DocGeneratorSpec        `yaml:"doc_generator"`           // What the bodies of the docs look like
+	Seed                  int64                   `yaml:"seed"`                    // If non-zero, makes the random choices (channels, doc bodies, etc) the same in every run with this seed
+	Channels              ChannelDistributionSpec `yaml:"channels"`                // How the docs are spread across the channels
 
 }
 
 func (ls LoadSpec) Validate() error {
 
+	if ls.NumChannels <= 0 {
+		return fieldError("load.num_channels", "Number of channels must be greater than zero")
+	}
+
+	// The channel layout keeps the index of each doc's channels in a uint16
+	if ls.NumChannels > 65535 {
+		return fieldError("load.num_channels", "Number of channels must be at most 65535")
+	}
+
 	if ls.NumChannels > ls.NumDocs {
-		return fmt.Errorf("Number of channels must be less than or equal to number of docs")
+		return fieldError("load.num_channels", "Number of channels must be less than or equal to number of docs")
+	}
+
+	if ls.Duration < 0 {
+		return fieldError("load.duration", "Duration must not be negative")
+	}
+
+	if ls.MaxErrorPercent < 0 || ls.MaxErrorPercent > 100 {
+		return fieldError("load.max_error_percent", "Must be between 0 and 100")
+	}
+
+	switch ls.Protocol {
+	case "", PROTOCOL_REST, PROTOCOL_BLIP:
+	default:
+		return fieldError("load.protocol", "Unknown protocol %q.  Values: %s, %s", ls.Protocol, PROTOCOL_REST, PROTOCOL_BLIP)
+	}
+
+	if err := ls.HTTPClient.Validate(ls.SyncGatewayUrl); err != nil {
+		return err
+	}
+
+	if err := ls.TLS.Validate(); err != nil {
+		return err
+	}
+
+	if err := ls.Auth.Validate(); err != nil {
+		return err
+	}
+
+	if err := ls.DocGenerator.Validate(); err != nil {
+		return err
+	}
+
+	if err := ls.Channels.Validate(ls.NumChannels); err != nil {
+		return err
+	}
+
+	if err := ls.Admin.Validate(); err != nil {
+		return err
+	}
+
+	keyspaces, err := parseKeyspaces(ls.Keyspaces)
+	if err != nil {
+		return fieldError("load.keyspaces", "%v", err)
+	}
+	if ls.Protocol == PROTOCOL_BLIP && (len(keyspaces) > 1 || !keyspaces[0].IsDefault()) {
+		return fieldError("load.keyspaces", "Only the default collection is supported with the %s protocol", PROTOCOL_BLIP)
 	}
 
 	if ls.SyncGatewayUrl == "" {
-		return fmt.Errorf("%+v missing Sync Gateway URL", ls)
+		return fieldError("load.sg_url", "Missing Sync Gateway URL")
 	}
 	return nil
 }
 
+// Whether agents run until the Duration is up, rather than until a fixed amount of work is done
+func (ls LoadSpec) OpenEnded() bool {
+	return ls.Duration > 0
+}
+
+// The parsed keyspaces, or none if the run only uses the default collection.  The
+// spec must have been validated.
+func (ls LoadSpec) keyspaces() []Keyspace {
+	if len(ls.Keyspaces) == 0 {
+		return nil
+	}
+	keyspaces, _ := parseKeyspaces(ls.Keyspaces)
+	return keyspaces
+}
+
+func (ls LoadSpec) ErrorBudget() ErrorBudget {
+	return ErrorBudget{
+		MaxErrors:       ls.MaxErrors,
+		MaxErrorPercent: ls.MaxErrorPercent,
+	}
+}
+
 func (ls *LoadSpec) generateUserCreds(numUsers int, usernamePrefix string) []UserCred {
 	userCreds := []UserCred{}
 	for userId := 0; userId < numUsers; userId++ {
-		username := fmt.Sprintf(
-			"%s-user-%d-%s",
-			usernamePrefix,
-			userId,
-			ls.TestSessionID,
-		)
-		password := fmt.Sprintf(
-			"%s-passw0rd-%d-%s",
-			usernamePrefix,
-			userId,
-			ls.TestSessionID,
-		)
-		userCred := UserCred{
-			Username: username,
-			Password: password,
-		}
-		userCreds = append(userCreds, userCred)
-
+		userCreds = append(userCreds, ls.generateUserCred(userId, usernamePrefix))
 	}
 	return userCreds
 }
 
+// The credentials of a single user, which are the same for a given test session ID
+func (ls *LoadSpec) generateUserCred(userId int, usernamePrefix string) UserCred {
+	username := fmt.Sprintf(
+		"%s-user-%d-%s",
+		usernamePrefix,
+		userId,
+		ls.TestSessionID,
+	)
+	password := fmt.Sprintf(
+		"%s-passw0rd-%d-%s",
+		usernamePrefix,
+		userId,
+		ls.TestSessionID,
+	)
+	return UserCred{
+		Username: username,
+		Password: password,
+	}
+}
+
 func NewUuid() string {
 	return uuid.NewV4().String()
 }
+
+// A new test session ID, which is random unless there's a seed.  Seeded runs get the same
+// one, so that they have the same usernames, channel names and doc IDs.
+func NewTestSessionID(seed int64) string {
+	if seed == 0 {
+		return NewUuid()
+	}
+	return randomUuid(LoadSpec{Seed: seed}.agentRand("session", 0))
+}
+
+// The random number generator for the channel layout.  Without a Seed it's derived from
+// the test session ID rather than the time, since a readload run has to lay out the docs
+// the same way as the writeload run (with the same --testsessionid) that wrote them.
+func (ls LoadSpec) channelLayoutRand() *rand.Rand {
+	if ls.Seed != 0 {
+		return ls.agentRand("channels", 0)
+	}
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%s-channels", ls.TestSessionID)
+	return rand.New(rand.NewSource(int64(hash.Sum64())))
+}
+
+var (
+	// The date the timestamps in seeded runs' doc bodies are generated before
+	seededTimestampEpoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// The time the timestamps in doc bodies are generated before.  Seeded runs use a fixed
+// date rather than the time the run started, so that they generate the same bodies.
+func (ls LoadSpec) timestampEpoch() time.Time {
+	if ls.Seed != 0 {
+		return seededTimestampEpoch
+	}
+	return time.Now()
+}
+
+// The random number generator for one agent (eg, kind USER_PREFIX_WRITER and the writer's
+// ID).  It's derived from the seed, the kind and the ID, so that with a Seed each agent
+// makes the same random choices in every run, however the agents get scheduled.
+func (ls LoadSpec) agentRand(kind string, agentID int) *rand.Rand {
+	seed := ls.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%d-%s-%d", seed, kind, agentID)
+	return rand.New(rand.NewSource(int64(hash.Sum64())))
+}
@@ -0,0 +1,93 @@
+package sgload
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/peterbourgon/g2s"
+)
+
+var (
+	// The sample rate -- set this to 0.1 if you only want
+	// 10% of the samples to be pushed to statds, or .01 if you only
+	// want 1% of the samples pushed to statsd.  Useful for
+	// not overwhelming stats if you have too many samples.
+	statsdSampleRate float32 = 1.0
+)
+
+// Where agents and data stores push their metrics (eg, the "create_document" timing or
+// the "retries" counter).  A run can push to several sinks at once, see MultiMetricsSink.
+type MetricsSink interface {
+	Counter(name string, n int)
+	Timing(name string, d time.Duration)
+	Gauge(name string, value float64)
+}
+
+// Pushes metrics to every one of the sinks
+type MultiMetricsSink []MetricsSink
+
+func (m MultiMetricsSink) Counter(name string, n int) {
+	for _, sink := range m {
+		sink.Counter(name, n)
+	}
+}
+
+func (m MultiMetricsSink) Timing(name string, d time.Duration) {
+	for _, sink := range m {
+		sink.Timing(name, d)
+	}
+}
+
+func (m MultiMetricsSink) Gauge(name string, value float64) {
+	for _, sink := range m {
+		sink.Gauge(name, value)
+	}
+}
+
+// An impl of MetricsSink which ignores every metric
+type NoOpMetricsSink struct{}
+
+func (n NoOpMetricsSink) Counter(name string, count int) {}
+
+func (n NoOpMetricsSink) Timing(name string, d time.Duration) {}
+
+func (n NoOpMetricsSink) Gauge(name string, value float64) {}
+
+// Pushes metrics to statsd over UDP
+type StatsdMetricsSink struct {
+	Statter g2s.Statter
+}
+
+// Connect to the statsd server at the given endpoint (eg, localhost:8125).  If prefix
+// is non-empty, it's prepended to every metric name.
+func NewStatsdMetricsSink(endpoint, prefix string) (*StatsdMetricsSink, error) {
+
+	var statter g2s.Statter
+	var err error
+
+	// statter *should* be safe to be shared among multiple
+	// goroutines, based on fact that connection returned from Dial
+	if prefix != "" {
+		statter, err = g2s.DialWithPrefix("udp", endpoint, prefix)
+	} else {
+		statter, err = g2s.Dial("udp", endpoint)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsdMetricsSink{Statter: statter}, nil
+
+}
+
+func (s StatsdMetricsSink) Counter(name string, n int) {
+	s.Statter.Counter(statsdSampleRate, name, n)
+}
+
+func (s StatsdMetricsSink) Timing(name string, d time.Duration) {
+	s.Statter.Timing(statsdSampleRate, name, d)
+}
+
+func (s StatsdMetricsSink) Gauge(name string, value float64) {
+	s.Statter.Gauge(statsdSampleRate, name, fmt.Sprintf("%v", value))
+}
@@ -0,0 +1,37 @@
+package sgload
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMultiMetricsSink(t *testing.T) {
+
+	latencies := NewLatencyRecorder()
+	prometheusSink := NewPrometheusMetricsSink(prometheus.NewRegistry())
+	sinks := MultiMetricsSink{latencies, prometheusSink, NoOpMetricsSink{}}
+
+	sinks.Timing("create_document", 10*time.Millisecond)
+	sinks.Timing("create_document", 20*time.Millisecond)
+	sinks.Counter("retries", 3)
+	sinks.Gauge("num_writers", 5)
+
+	report := latencies.Report("writeload", time.Second)
+	if len(report.Operations) != 1 || report.Operations[0].Count != 2 {
+		t.Fatalf("Expected the latency recorder to get 2 create_document timings, got: %+v", report.Operations)
+	}
+
+	if n := testutil.CollectAndCount(prometheusSink.latencies); n != 1 {
+		t.Fatalf("Expected 1 Prometheus latency histogram, got %d", n)
+	}
+	if retries := testutil.ToFloat64(prometheusSink.counters.WithLabelValues("retries")); retries != 3 {
+		t.Fatalf("Expected Prometheus retries counter to be 3, got %v", retries)
+	}
+	if numWriters := testutil.ToFloat64(prometheusSink.gauges.WithLabelValues("num_writers")); numWriters != 5 {
+		t.Fatalf("Expected Prometheus num_writers gauge to be 5, got %v", numWriters)
+	}
+
+}
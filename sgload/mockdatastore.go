@@ -1,6 +1,7 @@
 package sgload
 
 import (
+	"context"
 	"log"
 
 	sgreplicate "github.com/couchbaselabs/sg-replicate"
@@ -12,33 +13,62 @@ func NewMockDataStore() *MockDataStore {
 	return &MockDataStore{}
 }
 
-func (m MockDataStore) CreateUser(u UserCred, channelNames []string) error {
+func (m MockDataStore) CreateUser(ctx context.Context, u UserCred, channelNames []string) error {
 	log.Printf("MockDataStore CreateUser called with %+v", u)
 	return nil
 }
 
-func (m MockDataStore) BulkCreateDocuments(docs []Document, newEdits bool) ([]DocumentMetadata, error) {
+func (m MockDataStore) BulkCreateDocuments(ctx context.Context, docs []Document, newEdits bool) ([]DocumentMetadata, error) {
 	log.Printf("MockDataStore BulkCreateDocuments called with %d docs", len(docs))
 	return []DocumentMetadata{}, nil
 }
 
-func (m MockDataStore) BulkCreateDocumentsRetry(docs []Document, newEdits bool) ([]DocumentMetadata, error) {
-	return m.BulkCreateDocumentsRetry(docs, newEdits)
+func (m MockDataStore) BulkCreateDocumentsRetry(ctx context.Context, docs []Document, newEdits bool) ([]DocumentMetadata, error) {
+	return m.BulkCreateDocuments(ctx, docs, newEdits)
+}
+
+// Docs aren't kept, so every keyspace is the same
+func (m *MockDataStore) WithKeyspace(keyspace Keyspace) DataStore {
+	return m
 }
 
 func (m *MockDataStore) SetUserCreds(u UserCred) {
 	// ignore these
 }
 
-func (m MockDataStore) Changes(sinceVal Sincer, limit int, feedType ChangesFeedType) (changes sgreplicate.Changes, newSinceVal Sincer, err error) {
+func (m MockDataStore) Changes(ctx context.Context, sinceVal Sincer, limit int, feedType ChangesFeedType) (changes sgreplicate.Changes, newSinceVal Sincer, err error) {
 	return sgreplicate.Changes{}, nil, nil
 }
 
-func (m MockDataStore) BulkGetDocuments(r sgreplicate.BulkGetRequest) ([]sgreplicate.Document, error) {
+func (m MockDataStore) BulkGetDocuments(ctx context.Context, r sgreplicate.BulkGetRequest) ([]sgreplicate.Document, error) {
 	return nil, nil
 }
 
-func (m MockDataStore) CreateDocument(doc Document, attachSizeBytes int, newEdits bool) (DocumentMetadata, error) {
+func (m MockDataStore) BulkGetDocumentsAttsSince(ctx context.Context, r sgreplicate.BulkGetRequest, attsSince map[string][]string) ([]sgreplicate.Document, error) {
+	return m.BulkGetDocuments(ctx, r)
+}
+
+func (m MockDataStore) DeleteDocuments(ctx context.Context, docs []DocumentMetadata) ([]DocumentMetadata, error) {
+	return docs, nil
+}
+
+func (m MockDataStore) PurgeDocuments(ctx context.Context, docIds []string) error {
+	return nil
+}
+
+func (m MockDataStore) RevsDiff(ctx context.Context, revs map[string][]string) (map[string][]string, error) {
+	return revs, nil
+}
+
+func (m MockDataStore) GetCheckpoint(ctx context.Context, id string) (Checkpoint, error) {
+	return Checkpoint{ID: id}, nil
+}
+
+func (m MockDataStore) SetCheckpoint(ctx context.Context, checkpoint Checkpoint) (Checkpoint, error) {
+	return checkpoint, nil
+}
+
+func (m MockDataStore) CreateDocument(ctx context.Context, doc Document, attachSizeBytes int, newEdits bool) (DocumentMetadata, error) {
 	return DocumentMetadata{}, nil
 }
 
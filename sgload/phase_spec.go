@@ -0,0 +1,65 @@
+package sgload
+
+import (
+	"fmt"
+	"time"
+)
+
+// One phase of a phased gateload run.  At the start of the phase, the number of
+// writers, readers and updaters that are set are changed to the given numbers
+// (either all at once, or ramped linearly over the phase if Ramp is true), and
+// anything that isn't set keeps running as it was in the previous phase.  For
+// example, these phases ramp up the writers, hold, then add readers and finally
+// stop the updaters:
+//
+//	phases:
+//	  - name: ramp-up
+//	    duration: 5m
+//	    writers: 1000
+//	    updaters: 100
+//	    ramp: true
+//	  - name: steady-state
+//	    duration: 30m
+//	  - name: add-readers
+//	    duration: 10m
+//	    readers: 500
+//	  - name: stop-updaters
+//	    duration: 10m
+//	    updaters: 0
+//
+// Every run starts with no agents, and they're all stopped after the last phase.
+type PhaseSpec struct {
+	Name     string        `yaml:"name"`     // Used to label the stats of this phase.  Defaults to "phase-N"
+	Duration time.Duration `yaml:"duration"` // How long the phase lasts, including the ramp
+	Writers  *int          `yaml:"writers"`  // If set, the number of writers to have running by the end of the ramp
+	Readers  *int          `yaml:"readers"`  // If set, the number of readers to have running by the end of the ramp
+	Updaters *int          `yaml:"updaters"` // If set, the number of updaters to have running by the end of the ramp
+	Ramp     bool          `yaml:"ramp"`     // If true, add or stop agents gradually over the whole phase rather than all at once
+}
+
+func (ps PhaseSpec) Validate(index int) error {
+
+	field := func(name string) string {
+		return fmt.Sprintf("phases[%d].%s", index, name)
+	}
+
+	if ps.Duration <= 0 {
+		return fieldError(field("duration"), "Duration must be greater than zero")
+	}
+
+	for name, numAgents := range map[string]*int{"writers": ps.Writers, "readers": ps.Readers, "updaters": ps.Updaters} {
+		if numAgents != nil && *numAgents < 0 {
+			return fieldError(field(name), "Number of %s must not be negative", name)
+		}
+	}
+
+	return nil
+}
+
+// The name of the phase at the given index, for logs and stats
+func (ps PhaseSpec) nameOrDefault(index int) string {
+	if ps.Name != "" {
+		return ps.Name
+	}
+	return fmt.Sprintf("phase-%d", index+1)
+}
@@ -0,0 +1,97 @@
+package sgload
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// Where the Prometheus metrics are served, on the same port as the expvars
+	PrometheusMetricsPath = "/metrics"
+)
+
+var (
+	// Package-wide singleton, since the metrics can only be registered once
+	// even if several runs happen in this process (eg, readload + writeload)
+	prometheusSink     *PrometheusMetricsSink
+	prometheusSinkOnce sync.Once
+)
+
+// Exposes metrics to Prometheus.  Each metric name (eg, "create_document") becomes
+// the "name" label of one of:
+//
+//	sgload_events_total       counter
+//	sgload_latency_seconds    histogram
+//	sgload_gauge              gauge
+type PrometheusMetricsSink struct {
+	counters  *prometheus.CounterVec
+	latencies *prometheus.HistogramVec
+	gauges    *prometheus.GaugeVec
+}
+
+// Returns the Prometheus sink, and on the first call, registers its metrics and
+// serves them on PrometheusMetricsPath of http.DefaultServeMux, which is what the
+// expvar port serves.
+func SharedPrometheusMetricsSink() *PrometheusMetricsSink {
+
+	prometheusSinkOnce.Do(func() {
+		registry := prometheus.NewRegistry()
+		prometheusSink = NewPrometheusMetricsSink(registry)
+		http.Handle(PrometheusMetricsPath, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	})
+	return prometheusSink
+
+}
+
+// Create the metrics and register them with the given registerer
+func NewPrometheusMetricsSink(registerer prometheus.Registerer) *PrometheusMetricsSink {
+
+	sink := &PrometheusMetricsSink{
+		counters: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "sgload",
+				Name:      "events_total",
+				Help:      "Number of events (eg, retries) by name",
+			},
+			[]string{"name"},
+		),
+		latencies: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "sgload",
+				Name:      "latency_seconds",
+				Help:      "Latency of operations (eg, create_document, changes_feed) by name",
+				Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 20), // 0.5ms up to ~4.4 minutes
+			},
+			[]string{"name"},
+		),
+		gauges: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "sgload",
+				Name:      "gauge",
+				Help:      "Current value of gauges by name",
+			},
+			[]string{"name"},
+		),
+	}
+
+	registerer.MustRegister(sink.counters, sink.latencies, sink.gauges)
+
+	return sink
+
+}
+
+func (p *PrometheusMetricsSink) Counter(name string, n int) {
+	p.counters.WithLabelValues(name).Add(float64(n))
+}
+
+func (p *PrometheusMetricsSink) Timing(name string, d time.Duration) {
+	p.latencies.WithLabelValues(name).Observe(d.Seconds())
+}
+
+func (p *PrometheusMetricsSink) Gauge(name string, value float64) {
+	p.gauges.WithLabelValues(name).Set(value)
+}
@@ -0,0 +1,135 @@
+package sgload
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	sgreplicate "github.com/couchbaselabs/sg-replicate"
+)
+
+// Makes readers pull like a Couchbase Lite 1.x pull replicator, which keeps where it got
+// to in a checkpoint on Sync Gateway, rather than only in memory
+type PullReplicatorSpec struct {
+	Enabled bool `yaml:"enabled"`
+
+	// How often each reader saves its checkpoint, if it has pulled more changes since it
+	// last did.  Zero saves it after every batch of changes, which is the most load a
+	// reader can put on Sync Gateway with its checkpoints.
+	CheckpointIntervalMs int `yaml:"checkpoint_interval_ms"`
+}
+
+func (prs PullReplicatorSpec) Validate(loadSpec LoadSpec) error {
+	if prs.CheckpointIntervalMs < 0 {
+		return fieldError("read.pull_replicator.checkpoint_interval_ms", "CheckpointIntervalMs must not be negative")
+	}
+	if prs.Enabled && loadSpec.Protocol == PROTOCOL_BLIP {
+		return fieldError("read.pull_replicator.enabled", "Can't be used with the BLIP protocol, which has its own checkpoints")
+	}
+	return nil
+}
+
+func (prs PullReplicatorSpec) checkpointInterval() time.Duration {
+	return time.Duration(prs.CheckpointIntervalMs) * time.Millisecond
+}
+
+// The state of a reader's pull replication from one keyspace
+type pullReplication struct {
+	checkpoint       Checkpoint
+	checkpointLoaded bool              // Whether the checkpoint has been read (or needs to be again, eg after a conflict saving it)
+	since            StringSincer      // The since value of the last changes the reader has finished with
+	lastSaved        time.Time         // When the checkpoint was last saved
+	pulledRevs       map[string]string // The latest revision pulled of each doc, which is listed in atts_since
+}
+
+func newPullReplication() *pullReplication {
+	return &pullReplication{pulledRevs: map[string]string{}}
+}
+
+// The checkpoint is per user, like it's per device for Couchbase Lite, so a reader
+// with the same user (eg, from a run with the same --testsessionid) resumes from it
+func (r *Reader) pullCheckpointID() string {
+	return fmt.Sprintf("sgload-pull-%s", r.UserCred.Username)
+}
+
+// Get the checkpoint, and return the since value the reader should start from
+func (r *Reader) resumePullReplication(ctx context.Context, feed *keyspaceFeed) (StringSincer, error) {
+
+	replication := feed.pullReplication
+	checkpoint, err := feed.dataStore.GetCheckpoint(ctx, r.pullCheckpointID())
+	if err != nil {
+		return StringSincer{}, fmt.Errorf("Error getting checkpoint: %v", err)
+	}
+	replication.checkpoint = checkpoint
+	replication.checkpointLoaded = true
+	replication.since = StringSincer{Since: checkpoint.LastSequence}
+
+	if !replication.since.Empty() {
+		logger.Info("Resuming from checkpoint", "agent.ID", r.ID, "keyspace", feed.keyspace, "since", replication.since)
+	}
+	return replication.since, nil
+
+}
+
+// Get the docs with _bulk_get, listing the revisions already pulled of each in atts_since
+func (r *Reader) pullDocs(ctx context.Context, feed *keyspaceFeed, bulkGetRequest sgreplicate.BulkGetRequest) ([]sgreplicate.Document, error) {
+
+	replication := feed.pullReplication
+	if replication == nil {
+		return feed.dataStore.BulkGetDocuments(ctx, bulkGetRequest)
+	}
+
+	attsSince := map[string][]string{}
+	for _, doc := range bulkGetRequest.Docs {
+		if pulledRev, ok := replication.pulledRevs[doc.Id]; ok {
+			attsSince[doc.Id] = []string{pulledRev}
+		}
+	}
+
+	docs, err := feed.dataStore.BulkGetDocumentsAttsSince(ctx, bulkGetRequest, attsSince)
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range bulkGetRequest.Docs {
+		replication.pulledRevs[doc.Id] = doc.Revision
+	}
+	return docs, nil
+
+}
+
+// Save the since value of the changes the reader has finished with in the checkpoint, if
+// it has changed and it's been CheckpointIntervalMs since it was last saved (or force is
+// set, eg when the reader stops).  Like a real replicator, failing to save it doesn't stop
+// the reader, but the checkpoint is read again before the next save, in case it was a conflict.
+func (r *Reader) maybeSavePullCheckpoint(ctx context.Context, feed *keyspaceFeed, force bool) {
+
+	replication := feed.pullReplication
+	if replication.since.Empty() || replication.since.String() == replication.checkpoint.LastSequence {
+		return
+	}
+	if !force && time.Since(replication.lastSaved) < r.PullReplicator.checkpointInterval() {
+		return
+	}
+
+	if !replication.checkpointLoaded {
+		checkpoint, err := feed.dataStore.GetCheckpoint(ctx, r.pullCheckpointID())
+		if err != nil {
+			logger.Warn("Error getting checkpoint", "reader", r.UserCred.Username, "keyspace", feed.keyspace, "error", err)
+			return
+		}
+		replication.checkpoint = checkpoint
+		replication.checkpointLoaded = true
+	}
+
+	checkpoint := replication.checkpoint
+	checkpoint.LastSequence = replication.since.String()
+	saved, err := feed.dataStore.SetCheckpoint(ctx, checkpoint)
+	if err != nil {
+		logger.Warn("Error saving checkpoint", "reader", r.UserCred.Username, "keyspace", feed.keyspace, "since", replication.since, "error", err)
+		replication.checkpointLoaded = false
+		return
+	}
+	replication.checkpoint = saved
+	replication.lastSaved = time.Now()
+
+}
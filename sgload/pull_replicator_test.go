@@ -0,0 +1,112 @@
+package sgload
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/sgload/sgsimulator"
+)
+
+// Run a pull replicator reader until it has pulled the docs expected
+func runPullReplicatorReader(t *testing.T, dataStore *SGDataStore, userCreds UserCred, numDocsExpected int) *countingMetricsSink {
+
+	readerDataStore := *dataStore
+	readerDataStore.SetUserCreds(userCreds)
+	metrics := newCountingMetricsSink()
+	readerDataStore.Metrics = metrics
+
+	finishedWg := &sync.WaitGroup{}
+	finishedWg.Add(1)
+	reader := NewReader(AgentSpec{
+		FinishedWg:        finishedWg,
+		UserCred:          userCreds,
+		DataStore:         &readerDataStore,
+		AllSGUsersCreated: &sync.WaitGroup{},
+	})
+	reader.SetFeedType(FEED_TYPE_NORMAL)
+	reader.SetChannels([]string{"ABC"})
+	reader.SetNumDocsExpected(numDocsExpected)
+	reader.SetPullReplicator(PullReplicatorSpec{Enabled: true})
+	reader.SetMetricsSink(metrics)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	reader.Run(ctx)
+	if ctx.Err() != nil {
+		t.Fatalf("Reader did not pull the %d docs expected", numDocsExpected)
+	}
+	return metrics
+
+}
+
+func TestPullReplicatorResumesFromCheckpoint(t *testing.T) {
+
+	_, dataStore, cleanup := newSimulatorDataStore(t, sgsimulator.FaultConfig{})
+	defer cleanup()
+
+	ctx := context.Background()
+	userCreds := UserCred{Username: "puller", Password: "password"}
+	if err := dataStore.CreateUser(ctx, userCreds, []string{"ABC"}); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	if _, err := dataStore.BulkCreateDocuments(ctx, docsToWrite("doc", 3, []string{"ABC"}), true); err != nil {
+		t.Fatalf("Error creating docs: %v", err)
+	}
+
+	metrics := runPullReplicatorReader(t, dataStore, userCreds, 3)
+	if metrics.timingCount("get_checkpoint") != 1 || metrics.timingCount("set_checkpoint") == 0 {
+		t.Fatalf("Expected the checkpoint to be read once and saved")
+	}
+
+	readerDataStore := *dataStore
+	readerDataStore.SetUserCreds(userCreds)
+	checkpoint, err := readerDataStore.GetCheckpoint(ctx, "sgload-pull-puller")
+	if err != nil || checkpoint.LastSequence != "3" {
+		t.Fatalf("Unexpected checkpoint: %+v, %v", checkpoint, err)
+	}
+
+	// A reader restarting with the same user only pulls the docs written since
+	if _, err := dataStore.BulkCreateDocuments(ctx, docsToWrite("more", 1, []string{"ABC"}), true); err != nil {
+		t.Fatalf("Error creating docs: %v", err)
+	}
+	metrics = runPullReplicatorReader(t, dataStore, userCreds, 1)
+	if pulled := metrics.counter("get_document_counter"); pulled != 1 {
+		t.Fatalf("Expected the restarted reader to pull 1 doc, got %d", pulled)
+	}
+
+}
+
+// A reader that can't get its checkpoint waits longer after each failure before trying
+// again, rather than hammering _local
+func TestPullReplicatorBacksOffWhenCheckpointFails(t *testing.T) {
+
+	faultConfig := sgsimulator.FaultConfig{
+		Endpoints: map[string]sgsimulator.EndpointFaults{
+			sgsimulator.EndpointLocal: {ErrorRate: 1, ErrorStatus: 400, MaxErrors: 3},
+		},
+	}
+	sim, dataStore, cleanup := newSimulatorDataStore(t, faultConfig)
+	defer cleanup()
+
+	defer func(initial time.Duration) { failedPullInitialBackoff = initial }(failedPullInitialBackoff)
+	failedPullInitialBackoff = 50 * time.Millisecond
+
+	ctx := context.Background()
+	userCreds := UserCred{Username: "puller", Password: "password"}
+	if err := dataStore.CreateUser(ctx, userCreds, []string{"ABC"}); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	if _, err := dataStore.BulkCreateDocuments(ctx, docsToWrite("doc", 1, []string{"ABC"}), true); err != nil {
+		t.Fatalf("Error creating docs: %v", err)
+	}
+
+	// The waits after the three failures are 50ms, 100ms and 200ms
+	start := time.Now()
+	runPullReplicatorReader(t, dataStore, userCreds, 1)
+	if elapsed := time.Since(start); sim.FaultCount(sgsimulator.EndpointLocal, "error") != 3 || elapsed < 350*time.Millisecond {
+		t.Fatalf("Expected 3 failed checkpoint requests over at least 350ms, got %d over %v", sim.FaultCount(sgsimulator.EndpointLocal, "error"), elapsed)
+	}
+
+}
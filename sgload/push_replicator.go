@@ -0,0 +1,161 @@
+package sgload
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	sgreplicate "github.com/couchbaselabs/sg-replicate"
+)
+
+// Makes writers push their docs like a Couchbase Lite 1.x push replicator, rather than
+// just creating them with _bulk_docs
+type PushReplicatorSpec struct {
+	Enabled bool `yaml:"enabled"`
+
+	// How many of the revisions the writer has already pushed to ask about again in each
+	// _revs_diff, like a replicator does when it restarts from an older checkpoint.  Sync
+	// Gateway reports them as not missing, so they aren't sent again.
+	NumKnownRevs int `yaml:"num_known_revs"`
+}
+
+func (prs PushReplicatorSpec) Validate(loadSpec LoadSpec) error {
+	if prs.NumKnownRevs < 0 {
+		return fieldError("write.push_replicator.num_known_revs", "NumKnownRevs must not be negative")
+	}
+	if !prs.Enabled {
+		return nil
+	}
+	if loadSpec.Protocol == PROTOCOL_BLIP {
+		return fieldError("write.push_replicator.enabled", "Can't be used with the BLIP protocol, which has its own way of pushing revisions")
+	}
+	if loadSpec.AttachSizeBytes > 0 {
+		return fieldError("write.push_replicator.enabled", "Can't be used with attachments yet")
+	}
+	return nil
+}
+
+// The state of a writer's push replication to one keyspace
+type pushReplication struct {
+	checkpoint       Checkpoint
+	checkpointLoaded bool                               // Whether the checkpoint has been read (or needs to be again, eg after a conflict saving it)
+	sequence         int                                // The writer's local sequence, which is the number of docs it has pushed
+	knownRevs        []sgreplicate.DocumentRevisionPair // The latest revisions pushed, to ask about again in each _revs_diff
+}
+
+func (w *Writer) pushReplication(keyspace Keyspace) *pushReplication {
+	if w.pushReplications == nil {
+		w.pushReplications = map[Keyspace]*pushReplication{}
+	}
+	replication, ok := w.pushReplications[keyspace]
+	if !ok {
+		replication = &pushReplication{}
+		w.pushReplications[keyspace] = replication
+	}
+	return replication
+}
+
+// The checkpoint is per user, like it's per device for Couchbase Lite
+func (w *Writer) pushCheckpointID() string {
+	return fmt.Sprintf("sgload-push-%s", w.UserCred.Username)
+}
+
+// Push the docs like a Couchbase Lite 1.x push replicator: get the checkpoint (the first
+// time), give the docs their first revisions, ask Sync Gateway which of those (and of
+// NumKnownRevs it already has) it's missing with _revs_diff, send the missing ones with
+// new_edits=false and their _revisions, and then save the checkpoint.
+func (w *Writer) pushDocs(ctx context.Context, keyspace Keyspace, dataStore DataStore, docs []Document) ([]DocumentMetadata, error) {
+
+	replication := w.pushReplication(keyspace)
+	if !replication.checkpointLoaded {
+		checkpoint, err := dataStore.GetCheckpoint(ctx, w.pushCheckpointID())
+		if err != nil {
+			return nil, fmt.Errorf("Error getting checkpoint: %v", err)
+		}
+		replication.checkpoint = checkpoint
+		replication.checkpointLoaded = true
+	}
+
+	// Docs being pushed again keep the revisions they were given the first time
+	revs := map[string][]string{}
+	for _, doc := range docs {
+		if doc.Revision() == "" {
+			revId := createRevID(1, "", doc)
+			_, digest := parseRevID(revId)
+			doc.SetRevision(revId)
+			doc.SetRevisions(1, []string{digest})
+		}
+		revs[doc.Id()] = append(revs[doc.Id()], doc.Revision())
+	}
+	for _, knownRev := range replication.knownRevs {
+		revs[knownRev.Id] = append(revs[knownRev.Id], knownRev.Revision)
+	}
+
+	missing, err := dataStore.RevsDiff(ctx, revs)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting revs diff: %v", err)
+	}
+
+	docsToSend := []Document{}
+	alreadyPushed := []DocumentMetadata{}
+	for _, doc := range docs {
+		if containedIn(doc.Revision(), missing[doc.Id()]) {
+			docsToSend = append(docsToSend, doc)
+			continue
+		}
+		alreadyPushed = append(alreadyPushed, DocumentMetadata{
+			DocumentRevisionPair: sgreplicate.DocumentRevisionPair{Id: doc.Id(), Revision: doc.Revision()},
+			Channels:             doc.channelNames(),
+		})
+	}
+	numMissing := 0
+	for _, missingRevs := range missing {
+		numMissing += len(missingRevs)
+	}
+	if w.Metrics != nil {
+		w.Metrics.Counter("push_known_revs", len(replication.knownRevs)+len(docs)-numMissing)
+	}
+
+	pushed := alreadyPushed
+	if len(docsToSend) > 0 {
+		sent, err := dataStore.BulkCreateDocumentsRetry(ctx, docsToSend, false)
+		if err != nil {
+			return nil, err
+		}
+		pushed = append(pushed, sent...)
+	}
+
+	replication.sequence += len(docs)
+	replication.rememberPushed(pushed, w.PushReplicator.NumKnownRevs)
+	w.savePushCheckpoint(ctx, dataStore, replication)
+
+	return pushed, nil
+
+}
+
+// Keep the latest numKnownRevs revisions pushed, to ask about again
+func (p *pushReplication) rememberPushed(pushed []DocumentMetadata, numKnownRevs int) {
+	for _, doc := range pushed {
+		p.knownRevs = append(p.knownRevs, doc.DocumentRevisionPair)
+	}
+	if len(p.knownRevs) > numKnownRevs {
+		p.knownRevs = p.knownRevs[len(p.knownRevs)-numKnownRevs:]
+	}
+}
+
+// Save the writer's sequence in the checkpoint.  Like a real replicator, failing to save
+// it doesn't stop the writer, but the checkpoint is read again before the next save, in
+// case it was a conflict.
+func (w *Writer) savePushCheckpoint(ctx context.Context, dataStore DataStore, replication *pushReplication) {
+
+	checkpoint := replication.checkpoint
+	checkpoint.LastSequence = strconv.Itoa(replication.sequence)
+	saved, err := dataStore.SetCheckpoint(ctx, checkpoint)
+	if err != nil {
+		logger.Warn("Error saving checkpoint", "writer", w.UserCred.Username, "checkpoint", checkpoint.ID, "error", err)
+		replication.checkpointLoaded = false
+		return
+	}
+	replication.checkpoint = saved
+
+}
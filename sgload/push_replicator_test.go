@@ -0,0 +1,70 @@
+package sgload
+
+import (
+	"context"
+	"testing"
+
+	"github.com/couchbaselabs/sgload/sgsimulator"
+)
+
+func TestPushDocs(t *testing.T) {
+
+	_, dataStore, cleanup := newSimulatorDataStore(t, sgsimulator.FaultConfig{})
+	defer cleanup()
+
+	ctx := context.Background()
+	userCreds := UserCred{Username: "pusher", Password: "password"}
+	if err := dataStore.CreateUser(ctx, userCreds, []string{"*"}); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	dataStore.SetUserCreds(userCreds)
+
+	metrics := newCountingMetricsSink()
+	writer := NewWriter(
+		AgentSpec{UserCred: userCreds, DataStore: dataStore},
+		WriterSpec{PushReplicator: &PushReplicatorSpec{Enabled: true, NumKnownRevs: 2}},
+	)
+	writer.SetMetricsSink(metrics)
+
+	firstDocs := docsToWrite("first", 3, []string{"ABC"})
+	pushed, err := writer.writeDocs(ctx, firstDocs)
+	if err != nil || len(pushed) != 3 {
+		t.Fatalf("Error pushing docs: %+v, %v", pushed, err)
+	}
+	if generation, _ := parseRevID(pushed[0].Revision); generation != 1 {
+		t.Fatalf("Expected the pushed docs to be at generation 1, got %v", pushed[0].Revision)
+	}
+	if known := metrics.counter("push_known_revs"); known != 0 {
+		t.Fatalf("Expected no known revs on the first push, got %d", known)
+	}
+
+	// The last 2 revs pushed are asked about again, and Sync Gateway already has them
+	pushed, err = writer.writeDocs(ctx, docsToWrite("second", 3, []string{"ABC"}))
+	if err != nil || len(pushed) != 3 {
+		t.Fatalf("Error pushing docs: %+v, %v", pushed, err)
+	}
+	if known := metrics.counter("push_known_revs"); known != 2 {
+		t.Fatalf("Expected 2 known revs, got %d", known)
+	}
+
+	// Pushing the same revisions again doesn't send them, but still returns them
+	pushed, err = writer.writeDocs(ctx, firstDocs)
+	if err != nil || len(pushed) != 3 {
+		t.Fatalf("Error pushing docs again: %+v, %v", pushed, err)
+	}
+	if known := metrics.counter("push_known_revs"); known != 7 {
+		t.Fatalf("Expected 7 known revs, got %d", known)
+	}
+	if numDocs := numDocsInChanges(t, dataStore); numDocs != 6 {
+		t.Fatalf("Expected 6 docs on the changes feed, got %d", numDocs)
+	}
+
+	checkpoint, err := dataStore.GetCheckpoint(ctx, writer.pushCheckpointID())
+	if err != nil {
+		t.Fatalf("Error getting checkpoint: %v", err)
+	}
+	if checkpoint.LastSequence != "9" || checkpoint.Rev == "" {
+		t.Fatalf("Unexpected checkpoint: %+v", checkpoint)
+	}
+
+}
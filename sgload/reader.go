@@ -1,8 +1,10 @@
 package sgload
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	sgreplicate "github.com/couchbaselabs/sg-replicate"
@@ -10,19 +12,55 @@ import (
 
 type Reader struct {
 	Agent
-	SGChannels                []string // The Sync Gateway channels this reader is assigned to pull from
-	NumDocsExpected           int      // The total number of docs this reader is expected to pull'
-	NumRevGenerationsExpected int      // The expected generate that each doc is expected to reach
-	BatchSize                 int      // The number of docs to pull in batch (_changes feed and bulk_get)
+	SGChannels                []string            // The Sync Gateway channels this reader is assigned to pull from
+	NumDocsExpected           int                 // The total number of docs this reader is expected to pull'
+	NumRevGenerationsExpected int                 // The expected generate that each doc is expected to reach
+	BatchSize                 int                 // The number of docs to pull in batch (_changes feed and bulk_get)
+	ExpectTombstones          bool                // Whether docs get deleted (by the deleters), so that the expected generation of each doc is its tombstone
+	NumLeavesExpected         int                 // The number of leaf revisions each doc ends up with: more than 1 if updaters put the docs in conflict
+	PullReplicator            *PullReplicatorSpec // If set, the reader pulls like a pull replicator, keeping where it got to in a _local checkpoint
+	AccessRegistry            *AccessRegistry     // If set, access churners grant and revoke the reader's channels, and the reader checks its changes feed keeps up
+	access                    *accessTracker
 	lastNumRevs               int
-	feedType                  ChangesFeedType // Whether to use "feedtype=normal" or "feedtype=longpoll"
+	feedType                  ChangesFeedType // Whether to use "feedtype=normal" or "feedtype=longpoll", or hold a streaming feed open
 
 }
 
+// The changes feed of one of the keyspaces a reader pulls from.  Each has its own since
+// value and, for the streaming feed types, its own connection.
+type keyspaceFeed struct {
+	keyspace            Keyspace
+	dataStore           DataStore        // Works on the docs and changes feed of the keyspace
+	metrics             MetricsSink      // Tags the reader's metrics with the keyspace
+	changesStream       *ChangesStream   // The open changes feed, for the streaming feed types
+	changesStreamOpened bool             // Whether a changes feed has been opened before, so opening another one is a reconnect
+	pullReplication     *pullReplication // The checkpoint and the revisions pulled, if the reader is a pull replicator
+}
+
+// The result of pulling from one of the feeds, for the reader's main loop
+type keyspaceFeedResult struct {
+	pullMoreDocsResult
+	err error
+}
+
+// The docs pulled were wrong (eg, in the wrong channel), which pulling the same changes
+// again would find again, so the reader stops rather than retrying
+type verifyError struct {
+	error
+}
+
 const (
 	CHANGES_LIMIT = 100
 )
 
+var (
+	// How long a feed waits before pulling again after a failed pull, doubling after each
+	// failure in a row up to the max, so that an error that keeps happening doesn't turn
+	// into a hot loop
+	failedPullInitialBackoff = 500 * time.Millisecond
+	failedPullMaxBackoff     = 30 * time.Second
+)
+
 func NewReader(agentSpec AgentSpec) *Reader {
 
 	reader := Reader{
@@ -54,6 +92,10 @@ func (r *Reader) SetNumDocsExpected(n int) {
 
 func (r *Reader) SetNumRevGenerationsExpected(n int) {
 	r.NumRevGenerationsExpected = n
+	if r.OpenEnded {
+		// No fixed number of revs to expect
+		return
+	}
 	totalRevsExpected := int64(r.NumDocsExpected * r.NumRevGenerationsExpected)
 	r.ExpVarStats.Add(
 		"TotalRevsExpected",
@@ -63,19 +105,34 @@ func (r *Reader) SetNumRevGenerationsExpected(n int) {
 
 }
 
+func (r *Reader) SetExpectTombstones(expectTombstones bool) {
+	r.ExpectTombstones = expectTombstones
+}
+
+func (r *Reader) SetNumLeavesExpected(n int) {
+	r.NumLeavesExpected = n
+}
+
+func (r *Reader) SetPullReplicator(spec PullReplicatorSpec) {
+	r.PullReplicator = &spec
+}
+
+func (r *Reader) SetAccessRegistry(registry *AccessRegistry) {
+	r.AccessRegistry = registry
+}
+
 func (r *Reader) SetBatchSize(batchSize int) {
 	r.BatchSize = batchSize
 }
 
 func (r *Reader) pushPostRunTimingStats(numDocsPulled int, timeStartedCreatingDocs time.Time) {
-	if r.StatsdClient == nil {
+	if r.Metrics == nil {
 		return
 	}
 	delta := time.Since(timeStartedCreatingDocs)
 
 	// How long it took for this reader to read all of its docs
-	r.StatsdClient.Timing(
-		statsdSampleRate,
+	r.Metrics.Timing(
 		"get_all_documents",
 		delta,
 	)
@@ -84,8 +141,7 @@ func (r *Reader) pushPostRunTimingStats(numDocsPulled int, timeStartedCreatingDo
 		// Average time it took to read each doc from
 		// the changes feed and the doc itself
 		deltaChangeAndDoc := time.Duration(int64(delta) / int64(numDocsPulled))
-		r.StatsdClient.Timing(
-			statsdSampleRate,
+		r.Metrics.Timing(
 			"get_change_and_document",
 			deltaChangeAndDoc,
 		)
@@ -95,18 +151,22 @@ func (r *Reader) pushPostRunTimingStats(numDocsPulled int, timeStartedCreatingDo
 
 }
 
-// Main loop of reader goroutine
-func (r *Reader) Run() {
+// Main loop of reader goroutine.  Runs until all the expected docs and revs have
+// been pulled, or ctx is done.  In an open-ended run it keeps following the changes
+// feed until ctx is done, without keeping track of every doc it has seen.
+func (r *Reader) Run(ctx context.Context) {
 
-	since := StringSincer{}
-	result := pullMoreDocsResult{}
 	latestDocIdRevs := map[string]int{}
-	var err error
+	numRevsPulledOpenEnded := 0
 	var timeStartedCreatingDocs time.Time
 
 	defer r.FinishedWg.Done()
 	defer func() {
-		r.pushPostRunTimingStats(len(latestDocIdRevs), timeStartedCreatingDocs)
+		numDocsPulled := len(latestDocIdRevs)
+		if r.OpenEnded {
+			numDocsPulled = numRevsPulledOpenEnded
+		}
+		r.pushPostRunTimingStats(numDocsPulled, timeStartedCreatingDocs)
 	}()
 	defer func() {
 		logger.Info(
@@ -116,22 +176,106 @@ func (r *Reader) Run() {
 		)
 	}()
 
-	r.createReaderSGUserIfNeeded()
+	requestCtx, cancelRequests := r.requestContext(ctx)
+	defer cancelRequests()
+
+	if err := r.createReaderSGUserIfNeeded(requestCtx); err != nil {
+		r.reportError("create_user", err)
+		return
+	}
+
+	// Once the user exists, the churners can change its access
+	var accessChanges <-chan AccessChange
+	var accessTicks <-chan time.Time
+	if r.AccessRegistry != nil {
+		subscriber := r.AccessRegistry.register(r.UserCred.Username, r.SGChannels)
+		defer r.AccessRegistry.unregister(subscriber)
+		r.access = newAccessTracker(subscriber, r.AccessRegistry.VisibilityTimeout, r.Metrics)
+		accessChanges = subscriber.changes
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		accessTicks = ticker.C
+	}
+
+	feeds, err := r.keyspaceFeeds()
+	if err != nil {
+		r.reportError("read", err)
+		return
+	}
 
 	r.waitUntilAllSGUsersCreated()
 
 	timeStartedCreatingDocs = time.Now()
 
+	// Follow the feeds until the reader is done, and then wait for them to stop
+	// (finishing any _bulk_get in flight) before cancelling the requests
+	followCtx, stopFollowing := context.WithCancel(ctx)
+	followersWg := &sync.WaitGroup{}
+	results := make(chan keyspaceFeedResult)
+	for _, feed := range feeds {
+		followersWg.Add(1)
+		go r.followFeed(followCtx, requestCtx, feed, results, followersWg)
+	}
+	defer followersWg.Wait()
+	defer stopFollowing()
+
 	for {
 
-		if r.isFinished(latestDocIdRevs) {
-			break
+		if ctx.Err() != nil {
+			logger.Info("Reader stopped", "agent.ID", r.ID)
+			return
+		}
+
+		if !r.OpenEnded {
+			finished, err := r.isFinished(latestDocIdRevs)
+			if err != nil {
+				r.reportError("verify", err)
+				return
+			}
+			if finished {
+				break
+			}
+		}
+
+		var result keyspaceFeedResult
+		select {
+		case result = <-results:
+		case change := <-accessChanges:
+			r.access.accessChanged(change)
+			continue
+		case now := <-accessTicks:
+			for _, err := range r.access.overdue(now) {
+				logger.Error("Changes feed didn't keep up with access change", "agent.ID", r.ID, "err", err)
+				if r.reportError("verify_access", err) {
+					return
+				}
+			}
+			continue
+		case <-ctx.Done():
+			continue
+		}
+
+		err := result.err
+		if err != nil && requestCtx.Err() != nil {
+			logger.Info("Reader stopped during read", "agent.ID", r.ID)
+			return
+		}
+		if err != nil && ctx.Err() != nil {
+			// Cancelled while waiting for changes, which isn't a failed read
+			continue
+		}
+		if _, ok := err.(verifyError); ok {
+			r.reportError("verify", err)
+			return
 		}
-		result, err = r.pullMoreDocs(since)
 		if err != nil {
-			logger.Error("Error calling pullMoreDocs", "agent.ID", r.ID, "since", since, "err", err)
-			panic(fmt.Sprintf("Error calling pullMoreDocs: %v", err))
+			logger.Error("Error calling pullMoreDocs", "agent.ID", r.ID, "err", err)
+			if r.reportError("read", err) {
+				return
+			}
+			continue
 		}
+		r.Errors.RecordSuccess()
 
 		if len(result.uniqueDocIds) > 0 {
 			logger.Debug(
@@ -146,28 +290,149 @@ func (r *Reader) Run() {
 				r.NumDocsExpected,
 				"numRevGenerationsExpected",
 				r.NumRevGenerationsExpected,
-				"req since",
-				since,
 				"new since",
 				result.since,
 			)
 		}
 
-		// Increment the since so that it's used on the next changes feed request
-		since = result.since
+		if r.access != nil {
+			r.access.docsArrived(result.arrivals, result.docChannels, result.removals)
+		}
+
+		if r.OpenEnded {
+			numRevsPulledOpenEnded += len(result.uniqueDocIds)
+			r.addNumRevsPulled(len(result.uniqueDocIds))
+			continue
+		}
 
-		err = storeLatestDocRev(latestDocIdRevs, result)
+		err = storeLatestDocRev(latestDocIdRevs, result.pullMoreDocsResult)
 		if err != nil {
-			panic(fmt.Sprintf("Error geting the latest docs and revisions: %v", err))
+			r.reportError("verify", fmt.Errorf("Error getting the latest docs and revisions: %v", err))
+			return
 		}
 
 	}
 
 }
 
-func (r *Reader) createReaderSGUserIfNeeded() {
+// The feeds of the keyspaces the reader pulls from
+func (r *Reader) keyspaceFeeds() ([]*keyspaceFeed, error) {
+
+	keyspaces := r.keyspaces()
+	feeds := []*keyspaceFeed{}
+	for _, keyspace := range keyspaces {
+		feed, err := r.newKeyspaceFeed(keyspace)
+		if err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, feed)
+	}
+	return feeds, nil
+
+}
+
+func (r *Reader) newKeyspaceFeed(keyspace Keyspace) (*keyspaceFeed, error) {
+	dataStore, err := r.keyspaceDataStore(keyspace)
+	if err != nil {
+		return nil, err
+	}
+	feed := &keyspaceFeed{
+		keyspace:  keyspace,
+		dataStore: dataStore,
+		metrics:   newKeyspaceMetricsSink(r.Metrics, keyspace, len(r.Keyspaces)),
+	}
+	if r.PullReplicator != nil {
+		feed.pullReplication = newPullReplication()
+	}
+	return feed, nil
+}
+
+// Pull docs from the changes feed of a keyspace and send them to the reader's main
+// loop, until ctx is done.  Each keyspace's feed is followed concurrently, so that
+// waiting on one (eg, in a longpoll) doesn't hold up the others.  A pull replicator
+// starts from its checkpoint, and saves it as it goes and when it stops.  After a
+// failed pull it backs off before trying again, and it stops once the docs fail
+// verification.
+func (r *Reader) followFeed(ctx, requestCtx context.Context, feed *keyspaceFeed, results chan<- keyspaceFeedResult, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+	defer feed.closeChangesStream()
+
+	since := StringSincer{}
+	backoff := time.Duration(0)
+	resumed := true
+	if feed.pullReplication != nil {
+		defer r.maybeSavePullCheckpoint(requestCtx, feed, true)
+		resumed = false
+	}
+
+	for ctx.Err() == nil {
+
+		if !resumed {
+			checkpointSince, err := r.resumePullReplication(requestCtx, feed)
+			if err != nil {
+				select {
+				case results <- keyspaceFeedResult{err: err}:
+				case <-ctx.Done():
+					return
+				}
+				backoff = nextFailedPullBackoff(backoff)
+				sleepContext(ctx, backoff)
+				continue
+			}
+			since = checkpointSince
+			resumed = true
+			backoff = 0
+		}
+
+		result, err := r.pullMoreDocs(ctx, requestCtx, feed, since)
+		if err != nil {
+			// A streaming feed has moved on past since, so start it over from there
+			feed.closeChangesStream()
+		} else {
+			// Increment the since so that it's used on the next changes feed request
+			since = result.since
+		}
+
+		select {
+		case results <- keyspaceFeedResult{pullMoreDocsResult: result, err: err}:
+		case <-ctx.Done():
+			return
+		}
+
+		if _, ok := err.(verifyError); ok {
+			return
+		}
+		if err != nil {
+			backoff = nextFailedPullBackoff(backoff)
+			sleepContext(ctx, backoff)
+			continue
+		}
+		backoff = 0
+
+		if feed.pullReplication != nil {
+			feed.pullReplication.since = since
+			r.maybeSavePullCheckpoint(requestCtx, feed, false)
+		}
+	}
+
+}
+
+// How long to wait after a failed pull, given how long the last wait was (0 if the last
+// pull succeeded)
+func nextFailedPullBackoff(lastBackoff time.Duration) time.Duration {
+	if lastBackoff == 0 {
+		return failedPullInitialBackoff
+	}
+	if lastBackoff*2 > failedPullMaxBackoff {
+		return failedPullMaxBackoff
+	}
+	return lastBackoff * 2
+}
+
+func (r *Reader) createReaderSGUserIfNeeded(ctx context.Context) error {
 	defer globalProgressStats.Add("NumReaderUsers", 1)
-	r.createSGUserIfNeeded(r.SGChannels)
+	return r.createSGUserIfNeeded(ctx, r.SGChannels)
 }
 
 func getNumRevs(latestDocIdRevs map[string]int) int {
@@ -178,36 +443,32 @@ func getNumRevs(latestDocIdRevs map[string]int) int {
 	return numRevs
 }
 
-func (r *Reader) isFinished(latestDocIdRevs map[string]int) bool {
+// Returns true once all the expected docs have been pulled at the expected
+// generation, or an error if more docs or revs were pulled than expected.
+func (r *Reader) isFinished(latestDocIdRevs map[string]int) (bool, error) {
 
 	if len(latestDocIdRevs) > r.NumDocsExpected {
-		panic(fmt.Sprintf("Reader was only expected to pull %d docs, but pulled %d.", r.NumDocsExpected, len(latestDocIdRevs)))
+		return false, fmt.Errorf("Reader was only expected to pull %d docs, but pulled %d.", r.NumDocsExpected, len(latestDocIdRevs))
 	}
 
 	numRevs := getNumRevs(latestDocIdRevs)
-	delta := numRevs - r.lastNumRevs
-	r.ExpVarStats.Add(
-		"NumLatestDocIdRevs",
-		int64(delta),
-	)
-	globalProgressStats.Add("TotalNumRevsPulled", int64(delta))
+	r.addNumRevsPulled(numRevs - r.lastNumRevs)
 	r.lastNumRevs = numRevs
 
 	// Haven't seen all expected docs yet
 	if len(latestDocIdRevs) < r.NumDocsExpected {
-		return false
+		return false, nil
 	}
 
 	// We have seen all docs, verify that the revs are expected generation
 	for docId, generation := range latestDocIdRevs {
 
 		if generation > r.NumRevGenerationsExpected {
-			panic(
-				fmt.Sprintf(
-					"Pulled generation (%d) larger than expected generation (%d).",
-					generation,
-					r.NumRevGenerationsExpected,
-				),
+			return false, fmt.Errorf(
+				"Pulled generation (%d) larger than expected generation (%d) for doc %s.",
+				generation,
+				r.NumRevGenerationsExpected,
+				docId,
 			)
 		}
 
@@ -223,22 +484,37 @@ func (r *Reader) isFinished(latestDocIdRevs map[string]int) bool {
 				"expected-generation",
 				r.NumRevGenerationsExpected,
 			)
-			return false
+			return false, nil
 		}
 
 	}
 
 	// We have found the expected number of docs and each doc has the expected rev generation
-	return true
+	return true, nil
+
+}
 
+func (r *Reader) addNumRevsPulled(delta int) {
+	r.ExpVarStats.Add(
+		"NumLatestDocIdRevs",
+		int64(delta),
+	)
+	globalProgressStats.Add("TotalNumRevsPulled", int64(delta))
 }
 
 type pullMoreDocsResult struct {
 	since        StringSincer
 	uniqueDocIds map[string]sgreplicate.DocumentRevisionPair
+	generations  map[string]int       // If docs are in conflict, the generation each has reached on all its branches, rather than that of its winning revision
+	arrivals     map[string]time.Time // When each change (or removal) arrived on the changes feed, if the reader's access is changing
+	docChannels  map[string][]string  // The channels of each doc pulled, if the reader's access is changing
+	removals     Removals             // The docs the reader lost access to, and the channels they were removed from
 }
 
-func (r *Reader) pullMoreDocs(since Sincer) (pullMoreDocsResult, error) {
+// Pull the next batch of changes from the keyspace's feed and the docs they refer to.
+// Waiting on the changes feed (eg, a longpoll) uses ctx, so it stops as soon as the run
+// is stopped, whereas fetching the docs uses requestCtx so a _bulk_get in flight is drained.
+func (r *Reader) pullMoreDocs(ctx, requestCtx context.Context, feed *keyspaceFeed, since Sincer) (pullMoreDocsResult, error) {
 
 	// Create a retry sleeper which controls how many times to retry
 	// and how long to wait in between retries
@@ -254,13 +530,18 @@ func (r *Reader) pullMoreDocs(since Sincer) (pullMoreDocsResult, error) {
 
 		result := pullMoreDocsResult{}
 
-		changes, newSince, changesErr := r.DataStore.Changes(since, CHANGES_LIMIT, r.feedType)
+		changes, removals, newSince, arrivals, changesErr := r.nextChanges(ctx, feed, since)
+		if changesErr != nil && ctx.Err() != nil {
+			return false, ctx.Err(), result
+		}
 		if changesErr != nil {
 			logger.Warn("Error getting changes.  Retrying.",
 				"since",
 				since,
 				"feedtype",
 				r.feedType,
+				"keyspace",
+				feed.keyspace,
 				"limit",
 				CHANGES_LIMIT,
 				"agent.ID",
@@ -273,18 +554,41 @@ func (r *Reader) pullMoreDocs(since Sincer) (pullMoreDocsResult, error) {
 			return true, changesErr, result
 		}
 
-		if len(changes.Results) == 0 {
+		if len(changes.Results) == 0 && len(removals) == 0 && r.OpenEnded {
+			// Nothing new was written yet, which is normal in an open-ended run
+			if r.feedType != FEED_TYPE_LONGPOLL {
+				sleepContext(ctx, time.Duration(sleepMsBetweenRetry)*time.Millisecond)
+			}
+			result.since = since.(StringSincer)
+			return false, nil, result
+		}
+		if len(changes.Results) == 0 && len(removals) == 0 {
 			logger.Warn("Got empty changes.  Retrying.", "agent.ID", r.ID)
 			return true, nil, result
 		}
-		if newSince.Equals(since) {
+		// A streaming feed never sends a change twice, but the changes of one access
+		// change all have the same sequence, which can span batches
+		if !r.feedType.Streaming() && newSince.Equals(since) {
 			logger.Warn("Since value has not changed since last _changes request.  Ignorning and retrying.", "agent.ID", r.ID, "since", since, "newsince", newSince, "changes", changes)
 			return true, nil, result
 		}
 
+		if removalErr := r.removalsMustBeRevoked(removals); removalErr != nil {
+			return false, verifyError{removalErr}, result
+		}
+		result.since = newSince.(StringSincer)
+		result.removals = removals
+		if r.access != nil {
+			result.arrivals = arrivals
+		}
+
 		// Strip out any changes with id "id":"_user/*"
 		// since they are user docs and we don't care about them
 		changes = stripUserDocChanges(changes)
+		if len(changes.Results) == 0 {
+			// Only removals, or the user doc itself, so there are no docs to get
+			return false, nil, result
+		}
 
 		bulkGetRequest, uniqueDocIds, bulkGetErr := createBulkGetRequest(changes)
 		if bulkGetErr != nil {
@@ -292,24 +596,51 @@ func (r *Reader) pullMoreDocs(since Sincer) (pullMoreDocsResult, error) {
 			return true, nil, result
 		}
 
-		docs, bulkDocsErr := r.DataStore.BulkGetDocuments(bulkGetRequest)
+		docs, bulkDocsErr := r.pullDocs(requestCtx, feed, bulkGetRequest)
 		if bulkDocsErr != nil {
 			return false, bulkDocsErr, result
 		}
 		if len(docs) != len(bulkGetRequest.Docs) {
 			return false, fmt.Errorf("Expected %d docs, got %d", len(bulkGetRequest.Docs), len(docs)), result
 		}
+		if r.access != nil {
+			changes, docs = r.dropUnavailableDocs(changes, docs, uniqueDocIds)
+		}
+
+		if channelErr := docsMustBeInExpectedChannels(docs, r.expectedChannels()); channelErr != nil {
+			return false, verifyError{channelErr}, result
+		}
+		if keyspaceErr := docsMustBeInKeyspace(docs, feed.keyspace); keyspaceErr != nil {
+			return false, verifyError{keyspaceErr}, result
+		}
+		numTombstones, tombstoneErr := r.verifyTombstones(changes, docs)
+		if tombstoneErr != nil {
+			return false, verifyError{tombstoneErr}, result
+		}
+		r.addNumTombstonesPulled(feed, numTombstones)
+		if conflictErr := r.verifyConflicts(changes); conflictErr != nil {
+			return false, verifyError{conflictErr}, result
+		}
 
-		docsMustBeInExpectedChannels(docs, r.SGChannels)
+		r.pushPropagationStats(feed, docs, arrivals)
 
-		result.since = newSince.(StringSincer)
 		result.uniqueDocIds = uniqueDocIds
+		if r.access != nil {
+			result.docChannels = map[string][]string{}
+			for _, doc := range docs {
+				docId, _ := doc.Body["_id"].(string)
+				result.docChannels[docId] = doc.Body.ChannelNames()
+			}
+		}
+		if r.numLeavesExpected() > 1 {
+			result.generations = branchGenerations(changes, r.numLeavesExpected())
+		}
 		return false, nil, result
 
 	}
 
 	// Invoke the retry worker / sleeper combo in a loop
-	err, workerReturnVal := RetryLoop("pullMoreDocs", retryWorker, retrySleeper)
+	err, workerReturnVal := RetryLoop(ctx, "pullMoreDocs", retryWorker, retrySleeper)
 	if err != nil {
 		return pullMoreDocsResult{}, err
 	}
@@ -318,6 +649,308 @@ func (r *Reader) pullMoreDocs(since Sincer) (pullMoreDocsResult, error) {
 
 }
 
+// The channels the reader's docs can be in: those it was assigned, and any it has been
+// granted since
+func (r *Reader) expectedChannels() []string {
+	if r.access == nil {
+		return r.SGChannels
+	}
+	return r.access.subscriber.channelsEverGranted()
+}
+
+// When the reader's access is changing, _bulk_get can return an error instead of a doc:
+// forbidden if the reader lost access to it after getting it from the changes feed, or
+// missing if it was backfilled at a revision that has since been updated and pruned.
+// Those docs are dropped, since they'll be removed from the changes feed, or arrive at
+// their new revision, next.
+func (r *Reader) dropUnavailableDocs(changes sgreplicate.Changes, docs []sgreplicate.Document, uniqueDocIds map[string]sgreplicate.DocumentRevisionPair) (sgreplicate.Changes, []sgreplicate.Document) {
+
+	unavailable := map[string]bool{}
+	availableDocs := []sgreplicate.Document{}
+	for _, doc := range docs {
+		docErr, _ := doc.Body["error"].(string)
+		if docErr != "forbidden" && docErr != "not_found" {
+			availableDocs = append(availableDocs, doc)
+			continue
+		}
+		docId, _ := doc.Body["id"].(string)
+		unavailable[docId] = true
+		delete(uniqueDocIds, docId)
+		if r.Metrics != nil {
+			r.Metrics.Counter(fmt.Sprintf("access_docs_%s", docErr), 1)
+		}
+	}
+	if len(unavailable) == 0 {
+		return changes, docs
+	}
+
+	availableChanges := sgreplicate.Changes{LastSequence: changes.LastSequence}
+	for _, change := range changes.Results {
+		if !unavailable[change.Id] {
+			availableChanges.Results = append(availableChanges.Results, change)
+		}
+	}
+	return availableChanges, availableDocs
+
+}
+
+// Docs are only removed from the reader's changes feed when it loses access to all of
+// the channels they were in
+func (r *Reader) removalsMustBeRevoked(removals Removals) error {
+	for docId, channels := range removals {
+		if r.access == nil {
+			return fmt.Errorf("Doc %s was removed from channels %v, but the reader's access doesn't change", docId, channels)
+		}
+		if !r.access.subscriber.everRevokedAll(channels) {
+			return fmt.Errorf("Doc %s was removed from channels %v, but the reader's access to them wasn't revoked", docId, channels)
+		}
+	}
+	return nil
+}
+
+// Check the tombstones among the changes pulled: a change is marked deleted on the
+// changes feed if and only if _bulk_get returned a tombstone for it, and docs are only
+// deleted when there are deleters, at the last generation expected.  Returns how many
+// tombstones there were.
+func (r *Reader) verifyTombstones(changes sgreplicate.Changes, docs []sgreplicate.Document) (int, error) {
+
+	tombstones := map[string]bool{}
+	for _, doc := range docs {
+		if isTombstone(doc) {
+			docId, _ := doc.Body["_id"].(string)
+			tombstones[docId] = true
+		}
+	}
+
+	numTombstones := 0
+	for _, change := range changes.Results {
+		if change.Deleted != tombstones[change.Id] {
+			return 0, fmt.Errorf("Doc %s is deleted=%v on the changes feed, but _bulk_get returned deleted=%v", change.Id, change.Deleted, tombstones[change.Id])
+		}
+		if change.Deleted && !r.ExpectTombstones {
+			return 0, fmt.Errorf("Doc %s was deleted, but there are no deleters", change.Id)
+		}
+		if change.Deleted {
+			numTombstones++
+		}
+		if !r.ExpectTombstones || r.OpenEnded {
+			continue
+		}
+		generation, _ := parseRevID(change.ChangedRevs[0].Revision)
+		if change.Deleted && generation != r.NumRevGenerationsExpected {
+			return 0, fmt.Errorf("Doc %s was deleted at generation %d, but was expected to be deleted at generation %d", change.Id, generation, r.NumRevGenerationsExpected)
+		}
+		if !change.Deleted && generation >= r.NumRevGenerationsExpected {
+			return 0, fmt.Errorf("Doc %s reached generation %d without being deleted", change.Id, generation)
+		}
+	}
+	return numTombstones, nil
+
+}
+
+func (r *Reader) numLeavesExpected() int {
+	if r.NumLeavesExpected < 1 {
+		return 1
+	}
+	return r.NumLeavesExpected
+}
+
+// Check the leaf revisions of each change, which are all listed since the changes
+// feed is requested with style=all_docs: no doc has more of them than expected, and
+// the winning revision listed first is the one CouchDB's deterministic algorithm
+// picks.  That algorithm prefers live revisions to deleted ones, but docs are never
+// deleted when they're in conflict, so only the generation and digest count.
+func (r *Reader) verifyConflicts(changes sgreplicate.Changes) error {
+
+	for _, change := range changes.Results {
+		if len(change.ChangedRevs) > r.numLeavesExpected() {
+			return fmt.Errorf("Doc %s has %d leaf revisions %v, but expected at most %d", change.Id, len(change.ChangedRevs), change.ChangedRevs, r.numLeavesExpected())
+		}
+		winner := winningRevision(change.ChangedRevs)
+		if change.ChangedRevs[0].Revision != winner {
+			return fmt.Errorf("Doc %s has winning revision %s on the changes feed, but the deterministic winner of its leaf revisions %v is %s", change.Id, change.ChangedRevs[0].Revision, change.ChangedRevs, winner)
+		}
+	}
+	return nil
+
+}
+
+// The winning revision among the leaves of a doc that isn't deleted: the highest
+// generation wins, then the highest digest
+func winningRevision(leaves []sgreplicate.ChangedRev) string {
+	winner := ""
+	for _, leaf := range leaves {
+		if winner == "" || revisionBeats(leaf.Revision, winner) {
+			winner = leaf.Revision
+		}
+	}
+	return winner
+}
+
+func revisionBeats(revision, other string) bool {
+	generation, digest := parseRevID(revision)
+	otherGeneration, otherDigest := parseRevID(other)
+	if generation != otherGeneration {
+		return generation > otherGeneration
+	}
+	return digest > otherDigest
+}
+
+// The generation each doc has reached on all of its branches: that of its least
+// updated leaf revision, or 1 (the writer's revision, which they all start from)
+// until every branch has been started
+func branchGenerations(changes sgreplicate.Changes, numBranches int) map[string]int {
+	generations := map[string]int{}
+	for _, change := range changes.Results {
+		if len(change.ChangedRevs) < numBranches {
+			generations[change.Id] = 1
+			continue
+		}
+		for _, leaf := range change.ChangedRevs {
+			generation, _ := parseRevID(leaf.Revision)
+			if existing, ok := generations[change.Id]; !ok || generation < existing {
+				generations[change.Id] = generation
+			}
+		}
+	}
+	return generations
+}
+
+func (r *Reader) addNumTombstonesPulled(feed *keyspaceFeed, numTombstones int) {
+	if numTombstones == 0 {
+		return
+	}
+	r.ExpVarStats.Add("NumTombstonesPulled", int64(numTombstones))
+	globalProgressStats.Add("TotalNumTombstonesPulled", int64(numTombstones))
+	if feed.metrics != nil {
+		feed.metrics.Counter("tombstones_pulled", numTombstones)
+	}
+}
+
+// Get the next batch of changes from the keyspace's feed, the docs the reader lost
+// access to, and when each of them arrived.  A streaming feed is held open across calls,
+// and reconnected from since if the connection drops.
+func (r *Reader) nextChanges(ctx context.Context, feed *keyspaceFeed, since Sincer) (sgreplicate.Changes, Removals, Sincer, map[string]time.Time, error) {
+
+	if !r.feedType.Streaming() {
+		var changes sgreplicate.Changes
+		var removals Removals
+		var newSince Sincer
+		var err error
+		if removalsFeed, ok := feed.dataStore.(RemovalsChangesFeed); ok {
+			changes, removals, newSince, err = removalsFeed.ChangesWithRemovals(ctx, since, CHANGES_LIMIT, r.feedType)
+		} else {
+			changes, newSince, err = feed.dataStore.Changes(ctx, since, CHANGES_LIMIT, r.feedType)
+		}
+		arrivals := map[string]time.Time{}
+		arrived := time.Now()
+		for _, change := range changes.Results {
+			arrivals[change.Id] = arrived
+		}
+		for docId := range removals {
+			arrivals[docId] = arrived
+		}
+		return changes, removals, newSince, arrivals, err
+	}
+
+	if feed.changesStream == nil {
+		if err := r.openChangesStream(ctx, feed, since); err != nil {
+			return sgreplicate.Changes{}, nil, since, nil, err
+		}
+	}
+
+	streamed, err := feed.changesStream.Next(ctx, CHANGES_LIMIT)
+	if err != nil {
+		feed.closeChangesStream()
+		return sgreplicate.Changes{}, nil, since, nil, err
+	}
+
+	// A doc that changed again while the reader was busy can be in the batch twice,
+	// but only its latest revision matters
+	latest := map[string]int{}
+	for i, change := range streamed {
+		latest[change.Id] = i
+	}
+	changes := sgreplicate.Changes{}
+	removals := Removals{}
+	arrivals := map[string]time.Time{}
+	for i, change := range streamed {
+		if latest[change.Id] != i {
+			continue
+		}
+		arrivals[change.Id] = change.Arrived
+		if len(change.Removed) > 0 {
+			removals[change.Id] = change.Removed
+			continue
+		}
+		changes.Results = append(changes.Results, change.Change)
+	}
+	lastSequence := streamed[len(streamed)-1].Sequence.(string)
+	changes.LastSequence = lastSequence
+
+	return changes, removals, StringSincer{Since: lastSequence}, arrivals, nil
+
+}
+
+func (r *Reader) openChangesStream(ctx context.Context, feed *keyspaceFeed, since Sincer) error {
+
+	streamer, ok := feed.dataStore.(ChangesStreamer)
+	if !ok {
+		return fmt.Errorf("The data store doesn't support the %s feed type", r.feedType)
+	}
+
+	changesStream, err := streamer.OpenChangesStream(ctx, since, r.feedType)
+	if err != nil {
+		return err
+	}
+
+	if feed.changesStreamOpened {
+		logger.Info("Reconnected to changes feed", "agent.ID", r.ID, "feedtype", r.feedType, "keyspace", feed.keyspace, "since", since)
+		if feed.metrics != nil {
+			feed.metrics.Counter("changes_feed_reconnects", 1)
+		}
+		r.ExpVarStats.Add("NumChangesFeedReconnects", 1)
+		globalProgressStats.Add("TotalNumChangesFeedReconnects", 1)
+	}
+	feed.changesStream = changesStream
+	feed.changesStreamOpened = true
+	return nil
+
+}
+
+func (f *keyspaceFeed) closeChangesStream() {
+	if f.changesStream != nil {
+		f.changesStream.Close()
+		f.changesStream = nil
+	}
+}
+
+// How long it took each doc to go from being written to arriving on the changes feed
+func (r *Reader) pushPropagationStats(feed *keyspaceFeed, docs []sgreplicate.Document, arrivals map[string]time.Time) {
+
+	if feed.metrics == nil {
+		return
+	}
+
+	for _, doc := range docs {
+		docId, _ := doc.Body["_id"].(string)
+		arrived, ok := arrivals[docId]
+		if !ok {
+			continue
+		}
+		createdAt, err := docCreatedAt(doc)
+		if err != nil {
+			continue
+		}
+		delta := arrived.Sub(createdAt)
+		if delta < 0 {
+			delta = 0
+		}
+		feed.metrics.Timing("changes_feed_propagation", delta)
+	}
+
+}
+
 func createBulkGetRequest(changes sgreplicate.Changes) (sgreplicate.BulkGetRequest, map[string]sgreplicate.DocumentRevisionPair, error) {
 
 	uniqueDocIds := map[string]sgreplicate.DocumentRevisionPair{}
@@ -384,11 +1017,16 @@ type RetrySleeper func(retryCount int) (shouldContinue bool, timeTosleepMs int)
 // even if it returns shouldRetry = true.
 type RetryWorker func() (shouldRetry bool, err error, value interface{})
 
-func RetryLoop(description string, worker RetryWorker, sleeper RetrySleeper) (error, interface{}) {
+// Calls the worker until it succeeds, gives up, or ctx is done.  Once ctx is done
+// the worker won't be called again and ctx.Err() is returned.
+func RetryLoop(ctx context.Context, description string, worker RetryWorker, sleeper RetrySleeper) (error, interface{}) {
 
 	numAttempts := 1
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return err, nil
+		}
 		shouldRetry, err, value := worker()
 		if !shouldRetry {
 			if err != nil {
@@ -404,7 +1042,11 @@ func RetryLoop(description string, worker RetryWorker, sleeper RetrySleeper) (er
 			return err, value
 		}
 
-		<-time.After(time.Millisecond * time.Duration(sleepMs))
+		select {
+		case <-time.After(time.Millisecond * time.Duration(sleepMs)):
+		case <-ctx.Done():
+			return ctx.Err(), nil
+		}
 
 		numAttempts += 1
 
@@ -442,16 +1084,18 @@ func storeLatestDocRev(latestDocIdRevs map[string]int, r pullMoreDocsResult) err
 		if err != nil {
 			return err
 		}
+		if branchGeneration, ok := r.generations[docId]; ok {
+			generation = branchGeneration
+		}
 
 		existingGeneration, ok := latestDocIdRevs[docId]
 		if ok {
 			// This should never happen
 			if generation < existingGeneration {
-				panic(
-					fmt.Sprintf("New new generation (%d) was less than existing generation (%d)",
-						generation,
-						existingGeneration,
-					),
+				return fmt.Errorf("New generation (%d) was less than existing generation (%d) for doc %s",
+					generation,
+					existingGeneration,
+					docId,
 				)
 			}
 		}
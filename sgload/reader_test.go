@@ -0,0 +1,237 @@
+package sgload
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	sgreplicate "github.com/couchbaselabs/sg-replicate"
+	"github.com/couchbaselabs/sgload/sgsimulator"
+)
+
+func TestRetryLoopStopsWhenContextDone(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	numAttempts := 0
+	worker := func() (shouldRetry bool, err error, value interface{}) {
+		numAttempts++
+		cancel()
+		return true, nil, nil
+	}
+	sleeper := CreateDoublingSleeperFunc(10, 60*1000)
+
+	err, _ := RetryLoop(ctx, "test", worker, sleeper)
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if numAttempts != 1 {
+		t.Fatalf("Expected worker to be called once, got %d", numAttempts)
+	}
+
+}
+
+func TestReaderStopsDuringLongpoll(t *testing.T) {
+
+	_, dataStore, cleanup := newSimulatorDataStore(t, sgsimulator.FaultConfig{})
+	defer cleanup()
+
+	finishedWg := &sync.WaitGroup{}
+	finishedWg.Add(1)
+
+	// No docs will ever be written, so the reader will be waiting on a longpoll changes feed
+	reader := NewReader(AgentSpec{
+		FinishedWg:        finishedWg,
+		DataStore:         dataStore,
+		AllSGUsersCreated: &sync.WaitGroup{},
+		DrainTimeout:      time.Second,
+	})
+	reader.SetNumDocsExpected(1)
+	reader.SetMetricsSink(NoOpMetricsSink{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go reader.Run(ctx)
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	finished := make(chan struct{})
+	go func() {
+		finishedWg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Reader did not stop after the context was cancelled")
+	}
+
+}
+
+func TestReaderReconnectsChangesStream(t *testing.T) {
+
+	_, dataStore, cleanup := newSimulatorDataStore(t, sgsimulator.FaultConfig{})
+	defer cleanup()
+
+	ctx := context.Background()
+	readerCreds := UserCred{Username: "reader", Password: "password"}
+	if err := dataStore.CreateUser(ctx, readerCreds, []string{"ABC"}); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	if _, err := dataStore.BulkCreateDocuments(ctx, docsToWrite("doc", 2, []string{"ABC"}), true); err != nil {
+		t.Fatalf("Error creating docs: %v", err)
+	}
+
+	readerDataStore := *dataStore
+	readerDataStore.SetUserCreds(readerCreds)
+	reader := NewReader(AgentSpec{DataStore: &readerDataStore})
+	reader.SetFeedType(FEED_TYPE_CONTINUOUS)
+	reader.SetChannels([]string{"ABC"})
+	reader.SetMetricsSink(NoOpMetricsSink{})
+	feed, err := reader.newKeyspaceFeed(Keyspace{})
+	if err != nil {
+		t.Fatalf("Error creating feed: %v", err)
+	}
+
+	result, err := reader.pullMoreDocs(ctx, ctx, feed, StringSincer{})
+	if err != nil || len(result.uniqueDocIds) != 2 || result.since.String() != "2" {
+		t.Fatalf("Unexpected result: %+v, %v", result, err)
+	}
+
+	// The connection drops, and a doc is written before the reader reconnects
+	feed.changesStream.Close()
+	if _, err := dataStore.BulkCreateDocuments(ctx, docsToWrite("more", 1, []string{"ABC"}), true); err != nil {
+		t.Fatalf("Error creating docs: %v", err)
+	}
+
+	result, err = reader.pullMoreDocs(ctx, ctx, feed, result.since)
+	if err != nil || len(result.uniqueDocIds) != 1 || result.since.String() != "3" {
+		t.Fatalf("Unexpected result after reconnecting: %+v, %v", result, err)
+	}
+	if feed.changesStream == nil || !feed.changesStreamOpened {
+		t.Fatalf("Expected reader to have reconnected")
+	}
+	feed.closeChangesStream()
+
+}
+
+func TestVerifyConflicts(t *testing.T) {
+
+	change := func(revs ...string) sgreplicate.Change {
+		changedRevs := []sgreplicate.ChangedRev{}
+		for _, rev := range revs {
+			changedRevs = append(changedRevs, sgreplicate.ChangedRev{Revision: rev})
+		}
+		return sgreplicate.Change{Id: "doc", ChangedRevs: changedRevs}
+	}
+	changes := func(change sgreplicate.Change) sgreplicate.Changes {
+		return sgreplicate.Changes{Results: []sgreplicate.Change{change}}
+	}
+
+	reader := NewReader(AgentSpec{})
+	reader.SetNumLeavesExpected(2)
+
+	if err := reader.verifyConflicts(changes(change("3-aaa", "2-fff"))); err != nil {
+		t.Fatalf("The higher generation should win: %v", err)
+	}
+	if err := reader.verifyConflicts(changes(change("3-bbb", "3-aaa"))); err != nil {
+		t.Fatalf("The higher digest should win: %v", err)
+	}
+	if err := reader.verifyConflicts(changes(change("3-aaa", "3-bbb"))); err == nil {
+		t.Fatalf("Expected an error for the wrong winner")
+	}
+	if err := reader.verifyConflicts(changes(change("3-ccc", "3-bbb", "3-aaa"))); err == nil {
+		t.Fatalf("Expected an error for more leaves than branches")
+	}
+
+	// A doc has only reached a generation once all its branches have
+	generations := branchGenerations(changes(change("3-aaa")), 2)
+	if generations["doc"] != 1 {
+		t.Fatalf("Expected generation 1 until every branch has started, got %d", generations["doc"])
+	}
+	generations = branchGenerations(changes(change("3-aaa", "2-bbb")), 2)
+	if generations["doc"] != 2 {
+		t.Fatalf("Expected the generation of the least updated branch, got %d", generations["doc"])
+	}
+
+}
+
+// A pull that keeps failing backs off rather than retrying straight away, and docs that
+// fail verification stop the feed
+func TestFollowFeedBacksOffAndStopsOnVerifyErrors(t *testing.T) {
+
+	faultConfig := sgsimulator.FaultConfig{
+		Endpoints: map[string]sgsimulator.EndpointFaults{
+			sgsimulator.EndpointBulkGet: {ErrorRate: 1, ErrorStatus: 400, MaxErrors: 3},
+		},
+	}
+	_, dataStore, cleanup := newSimulatorDataStore(t, faultConfig)
+	defer cleanup()
+
+	defer func(initial time.Duration) { failedPullInitialBackoff = initial }(failedPullInitialBackoff)
+	failedPullInitialBackoff = 50 * time.Millisecond
+
+	// A tombstone, which the reader doesn't expect without deleters
+	ctx := context.Background()
+	readerCreds := UserCred{Username: "reader", Password: "password"}
+	if err := dataStore.CreateUser(ctx, readerCreds, []string{"ABC"}); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	created, err := dataStore.BulkCreateDocuments(ctx, docsToWrite("doc", 1, []string{"ABC"}), true)
+	if err != nil {
+		t.Fatalf("Error creating docs: %v", err)
+	}
+	if _, err := dataStore.DeleteDocuments(ctx, created); err != nil {
+		t.Fatalf("Error deleting docs: %v", err)
+	}
+
+	readerDataStore := *dataStore
+	readerDataStore.SetUserCreds(readerCreds)
+	reader := NewReader(AgentSpec{DataStore: &readerDataStore})
+	reader.SetFeedType(FEED_TYPE_NORMAL)
+	reader.SetChannels([]string{"ABC"})
+	reader.SetMetricsSink(NoOpMetricsSink{})
+	feed, err := reader.newKeyspaceFeed(Keyspace{})
+	if err != nil {
+		t.Fatalf("Error creating feed: %v", err)
+	}
+
+	followCtx, stopFollowing := context.WithCancel(ctx)
+	defer stopFollowing()
+	results := make(chan keyspaceFeedResult)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	start := time.Now()
+	go reader.followFeed(followCtx, ctx, feed, results, wg)
+
+	// The first three _bulk_gets fail, and the feed waits 50ms, 100ms and 200ms after
+	// them, and then the tombstone fails verification
+	numFailures := 0
+	for {
+		result := <-results
+		if _, ok := result.err.(verifyError); ok {
+			break
+		}
+		if result.err == nil {
+			t.Fatalf("Expected the pull to fail, got %+v", result)
+		}
+		numFailures++
+	}
+	if elapsed := time.Since(start); numFailures != 3 || elapsed < 350*time.Millisecond {
+		t.Fatalf("Expected 3 failed pulls over at least 350ms, got %d over %v", numFailures, elapsed)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the feed to stop after a verification error")
+	}
+
+}
@@ -1,9 +1,11 @@
 package sgload
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"sync"
+	"time"
 )
 
 const (
@@ -12,7 +14,8 @@ const (
 
 type ReadLoadRunner struct {
 	LoadRunner
-	ReadLoadSpec ReadLoadSpec
+	ReadLoadSpec   ReadLoadSpec
+	AccessRegistry *AccessRegistry // If set, the readers' access is changed by churners, which they register with
 }
 
 func NewReadLoadRunner(rls ReadLoadSpec) *ReadLoadRunner {
@@ -22,7 +25,11 @@ func NewReadLoadRunner(rls ReadLoadSpec) *ReadLoadRunner {
 	loadRunner := LoadRunner{
 		LoadSpec: rls.LoadSpec,
 	}
-	loadRunner.CreateStatsdClient()
+	loadRunner.CreateMetricsSinks()
+	loadRunner.CreateHTTPClient()
+	loadRunner.CreateAuthenticatorFactory()
+	loadRunner.CreateChannelLayout()
+	loadRunner.CreateErrorCollector()
 
 	return &ReadLoadRunner{
 		LoadRunner:   loadRunner,
@@ -31,7 +38,13 @@ func NewReadLoadRunner(rls ReadLoadSpec) *ReadLoadRunner {
 
 }
 
-func (rlr ReadLoadRunner) Run() error {
+// Runs the readers until they've pulled all the docs they expect, or ctx is done
+func (rlr ReadLoadRunner) Run(ctx context.Context) error {
+
+	defer rlr.reportLatencies("readload", time.Now())
+
+	runCtx, cancel := rlr.runContext(ctx)
+	defer cancel()
 
 	// Create a wait group to see when all the reader goroutines have finished
 	var wg sync.WaitGroup
@@ -46,7 +59,7 @@ func (rlr ReadLoadRunner) Run() error {
 		return fmt.Errorf("Error creating readers: %v", err)
 	}
 	for _, reader := range readers {
-		go reader.Run()
+		go reader.Run(runCtx)
 	}
 
 	// block until readers are done
@@ -54,7 +67,7 @@ func (rlr ReadLoadRunner) Run() error {
 	wg.Wait()
 	logger.Info("Readers finished")
 
-	return nil
+	return rlr.runResult(ctx)
 
 }
 
@@ -63,7 +76,6 @@ func (rlr ReadLoadRunner) createReaders(wg, AllSGUsersCreated *sync.WaitGroup) (
 	readers := []*Reader{}
 	var userCreds []UserCred
 	var err error
-	numDocsExpectedPerReader := rlr.numDocsExpectedPerReader()
 
 	switch rlr.ReadLoadSpec.CreateReaders {
 	case true:
@@ -76,57 +88,77 @@ func (rlr ReadLoadRunner) createReaders(wg, AllSGUsersCreated *sync.WaitGroup) (
 	}
 
 	for userId := 0; userId < rlr.ReadLoadSpec.NumReaders; userId++ {
-		userCred := userCreds[userId]
-		dataStore := rlr.createDataStore()
-		dataStore.SetUserCreds(userCred)
 
 		// get channels that should be assigned to this reader
 		sgChannels := assignChannelsToReader(
 			rlr.ReadLoadSpec.NumChansPerReader,
 			rlr.generateChannelNames(), // TODO: pass this in rather than re-generating
+			rlr.LoadSpec.agentRand(USER_PREFIX_READER, userId),
 		)
 
-		agentSpec := AgentSpec{
-			FinishedWg:              wg,
-			UserCred:                userCred,
-			ID:                      userId,
-			DataStore:               dataStore,
-			BatchSize:               rlr.ReadLoadSpec.BatchSize,
-			ExpvarProgressEnabled:   rlr.LoadRunner.LoadSpec.ExpvarProgressEnabled,
-			MaxConcurrentCreateUser: maxConcurrentCreateUser,
-			AllSGUsersCreated:       AllSGUsersCreated,
-		}
-
-		reader := NewReader(agentSpec)
-		reader.SetCreateUserSemaphore(createUserSemaphore)
-		reader.SetFeedType(rlr.ReadLoadSpec.FeedType)
-		reader.SetChannels(sgChannels)
-		reader.SetBatchSize(rlr.ReadLoadSpec.BatchSize)
-		reader.SetNumDocsExpected(numDocsExpectedPerReader)
-		reader.SetNumRevGenerationsExpected(rlr.ReadLoadSpec.NumRevGenerationsExpected)
-		reader.SetStatsdClient(rlr.StatsdClient)
-		reader.CreateDataStoreUser = rlr.ReadLoadSpec.CreateReaders
+		reader := rlr.newReader(userId, userCreds[userId], wg, AllSGUsersCreated, sgChannels, rlr.numDocsExpectedPerReader(sgChannels))
 		readers = append(readers, reader)
-		wg.Add(1)
 	}
 
 	return readers, nil
 }
 
-// Calculate how many docs each reader is expected to pull.  Find out how many docs are
-// in each channel, and then find out how many channels each reader is pulling from,
-// and then multiply to get the number docs each reader is expected to pull.
-func (rlr ReadLoadRunner) numDocsExpectedPerReader() int {
+// Create a reader with its own data store, which will pull from the given channels
+// and call wg.Done() once it has finished
+func (rlr ReadLoadRunner) newReader(userId int, userCred UserCred, wg, AllSGUsersCreated *sync.WaitGroup, sgChannels []string, numDocsExpected int) *Reader {
+
+	dataStore := rlr.createDataStore()
+	dataStore.SetUserCreds(userCred)
+	if revocationsFeed, ok := dataStore.(RevocationsChangesFeed); ok && rlr.AccessRegistry != nil {
+		revocationsFeed.SetRevocations(true)
+	}
+
+	agentSpec := AgentSpec{
+		FinishedWg:              wg,
+		UserCred:                userCred,
+		ID:                      userId,
+		DataStore:               dataStore,
+		BatchSize:               rlr.ReadLoadSpec.BatchSize,
+		ExpvarProgressEnabled:   rlr.LoadRunner.LoadSpec.ExpvarProgressEnabled,
+		MaxConcurrentCreateUser: maxConcurrentCreateUser,
+		AllSGUsersCreated:       AllSGUsersCreated,
+		Errors:                  rlr.Errors,
+		DrainTimeout:            rlr.LoadSpec.DrainTimeout,
+		OpenEnded:               rlr.LoadSpec.OpenEnded(),
+		Keyspaces:               rlr.LoadSpec.keyspaces(),
+	}
+
+	reader := NewReader(agentSpec)
+	reader.SetCreateUserSemaphore(createUserSemaphore)
+	reader.SetFeedType(rlr.ReadLoadSpec.FeedType)
+	reader.SetChannels(sgChannels)
+	reader.SetBatchSize(rlr.ReadLoadSpec.BatchSize)
+	reader.SetNumDocsExpected(numDocsExpected)
+	reader.SetNumRevGenerationsExpected(rlr.ReadLoadSpec.NumRevGenerationsExpected)
+	reader.SetExpectTombstones(rlr.ReadLoadSpec.ExpectTombstones)
+	reader.SetNumLeavesExpected(rlr.ReadLoadSpec.NumLeavesExpected)
+	if rlr.ReadLoadSpec.PullReplicator.Enabled {
+		reader.SetPullReplicator(rlr.ReadLoadSpec.PullReplicator)
+	}
+	if rlr.AccessRegistry != nil {
+		reader.SetAccessRegistry(rlr.AccessRegistry)
+	}
+	reader.SetMetricsSink(rlr.Metrics)
+	reader.CreateDataStoreUser = rlr.ReadLoadSpec.CreateReaders
+	wg.Add(1)
+
+	return reader
+
+}
 
-	// If we have 1000 docs total, and 10 channels, then there will be
-	// 100 docs per channel (1000 / 10)
-	numDocsPerChannel := rlr.ReadLoadSpec.NumDocs / rlr.ReadLoadSpec.NumChannels
+// Calculate how many docs a reader of these channels is expected to pull, from the
+// channel layout the writers use.  Channels aren't all the same size, and a doc can be
+// in more than one of the reader's channels, so this is the number of docs in any of them.
+func (rlr ReadLoadRunner) numDocsExpectedPerReader(sgChannels []string) int {
 
-	// If readers are subscribed to multiple channels, then they will expect
-	// to read more documents from the changes feed
-	docsPerReader := numDocsPerChannel * rlr.ReadLoadSpec.NumChansPerReader
+	docsPerReader := rlr.ChannelLayout.numDocsInChannels(sgChannels)
 
-	logger.Debug("DocsPerReader", "DocsPerReader", docsPerReader)
+	logger.Debug("DocsPerReader", "channels", sgChannels, "DocsPerReader", docsPerReader)
 
 	return docsPerReader
 
@@ -136,7 +168,7 @@ func (rlr ReadLoadRunner) numDocsExpectedPerReader() int {
 // SG channels to this particular reader.  This means that when the reader user is
 // created, this will have these channels listed in their admin_channels field
 // so they pull these channels when hittting the _changes feed.
-func assignChannelsToReader(numChansPerReader int, sgChannels []string) []string {
+func assignChannelsToReader(numChansPerReader int, sgChannels []string, rng *rand.Rand) []string {
 
 	assignedChannels := []string{}
 
@@ -146,7 +178,7 @@ func assignChannelsToReader(numChansPerReader int, sgChannels []string) []string
 
 	for i := 0; i < numChansPerReader; i++ {
 		for { // keep looping until we get a unique channel
-			chanIndex := rand.Intn(len(sgChannels))
+			chanIndex := rng.Intn(len(sgChannels))
 			sgChannel := sgChannels[chanIndex]
 			if contains(assignedChannels, sgChannel) {
 				continue
@@ -1,6 +1,9 @@
 package sgload
 
-import "testing"
+import (
+	"math/rand"
+	"testing"
+)
 
 func TestAssignChannelsToReader(t *testing.T) {
 	numChansPerReader := 2
@@ -15,10 +18,11 @@ func TestAssignChannelsToReader(t *testing.T) {
 
 	uniqueChansTotal := map[string]interface{}{}
 
+	rng := rand.New(rand.NewSource(1))
 	for i := 0; i < 100; i++ {
 
 		uniqueChans := map[string]interface{}{}
-		chansAssigned := assignChannelsToReader(numChansPerReader, sgChannels)
+		chansAssigned := assignChannelsToReader(numChansPerReader, sgChannels, rng)
 		for _, chanAssigned := range chansAssigned {
 			uniqueChansTotal[chanAssigned] = struct{}{}
 			uniqueChans[chanAssigned] = struct{}{}
@@ -3,13 +3,16 @@ package sgload
 import "log"
 
 type ReadLoadSpec struct {
-	LoadSpec
-	CreateReaders             bool // Whether or not to create users for readers
-	NumReaders                int
-	NumChansPerReader         int
-	NumRevGenerationsExpected int
-	SkipWriteLoadSetup        bool            // By default the readload scenario runs the writeload scenario first.  If this is true, it will skip the writeload scenario.
-	FeedType                  ChangesFeedType // "Normal" or "Longpoll"
+	LoadSpec                  `yaml:"-"`
+	CreateReaders             bool               `yaml:"create_readers"` // Whether or not to create users for readers
+	NumReaders                int                `yaml:"num_readers"`
+	NumChansPerReader         int                `yaml:"num_chans_per_reader"`
+	NumRevGenerationsExpected int                `yaml:"-"`                     // Derived from the updaters, see GateLoadSpec.numRevGenerationsExpected
+	ExpectTombstones          bool               `yaml:"-"`                     // Derived from the deleters: the last generation of each doc is a tombstone
+	NumLeavesExpected         int                `yaml:"-"`                     // Derived from the updaters' conflict branches: the number of leaf revisions each doc ends up with
+	SkipWriteLoadSetup        bool               `yaml:"skip_write_load_setup"` // By default the readload scenario runs the writeload scenario first.  If this is true, it will skip the writeload scenario.
+	FeedType                  ChangesFeedType    `yaml:"feed_type"`             // "normal", "longpoll", "continuous", "websocket" or "eventsource"
+	PullReplicator            PullReplicatorSpec `yaml:"pull_replicator"`       // Whether readers pull like a pull replicator, with a _local checkpoint
 
 }
 
@@ -19,6 +22,37 @@ func (rls ReadLoadSpec) Validate() error {
 		return err
 	}
 
+	if rls.NumReaders < 0 {
+		return fieldError("read.num_readers", "NumReaders must not be negative")
+	}
+
+	if rls.NumReaders > 0 && (rls.NumChansPerReader <= 0 || rls.NumChansPerReader > rls.NumChannels) {
+		return fieldError("read.num_chans_per_reader", "NumChansPerReader must be between 1 and the number of channels (%d)", rls.NumChannels)
+	}
+
+	switch rls.FeedType {
+	case FEED_TYPE_LONGPOLL, FEED_TYPE_NORMAL, FEED_TYPE_CONTINUOUS, FEED_TYPE_WEBSOCKET, FEED_TYPE_EVENTSOURCE:
+	default:
+		return fieldError(
+			"read.feed_type",
+			"Unknown feed type %q.  Values: %s, %s, %s, %s, %s",
+			rls.FeedType,
+			FEED_TYPE_NORMAL,
+			FEED_TYPE_LONGPOLL,
+			FEED_TYPE_CONTINUOUS,
+			FEED_TYPE_WEBSOCKET,
+			FEED_TYPE_EVENTSOURCE,
+		)
+	}
+
+	if rls.FeedType.Streaming() && rls.Protocol == PROTOCOL_BLIP {
+		return fieldError("read.feed_type", "The %s protocol has its own changes feed, so the feed type must be %s or %s", PROTOCOL_BLIP, FEED_TYPE_NORMAL, FEED_TYPE_LONGPOLL)
+	}
+
+	if err := rls.PullReplicator.Validate(rls.LoadSpec); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -0,0 +1,145 @@
+package sgload
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/inconshreveable/log15"
+	"gopkg.in/yaml.v2"
+)
+
+// A problem with a single field of a spec.  Field is the path of the field in a
+// scenario file, eg "write.num_writers", so the bad value is easy to find.
+type FieldError struct {
+	Field   string
+	Problem string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Problem)
+}
+
+func fieldError(field, format string, args ...interface{}) FieldError {
+	return FieldError{
+		Field:   field,
+		Problem: fmt.Sprintf(format, args...),
+	}
+}
+
+// The layout of a gateload scenario file.  The load section also sets the log level by name.
+type gateLoadScenarioFile struct {
+	Load struct {
+		LoadSpec `yaml:",inline"`
+		LogLevel string `yaml:"log_level"`
+	} `yaml:"load"`
+	Write  WriteLoadSpec  `yaml:"write"`
+	Read   ReadLoadSpec   `yaml:"read"`
+	Update UpdateLoadSpec `yaml:"update"`
+	Delete DeleteLoadSpec `yaml:"delete"`
+	Access AccessLoadSpec `yaml:"access"`
+	Phases []PhaseSpec    `yaml:"phases"`
+}
+
+// Read a gateload scenario file, which has a section for each of the specs, eg:
+//
+//	load:
+//	  sg_url: http://localhost:4984/db/
+//	  num_docs: 1000
+//	  num_channels: 10
+//	  duration: 8h
+//	  seed: 42
+//	  channels:
+//	    distribution: zipfian
+//	    max_channels_per_doc: 2
+//	write:
+//	  num_writers: 10
+//	  delay_between_writes: 100ms
+//	read:
+//	  num_readers: 10
+//	  feed_type: longpoll
+//	update:
+//	  num_updaters: 10
+//	  num_updates_per_doc: 5
+//	delete:
+//	  num_deleters: 2
+//	  purge_tombstones: true
+//	access:
+//	  num_churners: 1
+//	  delay_between_changes: 5s
+//	  num_roles: 2
+//	  num_chans_per_role: 3
+//
+// It can also have a list of phases, which decide how many writers, readers and
+// updaters are running at any time (see PhaseSpec).
+//
+// JSON files work as well, since JSON is also YAML.  The field names are the yaml
+// tags of the specs.  Anything that isn't in the file keeps its value from base (eg,
+// the command line flags or their defaults), and unknown fields are an error, so that
+// typos don't silently fall back to defaults.  A seed that's only in the file also
+// decides the test session ID, unless testSessionIDGiven says base has one the user gave.
+func ReadGateLoadScenario(path string, base GateLoadSpec, testSessionIDGiven bool) (GateLoadSpec, error) {
+
+	scenarioBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return GateLoadSpec{}, err
+	}
+
+	scenario := gateLoadScenarioFile{}
+	scenario.Load.LoadSpec = base.LoadSpec
+	scenario.Load.LogLevel = base.LoadSpec.LogLevel.String()
+	scenario.Write = base.WriteLoadSpec
+	scenario.Read = base.ReadLoadSpec
+	scenario.Update = base.UpdateLoadSpec
+	scenario.Delete = base.DeleteLoadSpec
+	scenario.Access = base.AccessLoadSpec
+	scenario.Phases = base.Phases
+
+	if err := yaml.UnmarshalStrict(scenarioBytes, &scenario); err != nil {
+		return GateLoadSpec{}, fmt.Errorf("Error parsing scenario file %s: %v", path, err)
+	}
+
+	logLevel, err := log15.LvlFromString(scenario.Load.LogLevel)
+	if err != nil {
+		return GateLoadSpec{}, fmt.Errorf(
+			"Invalid scenario file %s: %v",
+			path,
+			fieldError("load.log_level", "Unknown log level %q.  Values: crit, error, warn, info, debug", scenario.Load.LogLevel),
+		)
+	}
+	scenario.Load.LoadSpec.LogLevel = logLevel
+
+	// A seed that's only in the file also decides the test session ID, like --seed does,
+	// unless the file sets that as well, or the user gave one
+	seedFromFile := scenario.Load.Seed != base.LoadSpec.Seed
+	if seedFromFile && !testSessionIDGiven && scenario.Load.TestSessionID == base.LoadSpec.TestSessionID {
+		scenario.Load.TestSessionID = NewTestSessionID(scenario.Load.Seed)
+	}
+
+	gls := GateLoadSpec{
+		LoadSpec:       scenario.Load.LoadSpec,
+		WriteLoadSpec:  scenario.Write,
+		ReadLoadSpec:   scenario.Read,
+		UpdateLoadSpec: scenario.Update,
+		DeleteLoadSpec: scenario.Delete,
+		AccessLoadSpec: scenario.Access,
+		Phases:         scenario.Phases,
+	}
+
+	// The load section is shared by all the other specs
+	gls.WriteLoadSpec.LoadSpec = gls.LoadSpec
+	gls.ReadLoadSpec.LoadSpec = gls.LoadSpec
+	gls.UpdateLoadSpec.LoadSpec = gls.LoadSpec
+	gls.DeleteLoadSpec.LoadSpec = gls.LoadSpec
+	gls.AccessLoadSpec.LoadSpec = gls.LoadSpec
+
+	gls.ReadLoadSpec.NumRevGenerationsExpected = gls.numRevGenerationsExpected()
+	gls.ReadLoadSpec.ExpectTombstones = gls.DeleteLoadSpec.NumDeleters > 0
+	gls.ReadLoadSpec.NumLeavesExpected = gls.UpdateLoadSpec.numLeavesPerDoc()
+
+	if err := gls.Validate(); err != nil {
+		return GateLoadSpec{}, fmt.Errorf("Invalid scenario file %s: %v", path, err)
+	}
+
+	return gls, nil
+
+}
@@ -0,0 +1,217 @@
+package sgload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inconshreveable/log15"
+)
+
+// A valid spec, like the one built from the gateload command line defaults
+func baseGateLoadSpec() GateLoadSpec {
+	loadSpec := LoadSpec{
+		SyncGatewayUrl: "http://localhost:4984/db/",
+		NumDocs:        100,
+		NumChannels:    10,
+		TestSessionID:  "base",
+		LogLevel:       log15.LvlInfo,
+	}
+	return GateLoadSpec{
+		LoadSpec:       loadSpec,
+		WriteLoadSpec:  WriteLoadSpec{LoadSpec: loadSpec, NumWriters: 10},
+		ReadLoadSpec:   ReadLoadSpec{LoadSpec: loadSpec, NumReaders: 10, NumChansPerReader: 1, FeedType: FEED_TYPE_LONGPOLL},
+		UpdateLoadSpec: UpdateLoadSpec{LoadSpec: loadSpec, NumUpdaters: 10, NumUpdatesPerDoc: 5},
+	}
+}
+
+func writeScenarioFile(t *testing.T, contents string) (path string, cleanup func()) {
+	tempDir, err := ioutil.TempDir("", "sgload")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	path = filepath.Join(tempDir, "scenario")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("Error writing scenario file: %v", err)
+	}
+	return path, func() { os.RemoveAll(tempDir) }
+}
+
+func TestReadGateLoadScenario(t *testing.T) {
+
+	yamlScenario := `
+load:
+  sg_url: http://sg:4984/db/
+  num_docs: 1000
+  test_session_id: perf-run-1
+  duration: 8h
+  log_level: debug
+write:
+  num_writers: 20
+  delay_between_writes: 100ms
+read:
+  feed_type: normal
+update:
+  num_updates_per_doc: 2
+`
+	jsonScenario := `{
+  "load": {"sg_url": "http://sg:4984/db/", "num_docs": 1000, "test_session_id": "perf-run-1", "duration": "8h", "log_level": "debug"},
+  "write": {"num_writers": 20, "delay_between_writes": "100ms"},
+  "read": {"feed_type": "normal"},
+  "update": {"num_updates_per_doc": 2}
+}`
+
+	for _, scenario := range []string{yamlScenario, jsonScenario} {
+
+		path, cleanup := writeScenarioFile(t, scenario)
+		defer cleanup()
+
+		gls, err := ReadGateLoadScenario(path, baseGateLoadSpec(), false)
+		if err != nil {
+			t.Fatalf("Error reading scenario: %v", err)
+		}
+
+		// Each spec gets the shared load section
+		for _, loadSpec := range []LoadSpec{gls.LoadSpec, gls.WriteLoadSpec.LoadSpec, gls.ReadLoadSpec.LoadSpec, gls.UpdateLoadSpec.LoadSpec} {
+			if loadSpec.SyncGatewayUrl != "http://sg:4984/db/" || loadSpec.NumDocs != 1000 || loadSpec.Duration != 8*time.Hour {
+				t.Fatalf("Unexpected load spec: %+v", loadSpec)
+			}
+			if loadSpec.TestSessionID != "perf-run-1" || loadSpec.LogLevel != log15.LvlDebug {
+				t.Fatalf("Unexpected test session id or log level: %+v", loadSpec)
+			}
+			if loadSpec.NumChannels != 10 {
+				t.Fatalf("Expected num channels to keep its base value, got: %d", loadSpec.NumChannels)
+			}
+		}
+
+		if gls.WriteLoadSpec.NumWriters != 20 || gls.WriteLoadSpec.DelayBetweenWrites != 100*time.Millisecond {
+			t.Fatalf("Unexpected write spec: %+v", gls.WriteLoadSpec)
+		}
+		if gls.ReadLoadSpec.FeedType != FEED_TYPE_NORMAL || gls.ReadLoadSpec.NumReaders != 10 {
+			t.Fatalf("Unexpected read spec: %+v", gls.ReadLoadSpec)
+		}
+		if gls.ReadLoadSpec.NumRevGenerationsExpected != 3 {
+			t.Fatalf("Expected 3 rev generations (1 write + 2 updates), got %d", gls.ReadLoadSpec.NumRevGenerationsExpected)
+		}
+
+	}
+
+}
+
+func TestReadGateLoadScenarioPhases(t *testing.T) {
+
+	path, cleanup := writeScenarioFile(t, `
+update:
+  num_updaters: 20
+phases:
+  - name: ramp-up
+    duration: 5m
+    writers: 1000
+    ramp: true
+  - duration: 30m
+  - name: add-readers
+    duration: 10m
+    readers: 500
+  - name: stop-updaters
+    duration: 10m
+    updaters: 0
+`)
+	defer cleanup()
+
+	gls, err := ReadGateLoadScenario(path, baseGateLoadSpec(), false)
+	if err != nil {
+		t.Fatalf("Error reading scenario: %v", err)
+	}
+
+	if len(gls.Phases) != 4 {
+		t.Fatalf("Expected 4 phases, got: %+v", gls.Phases)
+	}
+	rampUp := gls.Phases[0]
+	if rampUp.Name != "ramp-up" || !rampUp.Ramp || rampUp.Duration != 5*time.Minute || *rampUp.Writers != 1000 || rampUp.Readers != nil {
+		t.Fatalf("Unexpected ramp-up phase: %+v", rampUp)
+	}
+	if name := gls.Phases[1].nameOrDefault(1); name != "phase-2" {
+		t.Fatalf("Expected unnamed phase to be called phase-2, got %s", name)
+	}
+	if updaters := gls.Phases[3].Updaters; updaters == nil || *updaters != 0 {
+		t.Fatalf("Expected the last phase to stop the updaters, got: %+v", gls.Phases[3])
+	}
+	if gls.phasesDuration() != 55*time.Minute {
+		t.Fatalf("Expected the phases to last 55m, got %v", gls.phasesDuration())
+	}
+
+	// Phases have their own users for updaters, so there can be more updaters than writers
+	if err := gls.Validate(); err != nil {
+		t.Fatalf("Expected phased spec to be valid, got: %v", err)
+	}
+
+}
+
+func TestReadGateLoadScenarioSeed(t *testing.T) {
+
+	path, cleanup := writeScenarioFile(t, "load:\n  seed: 42\n")
+	defer cleanup()
+
+	// The seed decides the test session ID, unless the user gave one
+	gls, err := ReadGateLoadScenario(path, baseGateLoadSpec(), false)
+	if err != nil {
+		t.Fatalf("Error reading scenario: %v", err)
+	}
+	if gls.LoadSpec.TestSessionID != NewTestSessionID(42) {
+		t.Fatalf("Expected the test session ID to come from the seed, got %s", gls.LoadSpec.TestSessionID)
+	}
+	gls, err = ReadGateLoadScenario(path, baseGateLoadSpec(), true)
+	if err != nil {
+		t.Fatalf("Error reading scenario: %v", err)
+	}
+	if gls.LoadSpec.TestSessionID != "base" || gls.WriteLoadSpec.TestSessionID != "base" {
+		t.Fatalf("Expected the test session ID given to be kept, got %s", gls.LoadSpec.TestSessionID)
+	}
+
+}
+
+func TestReadGateLoadScenarioErrors(t *testing.T) {
+
+	badScenarios := map[string]string{
+		"write:\n  num_writers: 0\n":                                                    "write.num_writers",
+		"write:\n  num_writers: 3\n":                                                    "write.num_writers",
+		"read:\n  feed_type: firehose\n":                                                "read.feed_type",
+		"load:\n  protocol: blip\nread:\n  feed_type: websocket\n":                      "read.feed_type",
+		"load:\n  num_docs: 105\n":                                                      "load.num_docs",
+		"load:\n  log_level: loud\n":                                                    "load.log_level",
+		"update:\n  num_updaters: 11\n":                                                 "update.num_updaters",
+		"write:\n  num_writerz: 10\n":                                                   "num_writerz",
+		"load:\n  drain_timeout: soon\n":                                                "soon",
+		"read:\n  num_chans_per_reader: 11\n":                                           "read.num_chans_per_reader",
+		"load:\n  num_channels: 0\n  num_docs: 100\n":                                   "load.num_channels",
+		"phases:\n  - writers: 10\n":                                                    "phases[0].duration",
+		"phases:\n  - duration: 1m\n  - duration: 1m\n    readers: -1\n":                "phases[1].readers",
+		"load:\n  duration: 1h\nphases:\n  - duration: 1m\n":                            "load.duration",
+		"write:\n  target_ops_per_sec: 10\nphases:\n  - duration: 1m\n":                 "write.target_ops_per_sec",
+		"write:\n  max_writes_in_flight: -1\n":                                          "write.max_writes_in_flight",
+		"read:\n  num_chans_per_reader: 0\nphases:\n  - duration: 1m\n    readers: 5\n": "read.num_chans_per_reader",
+		"access:\n  num_churners: 1\n":                                                  "access.num_churners",
+		"load:\n  duration: 1h\nread:\n  num_readers: 0\naccess:\n  num_churners: 1\n":  "access.num_churners",
+		"load:\n  duration: 1h\naccess:\n  num_churners: 1\n  num_roles: 1\n":           "access.num_chans_per_role",
+		"load:\n  duration: 1h\n  num_channels: 1\naccess:\n  num_churners: 1\n":        "access.num_churners",
+	}
+
+	for scenario, expectedInError := range badScenarios {
+
+		path, cleanup := writeScenarioFile(t, scenario)
+		defer cleanup()
+
+		_, err := ReadGateLoadScenario(path, baseGateLoadSpec(), false)
+		if err == nil {
+			t.Fatalf("Expected error reading scenario:\n%s", scenario)
+		}
+		if !strings.Contains(err.Error(), expectedInError) {
+			t.Fatalf("Expected error for scenario:\n%s\nto mention %q, got: %v", scenario, expectedInError, err)
+		}
+
+	}
+
+}
@@ -3,139 +3,194 @@ package sgload
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"path"
-	"regexp"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/couchbase/clog"
 	sgreplicate "github.com/couchbaselabs/sg-replicate"
 	"github.com/hashicorp/go-retryablehttp"
-	"github.com/peterbourgon/g2s"
 	"mime/multipart"
 	"net/textproto"
 )
 
 var (
-	// The sample rate -- set this to 0.1 if you only want
-	// 10% of the samples to be pushed to statds, or .01 if you only
-	// want 1% of the samples pushed to statsd.  Useful for
-	// not overwhelming stats if you have too many samples.
-	statsdSampleRate float32 = 1.0
-
 	initializeSgHttpClientOnce *sync.Once = &sync.Once{}
 
 	sgClient *retryablehttp.Client
 )
 
-func initSgHttpClientOnce(statsdClient g2s.Statter) {
+func initSgHttpClientOnce(metrics MetricsSink) {
 
 	// This is done _once_ because we only want one single client instance
 	// that is shared among all of the goroutines
 
 	doOnceFunc := func() {
+		sgClient = newSgHttpClient(metrics, transportWithConnPool(1000))
+	}
 
-		sgClient = retryablehttp.NewClient()
-
-		// This is the loghook that is called back for retries.
-		// Note that the exception to this is _bulk_docs responses
-		// that have a 201 status code, but have embedded partial
-		// failures.  In that case, a different mechanism must be
-		// used since the retryablehttp only retries 5xx statuses
-		logHook := func(
-			ignoredLogger retryablehttp.Logger,
-			req *http.Request,
-			numAttempts int) {
-
-			if numAttempts > 0 {
-				logger.Warn(
-					"HttpClientRetry",
-					"url",
-					req.URL,
-					"numAttempts",
-					numAttempts,
-				)
-				statsdClient.Counter(
-					statsdSampleRate,
-					"retries",
-					1,
-				)
-			}
+	initializeSgHttpClientOnce.Do(doOnceFunc)
+}
+
+// Create a client which retries temporary errors, and records the retries in the metrics
+func newSgHttpClient(metrics MetricsSink, transport http.RoundTripper) *retryablehttp.Client {
 
+	client := retryablehttp.NewClient()
+
+	// This is the loghook that is called back for retries.
+	// Note that the exception to this is _bulk_docs responses
+	// that have a 201 status code, but have embedded partial
+	// failures.  In that case, a different mechanism must be
+	// used since the retryablehttp only retries 5xx statuses
+	logHook := func(
+		ignoredLogger retryablehttp.Logger,
+		req *http.Request,
+		numAttempts int) {
+
+		if numAttempts > 0 {
+			logger.Warn(
+				"HttpClientRetry",
+				"url",
+				req.URL,
+				"numAttempts",
+				numAttempts,
+			)
+			metrics.Counter(
+				"retries",
+				1,
+			)
 		}
 
-		// Record retries in statsd
-		sgClient.RequestLogHook = logHook
+	}
+
+	// Record retries in the metrics
+	client.RequestLogHook = logHook
 
-		// Suppress retryablehttp client logs because they are noisy and
-		// don't use our structured logger.  To log retries, set a custom
-		// CheckRetry function based on the retryablehttp DefaultRetryPolicy
-		sgClient.Logger = log.New(ioutil.Discard, "", 0)
+	// Suppress retryablehttp client logs because they are noisy and
+	// don't use our structured logger.  To log retries, set a custom
+	// CheckRetry function based on the retryablehttp DefaultRetryPolicy
+	client.Logger = log.New(ioutil.Discard, "", 0)
 
-		sgClient.RetryMax = 10
-		sgClient.HTTPClient.Transport = transportWithConnPool(1000)
+	client.RetryMax = 10
 
-		// Set a long timeout on HTTP requests in case there are cases where _changes
-		// feeds are "stuck" indefinitely.  With this change, if that happens, the test
-		// will at least make progress, but there will be very long round trip times.
-		// See https://github.com/couchbaselabs/sgload/issues/56#issuecomment-273855696
-		sgClient.HTTPClient.Timeout = time.Duration(5) * time.Minute
+	// retryablehttp closes the idle connections after every request, which would
+	// stop keep-alive connections ever being reused
+	client.HTTPClient.Transport = keepIdleConnections{transport}
 
-	}
+	// Set a long timeout on HTTP requests in case there are cases where _changes
+	// feeds are "stuck" indefinitely.  With this change, if that happens, the test
+	// will at least make progress, but there will be very long round trip times.
+	// See https://github.com/couchbaselabs/sgload/issues/56#issuecomment-273855696
+	client.HTTPClient.Timeout = time.Duration(5) * time.Minute
+
+	return client
 
-	initializeSgHttpClientOnce.Do(doOnceFunc)
 }
 
 type SGDataStore struct {
 	SyncGatewayUrl       string
-	SyncGatewayAdminPort int
+	SyncGatewayAdminPort int                   // The admin API is on this port of the public URL's host, unless SyncGatewayAdminUrl is set
+	SyncGatewayAdminUrl  string                // The admin API URL of the database, if it's not just on another port
+	AdminCreds           UserCred              // If set, admin requests are sent with basic auth as this user
+	AdminHTTPClient      *retryablehttp.Client // For admin requests.  If nil, the same client as for the user's requests is used
 	UserCreds            UserCred
-	StatsdClient         g2s.Statter
+	Metrics              MetricsSink
 	CompressionEnabled   bool
+	HTTPClient           *retryablehttp.Client // If nil, the client shared by all data stores is used
+	TLSConfig            *tls.Config           // For the websocket connections to an https Sync Gateway, or nil for the defaults
+	NewAuthenticator     AuthenticatorFactory  // Creates the Authenticator when the user is set.  If nil, basic auth is used
+	Authenticator        Authenticator         // How requests are authenticated as UserCreds
+	Keyspace             Keyspace              // The collection docs are written to and read from.  The zero value is the default collection
+	Keyspaces            []Keyspace            // All the collections of the run, which users are granted their channels in.  If empty, the default collection
+	Revocations          bool                  // If true, changes feeds ask for the docs the user lost access to, which Sync Gateway only sends as removals with revocations=true
 }
 
-func NewSGDataStore(sgUrl string, sgAdminPort int, statsdClient g2s.Statter, compressionEnabled bool) *SGDataStore {
+func NewSGDataStore(sgUrl string, sgAdminPort int, metrics MetricsSink, compressionEnabled bool) *SGDataStore {
 
-	initSgHttpClientOnce(statsdClient)
+	initSgHttpClientOnce(metrics)
 
 	return &SGDataStore{
 		SyncGatewayUrl:       sgUrl,
 		SyncGatewayAdminPort: sgAdminPort,
-		StatsdClient:         statsdClient,
+		Metrics:              metrics,
 		CompressionEnabled:   compressionEnabled,
 	}
 }
 
 func (s *SGDataStore) SetUserCreds(u UserCred) {
 	s.UserCreds = u
+	s.Authenticator = nil
+	if s.NewAuthenticator != nil {
+		s.Authenticator = s.NewAuthenticator(*s, u)
+	}
+}
+
+// Use the given client, eg to give each agent its own connection pool
+func (s *SGDataStore) SetHTTPClient(client *retryablehttp.Client) {
+	s.HTTPClient = client
 }
 
-func (s SGDataStore) CreateUser(u UserCred, channelNames []string) error {
+// Authenticate as users with the authenticators the factory creates, eg with sessions
+// rather than basic auth.  Must be called before the user is set.
+func (s *SGDataStore) SetAuthenticatorFactory(newAuthenticator AuthenticatorFactory) {
+	s.NewAuthenticator = newAuthenticator
+}
 
-	adminUrl, err := s.sgAdminURL()
-	if err != nil {
-		return err
-	}
+// Send admin requests to the given URL (unless it's empty) with the given client
+// and credentials, rather than to the admin port of the public URL's host
+func (s *SGDataStore) SetAdmin(adminUrl string, adminCreds UserCred, client *retryablehttp.Client) {
+	s.SyncGatewayAdminUrl = adminUrl
+	s.AdminCreds = adminCreds
+	s.AdminHTTPClient = client
+}
 
-	adminUrlUserEndpoint, err := addEndpointToUrl(adminUrl, "_user")
+// Grant users their channels in the given keyspaces, rather than just in the default
+// collection
+func (s *SGDataStore) SetKeyspaces(keyspaces []Keyspace) {
+	s.Keyspaces = keyspaces
+}
+
+// A copy of the data store which works on the docs and changes feed of the given
+// keyspace, and tags its metrics with it.  It shares the user, authenticator and
+// clients of this one.
+func (s SGDataStore) WithKeyspace(keyspace Keyspace) DataStore {
+	s.Keyspace = keyspace
+	s.Metrics = newKeyspaceMetricsSink(s.Metrics, keyspace, len(s.Keyspaces))
+	return &s
+}
+
+// The URL of the keyspace the data store works on, which the doc and _changes
+// endpoints are under
+func (s SGDataStore) keyspaceUrl() string {
+	keyspaceUrl, err := s.Keyspace.url(s.SyncGatewayUrl)
 	if err != nil {
-		return err
+		// Left for the request to fail on
+		return s.SyncGatewayUrl
 	}
+	return keyspaceUrl
+}
 
-	adminUrlUserEndpoint = addTrailingSlash(adminUrlUserEndpoint)
+// Use the given TLS config for websocket connections.  HTTP requests get theirs from
+// the client's transport.
+func (s *SGDataStore) SetTLSConfig(tlsConfig *tls.Config) {
+	s.TLSConfig = tlsConfig
+}
+
+func (s SGDataStore) CreateUser(ctx context.Context, u UserCred, channelNames []string) error {
 
 	userDoc := map[string]interface{}{}
 	userDoc["name"] = u.Username
 	userDoc["password"] = u.Password
-	userDoc["admin_channels"] = channelNames
+	addChannelGrants(userDoc, s.Keyspaces, channelNames)
 
 	docBytes, err := json.Marshal(userDoc)
 	if err != nil {
@@ -143,18 +198,21 @@ func (s SGDataStore) CreateUser(u UserCred, channelNames []string) error {
 	}
 	buf := bytes.NewReader(docBytes)
 
-	req, err := retryablehttp.NewRequest("POST", adminUrlUserEndpoint, buf)
+	req, err := s.newAdminRequest(ctx, "POST", "_user/", buf)
+	if err != nil {
+		return err
+	}
 
 	req.Header.Set("Content-Type", "application/json")
 
-	client := getHttpClient()
+	client := s.adminHTTPClient()
 
 	startTime := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	defer drainAndClose(resp.Body)
 	s.pushTimingStat("create_user", time.Since(startTime))
 
 	if resp.StatusCode < 200 || resp.StatusCode > 201 {
@@ -166,56 +224,15 @@ func (s SGDataStore) CreateUser(u UserCred, channelNames []string) error {
 	return nil
 }
 
-func (s SGDataStore) sgAdminURL() (string, error) {
-
-	sgAdminURL := s.SyncGatewayUrl
-
-	parsedSgUrl, err := url.Parse(s.SyncGatewayUrl)
-	if err != nil {
-		log.Printf("Error parsing url: %v", err)
-		return sgAdminURL, err
-	}
-
-	// find the port from the url
-	host, port, err := splitHostPortWrapper(parsedSgUrl.Host)
-	if err != nil {
-		return sgAdminURL, err
-	}
-
-	if port != "" {
-		// is there a port?
-		// do a regex replace on :port on the original url
-		r := regexp.MustCompile(port)
-		sgAdminURL = r.ReplaceAllString(
-			sgAdminURL,
-			fmt.Sprintf("%d", s.SyncGatewayAdminPort),
-		)
-
-	} else {
-		// is there no port?
-		// do a regex replace of host with host:port
-		r := regexp.MustCompile(host)
-		hostWithAdminPort := fmt.Sprintf("%v:%v", host, s.SyncGatewayAdminPort)
-		sgAdminURL = r.ReplaceAllString(
-			sgAdminURL,
-			hostWithAdminPort,
-		)
-
-	}
-
-	// return it
-	return sgAdminURL, nil
-
-}
-
 func (s SGDataStore) changesFeedUrl(sinceVal Sincer, limit int, feedType ChangesFeedType) (string, error) {
 
-	changesFeedEndpoint, err := addEndpointToUrl(s.SyncGatewayUrl, "_changes")
+	changesFeedEndpoint, err := addEndpointToUrl(s.keyspaceUrl(), "_changes")
 	if err != nil {
 		return "", err
 	}
 
 	changesFeedParams := NewChangesFeedParams(sinceVal, limit, feedType)
+	changesFeedParams.revocations = s.Revocations
 
 	changesFeedUrl := fmt.Sprintf(
 		"%s?%s",
@@ -227,40 +244,55 @@ func (s SGDataStore) changesFeedUrl(sinceVal Sincer, limit int, feedType Changes
 
 }
 
-func (s SGDataStore) Changes(sinceVal Sincer, limit int, feedType ChangesFeedType) (changes sgreplicate.Changes, newSinceVal Sincer, err error) {
+func (s SGDataStore) Changes(ctx context.Context, sinceVal Sincer, limit int, feedType ChangesFeedType) (changes sgreplicate.Changes, newSinceVal Sincer, err error) {
 
-	changesFeedUrl, err := s.changesFeedUrl(sinceVal, limit, feedType)
+	decoded, newSinceVal, err := s.getChanges(ctx, sinceVal, limit, feedType)
 	if err != nil {
 		return sgreplicate.Changes{}, sinceVal, err
 	}
+	return decoded.changes(), newSinceVal, nil
+}
+
+// Get the changes, keeping the channels of any removals (see ChangesWithRemovals)
+func (s SGDataStore) getChanges(ctx context.Context, sinceVal Sincer, limit int, feedType ChangesFeedType) (changes changesWithRemovals, newSinceVal Sincer, err error) {
+
+	changesFeedUrl, err := s.changesFeedUrl(sinceVal, limit, feedType)
+	if err != nil {
+		return changesWithRemovals{}, sinceVal, err
+	}
 
-	req, err := retryablehttp.NewRequest("GET", changesFeedUrl, nil)
-	s.addAuthIfNeeded(req)
+	req, err := newRetryableRequest(ctx, "GET", changesFeedUrl, nil)
+	if err != nil {
+		return changesWithRemovals{}, sinceVal, err
+	}
+	if err := s.addAuthIfNeeded(ctx, req.Header); err != nil {
+		return changesWithRemovals{}, sinceVal, err
+	}
 
 	req.Header.Set("Content-Type", "application/json")
 
-	client := getHttpClient()
+	client := s.httpClient()
 
 	startTime := time.Now()
-	resp, err := client.Do(req)
+	resp, err := s.doAuthenticated(client, req)
 	if err != nil {
-		return sgreplicate.Changes{}, sinceVal, err
+		return changesWithRemovals{}, sinceVal, err
 	}
-	defer resp.Body.Close()
+	defer drainAndClose(resp.Body)
 
 	s.pushTimingStat("changes_feed", time.Since(startTime))
 	if resp.StatusCode < 200 || resp.StatusCode > 201 {
-		return sgreplicate.Changes{}, sinceVal, fmt.Errorf("Unexpected response status for changes_feed GET request: %d", resp.StatusCode)
+		return changesWithRemovals{}, sinceVal, fmt.Errorf("Unexpected response status for changes_feed GET request: %d", resp.StatusCode)
 	}
 
 	decoder := json.NewDecoder(resp.Body)
 	err = decoder.Decode(&changes)
 	if err != nil {
-		return sgreplicate.Changes{}, sinceVal, err
+		return changesWithRemovals{}, sinceVal, err
 	}
 	lastSequenceStr, ok := changes.LastSequence.(string)
 	if !ok {
-		return sgreplicate.Changes{}, sinceVal, fmt.Errorf("Could not convert changes.LastSequence to string")
+		return changesWithRemovals{}, sinceVal, fmt.Errorf("Could not convert changes.LastSequence to string")
 	}
 	lastSequenceSincer := StringSincer{
 		Since: lastSequenceStr,
@@ -277,10 +309,10 @@ type putResponse struct {
 }
 
 // Create or update a single document with attachment data
-func (s SGDataStore) CreateDocument(doc Document, attachSizeBytes int, newEdits bool) (DocumentMetadata, error) {
+func (s SGDataStore) CreateDocument(ctx context.Context, doc Document, attachSizeBytes int, newEdits bool) (DocumentMetadata, error) {
 
 	if attachSizeBytes <= 0 {
-		return s.CreateDocumentNoAttachment(doc, newEdits)
+		return s.CreateDocumentNoAttachment(ctx, doc, newEdits)
 	}
 
 	newEditsStr := "false"
@@ -288,7 +320,7 @@ func (s SGDataStore) CreateDocument(doc Document, attachSizeBytes int, newEdits
 		newEditsStr = "true"
 	}
 
-	putDocEndpoint, err := addEndpointToUrl(s.SyncGatewayUrl, doc.Id())
+	putDocEndpoint, err := addEndpointToUrl(s.keyspaceUrl(), doc.Id())
 	if err != nil {
 		return DocumentMetadata{}, err
 	}
@@ -299,7 +331,7 @@ func (s SGDataStore) CreateDocument(doc Document, attachSizeBytes int, newEdits
 	attachmentName := "my_attachment"
 	attachmentContent := doc.GenerateHtmlAttachmentContent(attachSizeBytes)
 
-	doc["body"] = createBodyContentAsMapWithSize(doc.GetBodySizeBytes())
+	doc.addBodyIfMissing()
 	doc.GenerateAndAddAttachmentMeta(attachmentName, attachmentContentType, attachmentContent)
 
 	docBytes, err := json.Marshal(doc)
@@ -345,25 +377,27 @@ func (s SGDataStore) CreateDocument(doc Document, attachSizeBytes int, newEdits
 	}
 
 	// Create request from multipart body
-	req, err := retryablehttp.NewRequest("PUT", putDocEndpoint, bytes.NewReader(body.Bytes()))
+	req, err := newRetryableRequest(ctx, "PUT", putDocEndpoint, bytes.NewReader(body.Bytes()))
 	if err != nil {
 		return DocumentMetadata{}, err
 	}
 
-	s.addAuthIfNeeded(req)
+	if err := s.addAuthIfNeeded(ctx, req.Header); err != nil {
+		return DocumentMetadata{}, err
+	}
 
 	contentType := fmt.Sprintf("multipart/related; boundary=%q", writer.Boundary())
 	req.Header.Set("Content-Type", contentType)
 
-	client := getHttpClient()
+	client := s.httpClient()
 
 	// Do the HTTP request
 	startTime := time.Now()
-	resp, err := client.Do(req)
+	resp, err := s.doAuthenticated(client, req)
 	if err != nil {
 		return DocumentMetadata{}, err
 	}
-	defer resp.Body.Close()
+	defer drainAndClose(resp.Body)
 
 	// Update stats
 	s.pushTimingStat("create_document", time.Since(startTime))
@@ -404,21 +438,21 @@ func (s SGDataStore) CreateDocument(doc Document, attachSizeBytes int, newEdits
 }
 
 // Create or update a single document
-func (s SGDataStore) CreateDocumentNoAttachment(doc Document, newEdits bool) (DocumentMetadata, error) {
+func (s SGDataStore) CreateDocumentNoAttachment(ctx context.Context, doc Document, newEdits bool) (DocumentMetadata, error) {
 
 	newEditsStr := "false"
 	if newEdits {
 		newEditsStr = "true"
 	}
 
-	putDocEndpoint, err := addEndpointToUrl(s.SyncGatewayUrl, doc.Id())
+	putDocEndpoint, err := addEndpointToUrl(s.keyspaceUrl(), doc.Id())
 	if err != nil {
 		return DocumentMetadata{}, err
 	}
 
 	putDocEndpoint = putDocEndpoint + fmt.Sprintf("?new_edits=%s", newEditsStr)
 
-	doc["body"] = createBodyContentAsMapWithSize(doc.GetBodySizeBytes())
+	doc.addBodyIfMissing()
 
 	docBytes, err := json.Marshal(doc)
 	if err != nil {
@@ -430,23 +464,28 @@ func (s SGDataStore) CreateDocumentNoAttachment(doc Document, newEdits bool) (Do
 		return DocumentMetadata{}, err
 	}
 
-	req, err := retryablehttp.NewRequest("PUT", putDocEndpoint, reader)
-	s.addAuthIfNeeded(req)
+	req, err := newRetryableRequest(ctx, "PUT", putDocEndpoint, reader)
+	if err != nil {
+		return DocumentMetadata{}, err
+	}
+	if err := s.addAuthIfNeeded(ctx, req.Header); err != nil {
+		return DocumentMetadata{}, err
+	}
 
 	req.Header.Set("Content-Type", "application/json")
 	if s.CompressionEnabled {
 		req.Header.Set("Content-Encoding", "gzip")
 	}
 
-	client := getHttpClient()
+	client := s.httpClient()
 
 	// Do the HTTP request
 	startTime := time.Now()
-	resp, err := client.Do(req)
+	resp, err := s.doAuthenticated(client, req)
 	if err != nil {
 		return DocumentMetadata{}, err
 	}
-	defer resp.Body.Close()
+	defer drainAndClose(resp.Body)
 
 	// Update stats
 	s.pushTimingStat("create_document", time.Since(startTime))
@@ -488,7 +527,7 @@ func (s SGDataStore) CreateDocumentNoAttachment(doc Document, newEdits bool) (Do
 
 
 // Bulk create/update a set of documents in Sync Gateway
-func (s SGDataStore) BulkCreateDocuments(docs []Document, newEdits bool) ([]DocumentMetadata, error) {
+func (s SGDataStore) BulkCreateDocuments(ctx context.Context, docs []Document, newEdits bool) ([]DocumentMetadata, error) {
 
 	fmt.Printf("BulkCreateDocuments() called.  numdocs: %v\n", len(docs))
 
@@ -498,15 +537,22 @@ func (s SGDataStore) BulkCreateDocuments(docs []Document, newEdits bool) ([]Docu
 	// gateload roundtrip time
 	updateCreatedAtTimestamp(docs)
 
+	s.addDocBodies(docs)
+
+	return s.postBulkDocs(ctx, docs, newEdits, "create_document")
+
+}
+
+// POST the docs to _bulk_docs, and push the time it took per doc as the timing stat
+func (s SGDataStore) postBulkDocs(ctx context.Context, docs []Document, newEdits bool, timingKey string) ([]DocumentMetadata, error) {
+
 	documentsAndMetadata := []DocumentMetadata{}
 
-	bulkDocsEndpoint, err := addEndpointToUrl(s.SyncGatewayUrl, "_bulk_docs")
+	bulkDocsEndpoint, err := addEndpointToUrl(s.keyspaceUrl(), "_bulk_docs")
 	if err != nil {
 		return documentsAndMetadata, err
 	}
 
-	s.addDocBodies(docs)
-
 	bulkDocs := BulkDocs{
 		Documents: docs,
 		NewEdits:  newEdits,
@@ -522,26 +568,31 @@ func (s SGDataStore) BulkCreateDocuments(docs []Document, newEdits bool) ([]Docu
 		return documentsAndMetadata, err
 	}
 
-	req, err := retryablehttp.NewRequest("POST", bulkDocsEndpoint, reader)
-	s.addAuthIfNeeded(req)
+	req, err := newRetryableRequest(ctx, "POST", bulkDocsEndpoint, reader)
+	if err != nil {
+		return documentsAndMetadata, err
+	}
+	if err := s.addAuthIfNeeded(ctx, req.Header); err != nil {
+		return documentsAndMetadata, err
+	}
 
 	req.Header.Set("Content-Type", "application/json")
 	if s.CompressionEnabled {
 		req.Header.Set("Content-Encoding", "gzip")
 	}
 
-	client := getHttpClient()
+	client := s.httpClient()
 
 	// Do the POST request
 	startTime := time.Now()
-	resp, err := client.Do(req)
+	resp, err := s.doAuthenticated(client, req)
 	if err != nil {
 		return documentsAndMetadata, err
 	}
-	defer resp.Body.Close()
+	defer drainAndClose(resp.Body)
 
 	// Update stats
-	s.pushTimingStat("create_document", timeDeltaPerDocument(len(docs), time.Since(startTime)))
+	s.pushTimingStat(timingKey, timeDeltaPerDocument(len(docs), time.Since(startTime)))
 
 	// Verify expected status code
 	if resp.StatusCode < 200 || resp.StatusCode > 201 {
@@ -567,7 +618,57 @@ func (s SGDataStore) BulkCreateDocuments(docs []Document, newEdits bool) ([]Docu
 
 }
 
-func (s SGDataStore) BulkCreateDocumentsRetry(docs []Document, newEdits bool) ([]DocumentMetadata, error) {
+func (s SGDataStore) BulkCreateDocumentsRetry(ctx context.Context, docs []Document, newEdits bool) ([]DocumentMetadata, error) {
+	return bulkCreateDocumentsRetry(ctx, docs, newEdits, s.BulkCreateDocuments, s.Metrics)
+}
+
+// Delete the docs with tombstones, via _bulk_docs
+func (s SGDataStore) DeleteDocuments(ctx context.Context, docs []DocumentMetadata) ([]DocumentMetadata, error) {
+
+	defer s.pushCounter("delete_document_counter", len(docs))
+
+	return s.postBulkDocs(ctx, newTombstones(docs), true, "delete_document")
+
+}
+
+// Purge the docs with the admin _purge endpoint, which takes the revisions to purge
+// per doc, where "*" is all of them
+func (s SGDataStore) PurgeDocuments(ctx context.Context, docIds []string) error {
+
+	defer s.pushCounter("purge_document_counter", len(docIds))
+
+	purgeRequest := map[string][]string{}
+	for _, docId := range docIds {
+		purgeRequest[docId] = []string{"*"}
+	}
+	purgeRequestBytes, err := json.Marshal(purgeRequest)
+	if err != nil {
+		return err
+	}
+	req, err := s.newKeyspaceAdminRequest(ctx, "POST", "_purge", purgeRequestBytes)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	startTime := time.Now()
+	resp, err := s.adminHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(resp.Body)
+
+	s.pushTimingStat("purge_document", timeDeltaPerDocument(len(docIds), time.Since(startTime)))
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected response status for POST _purge request: %d", resp.StatusCode)
+	}
+	return nil
+
+}
+
+// Calls bulkCreate with the docs, and then again with the ones that failed, until they've all been pushed
+func bulkCreateDocumentsRetry(ctx context.Context, docs []Document, newEdits bool, bulkCreate func(ctx context.Context, docs []Document, newEdits bool) ([]DocumentMetadata, error), metrics MetricsSink) ([]DocumentMetadata, error) {
 
 	totalPushedDocRevPairs := []DocumentMetadata{}
 	numRetries := 10
@@ -582,7 +683,12 @@ func (s SGDataStore) BulkCreateDocumentsRetry(docs []Document, newEdits bool) ([
 			logger.Debug("BulkCreateDocumentsRetry about to retry", "numdocs", len(pendingDocs))
 		}
 
-		pushedDocRevPairs, err := s.BulkCreateDocuments(pendingDocs, newEdits)
+		pushedDocRevPairs, err := bulkCreate(ctx, pendingDocs, newEdits)
+		if err != nil {
+			// The http client already retried transient failures of the whole
+			// request, so give up rather than retrying with no pending docs
+			return false, err, nil
+		}
 
 		// If any of the bulk docs had errors, remove them from the response.
 		successful, failed := splitSucceededAndFailed(pushedDocRevPairs)
@@ -614,8 +720,7 @@ func (s SGDataStore) BulkCreateDocumentsRetry(docs []Document, newEdits bool) ([
 		pendingDocs = filterDocsIncluding(pendingDocs, failed)
 
 		// Since the docs with errors will be retried, update retry stats
-		s.StatsdClient.Counter(
-			statsdSampleRate,
+		metrics.Counter(
 			"retries",
 			len(failed),
 		)
@@ -625,16 +730,21 @@ func (s SGDataStore) BulkCreateDocumentsRetry(docs []Document, newEdits bool) ([
 	}
 
 	err, _ := RetryLoop(
+		ctx,
 		"BulkCreateDocumentsRetry",
 		retryWorker,
 		retrySleeper,
 	)
 
+	if err != nil {
+		return totalPushedDocRevPairs, err
+	}
+
 	if len(totalPushedDocRevPairs) != len(docs) {
-		panic(fmt.Sprintf("Unexpected number of docs pushed.  Got %v Expected %v", len(totalPushedDocRevPairs), len(docs)))
+		return totalPushedDocRevPairs, fmt.Errorf("Unexpected number of docs pushed.  Got %v Expected %v", len(totalPushedDocRevPairs), len(docs))
 	}
 
-	return totalPushedDocRevPairs, err
+	return totalPushedDocRevPairs, nil
 
 }
 
@@ -677,15 +787,20 @@ func splitSucceededAndFailed(bulkDocsResponse []DocumentMetadata) (successful []
 
 func (s SGDataStore) addDocBodies(docs []Document) {
 	for _, doc := range docs {
-		doc["body"] = createBodyContentAsMapWithSize(doc.GetBodySizeBytes())
+		doc.addBodyIfMissing()
 	}
 }
 
-func (s SGDataStore) BulkGetDocuments(r sgreplicate.BulkGetRequest) ([]sgreplicate.Document, error) {
+func (s SGDataStore) BulkGetDocuments(ctx context.Context, r sgreplicate.BulkGetRequest) ([]sgreplicate.Document, error) {
+	return s.bulkGetDocuments(ctx, r, r)
+}
+
+// POST the body (which asks for the docs in r) to _bulk_get, and read the docs from the response
+func (s SGDataStore) bulkGetDocuments(ctx context.Context, r sgreplicate.BulkGetRequest, body interface{}) ([]sgreplicate.Document, error) {
 
 	defer s.pushCounter("get_document_counter", len(r.Docs))
 
-	bulkGetEndpoint, err := addEndpointToUrl(s.SyncGatewayUrl, "_bulk_get")
+	bulkGetEndpoint, err := addEndpointToUrl(s.keyspaceUrl(), "_bulk_get")
 	if err != nil {
 		return nil, err
 	}
@@ -695,26 +810,31 @@ func (s SGDataStore) BulkGetDocuments(r sgreplicate.BulkGetRequest) ([]sgreplica
 		bulkGetEndpoint,
 	)
 
-	bulkGetBytes, err := json.Marshal(r)
+	bulkGetBytes, err := json.Marshal(body)
 	if err != nil {
 		return nil, fmt.Errorf("BulkGetDocuments failed to marshal request: %v", err)
 	}
 
 	buf := bytes.NewReader(bulkGetBytes)
 
-	req, err := retryablehttp.NewRequest("POST", bulkGetEndpoint, buf)
-	s.addAuthIfNeeded(req)
+	req, err := newRetryableRequest(ctx, "POST", bulkGetEndpoint, buf)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.addAuthIfNeeded(ctx, req.Header); err != nil {
+		return nil, err
+	}
 
 	req.Header.Set("Content-Type", "application/json")
 
-	client := getHttpClient()
+	client := s.httpClient()
 
 	startTime := time.Now()
-	resp, err := client.Do(req)
+	resp, err := s.doAuthenticated(client, req)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	defer drainAndClose(resp.Body)
 
 	s.pushTimingStat("get_document", timeDeltaPerDocument(len(r.Docs), time.Since(startTime)))
 	if resp.StatusCode < 200 || resp.StatusCode > 201 {
@@ -724,7 +844,15 @@ func (s SGDataStore) BulkGetDocuments(r sgreplicate.BulkGetRequest) ([]sgreplica
 	// Parse the response and make sure that we got all the docs we requested
 
 	// Logger function that ignores any logging from the ReadBulkGetResponse method
-	documents, err := sgreplicate.ReadBulkGetResponse(resp, sgreplicate.Replication{})
+	ignoreLogs := sgreplicate.Replication{
+		Parameters: sgreplicate.ReplicationParameters{
+			LogFn: func(level clog.LogLevel, format string, args ...interface{}) {},
+		},
+	}
+	documents, err := sgreplicate.ReadBulkGetResponse(resp, ignoreLogs)
+	if err != nil {
+		return nil, err
+	}
 
 	if len(documents) != len(r.Docs) {
 		for i, doc := range r.Docs {
@@ -738,26 +866,27 @@ func (s SGDataStore) BulkGetDocuments(r sgreplicate.BulkGetRequest) ([]sgreplica
 		return nil, fmt.Errorf("BulkGetDocuments Expected %d docs, got %d docs", len(r.Docs), len(documents))
 	}
 
+	s.pushGateloadRoundtripStats(documents)
+
+	return documents, nil
+
+}
+
+// Push how long it took each of the docs to get from the writer to the reader,
+// based on the "created_at" timestamp set by the writer
+func (s SGDataStore) pushGateloadRoundtripStats(documents []sgreplicate.Document) {
+
 	for _, doc := range documents {
-		createAtRFC3339NanoIface, ok := doc.Body["created_at"]
-		if !ok {
-			logger.Warn("Document missing created_at field", "doc.Body", doc.Body)
-			continue
-		}
-		createAtRFC3339NanoStr, ok := createAtRFC3339NanoIface.(string)
-		if !ok {
-			logger.Warn("Document created_at not a string", "doc.Body", doc.Body)
+		if isTombstone(doc) {
+			// Tombstones are written by the deleters, which don't set created_at
 			continue
 		}
-		createAtRFC3339Nano, err := time.Parse(
-			time.RFC3339Nano,
-			createAtRFC3339NanoStr,
-		)
+		createdAt, err := docCreatedAt(doc)
 		if err != nil {
-			logger.Warn("Could not parse doc.created_at field into time", "createAtRFC3339Nano", createAtRFC3339Nano)
+			logger.Warn("Could not get doc created_at field", "doc.Body", doc.Body, "error", err)
 			continue
 		}
-		delta := time.Since(createAtRFC3339Nano)
+		delta := time.Since(createdAt)
 		s.pushTimingStat("gateload_roundtrip", delta)
 		logger.Debug("Gateload roundtrip time", "delta", delta, "user", s.UserCreds.Username)
 
@@ -765,8 +894,22 @@ func (s SGDataStore) BulkGetDocuments(r sgreplicate.BulkGetRequest) ([]sgreplica
 
 	}
 
-	return documents, nil
+}
 
+// When the writer (or updater) wrote this revision of the doc
+func docCreatedAt(doc sgreplicate.Document) (time.Time, error) {
+	createAtRFC3339NanoIface, ok := doc.Body["created_at"]
+	if !ok {
+		return time.Time{}, fmt.Errorf("Document missing created_at field")
+	}
+	createAtRFC3339NanoStr, ok := createAtRFC3339NanoIface.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("Document created_at not a string")
+	}
+	return time.Parse(
+		time.RFC3339Nano,
+		createAtRFC3339NanoStr,
+	)
 }
 
 // If the round trip time is over a certain threshold, log a verbose
@@ -814,28 +957,68 @@ func possiblyLogVerboseWarning(delta time.Duration, doc sgreplicate.Document) {
 
 }
 
-// add BasicAuth header for user if needed
-func (s SGDataStore) addAuthIfNeeded(req *retryablehttp.Request) {
-	if !s.UserCreds.Empty() {
-		req.SetBasicAuth(s.UserCreds.Username, s.UserCreds.Password)
-		req.Header.Set("X-sgload-username", s.UserCreds.Username)
+// Add the user's credentials to a request, if there's a user
+func (s SGDataStore) addAuthIfNeeded(ctx context.Context, header http.Header) error {
+	if s.UserCreds.Empty() {
+		return nil
 	}
+	header.Set("X-sgload-username", s.UserCreds.Username)
+	return s.authenticator().AddAuth(ctx, header)
+}
+
+// How requests are authenticated as the user
+func (s SGDataStore) authenticator() Authenticator {
+	if s.Authenticator != nil {
+		return s.Authenticator
+	}
+	return basicAuthenticator{userCreds: s.UserCreds}
+}
+
+// Do the request.  If Sync Gateway rejects the user's credentials, eg because their
+// session has expired, authenticate again and retry it once.
+func (s SGDataStore) doAuthenticated(client *retryablehttp.Client, req *retryablehttp.Request) (*http.Response, error) {
+
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || s.UserCreds.Empty() {
+		return resp, err
+	}
+	if !s.renewAuth() {
+		return resp, nil
+	}
+	drainAndClose(resp.Body)
+
+	if err := s.addAuthIfNeeded(req.Context(), req.Header); err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+
+}
+
+// Forget the credentials that Sync Gateway rejected, and return whether there are new
+// ones to try
+func (s SGDataStore) renewAuth() bool {
+	if !s.authenticator().Renew() {
+		return false
+	}
+	if s.Metrics != nil {
+		s.Metrics.Counter("auth_renewals", 1)
+	}
+	return true
 }
 
 func (s SGDataStore) pushTimingStat(key string, delta time.Duration) {
 
-	if s.StatsdClient == nil {
+	if s.Metrics == nil {
 		return
 	}
 
 	logger.Debug(
-		fmt.Sprintf("Statsd timing stat for %s", key),
+		fmt.Sprintf("Timing stat for %s", key),
 		"delta",
 		delta,
 	)
 
-	s.StatsdClient.Timing(
-		statsdSampleRate,
+	s.Metrics.Timing(
 		key,
 		delta,
 	)
@@ -843,18 +1026,17 @@ func (s SGDataStore) pushTimingStat(key string, delta time.Duration) {
 
 func (s SGDataStore) pushCounter(key string, n int) {
 
-	if s.StatsdClient == nil {
+	if s.Metrics == nil {
 		return
 	}
 
 	logger.Debug(
-		fmt.Sprintf("Statsd counter for %s", key),
+		fmt.Sprintf("Counter for %s", key),
 		"n",
 		n,
 	)
 
-	s.StatsdClient.Counter(
-		statsdSampleRate,
+	s.Metrics.Counter(
 		key,
 		n,
 	)
@@ -883,14 +1065,6 @@ func (s SGDataStore) getReaderFromDocBytes(docBytes []byte) (*bytes.Reader, erro
 	return reader, nil
 }
 
-func splitHostPortWrapper(host string) (string, string, error) {
-	if !strings.Contains(host, ":") {
-		return host, "", nil
-	}
-
-	return net.SplitHostPort(host)
-}
-
 func addEndpointToUrl(urlStr, endpoint string) (string, error) {
 	u, err := url.Parse(urlStr)
 	if err != nil {
@@ -911,10 +1085,26 @@ func timeDeltaPerDocument(numDocs int, timeDeltaAllDocs time.Duration) time.Dura
 	return time.Duration(int64(timeDeltaAllDocs) / int64(numDocs))
 }
 
+// Creates a retryable request which is cancelled, along with any retries, when ctx is done
+func newRetryableRequest(ctx context.Context, method, url string, rawBody interface{}) (*retryablehttp.Request, error) {
+	req, err := retryablehttp.NewRequest(method, url, rawBody)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(ctx), nil
+}
+
 func getHttpClient() *retryablehttp.Client {
 	return sgClient
 }
 
+func (s SGDataStore) httpClient() *retryablehttp.Client {
+	if s.HTTPClient != nil {
+		return s.HTTPClient
+	}
+	return getHttpClient()
+}
+
 // Customize the DefaultTransport to have larger connection pool
 // See http://tleyden.github.io/blog/2016/11/21/tuning-the-go-http-client-library-for-load-testing/
 func transportWithConnPool(numConnections int) *http.Transport {
@@ -923,10 +1113,10 @@ func transportWithConnPool(numConnections int) *http.Transport {
 	if !ok {
 		panic(fmt.Sprintf("http.DefaultTransport not an *http.Transport"))
 	}
-	customTransport := *defaultTransport
+	customTransport := defaultTransport.Clone()
 	customTransport.MaxIdleConns = numConnections
 	customTransport.MaxIdleConnsPerHost = numConnections
-	return &customTransport
+	return customTransport
 
 }
 
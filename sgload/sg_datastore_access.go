@@ -0,0 +1,166 @@
+package sgload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	sgreplicate "github.com/couchbaselabs/sg-replicate"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// A change on a changes feed, along with the channels the doc was removed from, which
+// Sync Gateway sends when the user loses access to a doc.  sg-replicate's Change
+// doesn't have them.
+type changeWithRemovals struct {
+	sgreplicate.Change
+	Removed []string `json:"removed"`
+}
+
+type changesWithRemovals struct {
+	Results      []changeWithRemovals `json:"results"`
+	LastSequence interface{}          `json:"last_seq"`
+}
+
+// All the changes, including the removals, the way sg-replicate decodes them
+func (c changesWithRemovals) changes() sgreplicate.Changes {
+	changes := sgreplicate.Changes{LastSequence: c.LastSequence}
+	for _, change := range c.Results {
+		changes.Results = append(changes.Results, change.Change)
+	}
+	return changes
+}
+
+// The changes which aren't removals, and the channels each removed doc was removed from
+func (c changesWithRemovals) split() (sgreplicate.Changes, Removals) {
+	changes := sgreplicate.Changes{LastSequence: c.LastSequence}
+	removals := Removals{}
+	for _, change := range c.Results {
+		if len(change.Removed) > 0 {
+			removals[change.Id] = change.Removed
+			continue
+		}
+		changes.Results = append(changes.Results, change.Change)
+	}
+	return changes, removals
+}
+
+func (s SGDataStore) ChangesWithRemovals(ctx context.Context, sinceVal Sincer, limit int, feedType ChangesFeedType) (sgreplicate.Changes, Removals, Sincer, error) {
+	changes, newSinceVal, err := s.getChanges(ctx, sinceVal, limit, feedType)
+	if err != nil {
+		return sgreplicate.Changes{}, nil, sinceVal, err
+	}
+	changesWithoutRemovals, removals := changes.split()
+	return changesWithoutRemovals, removals, newSinceVal, nil
+}
+
+// Ask for the docs the user loses access to on its changes feeds, which Sync Gateway 3.x
+// only sends as removals with revocations=true
+func (s *SGDataStore) SetRevocations(revocations bool) {
+	s.Revocations = revocations
+}
+
+// Replace the user's admin channels and roles, which Sync Gateway applies to the
+// user's changes feeds as soon as it's saved.  The user keeps its password.
+func (s SGDataStore) UpdateUserAccess(ctx context.Context, username string, channelNames []string, roles []string) error {
+
+	userDoc := map[string]interface{}{
+		"name":        username,
+		"admin_roles": roles,
+	}
+	addChannelGrants(userDoc, s.Keyspaces, channelNames)
+
+	status, err := s.doAdminJSONRequest(ctx, "PUT", "_user/"+username, userDoc, "update_user_access", nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusCreated {
+		return fmt.Errorf("Unexpected response status for PUT _user/%s request: %d", username, status)
+	}
+	return nil
+
+}
+
+// Create or replace a role, whose channels the users with the role get
+func (s SGDataStore) PutRole(ctx context.Context, name string, channelNames []string) error {
+
+	roleDoc := map[string]interface{}{
+		"name":           name,
+		"admin_channels": channelNames,
+	}
+	status, err := s.doAdminJSONRequest(ctx, "PUT", "_role/"+name, roleDoc, "put_role", nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusCreated {
+		return fmt.Errorf("Unexpected response status for PUT _role/%s request: %d", name, status)
+	}
+	return nil
+
+}
+
+// The IDs of the docs that are in any of the channels, from the admin changes feed
+func (s SGDataStore) ChannelDocIDs(ctx context.Context, channelNames []string) ([]string, error) {
+
+	changesFeedParams := NewChangesFeedParams(StringSincer{}, 0, FEED_TYPE_NORMAL)
+	changesFeedParams.channels = channelNames
+
+	req, err := s.newKeyspaceAdminRequest(ctx, "GET", "_changes", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = changesFeedParams.String()
+
+	changes := sgreplicate.Changes{}
+	status, err := s.doAdminRequest(req, "channel_doc_ids", &changes)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected response status for admin GET _changes request: %d", status)
+	}
+
+	docIds := []string{}
+	for _, change := range stripUserDocChanges(changes).Results {
+		docIds = append(docIds, change.Id)
+	}
+	return docIds, nil
+
+}
+
+// Send a request to an endpoint of the admin API, with body encoded as JSON, and decode
+// a successful response into result unless it's nil.  Returns the response status.
+func (s SGDataStore) doAdminJSONRequest(ctx context.Context, method, endpoint string, body interface{}, timingKey string, result interface{}) (int, error) {
+
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	req, err := s.newAdminRequest(ctx, method, endpoint, bodyBytes)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return s.doAdminRequest(req, timingKey, result)
+
+}
+
+func (s SGDataStore) doAdminRequest(req *retryablehttp.Request, timingKey string, result interface{}) (int, error) {
+
+	startTime := time.Now()
+	resp, err := s.adminHTTPClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer drainAndClose(resp.Body)
+
+	s.pushTimingStat(timingKey, time.Since(startTime))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || result == nil {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(result)
+
+}
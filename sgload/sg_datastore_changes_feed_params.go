@@ -10,13 +10,28 @@ type ChangesFeedType string
 const FEED_TYPE_LONGPOLL = ChangesFeedType("longpoll")
 const FEED_TYPE_NORMAL = ChangesFeedType("normal")
 
+// Streaming feed types, which hold one connection open and send changes as they happen
+const FEED_TYPE_CONTINUOUS = ChangesFeedType("continuous")
+const FEED_TYPE_WEBSOCKET = ChangesFeedType("websocket")
+const FEED_TYPE_EVENTSOURCE = ChangesFeedType("eventsource")
+
+// Whether the feed is held open, rather than being a request per batch of changes
+func (f ChangesFeedType) Streaming() bool {
+	switch f {
+	case FEED_TYPE_CONTINUOUS, FEED_TYPE_WEBSOCKET, FEED_TYPE_EVENTSOURCE:
+		return true
+	}
+	return false
+}
+
 type ChangesFeedParams struct {
 	feedType            ChangesFeedType // eg, "normal" or "longpoll"
-	limit               int             // eg, 50
+	limit               int             // eg, 50, or 0 for no limit
 	heartbeatTimeMillis int             // eg, 300000
 	feedStyle           string          // eg, "all_docs"
 	since               Sincer          // eg, "3",
 	channels            []string
+	revocations         bool // Whether to ask for removals of the docs the user lost access to
 }
 
 func NewChangesFeedParams(sinceVal Sincer, limit int, feedType ChangesFeedType) *ChangesFeedParams {
@@ -31,18 +46,23 @@ func NewChangesFeedParams(sinceVal Sincer, limit int, feedType ChangesFeedType)
 
 func (p ChangesFeedParams) String() string {
 	params := fmt.Sprintf(
-		"feed=%s&limit=%d&heartbeat=%d&style=%s",
+		"feed=%s&heartbeat=%d&style=%s",
 		p.feedType,
-		p.limit,
 		p.heartbeatTimeMillis,
 		p.feedStyle,
 	)
+	if p.limit > 0 {
+		params = fmt.Sprintf("%v&limit=%d", params, p.limit)
+	}
 	if !p.since.Empty() {
 		params = fmt.Sprintf("%v&since=%s", params, p.since)
 	}
 	if len(p.channels) > 0 {
 		params = fmt.Sprintf("%v&filter=sync_gateway/bychannel&channels=%s", params, strings.Join(p.channels, ","))
 	}
+	if p.revocations {
+		params = fmt.Sprintf("%v&revocations=true", params)
+	}
 	return params
 }
 
@@ -0,0 +1,373 @@
+package sgload
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	sgreplicate "github.com/couchbaselabs/sg-replicate"
+	"github.com/gorilla/websocket"
+)
+
+// How many changes a stream reads ahead of the reader before it stops reading from the connection
+const changesStreamBuffer = 1000
+
+// The error of a stream which Sync Gateway ended, eg because its timeout was reached
+var errChangesStreamEnded = errors.New("Changes feed ended")
+
+// A change from a streaming changes feed, and when it arrived
+type StreamedChange struct {
+	sgreplicate.Change
+	Removed []string // If the user lost access to the doc, the channels it was removed from
+	Arrived time.Time
+}
+
+// A changes feed that's held open (feed=continuous, websocket or eventsource), which
+// delivers changes as Sync Gateway sends them
+type ChangesStream struct {
+	FeedType ChangesFeedType
+	changes  chan StreamedChange // Closed when the connection ends, after the changes that arrived before that
+	cancel   context.CancelFunc
+	mutex    sync.Mutex
+	err      error
+}
+
+func newChangesStream(ctx context.Context, feedType ChangesFeedType) (*ChangesStream, context.Context) {
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream := &ChangesStream{
+		FeedType: feedType,
+		changes:  make(chan StreamedChange, changesStreamBuffer),
+		cancel:   cancel,
+	}
+	return stream, streamCtx
+}
+
+// Wait for a change, then take any others that have already arrived, up to limit.  Once
+// the connection has ended, returns why.
+func (cs *ChangesStream) Next(ctx context.Context, limit int) ([]StreamedChange, error) {
+
+	var first StreamedChange
+	select {
+	case change, ok := <-cs.changes:
+		if !ok {
+			return nil, cs.Err()
+		}
+		first = change
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	changes := []StreamedChange{first}
+	for limit <= 0 || len(changes) < limit {
+		select {
+		case change, ok := <-cs.changes:
+			if !ok {
+				return changes, nil
+			}
+			changes = append(changes, change)
+		default:
+			return changes, nil
+		}
+	}
+	return changes, nil
+
+}
+
+// Why the connection ended, or nil if it's still open
+func (cs *ChangesStream) Err() error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return cs.err
+}
+
+// Close the connection
+func (cs *ChangesStream) Close() {
+	cs.cancel()
+}
+
+// Called by the goroutine reading from the connection when it's done
+func (cs *ChangesStream) finish(err error) {
+	if err == nil || err == io.EOF {
+		err = errChangesStreamEnded
+	}
+	cs.mutex.Lock()
+	cs.err = err
+	cs.mutex.Unlock()
+	close(cs.changes)
+}
+
+// Deliver a change to the reader, unless the stream has been closed
+func (cs *ChangesStream) deliver(ctx context.Context, change changeWithRemovals) error {
+	select {
+	case cs.changes <- StreamedChange{Change: change.Change, Removed: change.Removed, Arrived: time.Now()}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Open a streaming changes feed.  Unlike the other requests it isn't retried, since
+// the reader reconnects from where it got to instead.
+func (s SGDataStore) OpenChangesStream(ctx context.Context, sinceVal Sincer, feedType ChangesFeedType) (*ChangesStream, error) {
+
+	changesFeedParams := NewChangesFeedParams(sinceVal, 0, feedType)
+	changesFeedParams.revocations = s.Revocations
+
+	switch feedType {
+	case FEED_TYPE_CONTINUOUS, FEED_TYPE_EVENTSOURCE:
+		return s.openHTTPChangesStream(ctx, changesFeedParams)
+	case FEED_TYPE_WEBSOCKET:
+		return s.openWebSocketChangesStream(ctx, changesFeedParams)
+	}
+	return nil, fmt.Errorf("Feed type %q isn't a streaming feed type", feedType)
+
+}
+
+func (s SGDataStore) openHTTPChangesStream(ctx context.Context, changesFeedParams *ChangesFeedParams) (*ChangesStream, error) {
+
+	changesFeedEndpoint, err := addEndpointToUrl(s.keyspaceUrl(), "_changes")
+	if err != nil {
+		return nil, err
+	}
+
+	stream, streamCtx := newChangesStream(ctx, changesFeedParams.feedType)
+	req, err := http.NewRequestWithContext(streamCtx, "GET", fmt.Sprintf("%s?%s", changesFeedEndpoint, changesFeedParams), nil)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if err := s.addAuthIfNeeded(streamCtx, req.Header); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if changesFeedParams.feedType == FEED_TYPE_EVENTSOURCE {
+		req.Header.Set("Accept", "text/event-stream")
+	}
+
+	// The shared client has a timeout on whole requests, which a stream would run into
+	client := &http.Client{Transport: s.httpClient().HTTPClient.Transport}
+
+	startTime := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		stream.Close()
+		if resp.StatusCode == http.StatusUnauthorized {
+			// Reconnecting will authenticate again
+			s.renewAuth()
+		}
+		return nil, fmt.Errorf("Unexpected response status for %s changes feed GET request: %d", changesFeedParams.feedType, resp.StatusCode)
+	}
+	s.pushTimingStat("changes_feed_connect", time.Since(startTime))
+
+	go func() {
+		defer resp.Body.Close()
+		if changesFeedParams.feedType == FEED_TYPE_EVENTSOURCE {
+			stream.finish(readEventSourceChanges(streamCtx, stream, resp.Body))
+		} else {
+			stream.finish(readContinuousChanges(streamCtx, stream, resp.Body))
+		}
+	}()
+
+	return stream, nil
+
+}
+
+// A continuous feed has a change per line, with empty lines as heartbeats.  When it
+// ends, the last line has the last_seq instead.
+func readContinuousChanges(ctx context.Context, stream *ChangesStream, body io.Reader) error {
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		change, isChange, err := decodeStreamedChange(line)
+		if err != nil {
+			return err
+		}
+		if !isChange {
+			return nil
+		}
+		if err := stream.deliver(ctx, change); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+
+}
+
+// An eventsource feed has an event per change, whose data is the change.  Lines
+// starting with a colon are comments, which Sync Gateway sends as heartbeats.
+func readEventSourceChanges(ctx context.Context, stream *ChangesStream, body io.Reader) error {
+
+	data := []string{}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// The end of an event
+			if len(data) == 0 {
+				continue
+			}
+			change, isChange, err := decodeStreamedChange([]byte(strings.Join(data, "\n")))
+			data = data[:0]
+			if err != nil {
+				return err
+			}
+			if !isChange {
+				return nil
+			}
+			if err := stream.deliver(ctx, change); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return scanner.Err()
+
+}
+
+// The options of a websocket feed are sent as the first message, rather than in the URL
+type webSocketChangesOptions struct {
+	Since       string `json:"since,omitempty"`
+	Style       string `json:"style,omitempty"`
+	Heartbeat   int    `json:"heartbeat,omitempty"`
+	Filter      string `json:"filter,omitempty"`
+	Channels    string `json:"channels,omitempty"`
+	Revocations bool   `json:"revocations,omitempty"`
+}
+
+func (s SGDataStore) openWebSocketChangesStream(ctx context.Context, changesFeedParams *ChangesFeedParams) (*ChangesStream, error) {
+
+	changesFeedEndpoint, err := addEndpointToUrl(s.keyspaceUrl(), "_changes")
+	if err != nil {
+		return nil, err
+	}
+	changesFeedUrl, err := webSocketURL(changesFeedEndpoint + "?feed=websocket")
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	if err := s.addAuthIfNeeded(ctx, header); err != nil {
+		return nil, err
+	}
+
+	dialer := s.webSocketDialer()
+	dialer.HandshakeTimeout = time.Minute
+
+	startTime := time.Now()
+	ws, resp, err := dialer.DialContext(ctx, changesFeedUrl, header)
+	if err != nil {
+		if resp != nil {
+			if resp.StatusCode == http.StatusUnauthorized {
+				s.renewAuth()
+			}
+			return nil, fmt.Errorf("Unexpected response status for websocket changes feed handshake: %d", resp.StatusCode)
+		}
+		return nil, err
+	}
+
+	options := webSocketChangesOptions{
+		Style:     changesFeedParams.feedStyle,
+		Heartbeat: changesFeedParams.heartbeatTimeMillis,
+	}
+	if !changesFeedParams.since.Empty() {
+		options.Since = changesFeedParams.since.String()
+	}
+	if len(changesFeedParams.channels) > 0 {
+		options.Filter = "sync_gateway/bychannel"
+		options.Channels = strings.Join(changesFeedParams.channels, ",")
+	}
+	options.Revocations = changesFeedParams.revocations
+	if err := ws.WriteJSON(options); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	s.pushTimingStat("changes_feed_connect", time.Since(startTime))
+
+	stream, streamCtx := newChangesStream(ctx, FEED_TYPE_WEBSOCKET)
+	go func() {
+		// Closing the connection is the only way to interrupt a read
+		<-streamCtx.Done()
+		ws.Close()
+	}()
+	go func() {
+		stream.finish(readWebSocketChanges(streamCtx, stream, ws))
+	}()
+
+	return stream, nil
+
+}
+
+// Each websocket message is an array of changes.  Empty arrays are heartbeats.
+func readWebSocketChanges(ctx context.Context, stream *ChangesStream, ws *websocket.Conn) error {
+
+	for {
+		_, message, err := ws.ReadMessage()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		rawChanges := []json.RawMessage{}
+		if err := json.Unmarshal(message, &rawChanges); err != nil {
+			return fmt.Errorf("Invalid websocket changes feed message: %v", err)
+		}
+		for _, rawChange := range rawChanges {
+			change, isChange, err := decodeStreamedChange(rawChange)
+			if err != nil {
+				return err
+			}
+			if !isChange {
+				return nil
+			}
+			if err := stream.deliver(ctx, change); err != nil {
+				return err
+			}
+		}
+	}
+
+}
+
+// Decode a change, keeping its sequence as a string like the last_seq of other feed
+// types.  Returns false if it's the last_seq entry which ends a feed.
+func decodeStreamedChange(data []byte) (change changeWithRemovals, isChange bool, err error) {
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&change); err != nil {
+		return change, false, fmt.Errorf("Invalid change %q: %v", data, err)
+	}
+	if change.Id == "" {
+		return change, false, nil
+	}
+	if len(change.ChangedRevs) == 0 {
+		return change, false, fmt.Errorf("Change for doc %s has no revisions", change.Id)
+	}
+	change.Sequence = fmt.Sprintf("%v", change.Sequence)
+	return change, true, nil
+
+}
@@ -0,0 +1,131 @@
+package sgload
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/sgload/sgsimulator"
+)
+
+// Gets changes from the stream until there are numChanges of them
+func nextStreamedChanges(t *testing.T, stream *ChangesStream, numChanges int) []StreamedChange {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	changes := []StreamedChange{}
+	for len(changes) < numChanges {
+		batch, err := stream.Next(ctx, numChanges-len(changes))
+		if err != nil {
+			t.Fatalf("Error getting %s changes after %d of %d: %v", stream.FeedType, len(changes), numChanges, err)
+		}
+		changes = append(changes, batch...)
+	}
+	return changes
+}
+
+func TestChangesStreamFeedTypes(t *testing.T) {
+
+	for _, feedType := range []ChangesFeedType{FEED_TYPE_CONTINUOUS, FEED_TYPE_WEBSOCKET, FEED_TYPE_EVENTSOURCE} {
+
+		_, dataStore, cleanup := newSimulatorDataStore(t, sgsimulator.FaultConfig{})
+
+		ctx := context.Background()
+		readerCreds := UserCred{Username: "reader", Password: "password"}
+		if err := dataStore.CreateUser(ctx, readerCreds, []string{"ABC"}); err != nil {
+			t.Fatalf("Error creating user: %v", err)
+		}
+		if _, err := dataStore.BulkCreateDocuments(ctx, docsToWrite("before", 3, []string{"ABC"}), true); err != nil {
+			t.Fatalf("Error creating docs: %v", err)
+		}
+
+		reader := *dataStore
+		reader.SetUserCreds(readerCreds)
+		stream, err := reader.OpenChangesStream(ctx, StringSincer{Since: "1"}, feedType)
+		if err != nil {
+			t.Fatalf("Error opening %s changes feed: %v", feedType, err)
+		}
+
+		// The changes since the since value, then the ones that happen while the feed is open
+		changes := nextStreamedChanges(t, stream, 2)
+		if changes[0].Id != "before-1" || changes[0].Sequence != "2" || changes[1].Sequence != "3" {
+			t.Fatalf("Unexpected %s changes: %+v", feedType, changes)
+		}
+		docs := append(docsToWrite("hidden", 1, []string{"XYZ"}), docsToWrite("after", 1, []string{"ABC"})...)
+		if _, err := dataStore.BulkCreateDocuments(ctx, docs, true); err != nil {
+			t.Fatalf("Error creating docs: %v", err)
+		}
+		changes = nextStreamedChanges(t, stream, 1)
+		if changes[0].Id != "after-0" || changes[0].Sequence != "5" || changes[0].Arrived.IsZero() {
+			t.Fatalf("Unexpected %s changes: %+v", feedType, changes)
+		}
+
+		// Once closed, the stream says why rather than waiting
+		stream.Close()
+		if _, err := stream.Next(ctx, 1); err == nil {
+			t.Fatalf("Expected error getting changes from a closed %s feed", feedType)
+		}
+
+		cleanup()
+	}
+
+}
+
+func TestChangesFeedsRevocations(t *testing.T) {
+
+	for _, feedType := range []ChangesFeedType{FEED_TYPE_NORMAL, FEED_TYPE_CONTINUOUS, FEED_TYPE_WEBSOCKET, FEED_TYPE_EVENTSOURCE} {
+
+		_, dataStore, cleanup := newSimulatorDataStore(t, sgsimulator.FaultConfig{})
+
+		ctx := context.Background()
+		readerCreds := UserCred{Username: "reader", Password: "password"}
+		if err := dataStore.CreateUser(ctx, readerCreds, []string{"A", "B"}); err != nil {
+			t.Fatalf("Error creating user: %v", err)
+		}
+		if _, err := dataStore.BulkCreateDocuments(ctx, docsToWrite("inA", 1, []string{"A"}), true); err != nil {
+			t.Fatalf("Error creating docs: %v", err)
+		}
+		if err := dataStore.UpdateUserAccess(ctx, "reader", []string{"B"}, []string{}); err != nil {
+			t.Fatalf("Error revoking channel: %v", err)
+		}
+
+		// Only a reader that asks for revocations hears that it lost access to inA-0
+		for _, revocations := range []bool{false, true} {
+
+			reader := *dataStore
+			reader.SetUserCreds(readerCreds)
+			reader.SetRevocations(revocations)
+
+			removals := Removals{}
+			if feedType.Streaming() {
+				stream, err := reader.OpenChangesStream(ctx, StringSincer{Since: "1"}, feedType)
+				if err != nil {
+					t.Fatalf("Error opening %s changes feed: %v", feedType, err)
+				}
+				streamCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+				changes, _ := stream.Next(streamCtx, 1)
+				cancel()
+				stream.Close()
+				for _, change := range changes {
+					removals[change.Id] = change.Removed
+				}
+			} else {
+				var err error
+				if _, removals, _, err = reader.ChangesWithRemovals(ctx, StringSincer{Since: "1"}, 0, feedType); err != nil {
+					t.Fatalf("Error getting changes: %v", err)
+				}
+			}
+
+			if revocations && (len(removals) != 1 || len(removals["inA-0"]) != 1 || removals["inA-0"][0] != "A") {
+				t.Fatalf("Expected inA-0 to be removed from A on the %s feed, got %v", feedType, removals)
+			}
+			if !revocations && len(removals) != 0 {
+				t.Fatalf("Expected no removals on the %s feed without revocations, got %v", feedType, removals)
+			}
+		}
+
+		cleanup()
+	}
+
+}
@@ -0,0 +1,142 @@
+package sgload
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/sgload/sgsimulator"
+)
+
+// Starts an in-process sgsimulator with the given faults and returns a datastore pointed at it
+func newSimulatorDataStore(t *testing.T, faultConfig sgsimulator.FaultConfig) (*sgsimulator.SGSimulator, *SGDataStore, func()) {
+
+	sim := sgsimulator.NewSGSimulator("db")
+	sim.SetFaultConfig(faultConfig)
+
+	publicServer := httptest.NewServer(sim.PublicHandler())
+	adminServer := httptest.NewServer(sim.AdminHandler())
+
+	adminUrl, err := url.Parse(adminServer.URL)
+	if err != nil {
+		t.Fatalf("Error parsing admin url: %v", err)
+	}
+	adminPort, err := strconv.Atoi(adminUrl.Port())
+	if err != nil {
+		t.Fatalf("Error parsing admin port: %v", err)
+	}
+
+	dataStore := NewSGDataStore(publicServer.URL+"/db/", adminPort, NoOpMetricsSink{}, false)
+
+	// Keep the retryablehttp backoff short so the tests run quickly
+	sgClient.RetryWaitMin = time.Millisecond
+	sgClient.RetryWaitMax = 10 * time.Millisecond
+
+	return sim, dataStore, func() {
+		publicServer.Close()
+		adminServer.Close()
+	}
+}
+
+func numDocsInChanges(t *testing.T, dataStore *SGDataStore) int {
+	changes, _, err := dataStore.Changes(context.Background(), StringSincer{}, 0, FEED_TYPE_NORMAL)
+	if err != nil {
+		t.Fatalf("Error getting changes: %v", err)
+	}
+	return len(changes.Results)
+}
+
+func TestBulkCreateDocumentsRetryPartialFailures(t *testing.T) {
+
+	faultConfig := sgsimulator.FaultConfig{
+		Endpoints: map[string]sgsimulator.EndpointFaults{
+			sgsimulator.EndpointBulkDocs: {DocErrorRate: 1, MaxDocErrors: 3},
+		},
+	}
+	sim, dataStore, cleanup := newSimulatorDataStore(t, faultConfig)
+	defer cleanup()
+
+	docs := createDocsToWrite("writer", 0, 5, 100, "session", nil, nil)
+	for _, doc := range docs {
+		doc.SetChannels([]string{"ABC"})
+	}
+
+	docRevPairs, err := dataStore.BulkCreateDocumentsRetry(context.Background(), docs, true)
+	if err != nil {
+		t.Fatalf("Error creating docs: %v", err)
+	}
+	if len(docRevPairs) != len(docs) {
+		t.Fatalf("Expected %d docs pushed, got %d", len(docs), len(docRevPairs))
+	}
+	if numFaults := sim.FaultCount(sgsimulator.EndpointBulkDocs, "doc_error"); numFaults != 3 {
+		t.Fatalf("Expected 3 doc errors injected, got %d", numFaults)
+	}
+	if numDocs := numDocsInChanges(t, dataStore); numDocs != len(docs) {
+		t.Fatalf("Expected %d docs in changes feed, got %d", len(docs), numDocs)
+	}
+
+}
+
+func TestBulkCreateDocumentsRetryServerErrors(t *testing.T) {
+
+	faultConfig := sgsimulator.FaultConfig{
+		Endpoints: map[string]sgsimulator.EndpointFaults{
+			sgsimulator.EndpointBulkDocs: {ErrorRate: 1, MaxErrors: 2, ResetRate: 1, MaxResets: 1},
+		},
+	}
+	sim, dataStore, cleanup := newSimulatorDataStore(t, faultConfig)
+	defer cleanup()
+
+	docs := createDocsToWrite("writer", 0, 3, 100, "session", nil, nil)
+
+	docRevPairs, err := dataStore.BulkCreateDocumentsRetry(context.Background(), docs, true)
+	if err != nil {
+		t.Fatalf("Error creating docs: %v", err)
+	}
+	if len(docRevPairs) != len(docs) {
+		t.Fatalf("Expected %d docs pushed, got %d", len(docs), len(docRevPairs))
+	}
+	if numResets := sim.FaultCount(sgsimulator.EndpointBulkDocs, "reset"); numResets != 1 {
+		t.Fatalf("Expected 1 connection reset, got %d", numResets)
+	}
+	if numErrors := sim.FaultCount(sgsimulator.EndpointBulkDocs, "error"); numErrors != 2 {
+		t.Fatalf("Expected 2 errors injected, got %d", numErrors)
+	}
+	if numDocs := numDocsInChanges(t, dataStore); numDocs != len(docs) {
+		t.Fatalf("Expected %d docs in changes feed, got %d", len(docs), numDocs)
+	}
+
+}
+
+// Faults can be changed while the simulator is serving, and apply from the next request
+func TestSimulatorFaultConfigChangedWhileServing(t *testing.T) {
+
+	sim, dataStore, cleanup := newSimulatorDataStore(t, sgsimulator.FaultConfig{})
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := dataStore.BulkCreateDocuments(ctx, docsToWrite("before", 1, []string{"ABC"}), true); err != nil {
+		t.Fatalf("Error creating docs without faults: %v", err)
+	}
+
+	sim.SetFaultConfig(sgsimulator.FaultConfig{
+		Endpoints: map[string]sgsimulator.EndpointFaults{
+			sgsimulator.EndpointBulkDocs: {ErrorRate: 1, ErrorStatus: 400},
+		},
+	})
+	if _, err := dataStore.BulkCreateDocuments(ctx, docsToWrite("during", 1, []string{"ABC"}), true); err == nil {
+		t.Fatalf("Expected an error once faults were configured")
+	}
+	if numFaults := sim.FaultCount(sgsimulator.EndpointBulkDocs, "error"); numFaults != 1 {
+		t.Fatalf("Expected 1 error injected, got %d", numFaults)
+	}
+
+	sim.SetFaultConfig(sgsimulator.FaultConfig{})
+	if _, err := dataStore.BulkCreateDocuments(ctx, docsToWrite("after", 1, []string{"ABC"}), true); err != nil {
+		t.Fatalf("Error creating docs once the faults were removed: %v", err)
+	}
+
+}
@@ -0,0 +1,149 @@
+package sgload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	sgreplicate "github.com/couchbaselabs/sg-replicate"
+)
+
+// Ask which of the revisions the keyspace doesn't have yet, like a push replicator
+// does before sending them
+func (s SGDataStore) RevsDiff(ctx context.Context, revs map[string][]string) (map[string][]string, error) {
+
+	defer s.pushCounter("revs_diff_counter", len(revs))
+
+	revsDiffResponse := map[string]struct {
+		Missing []string `json:"missing"`
+	}{}
+	status, err := s.doJSONRequest(ctx, "POST", "_revs_diff", revs, "revs_diff", &revsDiffResponse)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected response status for POST _revs_diff request: %d", status)
+	}
+
+	missing := map[string][]string{}
+	for docId, diff := range revsDiffResponse {
+		if len(diff.Missing) > 0 {
+			missing[docId] = diff.Missing
+		}
+	}
+	return missing, nil
+
+}
+
+// A doc to get with _bulk_get, along with the revisions of it that have already been
+// pulled, so that Sync Gateway only sends the attachments added since
+type bulkGetAttsSinceDoc struct {
+	Id        string   `json:"id"`
+	Revision  string   `json:"rev"`
+	AttsSince []string `json:"atts_since,omitempty"`
+}
+
+func (s SGDataStore) BulkGetDocumentsAttsSince(ctx context.Context, r sgreplicate.BulkGetRequest, attsSince map[string][]string) ([]sgreplicate.Document, error) {
+
+	docs := []bulkGetAttsSinceDoc{}
+	for _, doc := range r.Docs {
+		docs = append(docs, bulkGetAttsSinceDoc{
+			Id:        doc.Id,
+			Revision:  doc.Revision,
+			AttsSince: attsSince[doc.Id],
+		})
+	}
+	body := struct {
+		Docs []bulkGetAttsSinceDoc `json:"docs"`
+	}{Docs: docs}
+
+	return s.bulkGetDocuments(ctx, r, body)
+
+}
+
+// Get the checkpoint from its _local doc, or an empty one if it hasn't been saved yet
+func (s SGDataStore) GetCheckpoint(ctx context.Context, id string) (Checkpoint, error) {
+
+	checkpoint := Checkpoint{}
+	status, err := s.doJSONRequest(ctx, "GET", "_local/"+id, nil, "get_checkpoint", &checkpoint)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	switch status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		checkpoint = Checkpoint{}
+	default:
+		return Checkpoint{}, fmt.Errorf("Unexpected response status for GET _local/%s request: %d", id, status)
+	}
+	checkpoint.ID = id
+	return checkpoint, nil
+
+}
+
+// Save the checkpoint in its _local doc.  It has to have the revision of the one that
+// was saved last (if any), otherwise Sync Gateway rejects it as a conflict.
+func (s SGDataStore) SetCheckpoint(ctx context.Context, checkpoint Checkpoint) (Checkpoint, error) {
+
+	putResponse := struct {
+		Rev string `json:"rev"`
+	}{}
+	status, err := s.doJSONRequest(ctx, "PUT", "_local/"+checkpoint.ID, checkpoint, "set_checkpoint", &putResponse)
+	if err != nil {
+		return checkpoint, err
+	}
+	if status != http.StatusOK && status != http.StatusCreated {
+		return checkpoint, fmt.Errorf("Unexpected response status for PUT _local/%s request: %d", checkpoint.ID, status)
+	}
+	checkpoint.Rev = putResponse.Rev
+	return checkpoint, nil
+
+}
+
+// Send a request to an endpoint of the keyspace, with body encoded as JSON unless it's
+// nil, and push how long it took as the timing stat.  A successful response is decoded
+// into result.  Returns the response status.
+func (s SGDataStore) doJSONRequest(ctx context.Context, method, endpoint string, body interface{}, timingKey string, result interface{}) (int, error) {
+
+	endpointUrl, err := addEndpointToUrl(s.keyspaceUrl(), endpoint)
+	if err != nil {
+		return 0, err
+	}
+
+	var rawBody interface{}
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		rawBody = bodyBytes
+	}
+
+	req, err := newRetryableRequest(ctx, method, endpointUrl, rawBody)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.addAuthIfNeeded(ctx, req.Header); err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	startTime := time.Now()
+	resp, err := s.doAuthenticated(s.httpClient(), req)
+	if err != nil {
+		return 0, err
+	}
+	defer drainAndClose(resp.Body)
+
+	s.pushTimingStat(timingKey, time.Since(startTime))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(result)
+
+}
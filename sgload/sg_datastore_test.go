@@ -1,9 +1,13 @@
 package sgload
 
 import (
+	"context"
 	"log"
+	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"github.com/couchbaselabs/sgload/sgsimulator"
 )
 
 func TestSGAdminURLExplicitPort(t *testing.T) {
@@ -38,3 +42,84 @@ func TestSGAdminURLImplicitPort80(t *testing.T) {
 	}
 
 }
+
+func TestSGAdminURLPortInHostAndDb(t *testing.T) {
+
+	// Only the port is replaced, even where its digits appear elsewhere in the url
+	sgDataStore := SGDataStore{
+		SyncGatewayAdminPort: 4985,
+		SyncGatewayUrl:       "http://sg4984.example.com:4984/db4984/",
+	}
+	adminUrl, err := sgDataStore.sgAdminURL()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if expected := "http://sg4984.example.com:4985/db4984/"; adminUrl != expected {
+		t.Fatalf("Expected %v, got %v", expected, adminUrl)
+	}
+
+	// An explicit admin url is used as is
+	sgDataStore.SyncGatewayAdminUrl = "https://sg-admin.example.com/sync/db4984/"
+	adminUrl, err = sgDataStore.sgAdminURL()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if adminUrl != sgDataStore.SyncGatewayAdminUrl {
+		t.Fatalf("Expected %v, got %v", sgDataStore.SyncGatewayAdminUrl, adminUrl)
+	}
+
+}
+
+func TestAdminCredentials(t *testing.T) {
+
+	// A simulator whose admin API needs credentials, and isn't on any port of the
+	// public API's host that sgload would guess
+	sim := sgsimulator.NewSGSimulator("db")
+	sim.AdminUsername = "Administrator"
+	sim.AdminPassword = "password"
+	publicServer := httptest.NewServer(sim.PublicHandler())
+	defer publicServer.Close()
+	adminServer := httptest.NewServer(sim.AdminHandler())
+	defer adminServer.Close()
+
+	dataStore := NewSGDataStore(publicServer.URL+"/db/", 0, NoOpMetricsSink{}, false)
+	userCreds := UserCred{Username: "user", Password: "password"}
+	ctx := context.Background()
+
+	dataStore.SetAdmin(adminServer.URL+"/db/", UserCred{}, nil)
+	if err := dataStore.CreateUser(ctx, userCreds, []string{"ABC"}); err == nil {
+		t.Fatalf("Expected error creating user without admin credentials")
+	}
+	dataStore.SetAdmin(adminServer.URL+"/db/", UserCred{Username: "Administrator", Password: "wrong"}, nil)
+	if err := dataStore.CreateUser(ctx, userCreds, []string{"ABC"}); err == nil {
+		t.Fatalf("Expected error creating user with the wrong admin password")
+	}
+	dataStore.SetAdmin(adminServer.URL+"/db/", UserCred{Username: "Administrator", Password: "password"}, nil)
+	if err := dataStore.CreateUser(ctx, userCreds, []string{"ABC"}); err != nil {
+		t.Fatalf("Error creating user with admin credentials: %v", err)
+	}
+
+	// The user can then use the public API
+	dataStore.SetUserCreds(userCreds)
+	if _, _, err := dataStore.Changes(ctx, StringSincer{}, 0, FEED_TYPE_NORMAL); err != nil {
+		t.Fatalf("Error getting changes as the new user: %v", err)
+	}
+
+}
+
+func TestAdminSpecValidate(t *testing.T) {
+
+	badSpecs := []AdminSpec{
+		{Password: "password"},
+		{Username: "Administrator", TLS: TLSSpec{ClientCertFile: "cert.pem"}},
+	}
+	for _, spec := range badSpecs {
+		if err := spec.Validate(); err == nil {
+			t.Fatalf("Expected error validating %+v", spec)
+		}
+	}
+	if err := (AdminSpec{Username: "Administrator", Password: "password"}).Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+}
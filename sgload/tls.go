@@ -0,0 +1,94 @@
+package sgload
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// How the agents connect to a Sync Gateway with an https URL.  With none of these
+// set, the server certificate is verified against the system's CAs.
+type TLSSpec struct {
+	CACertFile         string `yaml:"ca_cert"`              // PEM bundle of the CAs to verify Sync Gateway's certificate with, instead of the system's
+	ClientCertFile     string `yaml:"client_cert"`          // PEM certificate to present to Sync Gateway, which needs ClientKeyFile
+	ClientKeyFile      string `yaml:"client_key"`           // PEM private key of ClientCertFile
+	ServerName         string `yaml:"server_name"`          // The name to verify Sync Gateway's certificate against (and send as SNI), if not the URL's host
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // Don't verify Sync Gateway's certificate at all
+}
+
+func (ts TLSSpec) Validate() error {
+	return ts.validate("load.tls")
+}
+
+// Validate the spec in the given section of the scenario file, which the field
+// names in the errors are under
+func (ts TLSSpec) validate(section string) error {
+
+	if ts.ClientCertFile != "" && ts.ClientKeyFile == "" {
+		return fieldError(section+".client_key", "A client key is needed with the client certificate")
+	}
+	if ts.ClientKeyFile != "" && ts.ClientCertFile == "" {
+		return fieldError(section+".client_cert", "A client certificate is needed with the client key")
+	}
+	if _, err := ts.caCertPool(); err != nil {
+		return fieldError(section+".ca_cert", err.Error())
+	}
+	if _, err := ts.clientCertificates(); err != nil {
+		return fieldError(section+".client_cert", err.Error())
+	}
+	return nil
+
+}
+
+// The config for connecting to Sync Gateway, which is cloned for each connection
+func (ts TLSSpec) Config() (*tls.Config, error) {
+
+	rootCAs, err := ts.caCertPool()
+	if err != nil {
+		return nil, err
+	}
+	certificates, err := ts.clientCertificates()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		RootCAs:            rootCAs,
+		Certificates:       certificates,
+		ServerName:         ts.ServerName,
+		InsecureSkipVerify: ts.InsecureSkipVerify,
+	}, nil
+
+}
+
+// The CAs in CACertFile, or nil to use the system's
+func (ts TLSSpec) caCertPool() (*x509.CertPool, error) {
+
+	if ts.CACertFile == "" {
+		return nil, nil
+	}
+	pemCerts, err := ioutil.ReadFile(ts.CACertFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return nil, fmt.Errorf("No PEM certificates found in %s", ts.CACertFile)
+	}
+	return pool, nil
+
+}
+
+func (ts TLSSpec) clientCertificates() ([]tls.Certificate, error) {
+
+	if ts.ClientCertFile == "" || ts.ClientKeyFile == "" {
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(ts.ClientCertFile, ts.ClientKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return []tls.Certificate{certificate}, nil
+
+}
@@ -0,0 +1,211 @@
+package sgload
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/sgload/sgsimulator"
+)
+
+// A certificate and its key, and where they were written as PEM files
+type testCertificate struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+func (tc testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{tc.cert.Raw}, PrivateKey: tc.key}
+}
+
+// Create a certificate for the given DNS name, signed by parent (or self-signed as
+// a CA if parent is nil), and write it to dir
+func newTestCertificate(t *testing.T, dir, name string, parent *testCertificate) testCertificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Error parsing certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshalling key: %v", err)
+	}
+
+	tc := testCertificate{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".pem"),
+		keyFile:  filepath.Join(dir, name+"-key.pem"),
+	}
+	if err := ioutil.WriteFile(tc.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Error writing certificate: %v", err)
+	}
+	if err := ioutil.WriteFile(tc.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("Error writing key: %v", err)
+	}
+	return tc
+
+}
+
+func TestTLSSpecValidate(t *testing.T) {
+
+	dir := t.TempDir()
+	ca := newTestCertificate(t, dir, "ca", nil)
+	notPem := filepath.Join(dir, "not-pem.txt")
+	if err := ioutil.WriteFile(notPem, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+
+	badSpecs := []TLSSpec{
+		{ClientCertFile: ca.certFile},
+		{ClientKeyFile: ca.keyFile},
+		{CACertFile: filepath.Join(dir, "missing.pem")},
+		{CACertFile: notPem},
+		{ClientCertFile: ca.certFile, ClientKeyFile: notPem},
+	}
+	for _, spec := range badSpecs {
+		if err := spec.Validate(); err == nil {
+			t.Fatalf("Expected error validating %+v", spec)
+		}
+	}
+	if err := (TLSSpec{CACertFile: ca.certFile, ClientCertFile: ca.certFile, ClientKeyFile: ca.keyFile}).Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+}
+
+func TestTLSConnections(t *testing.T) {
+
+	// A simulator with a certificate for a name other than the host in its URL, which
+	// only lets in clients with a certificate from the same CA
+	dir := t.TempDir()
+	ca := newTestCertificate(t, dir, "ca", nil)
+	serverCert := newTestCertificate(t, dir, "sgload.test", &ca)
+	clientCert := newTestCertificate(t, dir, "client", &ca)
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca.cert)
+
+	var numHTTP2Requests int64
+	sim := sgsimulator.NewSGSimulator("db")
+	handler := sim.PublicHandler()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor == 2 {
+			atomic.AddInt64(&numHTTP2Requests, 1)
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCertificate()},
+		ClientCAs:    caPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	validSpec := TLSSpec{
+		CACertFile:     ca.certFile,
+		ClientCertFile: clientCert.certFile,
+		ClientKeyFile:  clientCert.keyFile,
+		ServerName:     "sgload.test",
+	}
+	specs := []struct {
+		name      string
+		spec      TLSSpec
+		http2     bool
+		expectErr bool
+	}{
+		{"valid", validSpec, false, false},
+		{"valid HTTP/2", validSpec, true, false},
+		{"skip verify", TLSSpec{ClientCertFile: clientCert.certFile, ClientKeyFile: clientCert.keyFile, InsecureSkipVerify: true}, false, false},
+		{"system CAs", TLSSpec{ClientCertFile: clientCert.certFile, ClientKeyFile: clientCert.keyFile, ServerName: "sgload.test"}, false, true},
+		{"wrong server name", TLSSpec{CACertFile: ca.certFile, ClientCertFile: clientCert.certFile, ClientKeyFile: clientCert.keyFile}, false, true},
+		{"no client cert", TLSSpec{CACertFile: ca.certFile, ServerName: "sgload.test"}, false, true},
+	}
+
+	for _, s := range specs {
+
+		latencies := NewLatencyRecorder()
+		lr := LoadRunner{
+			LoadSpec: LoadSpec{
+				SyncGatewayUrl: server.URL + "/db/",
+				HTTPClient:     HTTPClientSpec{HTTP2: s.http2},
+				TLS:            s.spec,
+			},
+			Metrics: latencies,
+		}
+		lr.CreateHTTPClient()
+		dataStore := lr.createDataStore().(*SGDataStore)
+		dataStore.HTTPClient.RetryMax = 0
+
+		numHTTP2RequestsBefore := atomic.LoadInt64(&numHTTP2Requests)
+		_, _, err := dataStore.Changes(context.Background(), StringSincer{}, 0, FEED_TYPE_NORMAL)
+		if s.expectErr {
+			if err == nil {
+				t.Fatalf("Expected error connecting with the %s TLS spec", s.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error connecting with the %s TLS spec: %v", s.name, err)
+		}
+		if histogram := latencies.histograms["tls_handshake"]; histogram == nil || histogram.TotalCount() != 1 {
+			t.Fatalf("Expected a tls_handshake timing with the %s TLS spec", s.name)
+		}
+		if usedHTTP2 := atomic.LoadInt64(&numHTTP2Requests) > numHTTP2RequestsBefore; usedHTTP2 != s.http2 {
+			t.Fatalf("Expected HTTP/2 to be used %v with the %s TLS spec, got %v", s.http2, s.name, usedHTTP2)
+		}
+
+		// Websocket connections use the same TLS config
+		stream, err := dataStore.OpenChangesStream(context.Background(), StringSincer{}, FEED_TYPE_WEBSOCKET)
+		if err != nil {
+			t.Fatalf("Error opening websocket changes feed with the %s TLS spec: %v", s.name, err)
+		}
+		stream.Close()
+		if latencies.histograms["tls_handshake"].TotalCount() != 2 {
+			t.Fatalf("Expected a tls_handshake timing for the websocket with the %s TLS spec", s.name)
+		}
+	}
+
+}
@@ -1,6 +1,7 @@
 package sgload
 
 import (
+	"context"
 	"sync"
 )
 
@@ -9,44 +10,163 @@ type UpdateLoadRunner struct {
 	UpdateLoadSpec UpdateLoadSpec
 }
 
-func (ulr UpdateLoadRunner) createUpdaters(wg *sync.WaitGroup, userCreds []UserCred, numUniqueDocsToUpdate int, docsToUpdate <-chan []DocumentMetadata) ([]*Updater, error) {
+func (ulr UpdateLoadRunner) createUpdaters(ctx context.Context, wg *sync.WaitGroup, userCreds []UserCred, numUniqueDocsToUpdate int, docsToUpdate <-chan []DocumentMetadata) ([]*Updater, error) {
+
+	if ulr.UpdateLoadSpec.conflicts() {
+		return ulr.createConflictingUpdaters(ctx, wg, userCreds, numUniqueDocsToUpdate, docsToUpdate), nil
+	}
 
 	updaters := []*Updater{}
 
 	for userId := 0; userId < ulr.UpdateLoadSpec.NumUpdaters; userId++ {
-		userCred := userCreds[userId]
-		dataStore := ulr.createDataStore()
-		dataStore.SetUserCreds(userCred)
 		numUniqueDocsPerUpdater := numUniqueDocsToUpdate / ulr.UpdateLoadSpec.NumUpdaters
-
-		updater := NewUpdater(
-			AgentSpec{
-				FinishedWg:              wg,
-				UserCred:                userCred,
-				ID:                      userId,
-				DataStore:               dataStore,
-				ExpvarProgressEnabled:   ulr.LoadRunner.LoadSpec.ExpvarProgressEnabled,
-				MaxConcurrentCreateUser: maxConcurrentCreateUser,
-				AttachSizeBytes:         ulr.LoadSpec.AttachSizeBytes,
-			},
-			numUniqueDocsPerUpdater,
-			ulr.UpdateLoadSpec.NumUpdatesPerDoc,
-			ulr.UpdateLoadSpec.BatchSize,
-			ulr.UpdateLoadSpec.DocSizeBytes,
-			ulr.UpdateLoadSpec.NumRevsPerUpdate,
-			docsToUpdate,
-			ulr.UpdateLoadSpec.DelayBetweenUpdates,
-		)
-		updater.SetStatsdClient(ulr.StatsdClient)
-		updater.SetCreateUserSemaphore(createUserSemaphore)
+		updater := ulr.newUpdater(userId, userCreds[userId], wg, numUniqueDocsPerUpdater, docsToUpdate)
 		updaters = append(updaters, updater)
-		wg.Add(1)
 	}
 
 	return updaters, nil
 
 }
 
+// Create the updaters in groups of NumConflictBranches.  Every updater in a group gets
+// the same docs, and adds its own branch to each of them starting from the writer's
+// revision, so that each doc ends up with NumConflictBranches conflicting leaf revisions.
+func (ulr UpdateLoadRunner) createConflictingUpdaters(ctx context.Context, wg *sync.WaitGroup, userCreds []UserCred, numUniqueDocsToUpdate int, docsToUpdate <-chan []DocumentMetadata) []*Updater {
+
+	numBranches := ulr.UpdateLoadSpec.NumConflictBranches
+	numGroups := ulr.UpdateLoadSpec.NumUpdaters / numBranches
+	numUniqueDocsPerGroup := numUniqueDocsToUpdate / numGroups
+
+	updaters := []*Updater{}
+	groups := make([][]chan<- []DocumentMetadata, numGroups)
+
+	for userId := 0; userId < ulr.UpdateLoadSpec.NumUpdaters; userId++ {
+		branchDocs := make(chan []DocumentMetadata)
+		updater := ulr.newUpdater(userId, userCreds[userId], wg, numUniqueDocsPerGroup, branchDocs)
+		updater.ConflictBranch = userId%numBranches + 1
+		group := userId / numBranches
+		groups[group] = append(groups[group], branchDocs)
+		updaters = append(updaters, updater)
+	}
+
+	// In an open-ended run the updaters keep taking new docs, so the groups do too
+	if ulr.LoadSpec.OpenEnded() {
+		numUniqueDocsPerGroup = 0
+	}
+	go distributeDocsToBranches(ctx, docsToUpdate, groups, numUniqueDocsPerGroup)
+
+	return updaters
+
+}
+
+// Send each doc received on docsToUpdate to every updater in one of the groups,
+// spreading the docs evenly across the groups, until docsToUpdate is closed or ctx is
+// done.  Like the updaters in a linear run, each group takes no more than
+// numDocsPerGroup docs, unless that's 0.
+func distributeDocsToBranches(ctx context.Context, docsToUpdate <-chan []DocumentMetadata, groups [][]chan<- []DocumentMetadata, numDocsPerGroup int) {
+
+	defer func() {
+		for _, group := range groups {
+			for _, branchDocs := range group {
+				close(branchDocs)
+			}
+		}
+	}()
+
+	numDocsSent := make([]int, len(groups))
+	nextGroup := 0
+
+	for {
+		var docs []DocumentMetadata
+		select {
+		case received, ok := <-docsToUpdate:
+			if !ok {
+				return
+			}
+			docs = received
+		case <-ctx.Done():
+			return
+		}
+
+		docsPerGroup := make([][]DocumentMetadata, len(groups))
+		for _, doc := range docs {
+			group := nextGroupNeedingDocs(numDocsSent, nextGroup, numDocsPerGroup)
+			if group < 0 {
+				// Every group has all the docs it expects
+				break
+			}
+			docsPerGroup[group] = append(docsPerGroup[group], doc)
+			numDocsSent[group]++
+			nextGroup = (group + 1) % len(groups)
+		}
+
+		for group, groupDocs := range docsPerGroup {
+			if len(groupDocs) == 0 {
+				continue
+			}
+			for _, branchDocs := range groups[group] {
+				select {
+				case branchDocs <- groupDocs:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+
+}
+
+// The first group from next on that hasn't been sent numDocsPerGroup docs yet, or -1
+// if there isn't one
+func nextGroupNeedingDocs(numDocsSent []int, next, numDocsPerGroup int) int {
+	for i := range numDocsSent {
+		group := (next + i) % len(numDocsSent)
+		if numDocsPerGroup <= 0 || numDocsSent[group] < numDocsPerGroup {
+			return group
+		}
+	}
+	return -1
+}
+
+// Create an updater with its own data store, which will update the docs it receives
+// on docsToUpdate and call wg.Done() once it has finished
+func (ulr UpdateLoadRunner) newUpdater(userId int, userCred UserCred, wg *sync.WaitGroup, numUniqueDocsPerUpdater int, docsToUpdate <-chan []DocumentMetadata) *Updater {
+
+	dataStore := ulr.createDataStore()
+	dataStore.SetUserCreds(userCred)
+
+	updater := NewUpdater(
+		AgentSpec{
+			FinishedWg:              wg,
+			UserCred:                userCred,
+			ID:                      userId,
+			DataStore:               dataStore,
+			ExpvarProgressEnabled:   ulr.LoadRunner.LoadSpec.ExpvarProgressEnabled,
+			MaxConcurrentCreateUser: maxConcurrentCreateUser,
+			AttachSizeBytes:         ulr.LoadSpec.AttachSizeBytes,
+			Errors:                  ulr.Errors,
+			DrainTimeout:            ulr.LoadSpec.DrainTimeout,
+			OpenEnded:               ulr.LoadSpec.OpenEnded(),
+			Keyspaces:               ulr.LoadSpec.keyspaces(),
+			DocGenerator:            ulr.DocGenerator,
+		},
+		numUniqueDocsPerUpdater,
+		ulr.UpdateLoadSpec.NumUpdatesPerDoc,
+		ulr.UpdateLoadSpec.BatchSize,
+		ulr.UpdateLoadSpec.DocSizeBytes,
+		ulr.UpdateLoadSpec.NumRevsPerUpdate,
+		docsToUpdate,
+		ulr.UpdateLoadSpec.DelayBetweenUpdates,
+	)
+	updater.rng = ulr.LoadSpec.agentRand(USER_PREFIX_UPDATER, userId)
+	updater.SetMetricsSink(ulr.Metrics)
+	updater.SetCreateUserSemaphore(createUserSemaphore)
+	wg.Add(1)
+
+	return updater
+
+}
+
 func (ulr UpdateLoadRunner) generateUserCreds() []UserCred {
 	return ulr.LoadRunner.generateUserCreds(ulr.UpdateLoadSpec.NumUpdaters, USER_PREFIX_WRITER)
 }
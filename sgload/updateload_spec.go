@@ -6,11 +6,12 @@ import (
 )
 
 type UpdateLoadSpec struct {
-	LoadSpec
-	NumUpdatesPerDoc    int           // The total number of revisions to add per doc
-	NumRevsPerUpdate    int           // The number of revisions to add per update
-	NumUpdaters         int           // The number of updater goroutines
-	DelayBetweenUpdates time.Duration // Delay between updates (subtracting out the time they are blocked during write)
+	LoadSpec            `yaml:"-"`
+	NumUpdatesPerDoc    int           `yaml:"num_updates_per_doc"`   // The total number of revisions to add per doc
+	NumRevsPerUpdate    int           `yaml:"num_revs_per_update"`   // The number of revisions to add per update
+	NumUpdaters         int           `yaml:"num_updaters"`          // The number of updater goroutines
+	DelayBetweenUpdates time.Duration `yaml:"delay_between_updates"` // Delay between updates (subtracting out the time they are blocked during write)
+	NumConflictBranches int           `yaml:"num_conflict_branches"` // If > 1, each doc is updated by this many updaters, each on its own branch from the writer's revision, so that it ends up in conflict
 
 }
 
@@ -18,9 +19,41 @@ func (uls UpdateLoadSpec) Validate() error {
 	if err := uls.LoadSpec.Validate(); err != nil {
 		return err
 	}
+	if uls.NumUpdaters < 0 {
+		return fieldError("update.num_updaters", "NumUpdaters must not be negative")
+	}
+	if uls.NumUpdaters > 0 && uls.NumUpdatesPerDoc <= 0 {
+		return fieldError("update.num_updates_per_doc", "NumUpdatesPerDoc must be greater than zero when there are updaters")
+	}
+	if uls.DelayBetweenUpdates < 0 {
+		return fieldError("update.delay_between_updates", "DelayBetweenUpdates must not be negative")
+	}
+	if uls.NumConflictBranches < 0 {
+		return fieldError("update.num_conflict_branches", "NumConflictBranches must not be negative")
+	}
+	if uls.conflicts() && uls.NumUpdaters%uls.NumConflictBranches != 0 {
+		return fieldError("update.num_conflict_branches", "NumUpdaters (%d) must be a multiple of NumConflictBranches, since each doc is updated by a group of that many updaters", uls.NumUpdaters)
+	}
+	if uls.conflicts() && uls.Protocol == PROTOCOL_BLIP {
+		return fieldError("update.num_conflict_branches", "Can't be used with the BLIP protocol, which only pushes revisions that extend the winning revision")
+	}
 	return nil
 }
 
+// Whether updaters create conflicting branches, rather than each doc having a
+// single linear history
+func (uls UpdateLoadSpec) conflicts() bool {
+	return uls.NumConflictBranches > 1
+}
+
+// The number of leaf revisions each doc ends up with
+func (uls UpdateLoadSpec) numLeavesPerDoc() int {
+	if uls.conflicts() && uls.NumUpdaters > 0 {
+		return uls.NumConflictBranches
+	}
+	return 1
+}
+
 // Validate this spec or panic
 func (uls UpdateLoadSpec) MustValidate() {
 	if err := uls.Validate(); err != nil {
@@ -1,7 +1,9 @@
 package sgload
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
 	"time"
 
 	sgreplicate "github.com/couchbaselabs/sg-replicate"
@@ -14,6 +16,7 @@ type UpdaterSpec struct {
 	RevsPerUpdate            int           // How many revisions to include in each document update
 	DocSizeBytes             int           // The doc size in bytes to use when generating update docs
 	DelayBetweenUpdates      time.Duration // Delay between updates (subtracting out the time they are blocked during write)
+	ConflictBranch           int           // If > 0, the branch this updater adds to each doc's revision tree, when a group of updaters puts the docs in conflict
 }
 
 type Updater struct {
@@ -21,9 +24,12 @@ type Updater struct {
 	UpdaterSpec
 
 	DocsToUpdate <-chan []DocumentMetadata // This is a channel that this updater listens to for docs that are ready to be updated
+	FinishedDocs chan<- []DocumentMetadata // If set, docs that have had all their updates are pushed to this channel (eg, for the deleters)
 
 	DocUpdateStatuses map[string]DocUpdateStatus // The number of updates and latest rev that have been done per doc id.  Key = doc id, value = number of updates and latest rev
 
+	rng *rand.Rand // For the doc generator.  Seeded from the LoadSpec by the runner
+
 }
 
 type DocUpdateStatus struct {
@@ -47,6 +53,7 @@ func NewUpdater(agentSpec AgentSpec, numUniqueDocsPerUpdater, numUpdatesPerDoc,
 		},
 		DocsToUpdate:      docsToUpdate,
 		DocUpdateStatuses: map[string]DocUpdateStatus{},
+		rng:               rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 
 	logger.Info(
@@ -60,6 +67,10 @@ func NewUpdater(agentSpec AgentSpec, numUniqueDocsPerUpdater, numUpdatesPerDoc,
 	)
 
 	updater.setupExpVarStats(updatersProgressStats)
+	if agentSpec.OpenEnded {
+		// No fixed number of updates to expect
+		return updater
+	}
 	totalUpdatesExpected := int64(numUniqueDocsPerUpdater * updater.NumUpdatesPerDocRequired)
 	updater.ExpVarStats.Add(
 		"TotalUpdatesExpected",
@@ -71,13 +82,27 @@ func NewUpdater(agentSpec AgentSpec, numUniqueDocsPerUpdater, numUpdatesPerDoc,
 
 }
 
-func (u *Updater) Run() {
+// Main loop of updater goroutine.  Runs until all the docs it received have been
+// updated the required number of times, or ctx is done.  In an open-ended run it
+// keeps taking new docs from the writers until ctx is done.
+func (u *Updater) Run(ctx context.Context) {
 
 	defer u.FinishedWg.Done()
 
-	u.createSGUserIfNeeded([]string{"*"})
+	requestCtx, cancelRequests := u.requestContext(ctx)
+	defer cancelRequests()
+
+	if err := u.createSGUserIfNeeded(requestCtx, []string{"*"}); err != nil {
+		u.reportError("create_user", err)
+		return
+	}
 
 	for {
+		if ctx.Err() != nil {
+			logger.Info("Updater stopped", "agent.ID", u.ID)
+			return
+		}
+
 		if u.noMoreExpectedDocsToUpdate() {
 			logger.Info(
 				"Updater finished",
@@ -89,12 +114,32 @@ func (u *Updater) Run() {
 			return
 		}
 
-		if len(u.DocUpdateStatuses) < u.NumUniqueDocsPerUpdater {
+		if u.OpenEnded || len(u.DocUpdateStatuses) < u.NumUniqueDocsPerUpdater {
 
 			logger.Debug("Updater check for more docs to update", "updater", u.UserCred.Username, "numDocUpdateStatuses", len(u.DocUpdateStatuses))
 
+			// In an open-ended run, don't hold up updates to docs already received
+			// (completed docs are removed, so anything left still needs updates)
+			waitForDocs := time.Second * 10
+			if u.OpenEnded && len(u.DocUpdateStatuses) > 0 {
+				waitForDocs = 0
+			}
+
 			select {
-			case docsToUpdate := <-u.DocsToUpdate:
+			case docsToUpdate, ok := <-u.DocsToUpdate:
+
+				if !ok && u.OpenEnded {
+					// The run is stopping, so just update the docs already received
+					u.DocsToUpdate = nil
+					continue
+				}
+				if !ok {
+					// The writers are finished and some of their docs never made it
+					// (eg, failed writes), so only update the docs already received
+					logger.Warn("Updater will not receive all expected docs", "updater", u.UserCred.Username, "expected", u.NumUniqueDocsPerUpdater, "received", len(u.DocUpdateStatuses))
+					u.NumUniqueDocsPerUpdater = len(u.DocUpdateStatuses)
+					continue
+				}
 
 				logger.Debug("Updater received docs to update", "updater", u.UserCred.Username, "numdocs", len(docsToUpdate))
 
@@ -104,14 +149,15 @@ func (u *Updater) Run() {
 					if ok {
 						// Invalid state, this should be the first
 						// time seeing this doc
-						panic(fmt.Sprintf("Unexpected doc: %+v", docToUpdate))
+						u.reportError("update", fmt.Errorf("Unexpected doc: %+v", docToUpdate))
+						return
 					}
 					u.DocUpdateStatuses[docToUpdate.Id] = DocUpdateStatus{
 						NumUpdates:       0,
 						DocumentMetadata: docToUpdate,
 					}
 
-					if len(u.DocUpdateStatuses) >= u.NumUniqueDocsPerUpdater {
+					if !u.OpenEnded && len(u.DocUpdateStatuses) >= u.NumUniqueDocsPerUpdater {
 
 						logger.Debug("Updater has enough docs to update", "updater", u.UserCred.Username, "numDocUpdateStatuses", len(u.DocUpdateStatuses))
 
@@ -120,7 +166,13 @@ func (u *Updater) Run() {
 					}
 
 				}
-			case <-time.After(time.Second * 10):
+			case <-ctx.Done():
+				continue
+			case <-time.After(waitForDocs):
+				if waitForDocs == 0 {
+					// Didn't wait, go update the docs already received
+					break
+				}
 				numExpectedUpdatesPending := u.numExpectedUpdatesPending(false)
 				logger.Debug(
 					"Updater didn't receive anything after 10s",
@@ -163,13 +215,29 @@ func (u *Updater) Run() {
 		// Push the update
 		timeBeforeUpdate := time.Now()
 		logger.Debug("Updater performUpdate", "agent.ID", u.ID, "docbatch", len(docBatch))
-		docRevPairsUpdated, err := u.performUpdate(docBatch)
+		docRevPairsUpdated, err := u.performUpdate(requestCtx, docBatch)
+		timeBlockedDuringUpdate := time.Since(timeBeforeUpdate)
+		if err != nil && requestCtx.Err() != nil {
+			logger.Info("Updater stopped during update", "agent.ID", u.ID)
+			return
+		}
 		if err != nil {
-			panic(fmt.Sprintf("Error performing update: %v", err))
+			if u.reportError("update", fmt.Errorf("Error performing update: %v", err)) {
+				return
+			}
+			u.maybeDelayBetweenUpdates(ctx, timeBlockedDuringUpdate)
+			continue
 		}
-		timeBlockedDuringUpdate := time.Since(timeBeforeUpdate)
+		u.Errors.RecordSuccess()
 
-		u.updateDocStatuses(docRevPairsUpdated)
+		if err := u.updateDocStatuses(docRevPairsUpdated); err != nil {
+			u.reportError("update", err)
+			return
+		}
+		u.pushFinishedDocs(ctx, docRevPairsUpdated)
+		if u.OpenEnded {
+			u.forgetFinishedDocs()
+		}
 
 		u.updateExpVars(docRevPairsUpdated)
 
@@ -185,7 +253,7 @@ func (u *Updater) Run() {
 			numExpectedUpdatesPending,
 		)
 
-		u.maybeDelayBetweenUpdates(timeBlockedDuringUpdate)
+		u.maybeDelayBetweenUpdates(ctx, timeBlockedDuringUpdate)
 
 	}
 
@@ -251,26 +319,58 @@ func (u Updater) noMoreExpectedDocsToUpdate() bool {
 	// Find how many pending updates are still remaining
 	numExpectedUpdatesPending := u.numExpectedUpdatesPending(false)
 
-	// If no more pending updates remain, we're done
-	return numExpectedUpdatesPending == 0
+	// If no more pending updates remain, we're done.  Open-ended runs are
+	// never done until they are stopped.
+	return !u.OpenEnded && numExpectedUpdatesPending == 0
 
 }
 
 // The given docrevpairs were just updated *one* rev.  We need to update
 // the doc statuses
-func (u *Updater) updateDocStatuses(docRevPairsUpdated []DocumentMetadata) {
+func (u *Updater) updateDocStatuses(docRevPairsUpdated []DocumentMetadata) error {
 	for _, docRevPair := range docRevPairsUpdated {
 		docStatus, ok := u.DocUpdateStatuses[docRevPair.Id]
 		if !ok {
-			panic(fmt.Sprintf("Could not find doc status: %+v", docRevPair))
+			return fmt.Errorf("Could not find doc status: %+v", docRevPair)
 		}
 		docStatus.NumUpdates += 1
 		docStatus.DocumentMetadata = docRevPair
 		u.DocUpdateStatuses[docRevPair.Id] = docStatus
 	}
+	return nil
 
 }
 
+// Push the docs which just had their last update to FinishedDocs, if set
+func (u *Updater) pushFinishedDocs(ctx context.Context, docRevPairsUpdated []DocumentMetadata) {
+	if u.FinishedDocs == nil {
+		return
+	}
+	finishedDocs := []DocumentMetadata{}
+	for _, docRevPair := range docRevPairsUpdated {
+		if u.DocUpdateStatuses[docRevPair.Id].NumUpdates >= u.NumUpdatesPerDocRequired {
+			finishedDocs = append(finishedDocs, docRevPair)
+		}
+	}
+	if len(finishedDocs) == 0 {
+		return
+	}
+	select {
+	case u.FinishedDocs <- finishedDocs:
+	case <-ctx.Done():
+	}
+}
+
+// In an open-ended run the updater keeps receiving new docs, so drop the ones
+// that have had all their updates to keep memory usage bounded.
+func (u *Updater) forgetFinishedDocs() {
+	for docId, docUpdateStatus := range u.DocUpdateStatuses {
+		if docUpdateStatus.NumUpdates >= u.NumUpdatesPerDocRequired {
+			delete(u.DocUpdateStatuses, docId)
+		}
+	}
+}
+
 func (u *Updater) updateExpVars(docRevPairsUpdated []DocumentMetadata) {
 	u.ExpVarStats.Add("NumDocRevUpdates", int64(len(docRevPairsUpdated)))
 	globalProgressStats.Add("TotalNumRevsUpdated", int64(len(docRevPairsUpdated)))
@@ -286,6 +386,8 @@ func (u *Updater) getDocsReadyToUpdate() []DocumentMetadata {
 
 }
 
+// All the docs in a batch are in the same keyspace as the first, since each batch is
+// written with a single request
 func getDocsReadyToUpdate(batchSize, maxUpdatesPerDoc int, s map[string]DocUpdateStatus) []DocumentMetadata {
 
 	updateDocBatch := []DocumentMetadata{}
@@ -298,6 +400,11 @@ func getDocsReadyToUpdate(batchSize, maxUpdatesPerDoc int, s map[string]DocUpdat
 			return updateDocBatch
 		}
 
+		// docs in other keyspaces go in a later batch
+		if len(updateDocBatch) > 0 && docUpdateStatus.DocumentMetadata.Keyspace != updateDocBatch[0].Keyspace {
+			continue
+		}
+
 		// if doc needs more updates, add it to batch
 		if docUpdateStatus.NumUpdates < maxUpdatesPerDoc {
 			updateDocBatch = append(updateDocBatch, docUpdateStatus.DocumentMetadata)
@@ -307,7 +414,7 @@ func getDocsReadyToUpdate(batchSize, maxUpdatesPerDoc int, s map[string]DocUpdat
 
 }
 
-func (u *Updater) performUpdate(docRevPairs []DocumentMetadata) ([]DocumentMetadata, error) {
+func (u *Updater) performUpdate(ctx context.Context, docRevPairs []DocumentMetadata) ([]DocumentMetadata, error) {
 
 	bulkDocs := []Document{}
 	for _, docRevPair := range docRevPairs {
@@ -323,7 +430,7 @@ func (u *Updater) performUpdate(docRevPairs []DocumentMetadata) ([]DocumentMetad
 		// If RevsPerUpdate > 1, mock up a revision history, representing multiple updates made on the client prior to sync
 		digests := []string{parentDigest}
 		for i := 0; i < u.RevsPerUpdate-1; i++ {
-			fakeDigest := generateFakeDigest(i)
+			fakeDigest := u.generateFakeDigest(i)
 			// Prepend to the digests collection
 			digests = append(digests, "")
 			copy(digests[1:], digests)
@@ -354,21 +461,29 @@ func (u *Updater) performUpdate(docRevPairs []DocumentMetadata) ([]DocumentMetad
 
 	var updatedDocs []DocumentMetadata
 	var updatedDoc DocumentMetadata
-	var err error
+
+	keyspace := docRevPairs[0].Keyspace
+	dataStore, err := u.keyspaceDataStore(keyspace)
+	if err != nil {
+		return nil, err
+	}
 
 	switch len(bulkDocs) {
 	case 1:
 		doc := bulkDocs[0]
-		updatedDoc, err = u.DataStore.CreateDocument(doc, u.AttachSizeBytes, false)
+		updatedDoc, err = dataStore.CreateDocument(ctx, doc, u.AttachSizeBytes, false)
 		updatedDocs = []DocumentMetadata{ updatedDoc }
 	default:
-		updatedDocs, err = u.DataStore.BulkCreateDocumentsRetry(bulkDocs, false)
+		updatedDocs, err = dataStore.BulkCreateDocumentsRetry(ctx, bulkDocs, false)
 	}
 
+	for i := range updatedDocs {
+		updatedDocs[i].Keyspace = keyspace
+	}
 	return updatedDocs, err
 }
 
-func (u Updater) LookupCurrentRevisions(docsToLookup []Document) ([]sgreplicate.DocumentRevisionPair, error) {
+func (u Updater) LookupCurrentRevisions(ctx context.Context, docsToLookup []Document) ([]sgreplicate.DocumentRevisionPair, error) {
 
 	docRevPairs := []sgreplicate.DocumentRevisionPair{}
 	bulkGetRequest := sgreplicate.BulkGetRequest{}
@@ -381,7 +496,7 @@ func (u Updater) LookupCurrentRevisions(docsToLookup []Document) ([]sgreplicate.
 	}
 	bulkGetRequest.Docs = bulkGetRequestDocs
 
-	docs, err := u.DataStore.BulkGetDocuments(bulkGetRequest)
+	docs, err := u.DataStore.BulkGetDocuments(ctx, bulkGetRequest)
 	if err != nil {
 		return docRevPairs, err
 	}
@@ -405,15 +520,31 @@ func (u *Updater) generateDocUpdate(docRevPair DocumentMetadata) Document {
 	doc["created_at"] = time.Now().Format(time.RFC3339Nano) // misleading, but not sure what else to do at this point
 
 	doc["channels"] = docRevPair.Channels
+	Document(doc).SetKeyspace(docRevPair.Keyspace)
+
+	if u.DocGenerator != nil {
+		doc["body"] = u.DocGenerator.GenerateBody(u.rng, u.DocSizeBytes)
+	}
+
+	if u.ConflictBranch > 0 {
+		// Make sure each branch gets its own revision IDs, even for identical updates
+		doc["branch"] = u.ConflictBranch
+	}
 
 	return Document(doc)
 }
 
-func (u *Updater) maybeDelayBetweenUpdates(timeBlockedDuringUpdate time.Duration) {
+// The digest of the i'th revision mocked up in an update with RevsPerUpdate > 1.  Each
+// conflict branch gets its own, otherwise sibling branches would share revision IDs.
+func (u *Updater) generateFakeDigest(i int) string {
+	return generateFakeDigest(u.ConflictBranch*u.RevsPerUpdate + i)
+}
+
+func (u *Updater) maybeDelayBetweenUpdates(ctx context.Context, timeBlockedDuringUpdate time.Duration) {
 
 	timeToSleep := u.UpdaterSpec.DelayBetweenUpdates - timeBlockedDuringUpdate
 	if timeToSleep > time.Duration(0) {
-		time.Sleep(timeToSleep)
+		sleepContext(ctx, timeToSleep)
 	}
 
 }
@@ -1,6 +1,9 @@
 package sgload
 
-import "testing"
+import (
+	"context"
+	"testing"
+)
 
 func TestGetDocsReadyToUpdateLessThanBatch(t *testing.T) {
 
@@ -59,3 +62,43 @@ func TestGetDocsReadyToUpdateMoreThanBatch(t *testing.T) {
 	}
 
 }
+
+// Every updater in a group gets the same docs, and each group only gets as many as
+// it expects
+func TestDistributeDocsToBranches(t *testing.T) {
+
+	docsToUpdate := make(chan []DocumentMetadata, 1)
+	branches := []chan []DocumentMetadata{}
+	groups := [][]chan<- []DocumentMetadata{{}, {}}
+	for i := 0; i < 4; i++ {
+		branch := make(chan []DocumentMetadata, 1)
+		branches = append(branches, branch)
+		groups[i/2] = append(groups[i/2], branch)
+	}
+
+	docs := []DocumentMetadata{}
+	for _, docId := range []string{"a", "b", "c", "d", "e"} {
+		doc := DocumentMetadata{}
+		doc.Id = docId
+		docs = append(docs, doc)
+	}
+	docsToUpdate <- docs
+	close(docsToUpdate)
+
+	distributeDocsToBranches(context.Background(), docsToUpdate, groups, 2)
+
+	expected := []string{"ac", "ac", "bd", "bd"}
+	for i, branch := range branches {
+		received := ""
+		for _, doc := range <-branch {
+			received += doc.Id
+		}
+		if received != expected[i] {
+			t.Fatalf("Expected branch %d to get docs %s, got %s", i, expected[i], received)
+		}
+		if _, ok := <-branch; ok {
+			t.Fatalf("Expected branch %d to be closed", i)
+		}
+	}
+
+}
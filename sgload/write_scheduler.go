@@ -0,0 +1,52 @@
+package sgload
+
+import (
+	"sync"
+	"time"
+)
+
+// Dispatches writes across all the writers on a fixed arrival schedule, rather than
+// each writer waiting a delay after its last write (open-loop).
+//
+// Write number n of writer i is intended to be sent at:
+//
+//	start + (n * numWriters + i) * interval
+//
+// so the writers take turns, and together they send one write every interval.  A writer
+// that falls behind schedule sends its next write right away, and since latency is
+// measured from the intended send time, the time spent behind schedule is counted
+// rather than hidden (avoids coordinated omission).
+//
+// Writers send each write at its intended time without waiting for their earlier
+// writes to finish, so a slow Sync Gateway doesn't lower the rate offered to it.  Only
+// once a writer has WriterSpec.MaxWritesInFlight writes outstanding does it fall
+// behind, and those writes are counted as late.
+type WriteScheduler struct {
+	interval   time.Duration // Time between consecutive writes across all writers
+	numWriters int
+
+	startOnce sync.Once
+	start     time.Time // When the first write is intended to be sent
+}
+
+func NewWriteScheduler(targetOpsPerSec float64, numWriters int) *WriteScheduler {
+	return &WriteScheduler{
+		interval:   time.Duration(float64(time.Second) / targetOpsPerSec),
+		numWriters: numWriters,
+	}
+}
+
+// The schedule starts the first time any writer asks for a send time, which is
+// after the writers have finished creating their users.
+func (s *WriteScheduler) startTime() time.Time {
+	s.startOnce.Do(func() {
+		s.start = time.Now()
+	})
+	return s.start
+}
+
+// When the given write (counting from 0) of the writer with the given ID is intended to be sent
+func (s *WriteScheduler) IntendedSendTime(writerID, writeNum int) time.Time {
+	slot := writeNum*s.numWriters + writerID
+	return s.startTime().Add(time.Duration(slot) * s.interval)
+}
@@ -0,0 +1,33 @@
+package sgload
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWriteSchedulerIntendedSendTime(t *testing.T) {
+
+	numWriters := 4
+	scheduler := NewWriteScheduler(100, numWriters)
+
+	// Across all the writers, there should be one write every 10ms, with the
+	// writers taking turns
+	start := scheduler.IntendedSendTime(0, 0)
+	for writeNum := 0; writeNum < 3; writeNum++ {
+		for writerID := 0; writerID < numWriters; writerID++ {
+			slot := writeNum*numWriters + writerID
+			expected := start.Add(time.Duration(slot) * 10 * time.Millisecond)
+			intended := scheduler.IntendedSendTime(writerID, writeNum)
+			if !intended.Equal(expected) {
+				t.Fatalf("Expected writer %d write %d at %v, got %v", writerID, writeNum, expected, intended)
+			}
+		}
+	}
+
+	// The schedule doesn't depend on when the writers get around to asking
+	time.Sleep(20 * time.Millisecond)
+	if intended := scheduler.IntendedSendTime(1, 0); !intended.Equal(start.Add(10 * time.Millisecond)) {
+		t.Fatalf("Schedule moved: got %v, start %v", intended, start)
+	}
+
+}
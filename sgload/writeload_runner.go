@@ -1,8 +1,10 @@
 package sgload
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 )
 
 const (
@@ -21,7 +23,12 @@ func NewWriteLoadRunner(wls WriteLoadSpec) *WriteLoadRunner {
 	loadRunner := LoadRunner{
 		LoadSpec: wls.LoadSpec,
 	}
-	loadRunner.CreateStatsdClient()
+	loadRunner.CreateMetricsSinks()
+	loadRunner.CreateHTTPClient()
+	loadRunner.CreateAuthenticatorFactory()
+	loadRunner.CreateDocGenerator()
+	loadRunner.CreateChannelLayout()
+	loadRunner.CreateErrorCollector()
 
 	return &WriteLoadRunner{
 		LoadRunner:    loadRunner,
@@ -29,7 +36,13 @@ func NewWriteLoadRunner(wls WriteLoadSpec) *WriteLoadRunner {
 	}
 }
 
-func (wlr WriteLoadRunner) Run() error {
+// Runs the writers until they've written all their docs, or ctx is done
+func (wlr WriteLoadRunner) Run(ctx context.Context) error {
+
+	defer wlr.reportLatencies("writeload", time.Now())
+
+	runCtx, cancel := wlr.runContext(ctx)
+	defer cancel()
 
 	// Create a wait group to see when all the writer goroutines have finished
 	var wg sync.WaitGroup
@@ -43,8 +56,6 @@ func (wlr WriteLoadRunner) Run() error {
 		return err
 	}
 
-	channelNames := wlr.generateChannelNames()
-
 	// Update writer with expected docs list
 	approxDocsPerWriter := wlr.WriteLoadSpec.NumDocs / len(writers)
 	for _, writer := range writers {
@@ -53,15 +64,16 @@ func (wlr WriteLoadRunner) Run() error {
 
 	// Create writer goroutines
 	for _, writer := range writers {
-		go writer.Run()
+		go writer.Run(runCtx)
 	}
 
 	// Create doc feeder goroutine
 	go wlr.startDocFeeders(
+		runCtx,
 		writers,
 		wlr.WriteLoadSpec,
 		approxDocsPerWriter,
-		channelNames,
+		wlr.ChannelLayout,
 	)
 
 	// Wait for writers to finish
@@ -69,14 +81,14 @@ func (wlr WriteLoadRunner) Run() error {
 	wg.Wait()
 	logger.Info("Writers finished")
 
-	return nil
+	return wlr.runResult(ctx)
 
 }
 
-func (wlr WriteLoadRunner) startDocFeeders(writers []*Writer, wls WriteLoadSpec, approxDocsPerWriter int, channelNames []string) error {
+func (wlr WriteLoadRunner) startDocFeeders(ctx context.Context, writers []*Writer, wls WriteLoadSpec, approxDocsPerWriter int, channelLayout *ChannelLayout) error {
 	// Create doc feeder goroutines
 	for _, writer := range writers {
-		go feedDocsToWriter(writer, wls, approxDocsPerWriter, channelNames)
+		go feedDocsToWriter(ctx, writer, wls, approxDocsPerWriter, channelLayout)
 	}
 	return nil
 }
@@ -87,6 +99,12 @@ func (wlr WriteLoadRunner) createWriters(wg, AllSGUsersCreated *sync.WaitGroup)
 	var userCreds []UserCred
 	var err error
 
+	var scheduler *WriteScheduler
+	if wlr.WriteLoadSpec.TargetOpsPerSec > 0 {
+		logger.Info("Writers will send writes open-loop", "targetopspersec", wlr.WriteLoadSpec.TargetOpsPerSec)
+		scheduler = NewWriteScheduler(wlr.WriteLoadSpec.TargetOpsPerSec, wlr.WriteLoadSpec.NumWriters)
+	}
+
 	switch wlr.WriteLoadSpec.CreateWriters {
 	case true:
 		userCreds = wlr.generateUserCreds()
@@ -98,38 +116,56 @@ func (wlr WriteLoadRunner) createWriters(wg, AllSGUsersCreated *sync.WaitGroup)
 	}
 
 	for userId := 0; userId < wlr.WriteLoadSpec.NumWriters; userId++ {
-		userCred := userCreds[userId]
-		dataStore := wlr.createDataStore()
-		dataStore.SetUserCreds(userCred)
-
-		writerSpec := WriterSpec{
-			DelayBetweenWrites: wlr.WriteLoadSpec.DelayBetweenWrites,
-		}
-		writer := NewWriter(
-			AgentSpec{
-				FinishedWg:              wg,
-				UserCred:                userCred,
-				ID:                      userId,
-				DataStore:               dataStore,
-				BatchSize:               wlr.WriteLoadSpec.BatchSize,
-				ExpvarProgressEnabled:   wlr.LoadRunner.LoadSpec.ExpvarProgressEnabled,
-				MaxConcurrentCreateUser: maxConcurrentCreateUser,
-				AllSGUsersCreated:       AllSGUsersCreated,
-				AttachSizeBytes:         wlr.LoadSpec.AttachSizeBytes,
-			},
-			writerSpec,
-		)
-		writer.SetStatsdClient(wlr.StatsdClient)
-		writer.SetCreateUserSemaphore(createUserSemaphore)
-		writer.CreateDataStoreUser = wlr.WriteLoadSpec.CreateWriters
+		writer := wlr.newWriter(userId, userCreds[userId], wg, AllSGUsersCreated, scheduler)
 		writers = append(writers, writer)
-		wg.Add(1)
 	}
 
 	return writers, nil
 
 }
 
+// Create a writer with its own data store, which will call wg.Done() once it has finished
+func (wlr WriteLoadRunner) newWriter(userId int, userCred UserCred, wg, AllSGUsersCreated *sync.WaitGroup, scheduler *WriteScheduler) *Writer {
+
+	dataStore := wlr.createDataStore()
+	dataStore.SetUserCreds(userCred)
+
+	writerSpec := WriterSpec{
+		DelayBetweenWrites: wlr.WriteLoadSpec.DelayBetweenWrites,
+		Scheduler:          scheduler,
+		MaxWritesInFlight:  wlr.WriteLoadSpec.MaxWritesInFlight,
+	}
+	if wlr.WriteLoadSpec.PushReplicator.Enabled {
+		writerSpec.PushReplicator = &wlr.WriteLoadSpec.PushReplicator
+	}
+	writer := NewWriter(
+		AgentSpec{
+			FinishedWg:              wg,
+			UserCred:                userCred,
+			ID:                      userId,
+			DataStore:               dataStore,
+			BatchSize:               wlr.WriteLoadSpec.BatchSize,
+			ExpvarProgressEnabled:   wlr.LoadRunner.LoadSpec.ExpvarProgressEnabled,
+			MaxConcurrentCreateUser: maxConcurrentCreateUser,
+			AllSGUsersCreated:       AllSGUsersCreated,
+			AttachSizeBytes:         wlr.LoadSpec.AttachSizeBytes,
+			Errors:                  wlr.Errors,
+			DrainTimeout:            wlr.LoadSpec.DrainTimeout,
+			OpenEnded:               wlr.LoadSpec.OpenEnded(),
+			Keyspaces:               wlr.LoadSpec.keyspaces(),
+			DocGenerator:            wlr.DocGenerator,
+		},
+		writerSpec,
+	)
+	writer.SetMetricsSink(wlr.Metrics)
+	writer.SetCreateUserSemaphore(createUserSemaphore)
+	writer.CreateDataStoreUser = wlr.WriteLoadSpec.CreateWriters
+	wg.Add(1)
+
+	return writer
+
+}
+
 func (wlr WriteLoadRunner) generateUserCreds() []UserCred {
 	return wlr.LoadRunner.generateUserCreds(wlr.WriteLoadSpec.NumWriters, USER_PREFIX_WRITER)
 }
@@ -1,35 +1,72 @@
 package sgload
 
 import (
-	"fmt"
 	"log"
 	"time"
 )
 
 type WriteLoadSpec struct {
-	LoadSpec
+	LoadSpec `yaml:"-"`
 
-	CreateWriters bool // Whether or not to create users for writers
-	NumWriters    int
+	CreateWriters bool `yaml:"create_writers"` // Whether or not to create users for writers
+	NumWriters    int  `yaml:"num_writers"`
 
 	// How long writers should try to delay between writes
 	// (subtracting out the time they are blocked during actual write)
-	DelayBetweenWrites time.Duration
+	DelayBetweenWrites time.Duration `yaml:"delay_between_writes"`
+
+	// If > 0, the total number of writes per second to send across all writers, on
+	// a fixed schedule (open-loop, see WriteScheduler).  Writes are sent on schedule
+	// whether or not the ones before them have finished.  Each write is a single doc,
+	// or a batch of BatchSize docs.  DelayBetweenWrites is ignored in this mode.
+	TargetOpsPerSec float64 `yaml:"target_ops_per_sec"`
+
+	// With TargetOpsPerSec, the most writes each writer has in flight at once
+	// (default 100).  Writes due while that many are in flight are sent late and
+	// counted in the writes_late metric.
+	MaxWritesInFlight int `yaml:"max_writes_in_flight"`
+
+	// If enabled, writers push their docs like a Couchbase Lite 1.x push replicator
+	PushReplicator PushReplicatorSpec `yaml:"push_replicator"`
 }
 
 func (wls WriteLoadSpec) Validate() error {
 	if wls.NumWriters <= 0 {
-		return fmt.Errorf("NumWriters must be greater than zero")
+		return fieldError("write.num_writers", "NumWriters must be greater than zero")
+	}
+
+	if wls.DelayBetweenWrites < 0 {
+		return fieldError("write.delay_between_writes", "DelayBetweenWrites must not be negative")
+	}
+
+	if wls.TargetOpsPerSec < 0 {
+		return fieldError("write.target_ops_per_sec", "TargetOpsPerSec must not be negative")
+	}
+
+	if wls.MaxWritesInFlight < 0 {
+		return fieldError("write.max_writes_in_flight", "MaxWritesInFlight must not be negative")
 	}
 
 	if err := wls.LoadSpec.Validate(); err != nil {
 		return err
 	}
 
-	// the number of docs has to divide into the number of channels evenly
+	if err := wls.PushReplicator.Validate(wls.LoadSpec); err != nil {
+		return err
+	}
+
+	// the number of docs has to divide into the number of channels evenly, if they
+	// all get exactly the same number
 	remainder := wls.NumDocs % wls.NumChannels
-	if remainder != 0 {
-		return fmt.Errorf("Numdocs (%d) does not divide into num channels evenly (%d)", wls.NumDocs, wls.NumChannels)
+	if wls.Channels.exactlyEven() && remainder != 0 {
+		return fieldError("load.num_docs", "Numdocs (%d) does not divide into num channels evenly (%d)", wls.NumDocs, wls.NumChannels)
+	}
+
+	// Each writer writes NumDocs / NumWriters docs of the channel layout, so with a
+	// remainder the last docs of the layout would never be written, and the readers
+	// of their channels would wait for them forever
+	if wls.NumDocs%wls.NumWriters != 0 {
+		return fieldError("write.num_writers", "Numdocs (%d) does not divide into num writers evenly (%d)", wls.NumDocs, wls.NumWriters)
 	}
 
 	return nil
@@ -1,15 +1,36 @@
 package sgload
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	// How many scheduled writes a writer has in flight at once, unless its spec says
+	defaultMaxWritesInFlight = 100
+)
+
 type WriterSpec struct {
 
 	// How long writers should try to delay between writes
 	// (subtracting out the time they are blocked during actual write)
 	DelayBetweenWrites time.Duration
+
+	// If set, send writes open-loop on this schedule rather than delaying
+	// DelayBetweenWrites after each write.  Shared among all the writers.
+	Scheduler *WriteScheduler
+
+	// With a Scheduler, the most writes the writer has in flight at once.  A write
+	// that's due while that many are still in flight is sent once one of them
+	// finishes, and counted as late.  Defaults to defaultMaxWritesInFlight.
+	MaxWritesInFlight int
+
+	// If set, push docs like a Couchbase Lite 1.x push replicator (see pushDocs)
+	// rather than creating them
+	PushReplicator *PushReplicatorSpec
 }
 
 type Writer struct {
@@ -20,6 +41,12 @@ type Writer struct {
 	OutboundDocs chan []Document           // The Docfeeder pushes outbound docs to the writer
 	PushedDocs   chan<- []DocumentMetadata // After docs are sent, push to this channel
 
+	pushReplications map[Keyspace]*pushReplication // The state of the push replication to each keyspace, if PushReplicator is set
+	pushMutex        sync.Mutex                    // Held while pushing, since a push replication sends one batch at a time
+
+	numDocsPushed int64          // Updated atomically, since scheduled writes finish concurrently
+	inFlight      chan struct{}  // With a Scheduler, holds a token for each write in flight
+	inFlightWg    sync.WaitGroup // The writes in flight, which are drained before the writer finishes
 }
 
 func NewWriter(agentSpec AgentSpec, spec WriterSpec) *Writer {
@@ -39,83 +66,212 @@ func NewWriter(agentSpec AgentSpec, spec WriterSpec) *Writer {
 	return writer
 }
 
-
-func (w *Writer) Run() {
+// Main loop of writer goroutine.  Runs until the doc feeder sends the terminal doc
+// (never, in an open-ended run) or ctx is done; the writes in flight, if any, are
+// drained first.
+//
+// Without a Scheduler, it writes one batch after another.  With one, it sends each
+// batch at its intended send time without waiting for the writes before it to
+// finish, so a slow Sync Gateway doesn't lower the load it's offered.
+func (w *Writer) Run(ctx context.Context) {
 
 	defer w.FinishedWg.Done()
 
-	numDocsPushed := 0
+	requestCtx, cancelRequests := w.requestContext(ctx)
+	defer cancelRequests()
+
+	// Stops sending writes once one of them says to, eg when the error budget is used up
+	ctx, stopWrites := context.WithCancel(ctx)
+	defer stopWrites()
+	defer w.inFlightWg.Wait()
+
+	numWrites := 0
 
-	w.createWriterSGUserIfNeeded()
+	if err := w.createWriterSGUserIfNeeded(requestCtx); err != nil {
+		w.reportError("create_user", err)
+		return
+	}
 
 	w.waitUntilAllSGUsersCreated()
 
+	if w.Scheduler != nil {
+		maxWritesInFlight := w.MaxWritesInFlight
+		if maxWritesInFlight <= 0 {
+			maxWritesInFlight = defaultMaxWritesInFlight
+		}
+		w.inFlight = make(chan struct{}, maxWritesInFlight)
+	}
+
 	for {
 
 		select {
 		case docs := <-w.OutboundDocs:
 
-			timeBlockedDuringWrite := time.Duration(0)
+			if len(docs) == 1 {
+				if _, ok := docs[0]["_terminal"]; ok {
+					w.inFlightWg.Wait()
+					logger.Info("Writer finished", "agent.ID", w.ID, "numdocs", atomic.LoadInt64(&w.numDocsPushed))
+					return
+				}
+			}
 
-			switch len(docs) {
-			case 1:
-				doc := docs[0]
-				_, ok := doc["_terminal"]
-				if ok {
-					logger.Info("Writer finished", "agent.ID", w.ID, "numdocs", numDocsPushed)
+			if w.Scheduler == nil {
+				if !w.write(ctx, requestCtx, docs, time.Time{}) {
 					return
 				}
+				continue
+			}
+
+			intendedSendTime := w.Scheduler.IntendedSendTime(w.ID, numWrites)
+			numWrites += 1
+			sleepContext(ctx, time.Until(intendedSendTime))
+			if ctx.Err() != nil || !w.dispatch(ctx, requestCtx, docs, intendedSendTime, stopWrites) {
+				logger.Info("Writer stopped", "agent.ID", w.ID, "numdocs", atomic.LoadInt64(&w.numDocsPushed))
+				return
+			}
 
-				timeBeforeWrite := time.Now()
+		case <-ctx.Done():
+			logger.Info("Writer stopped", "agent.ID", w.ID, "numdocs", atomic.LoadInt64(&w.numDocsPushed))
+			return
 
-				docRevPair, err := w.DataStore.CreateDocument(doc, w.AttachSizeBytes, true)
-				if err != nil {
-					panic(fmt.Sprintf("Error creating doc in datastore.  Doc: %v, Err: %v", doc, err))
-				}
-				timeBlockedDuringWrite = time.Since(timeBeforeWrite)
-				docRevPairs := []DocumentMetadata{docRevPair}
+		}
 
-				w.notifyDocsPushed(docRevPairs)
-				numDocsPushed += len(docRevPairs)
+	}
 
-			default:
-				timeBeforeWrite := time.Now()
-				docRevPairs, err := w.DataStore.BulkCreateDocumentsRetry(docs, true)
-				if err != nil {
-					panic(fmt.Sprintf("Error creating docs in datastore.  Docs: %v, Err: %v", docs, err))
-				}
-				timeBlockedDuringWrite = time.Since(timeBeforeWrite)
-				w.notifyDocsPushed(docRevPairs)
-				numDocsPushed += len(docRevPairs)
-			}
+}
 
-			w.ExpVarStats.Add("NumDocsPushed", int64(len(docs)))
-			globalProgressStats.Add("TotalNumDocsPushed", int64(len(docs)))
-			logger.Debug(
-				"Writer pushed docs",
-				"writer",
-				w.Agent.UserCred.Username,
-				"numpushed",
-				len(docs),
-				"totalpushed",
-				numDocsPushed,
-			)
-
-			if timeBlockedDuringWrite > 10*time.Second {
-				logger.Warn("Writer took a while to write", "delta", timeBlockedDuringWrite, "user", w.Agent.UserCred.Username)
-			}
+// Send a scheduled write in its own goroutine.  If MaxWritesInFlight writes are still
+// in flight, it's counted as late and sent once one of them finishes.  Returns false
+// if ctx was done first.
+func (w *Writer) dispatch(ctx, requestCtx context.Context, docs []Document, intendedSendTime time.Time, stopWrites func()) bool {
 
-			w.maybeDelayBetweenWrites(timeBlockedDuringWrite)
+	select {
+	case w.inFlight <- struct{}{}:
+	default:
+		w.ExpVarStats.Add("NumWritesLate", 1)
+		globalProgressStats.Add("TotalNumWritesLate", 1)
+		if w.Metrics != nil {
+			w.Metrics.Counter("writes_late", 1)
+		}
+		select {
+		case w.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+	}
 
+	w.inFlightWg.Add(1)
+	go func() {
+		defer w.inFlightWg.Done()
+		defer func() { <-w.inFlight }()
+		if !w.write(ctx, requestCtx, docs, intendedSendTime) {
+			stopWrites()
 		}
+	}()
+	return true
 
+}
+
+// Write a batch of docs and record how it went.  With a Scheduler, the latency is
+// also measured from the intended send time.  Returns false if the writer should stop.
+func (w *Writer) write(ctx, requestCtx context.Context, docs []Document, intendedSendTime time.Time) bool {
+
+	timeBeforeWrite := time.Now()
+	docRevPairs, err := w.writeDocs(requestCtx, docs)
+	timeBlockedDuringWrite := time.Since(timeBeforeWrite)
+
+	if err != nil && requestCtx.Err() != nil {
+		// Cancelled after the drain timeout, so it didn't fail on its own
+		logger.Info("Writer stopped during write", "agent.ID", w.ID, "numdocs", atomic.LoadInt64(&w.numDocsPushed))
+		return false
 	}
 
+	// Failed writes count towards the latency too, or a slow Sync Gateway that
+	// times out would look faster than one that succeeds slowly
+	if w.Scheduler != nil {
+		w.pushIntendedLatencyStat(intendedSendTime)
+	}
+
+	if err != nil {
+		globalProgressStats.Add("TotalNumDocsFailed", int64(len(docs)))
+		if w.reportError("write", err) {
+			return false
+		}
+		w.maybeDelayBetweenWrites(ctx, timeBlockedDuringWrite)
+		return true
+	}
+	w.Errors.RecordSuccess()
+
+	w.notifyDocsPushed(ctx, docRevPairs)
+	numDocsPushed := atomic.AddInt64(&w.numDocsPushed, int64(len(docRevPairs)))
+
+	w.ExpVarStats.Add("NumDocsPushed", int64(len(docs)))
+	globalProgressStats.Add("TotalNumDocsPushed", int64(len(docs)))
+	logger.Debug(
+		"Writer pushed docs",
+		"writer",
+		w.Agent.UserCred.Username,
+		"numpushed",
+		len(docs),
+		"totalpushed",
+		numDocsPushed,
+	)
+
+	if timeBlockedDuringWrite > 10*time.Second {
+		logger.Warn("Writer took a while to write", "delta", timeBlockedDuringWrite, "user", w.Agent.UserCred.Username)
+	}
+
+	w.maybeDelayBetweenWrites(ctx, timeBlockedDuringWrite)
+	return true
+
 }
 
-func (w *Writer) createWriterSGUserIfNeeded() {
+// Write a single doc (possibly with an attachment) or a batch of docs via _bulk_docs,
+// to the keyspace the doc feeder put them in
+func (w *Writer) writeDocs(ctx context.Context, docs []Document) ([]DocumentMetadata, error) {
+
+	keyspace := docs[0].Keyspace()
+	dataStore, err := w.keyspaceDataStore(keyspace)
+	if err != nil {
+		return nil, err
+	}
+
+	if w.PushReplicator != nil {
+		w.pushMutex.Lock()
+		docRevPairs, err := w.pushDocs(ctx, keyspace, dataStore, docs)
+		w.pushMutex.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("Error pushing %d docs to datastore.  Err: %v", len(docs), err)
+		}
+		for i := range docRevPairs {
+			docRevPairs[i].Keyspace = keyspace
+		}
+		return docRevPairs, nil
+	}
+
+	if len(docs) == 1 {
+		docRevPair, err := dataStore.CreateDocument(ctx, docs[0], w.AttachSizeBytes, true)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating doc in datastore.  Doc: %v, Err: %v", docs[0].Id(), err)
+		}
+		docRevPair.Keyspace = keyspace
+		return []DocumentMetadata{docRevPair}, nil
+	}
+
+	docRevPairs, err := dataStore.BulkCreateDocumentsRetry(ctx, docs, true)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating %d docs in datastore.  Err: %v", len(docs), err)
+	}
+	for i := range docRevPairs {
+		docRevPairs[i].Keyspace = keyspace
+	}
+	return docRevPairs, nil
+
+}
+
+func (w *Writer) createWriterSGUserIfNeeded(ctx context.Context) error {
 	defer globalProgressStats.Add("NumWriterUsers", 1)
-	w.createSGUserIfNeeded([]string{"*"})
+	return w.createSGUserIfNeeded(ctx, []string{"*"})
 }
 
 func updateCreatedAtTimestamp(docs []Document) {
@@ -124,7 +280,25 @@ func updateCreatedAtTimestamp(docs []Document) {
 	}
 }
 
-func (w *Writer) maybeDelayBetweenWrites(timeBlockedDuringWrite time.Duration) {
+// Record how long the write took (whether or not it succeeded) measured from when the
+// scheduler intended it to be sent, which includes any time the writer spent behind
+// schedule
+func (w *Writer) pushIntendedLatencyStat(intendedSendTime time.Time) {
+	if w.Metrics == nil {
+		return
+	}
+	w.Metrics.Timing(
+		"create_document_intended",
+		time.Since(intendedSendTime),
+	)
+}
+
+func (w *Writer) maybeDelayBetweenWrites(ctx context.Context, timeBlockedDuringWrite time.Duration) {
+
+	if w.Scheduler != nil {
+		// The schedule decides when the next write is sent
+		return
+	}
 
 	timeToSleep := w.WriterSpec.DelayBetweenWrites - timeBlockedDuringWrite
 	if timeToSleep > time.Duration(0) {
@@ -135,21 +309,29 @@ func (w *Writer) maybeDelayBetweenWrites(timeBlockedDuringWrite time.Duration) {
 			"delay",
 			timeToSleep,
 		)
-		time.Sleep(timeToSleep)
+		sleepContext(ctx, timeToSleep)
 	}
 
 }
 
 func (w *Writer) SetApproxExpectedDocsWritten(numdocs int) {
+	if w.OpenEnded {
+		// No fixed number of docs to expect
+		return
+	}
 	w.ExpVarStats.Add("ApproxTotalDocs", int64(numdocs))
 	globalProgressStats.Add("TotalNumDocsPushedExpected", int64(numdocs))
 }
 
-func (w *Writer) notifyDocsPushed(docs []DocumentMetadata) {
+func (w *Writer) notifyDocsPushed(ctx context.Context, docs []DocumentMetadata) {
 
 	start := time.Now()
 	if w.PushedDocs != nil {
-		w.PushedDocs <- docs
+		select {
+		case w.PushedDocs <- docs:
+		case <-ctx.Done():
+			return
+		}
 	}
 	delta := time.Since(start)
 	if delta > time.Second {
@@ -158,21 +340,34 @@ func (w *Writer) notifyDocsPushed(docs []DocumentMetadata) {
 
 }
 
-func (w *Writer) AddToDataStore(docs []Document) {
+// Queue docs to be written by the writer goroutine.  Returns ctx.Err() if
+// the run was stopped before all the docs could be queued.
+func (w *Writer) AddToDataStore(ctx context.Context, docs []Document) error {
+
+	docBatches := [][]Document{}
 
 	switch w.BatchSize {
 	case 1:
 		for _, doc := range docs {
 			logger.Debug("Push single doc to writer", "writer", w.UserCred.Username, "channels", doc["channels"])
-			w.OutboundDocs <- []Document{doc}
+			docBatches = append(docBatches, []Document{doc})
 		}
 
 	default:
-		docBatches := breakIntoBatches(w.BatchSize, docs)
-		for _, docBatch := range docBatches {
+		for _, docBatch := range breakIntoBatches(w.BatchSize, docs) {
 			logger.Debug("Push doc batch to writer", "writer", w.UserCred.Username, "batchsize", len(docBatch))
-			w.OutboundDocs <- docBatch
+			docBatches = append(docBatches, docBatch)
+		}
+	}
+
+	for _, docBatch := range docBatches {
+		select {
+		case w.OutboundDocs <- docBatch:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 
+	return nil
+
 }
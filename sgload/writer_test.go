@@ -1 +1,178 @@
 package sgload
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/sgload/sgsimulator"
+)
+
+// Failed writes count towards the latency from the intended send time, as well as
+// the ones that succeed
+func TestWriterIntendedLatencyIncludesFailures(t *testing.T) {
+
+	faultConfig := sgsimulator.FaultConfig{
+		Endpoints: map[string]sgsimulator.EndpointFaults{
+			sgsimulator.EndpointBulkDocs: {ErrorRate: 1, ErrorStatus: 400},
+		},
+	}
+	_, dataStore, cleanup := newSimulatorDataStore(t, faultConfig)
+	defer cleanup()
+
+	ctx := context.Background()
+	userCreds := UserCred{Username: "writer", Password: "password"}
+	if err := dataStore.CreateUser(ctx, userCreds, []string{"*"}); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	dataStore.SetUserCreds(userCreds)
+
+	finishedWg := &sync.WaitGroup{}
+	finishedWg.Add(1)
+	writer := NewWriter(
+		AgentSpec{
+			FinishedWg:        finishedWg,
+			UserCred:          userCreds,
+			DataStore:         dataStore,
+			BatchSize:         2,
+			AllSGUsersCreated: &sync.WaitGroup{},
+			Errors:            NewErrorCollector(ErrorBudget{MaxErrors: -1}),
+		},
+		WriterSpec{Scheduler: NewWriteScheduler(100, 1)},
+	)
+	metrics := newCountingMetricsSink()
+	writer.SetMetricsSink(metrics)
+	go writer.Run(ctx)
+
+	if err := writer.AddToDataStore(ctx, docsToWrite("doc", 4, []string{"ABC"})); err != nil {
+		t.Fatalf("Error queueing docs: %v", err)
+	}
+	writer.OutboundDocs <- []Document{{"_terminal": true}}
+
+	finished := make(chan struct{})
+	go func() {
+		finishedWg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Writer did not finish")
+	}
+
+	if numTimings := metrics.timingCount("create_document_intended"); numTimings != 2 {
+		t.Fatalf("Expected the intended latency of both failed writes, got %d", numTimings)
+	}
+
+}
+
+// Records when each batch of docs is sent to the data store it wraps
+type sendTimesDataStore struct {
+	DataStore
+	mutex     sync.Mutex
+	sendTimes []time.Time
+}
+
+func (s *sendTimesDataStore) BulkCreateDocumentsRetry(ctx context.Context, docs []Document, newEdits bool) ([]DocumentMetadata, error) {
+	s.mutex.Lock()
+	s.sendTimes = append(s.sendTimes, time.Now())
+	s.mutex.Unlock()
+	return s.DataStore.BulkCreateDocumentsRetry(ctx, docs, newEdits)
+}
+
+// Run a writer on a schedule against a simulator whose _bulk_docs takes latencyMs, and
+// wait for it to write all the docs
+func runScheduledWriter(t *testing.T, targetOpsPerSec float64, maxWritesInFlight, numWrites int, latencyMs float64) (*sendTimesDataStore, *countingMetricsSink) {
+
+	faultConfig := sgsimulator.FaultConfig{
+		Endpoints: map[string]sgsimulator.EndpointFaults{
+			sgsimulator.EndpointBulkDocs: {Latency: &sgsimulator.LatencyDistribution{Distribution: "fixed", FixedMs: latencyMs}},
+		},
+	}
+	_, simDataStore, cleanup := newSimulatorDataStore(t, faultConfig)
+	defer cleanup()
+
+	ctx := context.Background()
+	userCreds := UserCred{Username: "writer", Password: "password"}
+	if err := simDataStore.CreateUser(ctx, userCreds, []string{"*"}); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	simDataStore.SetUserCreds(userCreds)
+	dataStore := &sendTimesDataStore{DataStore: simDataStore}
+
+	finishedWg := &sync.WaitGroup{}
+	finishedWg.Add(1)
+	writer := NewWriter(
+		AgentSpec{
+			FinishedWg:        finishedWg,
+			UserCred:          userCreds,
+			DataStore:         dataStore,
+			BatchSize:         2,
+			AllSGUsersCreated: &sync.WaitGroup{},
+			Errors:            NewErrorCollector(ErrorBudget{}),
+		},
+		WriterSpec{Scheduler: NewWriteScheduler(targetOpsPerSec, 1), MaxWritesInFlight: maxWritesInFlight},
+	)
+	metrics := newCountingMetricsSink()
+	writer.SetMetricsSink(metrics)
+	go writer.Run(ctx)
+
+	if err := writer.AddToDataStore(ctx, docsToWrite("doc", 2*numWrites, []string{"ABC"})); err != nil {
+		t.Fatalf("Error queueing docs: %v", err)
+	}
+	writer.OutboundDocs <- []Document{{"_terminal": true}}
+
+	finished := make(chan struct{})
+	go func() {
+		finishedWg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Writer did not finish")
+	}
+
+	if len(dataStore.sendTimes) != numWrites {
+		t.Fatalf("Expected %d writes, got %d", numWrites, len(dataStore.sendTimes))
+	}
+	if numTimings := metrics.timingCount("create_document_intended"); numTimings != int64(numWrites) {
+		t.Fatalf("Expected the intended latency of %d writes, got %d", numWrites, numTimings)
+	}
+	return dataStore, metrics
+
+}
+
+// A slow Sync Gateway doesn't slow down a writer on a schedule, since it doesn't wait
+// for its earlier writes to finish before sending the next
+func TestScheduledWriterKeepsTargetRateWhenSlow(t *testing.T) {
+
+	targetOpsPerSec := 50.0
+	numWrites := 20
+
+	// Each write takes 10x the interval between them, so a writer that waited for
+	// each one would send only 5 per second
+	dataStore, metrics := runScheduledWriter(t, targetOpsPerSec, 0, numWrites, 200)
+
+	sendTimes := dataStore.sendTimes
+	sendRate := float64(numWrites-1) / sendTimes[numWrites-1].Sub(sendTimes[0]).Seconds()
+	if sendRate < 0.8*targetOpsPerSec {
+		t.Fatalf("Expected writes to be sent at about %v per second, got %.1f", targetOpsPerSec, sendRate)
+	}
+	if numLate := metrics.counter("writes_late"); numLate != 0 {
+		t.Fatalf("Expected no late writes, got %d", numLate)
+	}
+
+}
+
+// Once MaxWritesInFlight writes are outstanding, the next ones wait and are counted as late
+func TestScheduledWriterCountsLateWrites(t *testing.T) {
+
+	_, metrics := runScheduledWriter(t, 50, 2, 6, 200)
+
+	if numLate := metrics.counter("writes_late"); numLate == 0 {
+		t.Fatalf("Expected writes beyond MaxWritesInFlight to be counted as late")
+	}
+
+}
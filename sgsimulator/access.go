@@ -0,0 +1,156 @@
+package sgsimulator
+
+import (
+	"sort"
+)
+
+// A Sync Gateway role, as created via the admin _role endpoint.  Users with the role
+// in their admin_roles get its channels.
+type role struct {
+	Name          string   `json:"name"`
+	AdminChannels []string `json:"admin_channels"`
+}
+
+// A change to the channels a user has access to, through its admin_channels or roles
+type accessChange struct {
+	username string
+	before   []string
+	after    []string
+}
+
+// Creates or replaces a role.  The users with the role get or lose access to channels
+// the same way as if their own channels had changed.
+func (db *database) putRole(r role) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	before := map[string][]string{}
+	for name, u := range db.users {
+		if containsString(u.AdminRoles, r.Name) {
+			before[name] = db.userChannels(u)
+		}
+	}
+	db.roles[r.Name] = &r
+	for name, channels := range before {
+		db.logAccessChange(name, channels, db.userChannels(db.users[name]))
+	}
+}
+
+func (db *database) getRole(name string) (role, bool) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	r, ok := db.roles[name]
+	if !ok {
+		return role{}, false
+	}
+	return *r, true
+}
+
+// The channels the user gets from its roles.  The caller must hold the lock.
+func (db *database) roleChannels(u *user) []string {
+	channels := []string{}
+	for _, roleName := range u.AdminRoles {
+		if r, ok := db.roles[roleName]; ok {
+			channels = append(channels, r.AdminChannels...)
+		}
+	}
+	return channels
+}
+
+// All the channels the user has access to.  The caller must hold the lock.
+func (db *database) userChannels(u *user) []string {
+	withRoles := *u
+	withRoles.roleChannels = db.roleChannels(u)
+	return withRoles.allChannels()
+}
+
+// The user's admin channels and the channels of its roles, sorted and without duplicates
+func (u user) allChannels() []string {
+	unique := map[string]bool{}
+	for _, channel := range append(append([]string{}, u.AdminChannels...), u.roleChannels...) {
+		unique[channel] = true
+	}
+	channels := []string{}
+	for channel := range unique {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// Give the change to the user's channels a sequence, like Sync Gateway does when it
+// saves the user, so that the user's changes feeds pick it up (see accessChangeEntries).
+// Nothing is logged if the channels are the same.  The caller must hold the lock.
+func (db *database) logAccessChange(username string, before, after []string) {
+
+	if sameChannels(before, after) {
+		return
+	}
+
+	db.sequenceLog = append(db.sequenceLog, "_user/"+username)
+	db.accessLog[uint64(len(db.sequenceLog))] = accessChange{username: username, before: before, after: after}
+	db.notifyChange()
+
+}
+
+// Whether a and b have the same channels, given they're both without duplicates
+func sameChannels(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, channel := range a {
+		if !containsString(b, channel) {
+			return false
+		}
+	}
+	return true
+}
+
+// The entries for a change to the user's channels at seq, on a changes feed since the
+// given sequence.  Docs before since that the user has been granted access to are
+// backfilled, since the feed has gone past them, whereas later ones are on the feed in
+// the usual way.  With revocations, docs the user has lost access to are sent as
+// removals, like Sync Gateway 3.x does when asked with revocations=true, wherever they
+// are in the sequence, since the client may have an earlier revision of them.  The
+// entries are all at the sequence of the access change.  The caller must hold the lock.
+func (db *database) accessChangeEntries(u *user, seq, since uint64, access accessChange, channelFilter []string, revocations bool) []changeEntry {
+
+	entries := []changeEntry{}
+
+	for docSeq := uint64(1); docSeq <= uint64(len(db.sequenceLog)); docSeq++ {
+
+		doc := db.docs[db.sequenceLog[docSeq-1]]
+		if doc == nil || doc.sequence != docSeq {
+			continue
+		}
+		winner := doc.revTree.winningRev()
+		if len(channelFilter) > 0 && !intersects(channelFilter, winner.channels) {
+			continue
+		}
+
+		visibleBefore := channelsCanSee(access.before, winner.channels)
+		visibleAfter := channelsCanSee(access.after, winner.channels)
+		entry := changeEntry{
+			Seq:     seq,
+			ID:      doc.id,
+			Changes: []changeRev{{Rev: winner.id}},
+		}
+
+		switch {
+		case !visibleBefore && visibleAfter && docSeq <= since && u.canSee(winner.channels):
+			entry.Deleted = winner.deleted
+			entries = append(entries, entry)
+		case revocations && visibleBefore && !visibleAfter && !u.canSee(winner.channels):
+			for _, channel := range winner.channels {
+				if channelsCanSee(access.before, []string{channel}) {
+					entry.Removed = append(entry.Removed, channel)
+				}
+			}
+			entry.Revoked = true
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+
+}
@@ -0,0 +1,180 @@
+package sgsimulator
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/sgload/jwt"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// The cookie that Sync Gateway's sessions are kept in
+	SessionCookieName = "SyncGatewaySession"
+
+	// How long a session lasts when no TTL is given, which is Sync Gateway's default
+	DefaultSessionTTL = 24 * time.Hour
+)
+
+// A session created by logging in with POST /{db}/_session
+type session struct {
+	username string
+	expires  time.Time
+}
+
+// Accepts bearer JWTs issued by Issuer and signed with one of Keys, like a Sync
+// Gateway OpenID Connect provider configured with username_claim "sub".  The users
+// must already exist.
+type JWTProvider struct {
+	Issuer string
+	Keys   jwt.KeySet
+}
+
+// Creates a session for the user which lasts for ttl, and returns its id
+func (db *database) createSession(username string, ttl time.Duration) (string, error) {
+
+	idBytes := make([]byte, 20)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(idBytes)
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.sessions[id] = &session{username: username, expires: time.Now().Add(ttl)}
+	return id, nil
+
+}
+
+// Returns the user whose session it is, unless the session has expired or been deleted
+func (db *database) sessionUser(id string) (*user, error) {
+
+	db.mutex.RLock()
+	s, ok := db.sessions[id]
+	db.mutex.RUnlock()
+	if !ok || time.Now().After(s.expires) {
+		return nil, newHTTPError(http.StatusUnauthorized, "Session Invalid")
+	}
+
+	u, ok := db.getUser(s.username)
+	if !ok {
+		return nil, newHTTPError(http.StatusUnauthorized, "Session Invalid")
+	}
+	return &u, nil
+
+}
+
+// Deletes all of a user's sessions, and returns how many there were
+func (db *database) deleteSessions(username string) int {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	numDeleted := 0
+	for id, s := range db.sessions {
+		if s.username == username {
+			delete(db.sessions, id)
+			numDeleted++
+		}
+	}
+	return numDeleted
+}
+
+// Returns the user the bearer token was issued to
+func (h dbHandler) tokenUser(token string) (*user, error) {
+
+	jwtProvider := h.settings.jwt()
+	if jwtProvider == nil {
+		return nil, newHTTPError(http.StatusUnauthorized, "No OpenID Connect provider is configured")
+	}
+	claims, err := jwt.Verify(token, jwtProvider.Keys)
+	if err != nil {
+		return nil, newHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	if claims.Issuer != jwtProvider.Issuer {
+		return nil, newHTTPError(http.StatusUnauthorized, "Unknown token issuer")
+	}
+
+	u, ok := h.users.getUser(claims.Subject)
+	if !ok {
+		return nil, newHTTPError(http.StatusUnauthorized, "Invalid login")
+	}
+	return &u, nil
+
+}
+
+func bearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(auth, "Bearer ")
+}
+
+// Logs in with the name and password in the body, and sets the session cookie
+func (h dbHandler) CreateSessionHandler(w http.ResponseWriter, req *http.Request) {
+
+	credentials := struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}{}
+	if err := readJSON(req, &credentials); err != nil {
+		writeError(w, err)
+		return
+	}
+	u, err := h.db.authenticate(credentials.Name, credentials.Password, true)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id, err := h.db.createSession(u.Name, h.sessionTTL)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    id,
+		Path:     "/" + h.db.Name + "/",
+		Expires:  time.Now().Add(h.sessionTTL),
+		HttpOnly: true,
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ok": true,
+		"userCtx": map[string]interface{}{
+			"name":     u.Name,
+			"channels": u.AdminChannels,
+		},
+	})
+
+}
+
+// Deletes all of a user's sessions, so that clients using them have to log in again
+func (h dbHandler) DeleteUserSessionsHandler(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	if _, ok := h.db.getUser(name); !ok {
+		writeError(w, newHTTPError(http.StatusNotFound, "missing"))
+		return
+	}
+	h.db.deleteSessions(name)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Only lets in admin requests with the given basic auth credentials, like Sync
+// Gateway 3.x does with the credentials of a Couchbase Server user
+func requireAdminCreds(username, password string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		reqUsername, reqPassword, hasAuth := req.BasicAuth()
+		if !hasAuth {
+			writeError(w, newHTTPError(http.StatusUnauthorized, "Login required"))
+			return
+		}
+		if reqUsername != username || reqPassword != password {
+			writeError(w, newHTTPError(http.StatusUnauthorized, "Invalid login"))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
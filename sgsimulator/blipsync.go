@@ -0,0 +1,425 @@
+package sgsimulator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/couchbaselabs/sgload/blip"
+)
+
+const (
+	// The number of changes in each changes message when subChanges doesn't ask for a batch size
+	defaultBlipChangesBatch = 200
+)
+
+// Handles one type of BLIP request, returning the reply or an error to reply with
+type blipHandlerFunc func(bsc *blipSyncContext, conn *blip.Conn, request *blip.Message) (*blip.Message, error)
+
+// The BLIP requests a client can send, by profile
+var blipHandlers = map[string]blipHandlerFunc{
+	"getCheckpoint":  (*blipSyncContext).handleGetCheckpoint,
+	"setCheckpoint":  (*blipSyncContext).handleSetCheckpoint,
+	"subChanges":     (*blipSyncContext).handleSubChanges,
+	"proposeChanges": (*blipSyncContext).handleProposeChanges,
+	"rev":            (*blipSyncContext).handleRev,
+	"getAttachment":  (*blipSyncContext).handleGetAttachment,
+}
+
+// The state of a BLIP replication connection from a Couchbase Lite 2.x style client
+type blipSyncContext struct {
+	db   *database
+	user *user // Nil on the admin API
+
+	mutex      sync.Mutex
+	subscribed bool // Whether changes are being sent to the client for a subChanges request
+}
+
+// Upgrades the request to a BLIP connection, over which the client can push and pull
+// revisions much like Couchbase Lite 2.x does with Sync Gateway
+func (h dbHandler) BlipSyncHandler(w http.ResponseWriter, req *http.Request) {
+
+	u, err := h.requestUser(req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	bsc := &blipSyncContext{db: h.db, user: u}
+	if _, err := blip.Upgrade(w, req, bsc.handleRequest); err != nil {
+		log.Printf("Error upgrading _blipsync request: %v", err)
+	}
+}
+
+func (bsc *blipSyncContext) handleRequest(conn *blip.Conn, request *blip.Message) *blip.Message {
+
+	handler, ok := blipHandlers[request.Profile()]
+	if !ok {
+		return request.ErrorResponse(blip.BLIPErrorDomain, http.StatusNotFound, fmt.Sprintf("Unknown profile %q", request.Profile()))
+	}
+
+	response, err := handler(bsc, conn, request)
+	if err != nil {
+		httpErr := asHTTPError(err)
+		return request.ErrorResponse(blip.HTTPErrorDomain, httpErr.Status, httpErr.Reason)
+	}
+	return response
+}
+
+// Checkpoints are stored as _local docs, keyed by the client ID
+func checkpointDocID(request *blip.Message) (string, error) {
+	client := request.Properties["client"]
+	if client == "" {
+		return "", newHTTPError(http.StatusBadRequest, "Missing client")
+	}
+	return "checkpoint/" + client, nil
+}
+
+func (bsc *blipSyncContext) handleGetCheckpoint(conn *blip.Conn, request *blip.Message) (*blip.Message, error) {
+
+	docid, err := checkpointDocID(request)
+	if err != nil {
+		return nil, err
+	}
+	body, err := bsc.db.getLocalDocument(docid)
+	if err != nil {
+		return nil, err
+	}
+
+	response := request.Response()
+	response.Properties["rev"] = body["_rev"].(string)
+	return response, response.SetJSONBody(stripSpecialProperties(body))
+}
+
+func (bsc *blipSyncContext) handleSetCheckpoint(conn *blip.Conn, request *blip.Message) (*blip.Message, error) {
+
+	docid, err := checkpointDocID(request)
+	if err != nil {
+		return nil, err
+	}
+	body := map[string]interface{}{}
+	if err := request.ReadJSONBody(&body); err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "Invalid checkpoint")
+	}
+	if rev := request.Properties["rev"]; rev != "" {
+		body["_rev"] = rev
+	}
+
+	revid, err := bsc.db.putLocalDocument(docid, body)
+	if err != nil {
+		return nil, err
+	}
+
+	response := request.Response()
+	response.Properties["rev"] = revid
+	return response, nil
+}
+
+// Starts sending the changes since the given sequence to the client, as changes
+// messages followed by a rev message for each revision the client asks for.  Once
+// the client is caught up it gets an empty changes message, and unless the
+// subscription is continuous, that's the end of it.
+func (bsc *blipSyncContext) handleSubChanges(conn *blip.Conn, request *blip.Message) (*blip.Message, error) {
+
+	// The since value is JSON, so it may be a quoted string
+	since, err := parseUintParam(strings.Trim(request.Properties["since"], `"`))
+	if err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "Invalid since")
+	}
+	batchSize := defaultBlipChangesBatch
+	if batch := request.Properties["batch"]; batch != "" {
+		if batchSize, err = strconv.Atoi(batch); err != nil || batchSize <= 0 {
+			return nil, newHTTPError(http.StatusBadRequest, "Invalid batch")
+		}
+	}
+	channelFilter := []string{}
+	if request.Properties["filter"] == "sync_gateway/bychannel" && request.Properties["channels"] != "" {
+		channelFilter = strings.Split(request.Properties["channels"], ",")
+	}
+	continuous := request.Properties["continuous"] == "true"
+
+	bsc.mutex.Lock()
+	defer bsc.mutex.Unlock()
+	if bsc.subscribed {
+		return nil, newHTTPError(http.StatusConflict, "Already subscribed to changes")
+	}
+	bsc.subscribed = true
+
+	go bsc.sendChanges(conn, since, batchSize, channelFilter, continuous)
+
+	return nil, nil
+}
+
+func (bsc *blipSyncContext) sendChanges(conn *blip.Conn, since uint64, batchSize int, channelFilter []string, continuous bool) {
+
+	defer func() {
+		bsc.mutex.Lock()
+		bsc.subscribed = false
+		bsc.mutex.Unlock()
+	}()
+
+	caughtUp := false
+	for {
+		// Grab the notification channel before reading changes so that nothing is missed in between
+		changeNotification := bsc.db.changeNotification()
+
+		changes, lastSeq := bsc.db.changes(bsc.user, since, batchSize, channelFilter, false, false)
+		if len(changes) > 0 || !caughtUp {
+			if err := bsc.sendChangesBatch(conn, changes); err != nil {
+				return
+			}
+			since = lastSeq
+			caughtUp = len(changes) == 0
+			continue
+		}
+
+		if !continuous {
+			return
+		}
+		select {
+		case <-changeNotification:
+		case <-conn.Done():
+			return
+		}
+	}
+}
+
+// Sends a changes message, where each change is [seq, docid, revid] with a trailing true
+// if it's a deletion.  The client replies with an entry for each change, which is either
+// the list of revisions of the doc it already has, or 0 if it doesn't want the revision.
+// The revisions it wants are then sent as rev messages.
+func (bsc *blipSyncContext) sendChangesBatch(conn *blip.Conn, changes []changeEntry) error {
+
+	rows := make([][]interface{}, 0, len(changes))
+	for _, change := range changes {
+		row := []interface{}{change.Seq, change.ID, change.Changes[0].Rev}
+		if change.Deleted {
+			row = append(row, true)
+		}
+		rows = append(rows, row)
+	}
+
+	request := blip.NewRequest("changes")
+	if err := request.SetJSONBody(rows); err != nil {
+		return err
+	}
+	response, err := conn.SendAndWait(context.Background(), request)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+
+	wanted := []interface{}{}
+	if len(response.Body) > 0 {
+		if err := response.ReadJSONBody(&wanted); err != nil {
+			return err
+		}
+	}
+
+	// Send all the revisions before waiting for the client to acknowledge them
+	replies := []<-chan *blip.Message{}
+	for i, change := range changes {
+		if i >= len(wanted) {
+			break
+		}
+		if _, ok := wanted[i].([]interface{}); !ok {
+			continue
+		}
+		reply, err := conn.Send(bsc.revisionMessage(change))
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			replies = append(replies, reply)
+		}
+	}
+	for _, reply := range replies {
+		select {
+		case <-reply:
+		case <-conn.Done():
+			return conn.Err()
+		}
+	}
+
+	return nil
+}
+
+// A rev message with the given revision, or a norev message if the user can't get it
+func (bsc *blipSyncContext) revisionMessage(change changeEntry) *blip.Message {
+
+	revid := change.Changes[0].Rev
+	docRev, err := bsc.db.getRevision(bsc.user, change.ID, revid, true, false)
+	if err != nil {
+		return norevMessage(change, err)
+	}
+
+	// The history is every ancestor, newest first
+	revisions := docRev.Body["_revisions"].(map[string]interface{})
+	history := expandRevisions(revisions["start"].(int), revisions["ids"].([]string))[1:]
+
+	// Like Sync Gateway, send the revisions compressed
+	request := blip.NewRequest("rev")
+	request.Compressed = true
+	request.Properties["id"] = change.ID
+	request.Properties["rev"] = revid
+	request.Properties["sequence"] = strconv.FormatUint(change.Seq, 10)
+	request.Properties["history"] = strings.Join(history, ",")
+	if change.Deleted {
+		request.Properties["deleted"] = "1"
+	}
+	if err := request.SetJSONBody(stripSpecialPropertiesExceptAttachments(docRev.Body)); err != nil {
+		return norevMessage(change, err)
+	}
+	return request
+}
+
+// Tells the client that it won't get a revision it asked for
+func norevMessage(change changeEntry, err error) *blip.Message {
+	httpErr := asHTTPError(err)
+	request := blip.NewRequest("norev")
+	request.NoReply = true
+	request.Properties["id"] = change.ID
+	request.Properties["rev"] = change.Changes[0].Rev
+	request.Properties["error"] = strconv.Itoa(httpErr.Status)
+	request.Properties["reason"] = httpErr.Reason
+	return request
+}
+
+// The client proposes revisions to push as [docid, revid, parentRevID] and gets a status
+// for each, where 0 means it should send the revision.  Trailing zeroes are left out.
+func (bsc *blipSyncContext) handleProposeChanges(conn *blip.Conn, request *blip.Message) (*blip.Message, error) {
+
+	proposed := [][]interface{}{}
+	if err := request.ReadJSONBody(&proposed); err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "Invalid proposeChanges")
+	}
+
+	statuses := []int{}
+	numStatuses := 0
+	for _, change := range proposed {
+		if len(change) < 2 {
+			return nil, newHTTPError(http.StatusBadRequest, "Invalid proposed change")
+		}
+		docid, _ := change[0].(string)
+		revid, _ := change[1].(string)
+		parentRevID := ""
+		if len(change) > 2 {
+			parentRevID, _ = change[2].(string)
+		}
+		status := bsc.db.proposeRevision(docid, revid, parentRevID)
+		statuses = append(statuses, status)
+		if status != 0 {
+			numStatuses = len(statuses)
+		}
+	}
+
+	response := request.Response()
+	return response, response.SetJSONBody(statuses[:numStatuses])
+}
+
+// The client pushes a revision, with its ancestors in the history property.  Any
+// attachments the database doesn't have yet are requested from the client.
+func (bsc *blipSyncContext) handleRev(conn *blip.Conn, request *blip.Message) (*blip.Message, error) {
+
+	docid, revid := request.Properties["id"], request.Properties["rev"]
+	if docid == "" || revid == "" {
+		return nil, newHTTPError(http.StatusBadRequest, "Missing id or rev")
+	}
+
+	body := map[string]interface{}{}
+	if len(request.Body) > 0 {
+		if err := request.ReadJSONBody(&body); err != nil {
+			return nil, newHTTPError(http.StatusBadRequest, "Invalid rev body")
+		}
+	}
+
+	// Turn the history into _revisions, as if it had been pushed with new_edits=false
+	history := []string{revid}
+	if request.Properties["history"] != "" {
+		history = append(history, strings.Split(request.Properties["history"], ",")...)
+	}
+	generation, _ := parseRevID(revid)
+	ids := make([]interface{}, 0, len(history))
+	for _, ancestor := range history {
+		_, digest := parseRevID(ancestor)
+		ids = append(ids, digest)
+	}
+	body["_id"] = docid
+	body["_rev"] = revid
+	body["_revisions"] = map[string]interface{}{"start": float64(generation), "ids": ids}
+	if deleted := request.Properties["deleted"]; deleted == "1" || deleted == "true" {
+		body["_deleted"] = true
+	}
+
+	attachmentData, err := bsc.fetchAttachments(conn, docid, body)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, err = bsc.db.putDocument(body, false, attachmentData)
+	return nil, err
+}
+
+// Gets the data of the attachments in a pushed revision, either from the database if it
+// already has it, or else from the client with getAttachment requests, and marks them as
+// following so that putDocument stores them
+func (bsc *blipSyncContext) fetchAttachments(conn *blip.Conn, docid string, body map[string]interface{}) (map[string][]byte, error) {
+
+	attachments, _ := body["_attachments"].(map[string]interface{})
+	attachmentData := map[string][]byte{}
+
+	for name, rawMeta := range attachments {
+		meta, ok := rawMeta.(map[string]interface{})
+		if !ok {
+			return nil, newHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid attachment %q", name))
+		}
+		digest, _ := meta["digest"].(string)
+		if digest == "" {
+			continue
+		}
+
+		data, ok := bsc.db.getAttachment(digest)
+		if !ok {
+			request := blip.NewRequest("getAttachment")
+			request.Properties["digest"] = digest
+			request.Properties["docID"] = docid
+			response, err := conn.SendAndWait(context.Background(), request)
+			if err != nil {
+				return nil, newHTTPError(http.StatusBadRequest, fmt.Sprintf("Error getting attachment %q: %v", name, err))
+			}
+			data = response.Body
+			if sha1DigestKey(data) != digest {
+				return nil, newHTTPError(http.StatusBadRequest, fmt.Sprintf("Wrong digest for attachment %q", name))
+			}
+		}
+
+		attachmentData[digest] = data
+		meta["follows"] = true
+		delete(meta, "stub")
+	}
+
+	return attachmentData, nil
+}
+
+func (bsc *blipSyncContext) handleGetAttachment(conn *blip.Conn, request *blip.Message) (*blip.Message, error) {
+	data, ok := bsc.db.getAttachment(request.Properties["digest"])
+	if !ok {
+		return nil, newHTTPError(http.StatusNotFound, "missing")
+	}
+	response := request.Response()
+	response.Body = data
+	return response, nil
+}
+
+// Unlike the REST API, a rev message keeps the _attachments in the body, and has
+// everything else that's special as properties
+func stripSpecialPropertiesExceptAttachments(body map[string]interface{}) map[string]interface{} {
+	stripped := stripSpecialProperties(body)
+	if attachments, ok := body["_attachments"]; ok {
+		stripped["_attachments"] = attachments
+	}
+	return stripped
+}
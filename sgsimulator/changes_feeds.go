@@ -0,0 +1,283 @@
+package sgsimulator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The options of a streaming changes feed
+type changesFeedOptions struct {
+	since         uint64
+	limit         int // The feed ends after this many changes, or never if 0
+	channelFilter []string
+	allDocs       bool
+	revocations   bool          // Whether to send the docs the user lost access to as removals
+	heartbeat     time.Duration // How often to send a heartbeat when there are no changes, or never if 0
+	timeout       time.Duration // When the feed ends, or never if 0
+}
+
+// Writes the changes of a streaming feed in the format of its feed type
+type changesFeedWriter interface {
+	writeChanges(changes []changeEntry) error
+	writeHeartbeat() error
+	writeEnd(lastSeq uint64) error
+}
+
+// Sends changes as they happen until the options' limit or timeout is reached, or the
+// client goes away
+func (h dbHandler) followChanges(ctx context.Context, u *user, options changesFeedOptions, writer changesFeedWriter) {
+
+	var heartbeat <-chan time.Time
+	if options.heartbeat > 0 {
+		ticker := time.NewTicker(options.heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	var deadline <-chan time.Time
+	if options.timeout > 0 {
+		deadline = time.After(options.timeout)
+	}
+
+	since := options.since
+	numSent := 0
+	for {
+		// Grab the notification channel before reading changes so that nothing is missed in between
+		changeNotification := h.db.changeNotification()
+
+		limit := 0
+		if options.limit > 0 {
+			limit = options.limit - numSent
+		}
+		u = h.refreshUser(u)
+		changes, lastSeq := h.db.changes(u, since, limit, options.channelFilter, options.allDocs, options.revocations)
+		if len(changes) > 0 {
+			if err := writer.writeChanges(changes); err != nil {
+				return
+			}
+			since = lastSeq
+			numSent += len(changes)
+			if options.limit > 0 && numSent >= options.limit {
+				writer.writeEnd(since)
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-changeNotification:
+		case <-heartbeat:
+			if err := writer.writeHeartbeat(); err != nil {
+				return
+			}
+		case <-deadline:
+			writer.writeEnd(since)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Unlike longpoll, a streaming feed only has a timeout if it's asked for
+func streamingChangesFeedOptions(query map[string][]string) (changesFeedOptions, error) {
+
+	get := func(key string) string {
+		if values := query[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	options := changesFeedOptions{
+		allDocs:     get("style") == "all_docs",
+		revocations: get("revocations") == "true",
+	}
+
+	var err error
+	if options.since, err = parseUintParam(strings.Trim(get("since"), `"`)); err != nil {
+		return options, newHTTPError(http.StatusBadRequest, "Invalid since")
+	}
+	limit, err := parseUintParam(get("limit"))
+	if err != nil {
+		return options, newHTTPError(http.StatusBadRequest, "Invalid limit")
+	}
+	options.limit = int(limit)
+	heartbeatMs, err := parseUintParam(get("heartbeat"))
+	if err != nil {
+		return options, newHTTPError(http.StatusBadRequest, "Invalid heartbeat")
+	}
+	options.heartbeat = time.Duration(heartbeatMs) * time.Millisecond
+	timeoutMs, err := parseUintParam(get("timeout"))
+	if err != nil {
+		return options, newHTTPError(http.StatusBadRequest, "Invalid timeout")
+	}
+	options.timeout = time.Duration(timeoutMs) * time.Millisecond
+
+	if get("filter") == "sync_gateway/bychannel" && get("channels") != "" {
+		options.channelFilter = strings.Split(get("channels"), ",")
+	}
+	return options, nil
+}
+
+// A change per line, with empty lines as heartbeats and the last_seq as the last line
+type continuousFeedWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (c continuousFeedWriter) writeChanges(changes []changeEntry) error {
+	for _, change := range changes {
+		js, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		if _, err := c.w.Write(append(js, '\n')); err != nil {
+			return err
+		}
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+func (c continuousFeedWriter) writeHeartbeat() error {
+	_, err := c.w.Write([]byte("\n"))
+	c.flusher.Flush()
+	return err
+}
+
+func (c continuousFeedWriter) writeEnd(lastSeq uint64) error {
+	_, err := fmt.Fprintf(c.w, "{\"last_seq\":\"%d\"}\n", lastSeq)
+	c.flusher.Flush()
+	return err
+}
+
+// An event per change, with comments as heartbeats
+type eventSourceFeedWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (e eventSourceFeedWriter) writeChanges(changes []changeEntry) error {
+	for _, change := range changes {
+		js, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(e.w, "id: %d\ndata: %s\n\n", change.Seq, js); err != nil {
+			return err
+		}
+	}
+	e.flusher.Flush()
+	return nil
+}
+
+func (e eventSourceFeedWriter) writeHeartbeat() error {
+	_, err := e.w.Write([]byte(":\n\n"))
+	e.flusher.Flush()
+	return err
+}
+
+func (e eventSourceFeedWriter) writeEnd(lastSeq uint64) error {
+	_, err := fmt.Fprintf(e.w, "data: {\"last_seq\":\"%d\"}\n\n", lastSeq)
+	e.flusher.Flush()
+	return err
+}
+
+// Serves feed=continuous and feed=eventsource
+func (h dbHandler) streamChanges(w http.ResponseWriter, req *http.Request, u *user, feed string) {
+
+	options, err := streamingChangesFeedOptions(req.URL.Query())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, newHTTPError(http.StatusInternalServerError, "Streaming isn't supported"))
+		return
+	}
+
+	var writer changesFeedWriter
+	if feed == "eventsource" {
+		w.Header().Set("Content-Type", "text/event-stream")
+		writer = eventSourceFeedWriter{w: w, flusher: flusher}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		writer = continuousFeedWriter{w: w, flusher: flusher}
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	h.followChanges(req.Context(), u, options, writer)
+}
+
+// A message per batch of changes, with empty batches as heartbeats
+type webSocketFeedWriter struct {
+	ws *websocket.Conn
+}
+
+func (ws webSocketFeedWriter) writeChanges(changes []changeEntry) error {
+	return ws.ws.WriteJSON(changes)
+}
+
+func (ws webSocketFeedWriter) writeHeartbeat() error {
+	return ws.ws.WriteMessage(websocket.TextMessage, []byte("[]"))
+}
+
+func (ws webSocketFeedWriter) writeEnd(lastSeq uint64) error {
+	return ws.ws.WriteMessage(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, strconv.FormatUint(lastSeq, 10)),
+	)
+}
+
+// Serves feed=websocket, whose options are sent by the client as the first message
+func (h dbHandler) webSocketChanges(w http.ResponseWriter, req *http.Request, u *user) {
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(req *http.Request) bool { return true },
+	}
+	ws, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	rawOptions := map[string]interface{}{}
+	if err := ws.ReadJSON(&rawOptions); err != nil {
+		return
+	}
+	query := map[string][]string{}
+	for key, value := range rawOptions {
+		query[key] = []string{fmt.Sprintf("%v", value)}
+	}
+	options, err := streamingChangesFeedOptions(query)
+	if err != nil {
+		ws.WriteMessage(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseUnsupportedData, asHTTPError(err).Reason),
+		)
+		return
+	}
+
+	// The client doesn't send anything else, so reading only finds out when it goes away
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	h.followChanges(ctx, u, options, webSocketFeedWriter{ws: ws})
+}
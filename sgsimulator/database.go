@@ -0,0 +1,724 @@
+package sgsimulator
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	// The wildcard channel which grants access to every channel
+	allChannels = "*"
+
+	// The name of the built-in guest user used for requests without credentials
+	guestUsername = "GUEST"
+)
+
+// An error which maps onto an HTTP status and a CouchDB style error/reason pair
+type httpError struct {
+	Status int
+	Err    string
+	Reason string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Err, e.Reason)
+}
+
+func newHTTPError(status int, reason string) *httpError {
+	errNames := map[int]string{
+		http.StatusBadRequest:   "Bad Request",
+		http.StatusUnauthorized: "Unauthorized",
+		http.StatusForbidden:    "forbidden",
+		http.StatusNotFound:     "not_found",
+		http.StatusConflict:     "conflict",
+	}
+	errName, ok := errNames[status]
+	if !ok {
+		errName = http.StatusText(status)
+	}
+	return &httpError{Status: status, Err: errName, Reason: reason}
+}
+
+// A Sync Gateway user, as created via the admin _user endpoint
+type user struct {
+	Name             string                                 `json:"name"`
+	Password         string                                 `json:"password,omitempty"`
+	AdminChannels    []string                               `json:"admin_channels"`
+	AdminRoles       []string                               `json:"admin_roles,omitempty"`
+	CollectionAccess map[string]map[string]collectionAccess `json:"collection_access,omitempty"` // Keyed by scope, then collection
+	roleChannels     []string                               // The channels the user gets from its roles, filled in when it's looked up
+}
+
+// The channels a user is granted in a collection other than the default one
+type collectionAccess struct {
+	AdminChannels []string `json:"admin_channels"`
+}
+
+// The user as seen by requests to a collection, where it only has the channels
+// it was granted in that collection
+func (u user) inCollection(scope, collection string) user {
+	u.AdminChannels = u.CollectionAccess[scope][collection].AdminChannels
+	u.roleChannels = nil
+	return u
+}
+
+// Whether this user has access to any of the given channels.  A nil user
+// represents the admin API, which can see everything.
+func (u *user) canSee(channels []string) bool {
+	if u == nil {
+		return true
+	}
+	return channelsCanSee(u.AdminChannels, channels) || channelsCanSee(u.roleChannels, channels)
+}
+
+// Whether a user with userChannels has access to any of the given channels
+func channelsCanSee(userChannels []string, channels []string) bool {
+	for _, userChannel := range userChannels {
+		if userChannel == allChannels {
+			return true
+		}
+		for _, channel := range channels {
+			if userChannel == channel {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type document struct {
+	id       string
+	revTree  revTree
+	sequence uint64 // The sequence of the most recent change to this doc
+}
+
+// A document revision as returned to a client
+type docRevision struct {
+	Body        map[string]interface{}
+	Attachments map[string][]byte // Attachment data keyed by attachment name, only when requested
+}
+
+// A single entry in the _changes feed
+type changeEntry struct {
+	Seq     uint64      `json:"seq"`
+	ID      string      `json:"id"`
+	Changes []changeRev `json:"changes"`
+	Deleted bool        `json:"deleted,omitempty"`
+	Removed []string    `json:"removed,omitempty"` // The channels the user lost access to the doc through
+	Revoked bool        `json:"revoked,omitempty"` // Whether it was removed because the user's access was revoked, as opposed to the doc leaving the channels
+}
+
+type changeRev struct {
+	Rev string `json:"rev"`
+}
+
+// A _local document, such as a replication checkpoint.  These have no revision
+// history and don't show up in the _changes feed.
+type localDocument struct {
+	rev  string // "0-N", where N goes up by one with every update
+	body map[string]interface{}
+}
+
+// An in-memory database holding documents, their revision trees, users and
+// attachments.  Safe for concurrent use.
+type database struct {
+	Name string
+
+	mutex        sync.RWMutex
+	docs         map[string]*document
+	users        map[string]*user
+	roles        map[string]*role
+	accessLog    map[uint64]accessChange   // The changes to users' channels, keyed by the sequence they were made at
+	attachments  map[string][]byte         // Attachment data keyed by digest
+	localDocs    map[string]*localDocument // Keyed by doc id, without the "_local/" prefix
+	sequenceLog  []string                  // Doc id changed at each sequence, where sequence N is at index N-1
+	changeNotify chan struct{}             // Closed (and replaced) whenever the database changes
+	sessions     map[string]*session       // Keyed by session id, which is the value of the session cookie
+}
+
+func newDatabase(name string) *database {
+	return &database{
+		Name:         name,
+		docs:         map[string]*document{},
+		users:        map[string]*user{guestUsername: {Name: guestUsername, AdminChannels: []string{allChannels}}},
+		roles:        map[string]*role{},
+		accessLog:    map[uint64]accessChange{},
+		attachments:  map[string][]byte{},
+		localDocs:    map[string]*localDocument{},
+		changeNotify: make(chan struct{}),
+		sessions:     map[string]*session{},
+	}
+}
+
+func (db *database) lastSequence() uint64 {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return uint64(len(db.sequenceLog))
+}
+
+// Creates or replaces a user.  Like Sync Gateway, an update without a password keeps
+// the user's password, and if the user's channels change, the change goes on the
+// changes feed (see accessChangeEntries).
+func (db *database) putUser(u user) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	existing, existed := db.users[u.Name]
+	if !existed {
+		db.users[u.Name] = &u
+		return
+	}
+	if u.Password == "" {
+		u.Password = existing.Password
+	}
+	before := db.userChannels(existing)
+	db.users[u.Name] = &u
+	db.logAccessChange(u.Name, before, db.userChannels(&u))
+}
+
+func (db *database) getUser(name string) (user, bool) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	u, ok := db.users[name]
+	if !ok {
+		return user{}, false
+	}
+	found := *u
+	found.roleChannels = db.roleChannels(u)
+	return found, true
+}
+
+// Returns the user for the given basic auth credentials, or the guest user if none were given
+func (db *database) authenticate(username, password string, hasAuth bool) (*user, error) {
+	if !hasAuth {
+		username = guestUsername
+	}
+	u, ok := db.getUser(username)
+	if !ok || (hasAuth && u.Password != password) {
+		return nil, newHTTPError(http.StatusUnauthorized, "Invalid login")
+	}
+	return &u, nil
+}
+
+// Returns a channel that will be closed the next time the database changes
+func (db *database) changeNotification() <-chan struct{} {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.changeNotify
+}
+
+// Stores a document revision.  With newEdits, a new revision is generated as a
+// child of the body's _rev.  Without newEdits, the body's _rev and _revisions are
+// inserted into the revision tree as-is.  Attachments marked as "follows" are
+// looked up by digest in attachmentData.
+func (db *database) putDocument(body map[string]interface{}, newEdits bool, attachmentData map[string][]byte) (docid, revid string, err error) {
+
+	docid, _ = body["_id"].(string)
+	if docid == "" {
+		if !newEdits {
+			return "", "", newHTTPError(http.StatusBadRequest, "Missing doc id")
+		}
+		docid = newDocID()
+	}
+	parentRevID, _ := body["_rev"].(string)
+	deleted, _ := body["_deleted"].(bool)
+	channels := channelsFromBody(body)
+	strippedBody := stripSpecialProperties(body)
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	doc, ok := db.docs[docid]
+	if !ok {
+		doc = &document{id: docid, revTree: revTree{}}
+	}
+
+	var history []string
+
+	switch newEdits {
+	case true:
+		if parentRevID == "" {
+			if winner := doc.revTree.winningRev(); winner != nil && !winner.deleted {
+				return docid, "", newHTTPError(http.StatusConflict, "Document exists")
+			} else if winner != nil {
+				parentRevID = winner.id
+			}
+		} else if !containsString(doc.revTree.leaves(), parentRevID) {
+			return docid, "", newHTTPError(http.StatusConflict, "Document revision conflict")
+		}
+		generation, _ := parseRevID(parentRevID)
+		revid = createRevID(generation+1, parentRevID, strippedBody)
+		history = append([]string{revid}, doc.revTree.history(parentRevID)...)
+	default:
+		if parentRevID == "" {
+			return docid, "", newHTTPError(http.StatusBadRequest, "Missing _rev with new_edits=false")
+		}
+		revid = parentRevID
+		history, err = historyFromBody(body, revid)
+		if err != nil {
+			return docid, "", err
+		}
+	}
+
+	if doc.revTree.contains(revid) {
+		return docid, revid, nil
+	}
+
+	generation, _ := parseRevID(revid)
+	attachments, err := db.storeAttachments(body, doc.revTree, history, generation, attachmentData)
+	if err != nil {
+		return docid, "", err
+	}
+	if len(attachments) > 0 {
+		strippedBody["_attachments"] = attachments
+	}
+
+	doc.revTree.addRevision(history, deleted, channels, strippedBody)
+	db.docs[docid] = doc
+
+	db.sequenceLog = append(db.sequenceLog, docid)
+	doc.sequence = uint64(len(db.sequenceLog))
+	db.notifyChange()
+
+	return docid, revid, nil
+}
+
+// Returns a document revision as the given user would see it.  An empty revid
+// returns the current winning revision.
+func (db *database) getRevision(u *user, docid, revid string, includeRevisions, includeAttachments bool) (docRevision, error) {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	doc, ok := db.docs[docid]
+	if !ok {
+		return docRevision{}, newHTTPError(http.StatusNotFound, "missing")
+	}
+
+	var rev *revInfo
+	if revid == "" {
+		rev = doc.revTree.winningRev()
+	} else {
+		rev = doc.revTree[revid]
+	}
+	if rev == nil || rev.body == nil {
+		return docRevision{}, newHTTPError(http.StatusNotFound, "missing")
+	}
+
+	if !u.canSee(rev.channels) {
+		return docRevision{}, newHTTPError(http.StatusForbidden, "forbidden")
+	}
+
+	result := docRevision{Body: map[string]interface{}{}}
+	for key, value := range rev.body {
+		result.Body[key] = value
+	}
+	result.Body["_id"] = docid
+	result.Body["_rev"] = rev.id
+	if rev.deleted {
+		result.Body["_deleted"] = true
+	}
+
+	if includeRevisions {
+		history := doc.revTree.history(rev.id)
+		generation, _ := parseRevID(rev.id)
+		ids := make([]string, 0, len(history))
+		for _, ancestor := range history {
+			_, digest := parseRevID(ancestor)
+			ids = append(ids, digest)
+		}
+		result.Body["_revisions"] = map[string]interface{}{
+			"start": generation,
+			"ids":   ids,
+		}
+	}
+
+	if attachments, ok := rev.body["_attachments"].(map[string]attachmentMeta); ok {
+		metas := map[string]attachmentMeta{}
+		for name, meta := range attachments {
+			if includeAttachments {
+				if result.Attachments == nil {
+					result.Attachments = map[string][]byte{}
+				}
+				result.Attachments[name] = db.attachments[meta.Digest]
+				meta.Stub = false
+				meta.Follows = true
+			}
+			metas[name] = meta
+		}
+		result.Body["_attachments"] = metas
+	}
+
+	return result, nil
+}
+
+// Turns the attachments of the revision back into stubs if the client already has them,
+// which it does if they were added no later than the newest of the attsSince revisions
+// that the doc has
+func (db *database) stubAttachmentsSince(docRev *docRevision, docid string, attsSince []string) {
+
+	db.mutex.RLock()
+	knownGeneration := 0
+	if doc, ok := db.docs[docid]; ok {
+		for _, revid := range attsSince {
+			generation, _ := parseRevID(revid)
+			if doc.revTree.contains(revid) && generation > knownGeneration {
+				knownGeneration = generation
+			}
+		}
+	}
+	db.mutex.RUnlock()
+
+	metas, _ := docRev.Body["_attachments"].(map[string]attachmentMeta)
+	for name, meta := range metas {
+		if meta.RevPos > knownGeneration {
+			continue
+		}
+		meta.Stub = true
+		meta.Follows = false
+		metas[name] = meta
+		delete(docRev.Attachments, name)
+	}
+}
+
+// Returns the changes visible to the user since the given sequence, one entry per doc
+// at its most recent sequence.  If channelFilter is non-empty, only docs in those
+// channels are returned.  With allDocs, every leaf revision is listed rather than
+// only the winner.  With revocations, the docs the user lost access to are listed as
+// removals (see accessChangeEntries).
+func (db *database) changes(u *user, since uint64, limit int, channelFilter []string, allDocs, revocations bool) (changes []changeEntry, lastSeq uint64) {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	changes = []changeEntry{}
+	lastSeq = since
+
+	for seq := since + 1; seq <= uint64(len(db.sequenceLog)); seq++ {
+
+		if limit > 0 && len(changes) >= limit {
+			break
+		}
+
+		if access, ok := db.accessLog[seq]; ok {
+			if u != nil && access.username == u.Name {
+				accessEntries := db.accessChangeEntries(u, seq, since, access, channelFilter, revocations)
+				if len(accessEntries) > 0 {
+					changes = append(changes, accessEntries...)
+					lastSeq = seq
+				}
+			}
+			continue
+		}
+
+		doc := db.docs[db.sequenceLog[seq-1]]
+		if doc == nil || doc.sequence != seq {
+			// doc has been purged, or changed again at a later sequence
+			continue
+		}
+
+		winner := doc.revTree.winningRev()
+		if !u.canSee(winner.channels) {
+			continue
+		}
+		if len(channelFilter) > 0 && !intersects(channelFilter, winner.channels) {
+			continue
+		}
+
+		entry := changeEntry{
+			Seq:     seq,
+			ID:      doc.id,
+			Deleted: winner.deleted,
+			Changes: []changeRev{{Rev: winner.id}},
+		}
+		if allDocs {
+			for _, leaf := range doc.revTree.sortedLeaves()[1:] {
+				entry.Changes = append(entry.Changes, changeRev{Rev: leaf})
+			}
+		}
+		changes = append(changes, entry)
+		lastSeq = seq
+	}
+
+	return changes, lastSeq
+}
+
+// The status of a revision that a client proposes to push, as in a BLIP proposeChanges
+// request: 0 if the client should send it, http.StatusNotModified if the database
+// already has it, or http.StatusConflict if it isn't a child of the current revision
+func (db *database) proposeRevision(docid, revid, parentRevID string) int {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	doc, ok := db.docs[docid]
+	if !ok {
+		if parentRevID == "" {
+			return 0
+		}
+		return http.StatusConflict
+	}
+
+	if doc.revTree.contains(revid) {
+		return http.StatusNotModified
+	}
+	winner := doc.revTree.winningRev()
+	if winner.id == parentRevID || (parentRevID == "" && winner.deleted) {
+		return 0
+	}
+	return http.StatusConflict
+}
+
+// Returns the revisions of each doc which aren't in its revision tree, as in a
+// _revs_diff request.  Docs that have all the revisions are left out.
+func (db *database) revsDiff(revs map[string][]string) map[string][]string {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	missing := map[string][]string{}
+	for docid, revids := range revs {
+		doc := db.docs[docid]
+		for _, revid := range revids {
+			if doc == nil || !doc.revTree.contains(revid) {
+				missing[docid] = append(missing[docid], revid)
+			}
+		}
+	}
+	return missing
+}
+
+// Removes a doc and all its revisions, including its tombstone, as if it had never
+// existed.  Returns false if there's no such doc.
+func (db *database) purgeDocument(docid string) bool {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ok := db.docs[docid]; !ok {
+		return false
+	}
+	delete(db.docs, docid)
+	return true
+}
+
+// Returns the attachment data with the given digest
+func (db *database) getAttachment(digest string) ([]byte, bool) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	data, ok := db.attachments[digest]
+	return data, ok
+}
+
+// Returns a _local document, with its _id and _rev.  The docid doesn't include the "_local/" prefix.
+func (db *database) getLocalDocument(docid string) (map[string]interface{}, error) {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	localDoc, ok := db.localDocs[docid]
+	if !ok {
+		return nil, newHTTPError(http.StatusNotFound, "missing")
+	}
+
+	body := map[string]interface{}{}
+	for key, value := range localDoc.body {
+		body[key] = value
+	}
+	body["_id"] = "_local/" + docid
+	body["_rev"] = localDoc.rev
+	return body, nil
+}
+
+// Creates or updates a _local document, and returns its new revision.  To update it,
+// the body's _rev must be the current revision.
+func (db *database) putLocalDocument(docid string, body map[string]interface{}) (revid string, err error) {
+
+	parentRevID, _ := body["_rev"].(string)
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	generation := 0
+	if localDoc, ok := db.localDocs[docid]; ok {
+		if parentRevID != localDoc.rev {
+			return "", newHTTPError(http.StatusConflict, "Document revision conflict")
+		}
+		fmt.Sscanf(localDoc.rev, "0-%d", &generation)
+	} else if parentRevID != "" {
+		return "", newHTTPError(http.StatusNotFound, "missing")
+	}
+
+	revid = fmt.Sprintf("0-%d", generation+1)
+	db.localDocs[docid] = &localDocument{
+		rev:  revid,
+		body: stripSpecialProperties(body),
+	}
+	return revid, nil
+}
+
+// Must be called with the write lock held
+func (db *database) notifyChange() {
+	close(db.changeNotify)
+	db.changeNotify = make(chan struct{})
+}
+
+type attachmentMeta struct {
+	ContentType string `json:"content_type,omitempty"`
+	Digest      string `json:"digest"`
+	Length      int    `json:"length"`
+	RevPos      int    `json:"revpos"`
+	Stub        bool   `json:"stub,omitempty"`
+	Follows     bool   `json:"follows,omitempty"`
+}
+
+// Stores the data of any new attachments in the body, and returns the
+// attachment metadata (as stubs) to keep with the revision.  Must be called
+// with the write lock held.
+func (db *database) storeAttachments(body map[string]interface{}, tree revTree, history []string, generation int, attachmentData map[string][]byte) (map[string]attachmentMeta, error) {
+
+	rawAttachments, ok := body["_attachments"].(map[string]interface{})
+	if !ok || len(rawAttachments) == 0 {
+		return nil, nil
+	}
+
+	// Attachment stubs refer to attachments on the closest ancestor that is still in memory
+	var parentAttachments map[string]attachmentMeta
+	for _, ancestor := range history[1:] {
+		if rev, ok := tree[ancestor]; ok && rev.body != nil {
+			parentAttachments, _ = rev.body["_attachments"].(map[string]attachmentMeta)
+			break
+		}
+	}
+
+	attachments := map[string]attachmentMeta{}
+	for name, rawMeta := range rawAttachments {
+		metaMap, ok := rawMeta.(map[string]interface{})
+		if !ok {
+			return nil, newHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid attachment %q", name))
+		}
+
+		meta := attachmentMeta{RevPos: generation, Stub: true}
+		meta.ContentType, _ = metaMap["content_type"].(string)
+		digest, _ := metaMap["digest"].(string)
+
+		var data []byte
+		switch {
+		case metaMap["stub"] == true:
+			parentMeta, ok := parentAttachments[name]
+			if !ok {
+				return nil, newHTTPError(http.StatusBadRequest, fmt.Sprintf("Unknown attachment stub %q", name))
+			}
+			attachments[name] = parentMeta
+			continue
+		case metaMap["follows"] == true:
+			data, ok = attachmentData[digest]
+			if !ok {
+				return nil, newHTTPError(http.StatusBadRequest, fmt.Sprintf("Missing data for attachment %q", name))
+			}
+		default:
+			encoded, _ := metaMap["data"].(string)
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, newHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid data for attachment %q", name))
+			}
+			data = decoded
+		}
+
+		meta.Digest = sha1DigestKey(data)
+		meta.Length = len(data)
+		db.attachments[meta.Digest] = data
+		attachments[name] = meta
+	}
+
+	return attachments, nil
+}
+
+// Builds the revision history (newest first) from the body's _revisions property,
+// falling back to just the revision itself when _revisions is absent
+func historyFromBody(body map[string]interface{}, revid string) ([]string, error) {
+	revisions, ok := body["_revisions"].(map[string]interface{})
+	if !ok {
+		return []string{revid}, nil
+	}
+	start, ok := revisions["start"].(float64)
+	rawIds, idsOk := revisions["ids"].([]interface{})
+	if !ok || !idsOk || len(rawIds) == 0 {
+		return nil, newHTTPError(http.StatusBadRequest, "Invalid _revisions")
+	}
+	ids := make([]string, 0, len(rawIds))
+	for _, rawId := range rawIds {
+		id, ok := rawId.(string)
+		if !ok {
+			return nil, newHTTPError(http.StatusBadRequest, "Invalid _revisions")
+		}
+		ids = append(ids, id)
+	}
+	history := expandRevisions(int(start), ids)
+	if history[0] != revid {
+		return nil, newHTTPError(http.StatusBadRequest, "_rev does not match _revisions")
+	}
+	return history, nil
+}
+
+// The channels a doc is assigned to by the default sync function, ie the "channels" property
+func channelsFromBody(body map[string]interface{}) []string {
+	switch channels := body["channels"].(type) {
+	case string:
+		return []string{channels}
+	case []interface{}:
+		result := make([]string, 0, len(channels))
+		for _, channel := range channels {
+			if channelName, ok := channel.(string); ok {
+				result = append(result, channelName)
+			}
+		}
+		return result
+	case []string:
+		return channels
+	}
+	return []string{}
+}
+
+func stripSpecialProperties(body map[string]interface{}) map[string]interface{} {
+	stripped := map[string]interface{}{}
+	for key, value := range body {
+		if key == "" || key[0] != '_' {
+			stripped[key] = value
+		}
+	}
+	return stripped
+}
+
+func sha1DigestKey(data []byte) string {
+	digester := sha1.New()
+	digester.Write(data)
+	return "sha1-" + base64.StdEncoding.EncodeToString(digester.Sum(nil))
+}
+
+func newDocID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+func intersects(a, b []string) bool {
+	for _, s := range a {
+		if containsString(b, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,286 @@
+package sgsimulator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWinningRev(t *testing.T) {
+
+	tree := revTree{}
+	tree.addRevision([]string{"2-aaa", "1-abc"}, false, nil, map[string]interface{}{})
+	tree.addRevision([]string{"2-bbb", "1-abc"}, false, nil, map[string]interface{}{})
+	tree.addRevision([]string{"3-ccc", "2-aaa", "1-abc"}, true, nil, map[string]interface{}{})
+
+	if len(tree.leaves()) != 2 {
+		t.Fatalf("Expected 2 leaves, got %v", tree.leaves())
+	}
+
+	// The deleted 3-ccc branch loses to the live 2-bbb branch
+	if winner := tree.winningRev(); winner.id != "2-bbb" {
+		t.Fatalf("Expected 2-bbb to win, got %v", winner.id)
+	}
+
+	if history := tree.history("3-ccc"); len(history) != 3 || history[2] != "1-abc" {
+		t.Fatalf("Unexpected history: %v", history)
+	}
+
+}
+
+func TestPutDocumentNewEditsFalse(t *testing.T) {
+
+	db := newDatabase("db")
+
+	_, rev1, err := db.putDocument(map[string]interface{}{"_id": "doc1", "channels": []interface{}{"ABC"}}, true, nil)
+	if err != nil {
+		t.Fatalf("Error creating doc: %v", err)
+	}
+	_, rev1Digest := parseRevID(rev1)
+
+	update := map[string]interface{}{
+		"_id":        "doc1",
+		"_rev":       "3-ccc",
+		"_revisions": map[string]interface{}{"start": float64(3), "ids": []interface{}{"ccc", "bbb", rev1Digest}},
+		"channels":   []interface{}{"ABC"},
+	}
+	if _, _, err := db.putDocument(update, false, nil); err != nil {
+		t.Fatalf("Error updating doc: %v", err)
+	}
+
+	abcUser := &user{Name: "abc", AdminChannels: []string{"ABC"}}
+	changes, lastSeq := db.changes(abcUser, 0, 0, nil, false, false)
+	if len(changes) != 1 || changes[0].Changes[0].Rev != "3-ccc" {
+		t.Fatalf("Unexpected changes: %+v", changes)
+	}
+	if lastSeq != 2 {
+		t.Fatalf("Expected last seq 2, got %d", lastSeq)
+	}
+
+	cbsUser := &user{Name: "cbs", AdminChannels: []string{"CBS"}}
+	if changes, _ := db.changes(cbsUser, 0, 0, nil, false, false); len(changes) != 0 {
+		t.Fatalf("Expected no changes visible in channel CBS, got %+v", changes)
+	}
+
+	docRev, err := db.getRevision(abcUser, "doc1", "3-ccc", true, false)
+	if err != nil {
+		t.Fatalf("Error getting doc: %v", err)
+	}
+	revisions := docRev.Body["_revisions"].(map[string]interface{})
+	if len(revisions["ids"].([]string)) != 3 {
+		t.Fatalf("Unexpected _revisions: %v", revisions)
+	}
+
+	if _, err := db.getRevision(cbsUser, "doc1", "", false, false); err == nil {
+		t.Fatalf("Expected error getting doc without channel access")
+	}
+
+}
+
+func TestProposeRevisionAndLocalDocuments(t *testing.T) {
+
+	db := newDatabase("db")
+
+	_, rev1, err := db.putDocument(map[string]interface{}{"_id": "doc1"}, true, nil)
+	if err != nil {
+		t.Fatalf("Error creating doc: %v", err)
+	}
+
+	if status := db.proposeRevision("doc2", "1-abc", ""); status != 0 {
+		t.Fatalf("Expected new doc to be wanted, got %d", status)
+	}
+	if status := db.proposeRevision("doc1", "2-abc", rev1); status != 0 {
+		t.Fatalf("Expected update of current rev to be wanted, got %d", status)
+	}
+	if status := db.proposeRevision("doc1", rev1, ""); status != 304 {
+		t.Fatalf("Expected known rev to be 304, got %d", status)
+	}
+	if status := db.proposeRevision("doc1", "2-abc", "1-other"); status != 409 {
+		t.Fatalf("Expected update of non-current rev to be 409, got %d", status)
+	}
+
+	localRev, err := db.putLocalDocument("checkpoint", map[string]interface{}{"remote": "5"})
+	if err != nil || localRev != "0-1" {
+		t.Fatalf("Error creating local doc: %v, %v", localRev, err)
+	}
+	if _, err := db.putLocalDocument("checkpoint", map[string]interface{}{"remote": "6"}); err == nil {
+		t.Fatalf("Expected conflict updating local doc without its _rev")
+	}
+	if _, err := db.putLocalDocument("checkpoint", map[string]interface{}{"_rev": localRev, "remote": "6"}); err != nil {
+		t.Fatalf("Error updating local doc: %v", err)
+	}
+	localDoc, err := db.getLocalDocument("checkpoint")
+	if err != nil || localDoc["remote"] != "6" || localDoc["_rev"] != "0-2" || localDoc["_id"] != "_local/checkpoint" {
+		t.Fatalf("Unexpected local doc: %v, %v", localDoc, err)
+	}
+
+}
+
+func TestSessions(t *testing.T) {
+
+	db := newDatabase("db")
+	db.putUser(user{Name: "alice", Password: "password"})
+
+	id, err := db.createSession("alice", time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating session: %v", err)
+	}
+	if u, err := db.sessionUser(id); err != nil || u.Name != "alice" {
+		t.Fatalf("Expected session to be alice's, got %v, %v", u, err)
+	}
+
+	// Expired, unknown and deleted sessions are rejected
+	expired, _ := db.createSession("alice", -time.Second)
+	if _, err := db.sessionUser(expired); err == nil {
+		t.Fatalf("Expected expired session to be rejected")
+	}
+	if _, err := db.sessionUser("unknown"); err == nil {
+		t.Fatalf("Expected unknown session to be rejected")
+	}
+	if numDeleted := db.deleteSessions("alice"); numDeleted != 2 {
+		t.Fatalf("Expected to delete 2 sessions, deleted %d", numDeleted)
+	}
+	if _, err := db.sessionUser(id); err == nil {
+		t.Fatalf("Expected deleted session to be rejected")
+	}
+
+}
+
+func TestDeleteAndPurgeDocument(t *testing.T) {
+
+	db := newDatabase("db")
+
+	_, rev1, err := db.putDocument(map[string]interface{}{"_id": "doc1", "channels": []interface{}{"ABC"}}, true, nil)
+	if err != nil {
+		t.Fatalf("Error creating doc: %v", err)
+	}
+	tombstone := map[string]interface{}{"_id": "doc1", "_rev": rev1, "_deleted": true, "channels": []interface{}{"ABC"}}
+	if _, _, err := db.putDocument(tombstone, true, nil); err != nil {
+		t.Fatalf("Error deleting doc: %v", err)
+	}
+
+	// The tombstone stays in the doc's channel
+	abcUser := &user{Name: "abc", AdminChannels: []string{"ABC"}}
+	changes, _ := db.changes(abcUser, 0, 0, nil, false, false)
+	if len(changes) != 1 || !changes[0].Deleted {
+		t.Fatalf("Expected the tombstone on the changes feed, got %+v", changes)
+	}
+
+	if !db.purgeDocument("doc1") || db.purgeDocument("doc1") {
+		t.Fatalf("Expected the doc to be purged once")
+	}
+	if changes, _ := db.changes(abcUser, 0, 0, nil, false, false); len(changes) != 0 {
+		t.Fatalf("Expected no changes after purging, got %+v", changes)
+	}
+
+}
+
+func TestStubAttachmentsSince(t *testing.T) {
+
+	db := newDatabase("db")
+
+	doc := map[string]interface{}{
+		"_id":          "doc1",
+		"channels":     []interface{}{"ABC"},
+		"_attachments": map[string]interface{}{"first": map[string]interface{}{"data": "Zmlyc3Q="}},
+	}
+	_, rev1, err := db.putDocument(doc, true, nil)
+	if err != nil {
+		t.Fatalf("Error creating doc: %v", err)
+	}
+	update := map[string]interface{}{
+		"_id":      "doc1",
+		"_rev":     rev1,
+		"channels": []interface{}{"ABC"},
+		"_attachments": map[string]interface{}{
+			"first":  map[string]interface{}{"stub": true},
+			"second": map[string]interface{}{"data": "c2Vjb25k"},
+		},
+	}
+	_, rev2, err := db.putDocument(update, true, nil)
+	if err != nil {
+		t.Fatalf("Error updating doc: %v", err)
+	}
+
+	abcUser := &user{Name: "abc", AdminChannels: []string{"ABC"}}
+	docRev, err := db.getRevision(abcUser, "doc1", rev2, true, true)
+	if err != nil || len(docRev.Attachments) != 2 {
+		t.Fatalf("Expected both attachments, got %+v, %v", docRev, err)
+	}
+
+	// A client that has the first revision only needs the attachment added since
+	db.stubAttachmentsSince(&docRev, "doc1", []string{rev1, "5-unknown"})
+	if _, ok := docRev.Attachments["second"]; !ok || len(docRev.Attachments) != 1 {
+		t.Fatalf("Expected only the second attachment, got %v", docRev.Attachments)
+	}
+	metas := docRev.Body["_attachments"].(map[string]attachmentMeta)
+	if !metas["first"].Stub || metas["first"].Follows || metas["second"].Stub {
+		t.Fatalf("Unexpected attachment metadata: %+v", metas)
+	}
+
+}
+
+func TestAccessGrantsAndRevocations(t *testing.T) {
+
+	db := newDatabase("db")
+	for _, doc := range []map[string]interface{}{
+		{"_id": "inB", "channels": []interface{}{"B"}},
+		{"_id": "inA", "channels": []interface{}{"A"}},
+		{"_id": "inAB", "channels": []interface{}{"A", "B"}},
+	} {
+		if _, _, err := db.putDocument(doc, true, nil); err != nil {
+			t.Fatalf("Error creating doc: %v", err)
+		}
+	}
+
+	db.putUser(user{Name: "reader", Password: "pass", AdminChannels: []string{"A"}})
+	userNow := func() *user {
+		u, _ := db.getUser("reader")
+		return &u
+	}
+	changes, since := db.changes(userNow(), 0, 0, nil, false, false)
+	if len(changes) != 2 || since != 3 {
+		t.Fatalf("Expected inA and inAB up to seq 3, got %+v up to %d", changes, since)
+	}
+
+	// Granting B backfills the doc that's only in B, at the sequence of the grant
+	db.putUser(user{Name: "reader", AdminChannels: []string{"A", "B"}})
+	changes, since = db.changes(userNow(), since, 0, nil, false, false)
+	if len(changes) != 1 || changes[0].ID != "inB" || changes[0].Seq != 4 || len(changes[0].Removed) != 0 {
+		t.Fatalf("Expected inB to be backfilled at seq 4, got %+v", changes)
+	}
+	if _, err := db.authenticate("reader", "pass", true); err != nil {
+		t.Fatalf("Expected the user to keep its password, got %v", err)
+	}
+
+	// Revoking A removes the doc that's only in A, but not the one that's in B too, as
+	// long as the feed asks for revocations
+	db.putUser(user{Name: "reader", AdminChannels: []string{"B"}, AdminRoles: []string{"hasC"}})
+	if changes, _ := db.changes(userNow(), since, 0, nil, false, false); len(changes) != 0 {
+		t.Fatalf("Expected no removals without revocations, got %+v", changes)
+	}
+	changes, since = db.changes(userNow(), since, 0, nil, false, true)
+	if len(changes) != 1 || changes[0].ID != "inA" || !changes[0].Revoked || len(changes[0].Removed) != 1 || changes[0].Removed[0] != "A" {
+		t.Fatalf("Expected inA to be removed from channel A, got %+v", changes)
+	}
+
+	// A role grants its channels to the users that have it, once the role exists
+	if _, _, err := db.putDocument(map[string]interface{}{"_id": "inC", "channels": []interface{}{"C"}}, true, nil); err != nil {
+		t.Fatalf("Error creating doc: %v", err)
+	}
+	if changes, _ := db.changes(userNow(), since, 0, nil, false, false); len(changes) != 0 {
+		t.Fatalf("Expected no changes before the role exists, got %+v", changes)
+	}
+	db.putRole(role{Name: "hasC", AdminChannels: []string{"C"}})
+	if all := userNow().allChannels(); len(all) != 2 || all[0] != "B" || all[1] != "C" {
+		t.Fatalf("Expected the user to have channels B and C, got %v", all)
+	}
+	if changes, _ := db.changes(userNow(), since, 0, nil, false, false); len(changes) != 1 || changes[0].ID != "inC" {
+		t.Fatalf("Expected inC through the role, got %+v", changes)
+	}
+
+	// The feeds of other users don't see the access changes
+	if changes, _ := db.changes(&user{Name: "other", AdminChannels: []string{"A"}}, 3, 0, nil, false, false); len(changes) != 0 {
+		t.Fatalf("Expected no changes for another user, got %+v", changes)
+	}
+
+}
@@ -0,0 +1,242 @@
+package sgsimulator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Applies to every endpoint that does not have its own entry in FaultConfig.Endpoints
+	EndpointDefault = "*"
+
+	EndpointBulkDocs = "_bulk_docs"
+	EndpointBulkGet  = "_bulk_get"
+	EndpointChanges  = "_changes"
+	EndpointUser     = "_user"
+	EndpointRole     = "_role"
+	EndpointSession  = "_session"
+	EndpointPurge    = "_purge"
+	EndpointRevsDiff = "_revs_diff"
+	EndpointLocal    = "_local" // _local doc (eg, checkpoint) GET and PUT
+	EndpointDoc      = "doc"    // Single doc GET and PUT
+	EndpointDbInfo   = "db"
+	EndpointBlipSync = "_blipsync" // Faults only apply to the WebSocket handshake
+)
+
+// Describes which faults the simulator should inject, per endpoint.  Loaded
+// from a JSON file, eg:
+//
+//	{
+//	  "seed": 42,
+//	  "endpoints": {
+//	    "_bulk_docs": {"error_rate": 0.1, "doc_error_rate": 0.05},
+//	    "_changes": {"stuck_rate": 0.01, "latency": {"distribution": "exponential", "mean_ms": 50}}
+//	  }
+//	}
+type FaultConfig struct {
+	Seed      int64                     `json:"seed"`      // Seeds the random decisions about which requests get faults, so runs are repeatable
+	Endpoints map[string]EndpointFaults `json:"endpoints"` // Keyed by endpoint, eg "_bulk_docs", or "*" for all other endpoints
+}
+
+type EndpointFaults struct {
+	Latency *LatencyDistribution `json:"latency,omitempty"` // Delay added before the request is handled
+
+	ErrorRate   float64 `json:"error_rate"`   // Fraction of requests that fail with ErrorStatus
+	ErrorStatus int     `json:"error_status"` // Defaults to 503
+	MaxErrors   int     `json:"max_errors"`   // Stop injecting errors after this many.  0 means no maximum
+
+	ResetRate float64 `json:"reset_rate"` // Fraction of requests where the connection is reset without a response
+	MaxResets int     `json:"max_resets"` // Stop resetting connections after this many.  0 means no maximum
+
+	StuckRate       float64 `json:"stuck_rate"`        // Fraction of requests that never get a response, like a stuck longpoll _changes feed
+	StuckDurationMs int     `json:"stuck_duration_ms"` // How long a stuck request hangs.  0 means until the client gives up
+	MaxStuck        int     `json:"max_stuck"`         // Stop sticking requests after this many.  0 means no maximum
+
+	DocErrorRate   float64 `json:"doc_error_rate"`   // _bulk_docs only: fraction of docs rejected with an embedded error/reason in a 201 response
+	DocErrorStatus int     `json:"doc_error_status"` // Defaults to 503
+	MaxDocErrors   int     `json:"max_doc_errors"`   // Stop rejecting docs after this many.  0 means no maximum
+}
+
+type LatencyDistribution struct {
+	Distribution string  `json:"distribution"` // "fixed", "uniform", "normal" or "exponential"
+	FixedMs      float64 `json:"fixed_ms"`     // fixed
+	MinMs        float64 `json:"min_ms"`       // uniform, and the lower bound for normal and exponential
+	MaxMs        float64 `json:"max_ms"`       // uniform, and the upper bound (if > 0) for normal and exponential
+	MeanMs       float64 `json:"mean_ms"`      // normal, exponential
+	StdDevMs     float64 `json:"stddev_ms"`    // normal
+}
+
+func LoadFaultConfig(path string) (FaultConfig, error) {
+	config := FaultConfig{}
+	configBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(configBytes, &config)
+	return config, err
+}
+
+// Decides which requests get which faults.  Safe for concurrent use.
+type faultInjector struct {
+	config FaultConfig
+
+	mutex  sync.Mutex
+	rng    *rand.Rand
+	counts map[string]map[string]int // Number of faults injected, keyed by endpoint then fault type
+}
+
+func newFaultInjector(config FaultConfig) *faultInjector {
+	return &faultInjector{
+		config: config,
+		rng:    rand.New(rand.NewSource(config.Seed)),
+		counts: map[string]map[string]int{},
+	}
+}
+
+func (f *faultInjector) faultsFor(endpoint string) (EndpointFaults, bool) {
+	if f == nil {
+		return EndpointFaults{}, false
+	}
+	faults, ok := f.config.Endpoints[endpoint]
+	if !ok {
+		faults, ok = f.config.Endpoints[EndpointDefault]
+	}
+	return faults, ok
+}
+
+// Rolls the dice for a fault with the given rate, and records it if it was injected
+func (f *faultInjector) roll(endpoint, faultType string, rate float64, max int) bool {
+	if rate <= 0 {
+		return false
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.counts[endpoint] == nil {
+		f.counts[endpoint] = map[string]int{}
+	}
+	if max > 0 && f.counts[endpoint][faultType] >= max {
+		return false
+	}
+	if f.rng.Float64() >= rate {
+		return false
+	}
+	f.counts[endpoint][faultType]++
+	return true
+}
+
+func (f *faultInjector) latency(dist *LatencyDistribution) time.Duration {
+	if dist == nil {
+		return 0
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var ms float64
+	switch dist.Distribution {
+	case "uniform":
+		ms = dist.MinMs + f.rng.Float64()*(dist.MaxMs-dist.MinMs)
+	case "normal":
+		ms = f.rng.NormFloat64()*dist.StdDevMs + dist.MeanMs
+	case "exponential":
+		ms = dist.MinMs + f.rng.ExpFloat64()*dist.MeanMs
+	default:
+		ms = dist.FixedMs
+	}
+	ms = math.Max(ms, dist.MinMs)
+	if dist.MaxMs > 0 {
+		ms = math.Min(ms, dist.MaxMs)
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// Whether a doc in a _bulk_docs request should be rejected, and with which status
+func (f *faultInjector) docError(endpoint string) (int, bool) {
+	faults, ok := f.faultsFor(endpoint)
+	if !ok || !f.roll(endpoint, "doc_error", faults.DocErrorRate, faults.MaxDocErrors) {
+		return 0, false
+	}
+	return statusOrDefault(faults.DocErrorStatus), true
+}
+
+// Returns the number of faults of the given type injected so far on the endpoint
+func (f *faultInjector) count(endpoint, faultType string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.counts[endpoint][faultType]
+}
+
+// Wraps an endpoint handler with latency, error, connection reset and stuck request faults
+func (f *faultInjector) wrap(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+
+		faults, ok := f.faultsFor(endpoint)
+		if !ok {
+			handler(w, req)
+			return
+		}
+
+		if delay := f.latency(faults.Latency); delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-req.Context().Done():
+				return
+			}
+		}
+
+		if f.roll(endpoint, "reset", faults.ResetRate, faults.MaxResets) {
+			resetConnection(w)
+			return
+		}
+
+		if f.roll(endpoint, "stuck", faults.StuckRate, faults.MaxStuck) {
+			var stuckUntil <-chan time.Time
+			if faults.StuckDurationMs > 0 {
+				stuckUntil = time.After(time.Duration(faults.StuckDurationMs) * time.Millisecond)
+			}
+			select {
+			case <-stuckUntil:
+			case <-req.Context().Done():
+			}
+			resetConnection(w)
+			return
+		}
+
+		if f.roll(endpoint, "error", faults.ErrorRate, faults.MaxErrors) {
+			status := statusOrDefault(faults.ErrorStatus)
+			writeError(w, &httpError{Status: status, Err: http.StatusText(status), Reason: "Injected fault"})
+			return
+		}
+
+		handler(w, req)
+	}
+}
+
+// Drop the connection without writing a response.  Setting linger to 0 makes
+// the close send a TCP RST, so the client sees "connection reset by peer".
+func resetConnection(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func statusOrDefault(status int) int {
+	if status == 0 {
+		return http.StatusServiceUnavailable
+	}
+	return status
+}
@@ -0,0 +1,640 @@
+package sgsimulator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// How long a longpoll _changes request waits for new changes when no timeout is given
+	defaultLongpollTimeout = 5 * time.Minute
+)
+
+// Serves the database endpoints for either the public or the admin API
+type dbHandler struct {
+	db         *database
+	users      *database     // Where users and sessions are kept: the database of the default collection
+	scope      string        // If db is a collection other than the default one, its scope
+	collection string        // and its name, which the user's channel grants are looked up under
+	admin      bool          // Admin requests skip authentication and can see every channel
+	settings   *liveSettings // The faults and the token provider, which can change while serving
+	sessionTTL time.Duration // How long the sessions created by logging in last
+}
+
+func HomeHandler(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte("Sync Gateway Simulator\n"))
+}
+
+// Returns the user making the request, or nil for admin requests.  Like Sync Gateway,
+// a bearer token is tried first, then the session cookie, then basic auth.
+func (h dbHandler) requestUser(req *http.Request) (*user, error) {
+	if h.admin {
+		return nil, nil
+	}
+	u, err := h.authenticatedUser(req)
+	if err != nil || h.collection == "" {
+		return u, err
+	}
+	collectionUser := u.inCollection(h.scope, h.collection)
+	return &collectionUser, nil
+}
+
+// The user as it is now, for changes feeds that outlive a change to its channels
+func (h dbHandler) refreshUser(u *user) *user {
+	if u == nil {
+		return nil
+	}
+	current, ok := h.users.getUser(u.Name)
+	if !ok {
+		return u
+	}
+	if h.collection != "" {
+		current = current.inCollection(h.scope, h.collection)
+	}
+	return &current
+}
+
+func (h dbHandler) authenticatedUser(req *http.Request) (*user, error) {
+	if token := bearerToken(req); token != "" {
+		return h.tokenUser(token)
+	}
+	if cookie, err := req.Cookie(SessionCookieName); err == nil {
+		return h.users.sessionUser(cookie.Value)
+	}
+	username, password, hasAuth := req.BasicAuth()
+	return h.users.authenticate(username, password, hasAuth)
+}
+
+func (h dbHandler) DbInfoHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"db_name":    h.db.Name,
+		"update_seq": h.db.lastSequence(),
+		"state":      "Online",
+	})
+}
+
+func (h dbHandler) PutUserHandler(w http.ResponseWriter, req *http.Request) {
+
+	u := user{}
+	if err := readJSON(req, &u); err != nil {
+		writeError(w, err)
+		return
+	}
+	if name, ok := mux.Vars(req)["name"]; ok {
+		u.Name = name
+	}
+	if u.Name == "" {
+		writeError(w, newHTTPError(http.StatusBadRequest, "Missing user name"))
+		return
+	}
+	u.roleChannels = nil
+
+	_, existed := h.db.getUser(u.Name)
+	h.db.putUser(u)
+
+	status := http.StatusCreated
+	if existed {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+}
+
+func (h dbHandler) GetUserHandler(w http.ResponseWriter, req *http.Request) {
+	u, ok := h.db.getUser(mux.Vars(req)["name"])
+	if !ok {
+		writeError(w, newHTTPError(http.StatusNotFound, "missing"))
+		return
+	}
+	u.Password = ""
+	userInfo := map[string]interface{}{
+		"name":           u.Name,
+		"admin_channels": u.AdminChannels,
+		"admin_roles":    u.AdminRoles,
+		"all_channels":   u.allChannels(),
+	}
+	if len(u.CollectionAccess) > 0 {
+		userInfo["collection_access"] = u.CollectionAccess
+	}
+	writeJSON(w, http.StatusOK, userInfo)
+}
+
+func (h dbHandler) PutRoleHandler(w http.ResponseWriter, req *http.Request) {
+
+	r := role{}
+	if err := readJSON(req, &r); err != nil {
+		writeError(w, err)
+		return
+	}
+	if name, ok := mux.Vars(req)["name"]; ok {
+		r.Name = name
+	}
+	if r.Name == "" {
+		writeError(w, newHTTPError(http.StatusBadRequest, "Missing role name"))
+		return
+	}
+
+	_, existed := h.db.getRole(r.Name)
+	h.db.putRole(r)
+
+	status := http.StatusCreated
+	if existed {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+}
+
+func (h dbHandler) GetRoleHandler(w http.ResponseWriter, req *http.Request) {
+	r, ok := h.db.getRole(mux.Vars(req)["name"])
+	if !ok {
+		writeError(w, newHTTPError(http.StatusNotFound, "missing"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"name":           r.Name,
+		"admin_channels": r.AdminChannels,
+		"all_channels":   r.AdminChannels,
+	})
+}
+
+func (h dbHandler) BulkDocsHandler(w http.ResponseWriter, req *http.Request) {
+
+	if _, err := h.requestUser(req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	bulkDocs := struct {
+		NewEdits *bool                    `json:"new_edits"`
+		Docs     []map[string]interface{} `json:"docs"`
+	}{}
+	if err := readJSON(req, &bulkDocs); err != nil {
+		writeError(w, err)
+		return
+	}
+	newEdits := bulkDocs.NewEdits == nil || *bulkDocs.NewEdits
+
+	results := []map[string]interface{}{}
+	for _, doc := range bulkDocs.Docs {
+		var docid, revid string
+		var err error
+		if status, inject := h.settings.faultInjector().docError(EndpointBulkDocs); inject {
+			docid, _ = doc["_id"].(string)
+			err = &httpError{Status: status, Err: http.StatusText(status), Reason: "Injected fault"}
+		} else {
+			docid, revid, err = h.db.putDocument(doc, newEdits, nil)
+		}
+		result := map[string]interface{}{"id": docid}
+		if err != nil {
+			httpErr := asHTTPError(err)
+			result["status"] = httpErr.Status
+			result["error"] = httpErr.Err
+			result["reason"] = httpErr.Reason
+		} else {
+			result["rev"] = revid
+		}
+		results = append(results, result)
+	}
+
+	writeJSON(w, http.StatusCreated, results)
+}
+
+// Purges the docs in the request, which lists the revisions to purge for each doc.
+// Only purging all of them ("*") is supported, like Sync Gateway.
+func (h dbHandler) PurgeHandler(w http.ResponseWriter, req *http.Request) {
+
+	purgeRequest := map[string][]string{}
+	if err := readJSON(req, &purgeRequest); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	purged := map[string][]string{}
+	for docid, revs := range purgeRequest {
+		if len(revs) != 1 || revs[0] != "*" {
+			writeError(w, newHTTPError(http.StatusBadRequest, "Only purging all revisions (\"*\") is supported"))
+			return
+		}
+		if h.db.purgeDocument(docid) {
+			purged[docid] = revs
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"purged": purged})
+}
+
+func (h dbHandler) RevsDiffHandler(w http.ResponseWriter, req *http.Request) {
+
+	if _, err := h.requestUser(req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	revsDiffRequest := map[string][]string{}
+	if err := readJSON(req, &revsDiffRequest); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := map[string]interface{}{}
+	for docid, missing := range h.db.revsDiff(revsDiffRequest) {
+		response[docid] = map[string]interface{}{"missing": missing}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h dbHandler) GetLocalDocHandler(w http.ResponseWriter, req *http.Request) {
+
+	if _, err := h.requestUser(req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	body, err := h.db.getLocalDocument(mux.Vars(req)["docid"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (h dbHandler) PutLocalDocHandler(w http.ResponseWriter, req *http.Request) {
+
+	if _, err := h.requestUser(req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	docid := mux.Vars(req)["docid"]
+	body := map[string]interface{}{}
+	if err := readJSON(req, &body); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	revid, err := h.db.putLocalDocument(docid, body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"id":  "_local/" + docid,
+		"rev": revid,
+		"ok":  true,
+	})
+}
+
+func (h dbHandler) PutDocHandler(w http.ResponseWriter, req *http.Request) {
+
+	if _, err := h.requestUser(req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	docid := mux.Vars(req)["docid"]
+	newEdits := req.URL.Query().Get("new_edits") != "false"
+
+	body, attachmentData, err := readDocumentBody(req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	body["_id"] = docid
+	if rev := req.URL.Query().Get("rev"); rev != "" {
+		body["_rev"] = rev
+	}
+
+	docid, revid, err := h.db.putDocument(body, newEdits, attachmentData)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"id":  docid,
+		"rev": revid,
+		"ok":  true,
+	})
+}
+
+func (h dbHandler) GetDocHandler(w http.ResponseWriter, req *http.Request) {
+
+	u, err := h.requestUser(req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	query := req.URL.Query()
+	docRev, err := h.db.getRevision(
+		u,
+		mux.Vars(req)["docid"],
+		query.Get("rev"),
+		query.Get("revs") == "true",
+		false,
+	)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, docRev.Body)
+}
+
+func (h dbHandler) BulkGetHandler(w http.ResponseWriter, req *http.Request) {
+
+	u, err := h.requestUser(req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	bulkGet := struct {
+		Docs []struct {
+			Id        string   `json:"id"`
+			Rev       string   `json:"rev"`
+			AttsSince []string `json:"atts_since"`
+		} `json:"docs"`
+	}{}
+	if err := readJSON(req, &bulkGet); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	query := req.URL.Query()
+	includeRevisions := query.Get("revs") == "true"
+	includeAttachments := query.Get("attachments") == "true"
+
+	// Build the whole response up front so that errors can still be reported with a status code
+	buf := &bytes.Buffer{}
+	writer := multipart.NewWriter(buf)
+
+	for _, requested := range bulkGet.Docs {
+		docRev, err := h.db.getRevision(u, requested.Id, requested.Rev, includeRevisions, includeAttachments)
+		if err != nil {
+			httpErr := asHTTPError(err)
+			docRev = docRevision{Body: map[string]interface{}{
+				"id":     requested.Id,
+				"rev":    requested.Rev,
+				"status": httpErr.Status,
+				"error":  httpErr.Err,
+				"reason": httpErr.Reason,
+			}}
+		} else if includeAttachments && len(requested.AttsSince) > 0 {
+			h.db.stubAttachmentsSince(&docRev, requested.Id, requested.AttsSince)
+		}
+		if err := writeDocRevisionPart(writer, docRev); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", fmt.Sprintf("multipart/mixed; boundary=%q", writer.Boundary()))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+func (h dbHandler) ChangesHandler(w http.ResponseWriter, req *http.Request) {
+
+	u, err := h.requestUser(req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	query := req.URL.Query()
+
+	switch query.Get("feed") {
+	case "continuous", "eventsource":
+		h.streamChanges(w, req, u, query.Get("feed"))
+		return
+	case "websocket":
+		h.webSocketChanges(w, req, u)
+		return
+	}
+
+	since, err := parseUintParam(query.Get("since"))
+	if err != nil {
+		writeError(w, newHTTPError(http.StatusBadRequest, "Invalid since"))
+		return
+	}
+	limit, err := parseUintParam(query.Get("limit"))
+	if err != nil {
+		writeError(w, newHTTPError(http.StatusBadRequest, "Invalid limit"))
+		return
+	}
+
+	channelFilter := []string{}
+	if query.Get("filter") == "sync_gateway/bychannel" && query.Get("channels") != "" {
+		channelFilter = strings.Split(query.Get("channels"), ",")
+	}
+	allDocs := query.Get("style") == "all_docs"
+	revocations := query.Get("revocations") == "true"
+
+	timeout := defaultLongpollTimeout
+	if timeoutMs, err := parseUintParam(query.Get("timeout")); err == nil && timeoutMs > 0 {
+		timeout = time.Duration(timeoutMs) * time.Millisecond
+	}
+	deadline := time.After(timeout)
+
+	for {
+		// Grab the notification channel before reading changes so that nothing is missed in between
+		changeNotification := h.db.changeNotification()
+
+		u = h.refreshUser(u)
+		changes, lastSeq := h.db.changes(u, since, int(limit), channelFilter, allDocs, revocations)
+		if len(changes) > 0 || query.Get("feed") != "longpoll" {
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"results":  changes,
+				"last_seq": strconv.FormatUint(lastSeq, 10),
+			})
+			return
+		}
+
+		select {
+		case <-changeNotification:
+		case <-deadline:
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"results":  changes,
+				"last_seq": strconv.FormatUint(lastSeq, 10),
+			})
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// Writes a document revision as a part of a multipart/mixed _bulk_get response.  Docs
+// with attachment data are written as a nested multipart/related part.
+func writeDocRevisionPart(writer *multipart.Writer, docRev docRevision) error {
+
+	docBytes, err := json.Marshal(docRev.Body)
+	if err != nil {
+		return err
+	}
+
+	if len(docRev.Attachments) == 0 {
+		partHeaders := textproto.MIMEHeader{}
+		partHeaders.Set("Content-Type", "application/json")
+		part, err := writer.CreatePart(partHeaders)
+		if err != nil {
+			return err
+		}
+		_, err = part.Write(docBytes)
+		return err
+	}
+
+	nestedBuf := &bytes.Buffer{}
+	nestedWriter := multipart.NewWriter(nestedBuf)
+
+	jsonHeaders := textproto.MIMEHeader{}
+	jsonHeaders.Set("Content-Type", "application/json")
+	jsonPart, err := nestedWriter.CreatePart(jsonHeaders)
+	if err != nil {
+		return err
+	}
+	if _, err := jsonPart.Write(docBytes); err != nil {
+		return err
+	}
+
+	attachmentMetas, _ := docRev.Body["_attachments"].(map[string]attachmentMeta)
+	for name, data := range docRev.Attachments {
+		attachmentHeaders := textproto.MIMEHeader{}
+		attachmentHeaders.Set("Content-Type", attachmentMetas[name].ContentType)
+		attachmentHeaders.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		attachmentPart, err := nestedWriter.CreatePart(attachmentHeaders)
+		if err != nil {
+			return err
+		}
+		if _, err := attachmentPart.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if err := nestedWriter.Close(); err != nil {
+		return err
+	}
+
+	partHeaders := textproto.MIMEHeader{}
+	partHeaders.Set("Content-Type", fmt.Sprintf("multipart/related; boundary=%q", nestedWriter.Boundary()))
+	part, err := writer.CreatePart(partHeaders)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(nestedBuf.Bytes())
+	return err
+}
+
+// Reads a document body from either a JSON or a multipart/related request.  In the
+// multipart case the first part is the JSON body and the remaining parts are
+// attachment data, which is returned keyed by digest.
+func readDocumentBody(req *http.Request) (map[string]interface{}, map[string][]byte, error) {
+
+	body := map[string]interface{}{}
+	attachmentData := map[string][]byte{}
+
+	mediaType, attrs, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "multipart/related" {
+		err := readJSON(req, &body)
+		return body, attachmentData, err
+	}
+
+	reader := multipart.NewReader(req.Body, attrs["boundary"])
+	for partIndex := 0; ; partIndex++ {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, newHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid multipart body: %v", err))
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		if partIndex == 0 {
+			if err := json.Unmarshal(data, &body); err != nil {
+				return nil, nil, newHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid JSON: %v", err))
+			}
+			continue
+		}
+		attachmentData[sha1DigestKey(data)] = data
+	}
+
+	return body, attachmentData, nil
+}
+
+// Decodes a JSON request body, which may be gzip compressed
+func readJSON(req *http.Request, into interface{}) error {
+	var reader io.Reader = req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return newHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid gzip body: %v", err))
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	if err := json.NewDecoder(reader).Decode(into); err != nil {
+		return newHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid JSON: %v", err))
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	js, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	httpErr := asHTTPError(err)
+	if httpErr.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Sync Gateway"`)
+	}
+	writeJSON(w, httpErr.Status, map[string]string{
+		"error":  httpErr.Err,
+		"reason": httpErr.Reason,
+	})
+}
+
+func asHTTPError(err error) *httpError {
+	if httpErr, ok := err.(*httpError); ok {
+		return httpErr
+	}
+	return &httpError{
+		Status: http.StatusInternalServerError,
+		Err:    "Internal Server Error",
+		Reason: err.Error(),
+	}
+}
+
+func parseUintParam(value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
@@ -1,2 +1,3 @@
-// Run a simulated Sync Gateway that ignores requests
+// Run a simulated Sync Gateway that keeps documents, revisions, channels
+// and users in memory
 package sgsimulator
@@ -0,0 +1,171 @@
+package sgsimulator
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// A single node in a document's revision tree
+type revInfo struct {
+	id       string
+	parent   string
+	deleted  bool
+	channels []string
+	body     map[string]interface{} // nil once the revision has been pruned from memory
+}
+
+// The revision tree of a document, keyed by revision id
+type revTree map[string]*revInfo
+
+func (t revTree) contains(revid string) bool {
+	_, ok := t[revid]
+	return ok
+}
+
+// Returns the revisions which do not have any children
+func (t revTree) leaves() []string {
+	parents := map[string]struct{}{}
+	for _, rev := range t {
+		if rev.parent != "" {
+			parents[rev.parent] = struct{}{}
+		}
+	}
+	leaves := []string{}
+	for revid := range t {
+		if _, isParent := parents[revid]; !isParent {
+			leaves = append(leaves, revid)
+		}
+	}
+	return leaves
+}
+
+// Returns the leaves ordered by CouchDB's deterministic winning rev algorithm,
+// so the first entry is the winner: non-deleted revisions beat deleted ones,
+// then the highest generation wins, then the highest revid string.
+func (t revTree) sortedLeaves() []string {
+	leaves := t.leaves()
+	sort.Slice(leaves, func(i, j int) bool {
+		return revBeats(t[leaves[i]], t[leaves[j]])
+	})
+	return leaves
+}
+
+func (t revTree) winningRev() *revInfo {
+	leaves := t.sortedLeaves()
+	if len(leaves) == 0 {
+		return nil
+	}
+	return t[leaves[0]]
+}
+
+// Returns the revision ids from revid back to the root of the tree, newest first
+func (t revTree) history(revid string) []string {
+	history := []string{}
+	for revid != "" {
+		rev, ok := t[revid]
+		if !ok {
+			break
+		}
+		history = append(history, revid)
+		revid = rev.parent
+	}
+	return history
+}
+
+// Adds a revision along with its history (newest first) to the tree.  Any
+// ancestors that are already in the tree are left untouched.  Returns false
+// if the revision was already present.
+func (t revTree) addRevision(history []string, deleted bool, channels []string, body map[string]interface{}) bool {
+
+	if len(history) == 0 || t.contains(history[0]) {
+		return false
+	}
+
+	for i, revid := range history {
+		if t.contains(revid) {
+			break
+		}
+		parent := ""
+		if i+1 < len(history) {
+			parent = history[i+1]
+		}
+		t[revid] = &revInfo{
+			id:     revid,
+			parent: parent,
+		}
+	}
+
+	newRev := t[history[0]]
+	newRev.deleted = deleted
+	newRev.channels = channels
+	newRev.body = body
+
+	t.pruneBodies(newRev.parent)
+
+	return true
+}
+
+// Drop the bodies of revisions that are no longer leaves, except for the
+// immediate parent of the revision that was just added.  Readers that saw
+// the parent on the changes feed can still fetch it, but memory use stays
+// proportional to the number of docs rather than the number of revisions.
+func (t revTree) pruneBodies(keep string) {
+	leaves := map[string]struct{}{}
+	for _, revid := range t.leaves() {
+		leaves[revid] = struct{}{}
+	}
+	for revid, rev := range t {
+		if _, isLeaf := leaves[revid]; isLeaf || revid == keep {
+			continue
+		}
+		rev.body = nil
+	}
+}
+
+func revBeats(a, b *revInfo) bool {
+	if a.deleted != b.deleted {
+		return !a.deleted
+	}
+	genA, digestA := parseRevID(a.id)
+	genB, digestB := parseRevID(b.id)
+	if genA != genB {
+		return genA > genB
+	}
+	return digestA > digestB
+}
+
+// Splits a revision ID into generation number and hex digest.
+func parseRevID(revid string) (int, string) {
+	if revid == "" {
+		return 0, ""
+	}
+	var generation int
+	var id string
+	n, _ := fmt.Sscanf(revid, "%d-%s", &generation, &id)
+	if n < 1 || generation < 1 {
+		return -1, ""
+	}
+	return generation, id
+}
+
+// Expands the CouchDB _revisions property into a list of full revision ids, newest first
+func expandRevisions(start int, ids []string) []string {
+	history := make([]string, 0, len(ids))
+	for i, digest := range ids {
+		history = append(history, fmt.Sprintf("%d-%s", start-i, digest))
+	}
+	return history
+}
+
+// Generate a new revision id the same way Sync Gateway does: the md5 of the
+// parent revision id and the canonical JSON encoding of the body.
+func createRevID(generation int, parentRevID string, body map[string]interface{}) string {
+	digester := md5.New()
+	digester.Write([]byte{byte(len(parentRevID))})
+	digester.Write([]byte(parentRevID))
+	encoded, _ := json.Marshal(body)
+	digester.Write(encoded)
+	return fmt.Sprintf("%d-%x", generation, digester.Sum(nil))
+}
@@ -1,81 +1,265 @@
 package sgsimulator
 
 import (
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	DefaultPort      = 4984
+	DefaultAdminPort = 4985
 )
 
 type SGSimulator struct {
-	Db string // the name of the database to serve
+	Db              string        // the name of the database to serve
+	Port            int           // the port to serve the public REST API on
+	AdminPort       int           // the port to serve the admin REST API on
+	ListenIpAddress string        // the address to listen on
+	TLSCertFile     string        // if set along with TLSKeyFile, serve https with this PEM certificate
+	TLSKeyFile      string        // the PEM private key of TLSCertFile
+	TLSClientCAFile string        // if set, require clients to present a certificate signed by one of the CAs in this PEM bundle
+	SessionTTL      time.Duration // how long the sessions created with POST /{db}/_session last
+	AdminUsername   string        // if set, the admin API only lets in requests with basic auth as this user
+	AdminPassword   string        // the password of AdminUsername
+
+	database    *database
+	collections map[string]*database // The databases of the collections other than the default one, keyed by scope.collection
+	settings    *liveSettings
 }
 
-type BulkDocsResponse struct {
-	Name    string
-	Hobbies []string
+// The settings that can be changed while the simulator is serving.  The handlers look
+// them up for every request, rather than when they're built.
+type liveSettings struct {
+	mutex       sync.Mutex
+	faults      *faultInjector // Nil if no faults are configured
+	jwtProvider *JWTProvider   // Nil if bearer tokens aren't accepted
 }
 
-func HomeHandler(w http.ResponseWriter, req *http.Request) {
-	w.Write([]byte("Sync Gateway Simulator\n"))
+func (s *liveSettings) faultInjector() *faultInjector {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.faults
 }
 
-func DoNothingHandler(w http.ResponseWriter, req *http.Request) {
-	w.Write([]byte("Sync Gateway Simulator DB\n"))
+func (s *liveSettings) jwt() *JWTProvider {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.jwtProvider
 }
 
-func BulkDocsHandler(w http.ResponseWriter, req *http.Request) {
-	bulkDocsResponseSlice := []map[string]string{}
-	bulkDocResponse := map[string]string{
-		"id":  "1",
-		"rev": "1-34243",
+// Wraps an endpoint handler with the faults configured when each request arrives
+func (s *liveSettings) wrap(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		s.faultInjector().wrap(endpoint, handler)(w, req)
 	}
-	bulkDocsResponseSlice = append(bulkDocsResponseSlice, bulkDocResponse)
-	js, err := json.Marshal(bulkDocsResponseSlice)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+}
+
+func NewSGSimulator(db string) *SGSimulator {
+	return &SGSimulator{
+		Db:              db,
+		Port:            DefaultPort,
+		AdminPort:       DefaultAdminPort,
+		ListenIpAddress: "0.0.0.0",
+		SessionTTL:      DefaultSessionTTL,
+		database:        newDatabase(db),
+		collections:     map[string]*database{},
+		settings:        &liveSettings{},
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+// Serve a collection besides the default one, given as "scope.collection", at
+// /{db}.{scope}.{collection}/ like Sync Gateway 3.1+.  Its docs and changes feed are
+// separate from the default collection's, and users only see the channels they were
+// granted in it under collection_access.  Users and sessions are shared.
+func (sg *SGSimulator) AddCollection(keyspace string) error {
+	parts := strings.Split(keyspace, ".")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("Collection %q isn't of the form scope.collection", keyspace)
+	}
+	sg.collections[keyspace] = newDatabase(sg.Db + "." + keyspace)
+	return nil
+}
 
-	w.Write([]byte("Sync Gateway Simulator DB\n"))
+// Inject the faults described in the config into all subsequent requests, even while
+// serving.  It replaces the faults configured before, and starts their counts afresh.
+func (sg *SGSimulator) SetFaultConfig(config FaultConfig) {
+	sg.settings.mutex.Lock()
+	defer sg.settings.mutex.Unlock()
+	sg.settings.faults = newFaultInjector(config)
 }
 
-func NewSGSimulator(db string) *SGSimulator {
-	return &SGSimulator{
-		Db: db,
+// Accept bearer tokens from the provider in all subsequent requests, even while serving
+func (sg *SGSimulator) SetJWTProvider(provider JWTProvider) {
+	sg.settings.mutex.Lock()
+	defer sg.settings.mutex.Unlock()
+	sg.settings.jwtProvider = &provider
+}
+
+// The number of faults of the given type ("error", "reset", "stuck" or "doc_error")
+// that have been injected on the endpoint since the faults were configured
+func (sg *SGSimulator) FaultCount(endpoint, faultType string) int {
+	faults := sg.settings.faultInjector()
+	if faults == nil {
+		return 0
 	}
+	return faults.count(endpoint, faultType)
 }
 
-func (sg *SGSimulator) Run() {
+// The handler for the public REST API, where requests are authenticated as
+// Sync Gateway users and only see docs in channels those users have access to
+func (sg *SGSimulator) PublicHandler() http.Handler {
+	return sg.newRouter(false)
+}
+
+// The handler for the admin REST API, which also serves the _user and _role endpoints.  It's
+// unauthenticated unless AdminUsername is set.
+func (sg *SGSimulator) AdminHandler() http.Handler {
+	if sg.AdminUsername != "" {
+		return requireAdminCreds(sg.AdminUsername, sg.AdminPassword, sg.newRouter(true))
+	}
+	return sg.newRouter(true)
+}
 
-	// TODO: parameterize via CLI
-	port := 8000
-	listenIpAddress := "0.0.0.0"
+func (sg *SGSimulator) newRouter(admin bool) *mux.Router {
+
+	h := dbHandler{
+		db:         sg.database,
+		users:      sg.database,
+		admin:      admin,
+		settings:   sg.settings,
+		sessionTTL: sg.SessionTTL,
+	}
+	f := sg.settings
 
 	r := mux.NewRouter()
-	r.HandleFunc("/", DoNothingHandler)
+	r.HandleFunc("/", HomeHandler)
+
+	// The collections go first, since the default collection's path is a prefix of theirs
+	for keyspace, collectionDb := range sg.collections {
+		collectionHandler := h
+		collectionHandler.db = collectionDb
+		collectionHandler.scope, collectionHandler.collection = splitKeyspace(keyspace)
+		collectionRouter := r.PathPrefix(fmt.Sprintf("/%v", collectionDb.Name)).Subrouter()
+		collectionRouter.Path("/").Methods("GET").HandlerFunc(f.wrap(EndpointDbInfo, collectionHandler.DbInfoHandler))
+		addDocRoutes(collectionRouter, collectionHandler, f)
+	}
+
 	dbRouter := r.PathPrefix(fmt.Sprintf("/%v", sg.Db)).Subrouter()
-	dbRouter.Path("/").HandlerFunc(DoNothingHandler)
-	dbRouter.Path("/_user/").HandlerFunc(DoNothingHandler)
-	dbRouter.Path("/_bulk_docs").HandlerFunc(BulkDocsHandler)
+	dbRouter.Path("/").Methods("GET").HandlerFunc(f.wrap(EndpointDbInfo, h.DbInfoHandler))
+	if admin {
+		dbRouter.Path("/_user/").Methods("POST").HandlerFunc(f.wrap(EndpointUser, h.PutUserHandler))
+		dbRouter.Path("/_user/{name}").Methods("PUT").HandlerFunc(f.wrap(EndpointUser, h.PutUserHandler))
+		dbRouter.Path("/_user/{name}").Methods("GET").HandlerFunc(f.wrap(EndpointUser, h.GetUserHandler))
+		dbRouter.Path("/_user/{name}/_session").Methods("DELETE").HandlerFunc(f.wrap(EndpointUser, h.DeleteUserSessionsHandler))
+		dbRouter.Path("/_role/").Methods("POST").HandlerFunc(f.wrap(EndpointRole, h.PutRoleHandler))
+		dbRouter.Path("/_role/{name}").Methods("PUT").HandlerFunc(f.wrap(EndpointRole, h.PutRoleHandler))
+		dbRouter.Path("/_role/{name}").Methods("GET").HandlerFunc(f.wrap(EndpointRole, h.GetRoleHandler))
+	} else {
+		dbRouter.Path("/_session").Methods("POST").HandlerFunc(f.wrap(EndpointSession, h.CreateSessionHandler))
+	}
+	dbRouter.Path("/_blipsync").Methods("GET").HandlerFunc(f.wrap(EndpointBlipSync, h.BlipSyncHandler))
+	addDocRoutes(dbRouter, h, f)
 
-	http.Handle("/", r)
+	return r
+}
+
+// The endpoints for the docs and changes feed, which every collection has
+func addDocRoutes(router *mux.Router, h dbHandler, f *liveSettings) {
+	if h.admin {
+		router.Path("/_purge").Methods("POST").HandlerFunc(f.wrap(EndpointPurge, h.PurgeHandler))
+	}
+	router.Path("/_bulk_docs").Methods("POST").HandlerFunc(f.wrap(EndpointBulkDocs, h.BulkDocsHandler))
+	router.Path("/_bulk_get").Methods("POST").HandlerFunc(f.wrap(EndpointBulkGet, h.BulkGetHandler))
+	router.Path("/_changes").Methods("GET").HandlerFunc(f.wrap(EndpointChanges, h.ChangesHandler))
+	router.Path("/_revs_diff").Methods("POST").HandlerFunc(f.wrap(EndpointRevsDiff, h.RevsDiffHandler))
+	router.Path("/_local/{docid}").Methods("PUT").HandlerFunc(f.wrap(EndpointLocal, h.PutLocalDocHandler))
+	router.Path("/_local/{docid}").Methods("GET").HandlerFunc(f.wrap(EndpointLocal, h.GetLocalDocHandler))
+	router.Path("/{docid}").Methods("PUT").HandlerFunc(f.wrap(EndpointDoc, h.PutDocHandler))
+	router.Path("/{docid}").Methods("GET").HandlerFunc(f.wrap(EndpointDoc, h.GetDocHandler))
+}
+
+func splitKeyspace(keyspace string) (scope, collection string) {
+	parts := strings.SplitN(keyspace, ".", 2)
+	return parts[0], parts[1]
+}
+
+// Serves HTTP/1.1, and HTTP/2 with prior knowledge (h2c) for clients which ask for it
+func (sg *SGSimulator) newServer(port int, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:     h2c.NewHandler(handler, &http2.Server{}),
+		Addr:        fmt.Sprintf("%v:%d", sg.ListenIpAddress, port),
+		ReadTimeout: 15 * time.Second,
+
+		// Longpoll _changes requests can legitimately block for up to
+		// defaultLongpollTimeout, so leave some headroom on top of that
+		WriteTimeout: defaultLongpollTimeout + time.Minute,
+	}
+}
+
+// The TLS config of the servers, which asks for client certificates if there's a
+// client CA, or nil if they serve plain http
+func (sg *SGSimulator) tlsConfig() (*tls.Config, error) {
+
+	if sg.TLSCertFile == "" && sg.TLSKeyFile == "" {
+		return nil, nil
+	}
+	if sg.TLSCertFile == "" || sg.TLSKeyFile == "" {
+		return nil, fmt.Errorf("Serving TLS needs both a certificate and a key")
+	}
 
-	srv := &http.Server{
-		Handler:      r,
-		Addr:         fmt.Sprintf("%v:%d", listenIpAddress, port),
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+	tlsConfig := &tls.Config{}
+	if sg.TLSClientCAFile != "" {
+		pemCerts, err := ioutil.ReadFile(sg.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("No PEM certificates found in %s", sg.TLSClientCAFile)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 	}
+	return tlsConfig, nil
+
+}
+
+func (sg *SGSimulator) listenAndServe(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS(sg.TLSCertFile, sg.TLSKeyFile)
+	}
+	return srv.ListenAndServe()
+}
+
+func (sg *SGSimulator) Run() {
+
+	tlsConfig, err := sg.tlsConfig()
+	if err != nil {
+		log.Fatalf("Unable to serve TLS: %v", err)
+	}
+
+	adminSrv := sg.newServer(sg.AdminPort, sg.AdminHandler())
+	adminSrv.TLSConfig = tlsConfig
+	go func() {
+		log.Printf("Admin API listening on %v", adminSrv.Addr)
+		log.Fatal(sg.listenAndServe(adminSrv))
+	}()
+
+	srv := sg.newServer(sg.Port, sg.PublicHandler())
+	srv.TLSConfig = tlsConfig
 
 	log.Printf("Listening on %v", srv.Addr)
 
-	log.Fatal(srv.ListenAndServe())
+	log.Fatal(sg.listenAndServe(srv))
 
 }